@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/command_router"
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"go.uber.org/zap"
+)
+
+/*
+SendQueueAlertsForReport notifies all users of the mensa whose queue alert matches the
+given report. The reporter themselves already knows about the queue, and isn't
+notified. Each user is notified at most once per day.
+*/
+func SendQueueAlertsForReport(reporterChatID int, messageUnixTime int, queueLength string, mensa mensas.Mensa) {
+	reportedLevel := mensa.GetLevelOfQueueLength(queueLength)
+	if reportedLevel < 0 {
+		return
+	}
+	reportTimeUTC := time.Unix(int64(messageUnixTime), 0).UTC()
+	usersToAlert, err := db_connectors.GetUsersToAlertForReport(reportTimeUTC, reportedLevel, mensa.ID)
+	if err != nil {
+		return
+	}
+
+	message := fmt.Sprintf("Heads up, someone just reported length %s at %s. Now might be a good time to go to the mensa %s", queueLength, mensa.Name, string(GetRandomAcceptableEmoji()))
+	for _, chatID := range usersToAlert {
+		if chatID == reporterChatID {
+			continue
+		}
+		// Mark first, so that a failing message doesn't lead to a second alert later that day
+		db_connectors.SetUserToAlertedOnDate(chatID, reportTimeUTC)
+		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PUSH_MESSAGE, chatID)
+		if err := telegram_connector.QueueMessage(chatID, message, keyboardIdentifier); err != nil {
+			zap.S().Errorw("Error while queueing queue alert", "chatID", chatID, "error", err)
+		}
+	}
+}
+
+// Setting up alerts via /alerts is a flow, see conversation_handler.go
+const ALERT_SETUP_FLOW = "alertSetup"
+const ALERT_SETUP_STEP_LEVEL = "level"
+const ALERT_SETUP_STEP_TIMEFRAME = "timeframe"
+
+// StartAlertSetup asks the user about the queue lengths they want to be alerted about
+func StartAlertSetup(chatID int) {
+	if err := startFlow(chatID, ALERT_SETUP_FLOW, ALERT_SETUP_STEP_LEVEL); err != nil {
+		zap.S().Errorw("Can't start alert setup", "error", err)
+		return
+	}
+	usersMensa := getUsersMensa(chatID)
+	message := "Let's set up your queue alert for " + usersMensa.Name + ". Once a day I'll tell you when someone reports a queue that's short enough for you. What's the longest queue you'd still go for?\n\n" +
+		strings.Join(usersMensa.GetLevelLabels(), "\n")
+	if err := sendMessage(chatID, message, telegram_connector.AlertLevelKeyboard); err != nil {
+		zap.S().Error("Error while sending alert setup message", err)
+	}
+}
+
+func handleAlertLevelStep(request *command_router.Request, state *db_connectors.ConversationState) string {
+	var level int
+	_, err := fmt.Sscanf(request.Text, telegram_connector.ALERT_LEVEL_BUTTON_FORMAT, &level)
+	if err != nil || level < 0 || level >= len(getUsersMensa(request.ChatID).QueueLevels) {
+		sendMessage(request.ChatID, "Please choose one of the buttons below", telegram_connector.AlertLevelKeyboard)
+		return ALERT_SETUP_STEP_LEVEL
+	}
+	state.FlowData["maximumLevel"] = strconv.Itoa(level)
+	message := "And when do you want to be alerted? You can also send your own timeframe, like 11:15 - 13:45"
+	sendMessage(request.ChatID, message, telegram_connector.AlertTimeKeyboard)
+	return ALERT_SETUP_STEP_TIMEFRAME
+}
+
+func handleAlertTimeframeStep(request *command_router.Request, state *db_connectors.ConversationState) string {
+	startMinute, endMinute, isValid := parseTimeframe(request.Text)
+	if !isValid {
+		sendMessage(request.ChatID, "I don't understand that timeframe. Please choose one of the buttons below, or send something like 11:15 - 13:45", telegram_connector.AlertTimeKeyboard)
+		return ALERT_SETUP_STEP_TIMEFRAME
+	}
+	maximumLevel, _ := strconv.Atoi(state.FlowData["maximumLevel"])
+	if err := db_connectors.UpdateQueueAlert(request.ChatID, true, maximumLevel, startMinute, endMinute); err != nil {
+		zap.S().Errorw("Can't save queue alert", "error", err)
+		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_MAIN, request.ChatID)
+		sendMessage(request.ChatID, "I'm so sorry, something went wrong while saving your alert 🤕", keyboardIdentifier)
+		return ""
+	}
+	message := fmt.Sprintf("Done! I'll let you know about queues of at most L%d between %s. You can change this in the /settings", maximumLevel, request.Text)
+	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_MAIN, request.ChatID)
+	sendMessage(request.ChatID, message, keyboardIdentifier)
+	return ""
+}
+
+// parseTimeframe turns "11:00 - 14:00" into minutes of the day. Returns false if that doesn't work, or if the timeframe is empty
+func parseTimeframe(timeframe string) (int, int, bool) {
+	startString, endString, found := strings.Cut(timeframe, "-")
+	if !found {
+		return 0, 0, false
+	}
+	startTime, startErr := time.Parse("15:04", strings.TrimSpace(startString))
+	endTime, endErr := time.Parse("15:04", strings.TrimSpace(endString))
+	if startErr != nil || endErr != nil || !startTime.Before(endTime) {
+		return 0, 0, false
+	}
+	return startTime.Hour()*60 + startTime.Minute(), endTime.Hour()*60 + endTime.Minute(), true
+}
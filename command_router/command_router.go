@@ -0,0 +1,239 @@
+/*
+Decides which handler is responsible for a message a user sent us.
+
+Handlers register for one of
+  - an exact text, usually the text of a keyboard button ("Queue?")
+  - a bot command ("/start"), which also matches "/start@MensaQueueBot" and "/start with arguments"
+  - a prefix
+  - a regular expression
+  - data sent by a web app, identified by the text of the button that opened it
+  - presses of inline keyboard buttons, identified by the action of their
+    callback data ("forgetme:confirm" has the action "forgetme" and the arguments "confirm")
+
+Button presses only ever match callback routes. For messages, if several routes
+match the first of the list above wins. Within prefixes the
+longest one wins, and regular expressions are tried in the order they were
+registered.
+
+Middleware wraps handlers, either for all routes (Router.Use) or for a
+single one (Route.With). Router wide middleware is applied first.
+*/
+package command_router
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+)
+
+// Request is a single message a user sent us, as seen by handlers
+type Request struct {
+	ChatID int
+	Text   string
+	// Everything after the command, for requests routed via bot commands
+	Arguments string
+	// The pattern of the matched route, e.g. "Queue?" or "/start". Empty for the fallback
+	RouteName string
+	// Set if the request is a press of an inline keyboard button
+	CallbackQueryID string
+	// For presses of inline keyboard buttons, the message the button belongs to. Handlers can edit it
+	MessageID int
+	Update    *telegram_connector.WebhookRequestBody
+}
+
+// NewRequest builds the Request for an update telegram sent us
+func NewRequest(update *telegram_connector.WebhookRequestBody) *Request {
+	if update.CallbackQuery.ID != "" {
+		return &Request{
+			ChatID:          update.CallbackQuery.Message.Chat.ID,
+			Text:            update.CallbackQuery.Data,
+			CallbackQueryID: update.CallbackQuery.ID,
+			MessageID:       update.CallbackQuery.Message.MessageID,
+			Update:          update,
+		}
+	}
+	return &Request{
+		ChatID: update.Message.Chat.ID,
+		Text:   update.Message.Text,
+		Update: update,
+	}
+}
+
+// IsCallback returns whether the request is a press of an inline keyboard button
+func (request *Request) IsCallback() bool {
+	return request.CallbackQueryID != ""
+}
+
+type HandlerFunc func(request *Request)
+
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type Route struct {
+	name        string
+	handler     HandlerFunc
+	middlewares []Middleware
+}
+
+// With adds middleware that only applies to this route
+func (route *Route) With(middlewares ...Middleware) *Route {
+	route.middlewares = append(route.middlewares, middlewares...)
+	return route
+}
+
+type regexRoute struct {
+	regex *regexp.Regexp
+	route *Route
+}
+
+type Router struct {
+	textRoutes     map[string]*Route
+	commandRoutes  map[string]*Route
+	webAppRoutes   map[string]*Route
+	callbackRoutes map[string]*Route
+	prefixRoutes   map[string]*Route
+	regexRoutes    []regexRoute
+	fallback       *Route
+	middlewares    []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{
+		textRoutes:     make(map[string]*Route),
+		commandRoutes:  make(map[string]*Route),
+		webAppRoutes:   make(map[string]*Route),
+		callbackRoutes: make(map[string]*Route),
+		prefixRoutes:   make(map[string]*Route),
+		fallback:       &Route{handler: func(*Request) {}},
+	}
+}
+
+// Use adds middleware that applies to all routes, including the fallback
+func (router *Router) Use(middlewares ...Middleware) {
+	router.middlewares = append(router.middlewares, middlewares...)
+}
+
+// HandleText routes messages that are exactly the given text
+func (router *Router) HandleText(text string, handler HandlerFunc) *Route {
+	route := &Route{name: text, handler: handler}
+	router.textRoutes[text] = route
+	return route
+}
+
+// HandleCommand routes the given bot command. Pass the command with its leading slash
+func (router *Router) HandleCommand(command string, handler HandlerFunc) *Route {
+	route := &Route{name: command, handler: handler}
+	router.commandRoutes[command] = route
+	return route
+}
+
+// HandlePrefix routes all messages that start with the given prefix
+func (router *Router) HandlePrefix(prefix string, handler HandlerFunc) *Route {
+	route := &Route{name: prefix, handler: handler}
+	router.prefixRoutes[prefix] = route
+	return route
+}
+
+// HandleRegex routes all messages that match the given regular expression. Panics if it doesn't compile
+func (router *Router) HandleRegex(expression string, handler HandlerFunc) *Route {
+	route := &Route{name: expression, handler: handler}
+	router.regexRoutes = append(router.regexRoutes, regexRoute{regex: regexp.MustCompile(expression), route: route})
+	return route
+}
+
+// HandleWebApp routes data that was sent by the web app behind the button with the given text
+func (router *Router) HandleWebApp(buttonText string, handler HandlerFunc) *Route {
+	route := &Route{name: buttonText, handler: handler}
+	router.webAppRoutes[buttonText] = route
+	return route
+}
+
+/*
+HandleCallback routes presses of inline keyboard buttons whose callback data is
+either the given action, or the action followed by a colon and arguments
+*/
+func (router *Router) HandleCallback(action string, handler HandlerFunc) *Route {
+	route := &Route{name: action, handler: handler}
+	router.callbackRoutes[action] = route
+	return route
+}
+
+// SetFallback defines what happens to messages that no route matches. By default nothing happens
+func (router *Router) SetFallback(handler HandlerFunc) *Route {
+	router.fallback = &Route{handler: handler}
+	return router.fallback
+}
+
+// Route hands the request to the matching handler, wrapped in all applicable middleware
+func (router *Router) Route(request *Request) {
+	route, arguments := router.match(request)
+	request.RouteName = route.name
+	request.Arguments = arguments
+
+	handler := route.handler
+	for i := len(route.middlewares) - 1; i >= 0; i-- {
+		handler = route.middlewares[i](handler)
+	}
+	for i := len(router.middlewares) - 1; i >= 0; i-- {
+		handler = router.middlewares[i](handler)
+	}
+	handler(request)
+}
+
+// match returns the route responsible for the request, as well as the arguments of commands
+func (router *Router) match(request *Request) (*Route, string) {
+	if request.IsCallback() {
+		action, arguments, _ := strings.Cut(request.Text, telegram_connector.CALLBACK_DATA_SEPARATOR)
+		if route, found := router.callbackRoutes[action]; found {
+			return route, arguments
+		}
+		return router.fallback, ""
+	}
+	if request.Update != nil && request.Update.Message.WebAppData.Data != "" {
+		if route, found := router.webAppRoutes[request.Update.Message.WebAppData.ButtonText]; found {
+			return route, ""
+		}
+	}
+	if route, found := router.textRoutes[request.Text]; found {
+		return route, ""
+	}
+	if command, arguments, isCommand := splitCommand(request.Text); isCommand {
+		if route, found := router.commandRoutes[command]; found {
+			return route, arguments
+		}
+	}
+
+	var matchingPrefixes []string
+	for prefix := range router.prefixRoutes {
+		if strings.HasPrefix(request.Text, prefix) {
+			matchingPrefixes = append(matchingPrefixes, prefix)
+		}
+	}
+	if len(matchingPrefixes) > 0 {
+		sort.Slice(matchingPrefixes, func(i, j int) bool {
+			return len(matchingPrefixes[i]) > len(matchingPrefixes[j])
+		})
+		return router.prefixRoutes[matchingPrefixes[0]], ""
+	}
+
+	for _, regexRoute := range router.regexRoutes {
+		if regexRoute.regex.MatchString(request.Text) {
+			return regexRoute.route, ""
+		}
+	}
+	return router.fallback, ""
+}
+
+/*
+splitCommand splits "/command@BotName arguments" into "/command" and "arguments".
+Returns false if the text isn't a bot command
+*/
+func splitCommand(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, "/") || len(text) < 2 {
+		return "", "", false
+	}
+	command, arguments, _ := strings.Cut(text, " ")
+	command, _, _ = strings.Cut(command, "@")
+	return command, strings.TrimSpace(arguments), true
+}
@@ -0,0 +1,115 @@
+package command_router
+
+import (
+	"testing"
+
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+)
+
+// newTestRouter returns a router whose handlers record the route they were called for
+func newTestRouter(handledBy *string) *Router {
+	record := func(name string) HandlerFunc {
+		return func(*Request) { *handledBy = name }
+	}
+	router := NewRouter()
+	router.HandleText("Queue?", record("text Queue?"))
+	router.HandleText("/start", record("text /start"))
+	router.HandleCommand("/jetze", record("command /jetze"))
+	router.HandleCommand("/help", record("command /help"))
+	router.HandlePrefix("L", record("prefix L"))
+	router.HandlePrefix("L1", record("prefix L1"))
+	router.HandleRegex(`^L\d: `, record("regex report"))
+	router.HandleRegex(`^/points(_track|_delete|_help|)$`, record("regex points"))
+	router.HandleWebApp("Change Settings", record("web app settings"))
+	router.HandleCallback("forgetme", record("callback forgetme"))
+	router.SetFallback(record("fallback"))
+	return router
+}
+
+func TestRouting(t *testing.T) {
+	tests := []struct {
+		name              string
+		text              string
+		webAppButton      string
+		callbackData      string
+		expectedHandler   string
+		expectedArguments string
+	}{
+		{"exact text", "Queue?", "", "", "text Queue?", ""},
+		{"exact text is case sensitive", "queue?", "", "", "fallback", ""},
+		{"exact text wins over command", "/start", "", "", "text /start", ""},
+		{"command", "/jetze", "", "", "command /jetze", ""},
+		{"command in group", "/jetze@MensaQueueBot", "", "", "command /jetze", ""},
+		{"command with arguments", "/help me please", "", "", "command /help", "me please"},
+		{"command needs exact name", "/jetzenicht", "", "", "fallback", ""},
+		{"longest prefix wins", "L1: Within kitchen", "", "", "prefix L1", ""},
+		{"prefix wins over regex", "L3: Within first room", "", "", "prefix L", ""},
+		{"regex", "/points_track", "", "", "regex points", ""},
+		{"regex without match", "/points_everything", "", "", "fallback", ""},
+		{"web app", "", "Change Settings", "", "web app settings", ""},
+		{"unknown web app", "", "Other Web App", "", "fallback", ""},
+		{"callback", "", "", "forgetme", "callback forgetme", ""},
+		{"callback with arguments", "", "", "forgetme:confirm", "callback forgetme", "confirm"},
+		{"callback only matches callback routes", "", "", "Queue?", "fallback", ""},
+		{"unknown callback", "", "", "forget", "fallback", ""},
+		{"empty message", "", "", "", "fallback", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var handledBy string
+			router := newTestRouter(&handledBy)
+
+			update := &telegram_connector.WebhookRequestBody{}
+			update.Message.Text = test.text
+			if test.webAppButton != "" {
+				update.Message.WebAppData.ButtonText = test.webAppButton
+				update.Message.WebAppData.Data = "{}"
+			}
+			if test.callbackData != "" {
+				update.CallbackQuery.ID = "1"
+				update.CallbackQuery.Data = test.callbackData
+			}
+			request := NewRequest(update)
+			router.Route(request)
+
+			if handledBy != test.expectedHandler {
+				t.Errorf("%q was handled by %q, expected %q", test.text, handledBy, test.expectedHandler)
+			}
+			if request.Arguments != test.expectedArguments {
+				t.Errorf("%q has arguments %q, expected %q", test.text, request.Arguments, test.expectedArguments)
+			}
+		})
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	recordingMiddleware := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(request *Request) {
+				calls = append(calls, name)
+				next(request)
+			}
+		}
+	}
+	router := NewRouter()
+	router.Use(recordingMiddleware("first"), recordingMiddleware("second"))
+	router.HandleText("Queue?", func(*Request) { calls = append(calls, "handler") }).With(recordingMiddleware("route"))
+
+	router.Route(&Request{Text: "Queue?"})
+	expectedCalls := []string{"first", "second", "route", "handler"}
+	if len(calls) != len(expectedCalls) {
+		t.Fatalf("Expected calls %v, got %v", expectedCalls, calls)
+	}
+	for i := range calls {
+		if calls[i] != expectedCalls[i] {
+			t.Errorf("Expected calls %v, got %v", expectedCalls, calls)
+		}
+	}
+
+	calls = nil
+	router.Route(&Request{Text: "Something else"})
+	if len(calls) != 2 {
+		t.Errorf("Router middleware should also wrap the fallback, got calls %v", calls)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+/*
+Multi-step conversations ("flows"), and the keyboards users are expected to use.
+
+A flow is started by a handler via startFlow. While it is pending, typed messages
+and button presses are handed to the current step of the flow instead of being
+routed as usual. Commands, web app data and presses of inline keyboard buttons
+end the flow, and are routed as usual.
+Flows expire after FLOW_EXPIRY, and can always be cancelled via the cancel button.
+*/
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/command_router"
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"go.uber.org/zap"
+)
+
+// How long users have to answer a step of a flow
+const FLOW_EXPIRY = 10 * time.Minute
+
+/*
+flowStep handles a message the user sent while in a flow. It may add to the
+data of the flow, and returns the next step, or "" if the flow is done
+*/
+type flowStep func(request *command_router.Request, state *db_connectors.ConversationState) string
+
+// All flows, with their steps by name
+var conversationFlows = map[string]map[string]flowStep{
+	ALERT_SETUP_FLOW: {
+		ALERT_SETUP_STEP_LEVEL:     handleAlertLevelStep,
+		ALERT_SETUP_STEP_TIMEFRAME: handleAlertTimeframeStep,
+	},
+}
+
+// Keyboards that only make sense while a flow is pending
+var flowKeyboards = map[telegram_connector.KeyboardIdentifier]bool{
+	telegram_connector.AlertLevelKeyboard: true,
+	telegram_connector.AlertTimeKeyboard:  true,
+}
+
+/*
+sendMessage sends the message via telegram_connector.SendMessage, and remembers which keyboard the
+user now has, see currentKeyboardOf. Handlers use this for everything they reply with
+*/
+func sendMessage(chatID int, message string, keyboardIdentifier telegram_connector.KeyboardIdentifier) error {
+	err := telegram_connector.SendMessage(chatID, message, keyboardIdentifier)
+	// Removing the keyboard happens when users delete their account, we shouldn't store anything after that
+	if err == nil && keyboardIdentifier != telegram_connector.NilKeyboard && keyboardIdentifier != telegram_connector.NoKeyboard {
+		if err := db_connectors.SetCurrentKeyboard(chatID, int(keyboardIdentifier)); err != nil {
+			zap.S().Errorw("Can't remember keyboard of user", "error", err)
+		}
+	}
+	return err
+}
+
+// startFlow puts the user into the given step of a flow. Replaces any flow they were in before
+func startFlow(chatID int, flow string, firstStep string) error {
+	return db_connectors.SaveFlowOfConversation(chatID, db_connectors.ConversationState{
+		Flow:      flow,
+		Step:      firstStep,
+		FlowData:  make(map[string]string),
+		ExpiresAt: time.Now().UTC().Add(FLOW_EXPIRY),
+	})
+}
+
+// endsFlows returns whether the request is something other than an answer to a step of a flow
+func endsFlows(request *command_router.Request) bool {
+	isWebAppData := request.Update != nil && request.Update.Message.WebAppData.Data != ""
+	return strings.HasPrefix(request.Text, "/") || isWebAppData || request.IsCallback()
+}
+
+/*
+continuePendingFlows hands messages to the flow the user is in, if any,
+instead of the handler the message was routed to
+*/
+func continuePendingFlows(next command_router.HandlerFunc) command_router.HandlerFunc {
+	return func(request *command_router.Request) {
+		state, err := db_connectors.GetConversationState(request.ChatID, time.Now().UTC())
+		if err != nil || !state.HasPendingFlow() {
+			next(request)
+			return
+		}
+		if endsFlows(request) {
+			zap.S().Infow("User left flow", "flow", state.Flow)
+			db_connectors.EndFlowOfConversation(request.ChatID)
+			next(request)
+			return
+		}
+		if request.Text == telegram_connector.CANCEL_BUTTON_TEXT {
+			db_connectors.EndFlowOfConversation(request.ChatID)
+			keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_MAIN, request.ChatID)
+			sendMessage(request.ChatID, "Alright, nothing changed", keyboardIdentifier)
+			return
+		}
+
+		step, stepExists := conversationFlows[state.Flow][state.Step]
+		if !stepExists {
+			zap.S().Errorw("User is in unknown step of flow", "flow", state.Flow, "step", state.Step)
+			db_connectors.EndFlowOfConversation(request.ChatID)
+			next(request)
+			return
+		}
+		zap.S().Infow("Continuing flow", "flow", state.Flow, "step", state.Step)
+		nextStep := step(request, &state)
+		if nextStep == "" {
+			err = db_connectors.EndFlowOfConversation(request.ChatID)
+		} else {
+			state.Step = nextStep
+			state.ExpiresAt = time.Now().UTC().Add(FLOW_EXPIRY)
+			err = db_connectors.SaveFlowOfConversation(request.ChatID, state)
+		}
+		if err != nil {
+			zap.S().Errorw("Can't save state of flow", "flow", state.Flow, "error", err)
+		}
+	}
+}
+
+/*
+currentKeyboardOf returns the keyboard the user should currently see, or NilKeyboard if we
+don't know. Users with a keyboard of a flow that expired should go back to the main keyboard
+*/
+func currentKeyboardOf(state db_connectors.ConversationState) telegram_connector.KeyboardIdentifier {
+	keyboard := telegram_connector.KeyboardIdentifier(state.Keyboard)
+	if flowKeyboards[keyboard] && !state.HasPendingFlow() {
+		return telegram_connector.MainKeyboard
+	}
+	return keyboard
+}
+
+/*
+expectsKeyboard makes a route only accept messages from users that currently see one of
+the given keyboards. Everybody else gets told, and receives the keyboard they should see.
+Users whose keyboard we don't know are always accepted
+*/
+func expectsKeyboard(keyboards ...telegram_connector.KeyboardIdentifier) command_router.Middleware {
+	return func(next command_router.HandlerFunc) command_router.HandlerFunc {
+		return func(request *command_router.Request) {
+			state, err := db_connectors.GetConversationState(request.ChatID, time.Now().UTC())
+			currentKeyboard := currentKeyboardOf(state)
+			if err != nil || currentKeyboard == telegram_connector.NilKeyboard {
+				next(request)
+				return
+			}
+			for _, keyboard := range keyboards {
+				if keyboard == currentKeyboard {
+					next(request)
+					return
+				}
+			}
+			zap.S().Infow("Rejecting button of stale keyboard", "route", request.RouteName, "currentKeyboard", currentKeyboard)
+			message := "\"" + request.Text + "\" is from a keyboard you shouldn't see anymore, so I'm ignoring it. Here's the current one"
+			sendMessage(request.ChatID, message, currentKeyboard)
+		}
+	}
+}
+
+// handleUnknownMessage tells users of expired flows what happened, and ignores all other unknown messages
+func handleUnknownMessage(request *command_router.Request) {
+	state, err := db_connectors.GetConversationState(request.ChatID, time.Now().UTC())
+	if err != nil || !flowKeyboards[telegram_connector.KeyboardIdentifier(state.Keyboard)] || state.HasPendingFlow() {
+		return
+	}
+	message := "Sorry, you took a bit too long and I forgot what we were talking about. Nothing was changed"
+	sendMessage(request.ChatID, message, currentKeyboardOf(state))
+}
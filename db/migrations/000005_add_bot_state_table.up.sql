@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS botState (
+id INTEGER NOT NULL PRIMARY KEY,
+stateKey TEXT UNIQUE NOT NULL,
+stateValue TEXT NOT NULL
+);
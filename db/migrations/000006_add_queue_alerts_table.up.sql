@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS queueAlerts (
+id INTEGER NOT NULL PRIMARY KEY,
+reporterID INTEGER UNIQUE NOT NULL,
+wantsQueueAlerts INTEGER NOT NULL,
+maximumLevel INTEGER NOT NULL,
+startTimeInCESTMinutes INTEGER NOT NULL,
+endTimeInCESTMinutes INTEGER NOT NULL,
+lastAlertDate TEXT
+);
@@ -0,0 +1,3 @@
+ALTER TABLE queueReports DROP COLUMN mensaID;
+ALTER TABLE mensaMenus DROP COLUMN mensaID;
+ALTER TABLE mensaPreferences DROP COLUMN mensaID;
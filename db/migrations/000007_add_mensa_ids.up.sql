@@ -0,0 +1,3 @@
+ALTER TABLE queueReports ADD COLUMN mensaID TEXT NOT NULL DEFAULT 'griebnitzsee';
+ALTER TABLE mensaMenus ADD COLUMN mensaID TEXT NOT NULL DEFAULT 'griebnitzsee';
+ALTER TABLE mensaPreferences ADD COLUMN mensaID TEXT NOT NULL DEFAULT 'griebnitzsee';
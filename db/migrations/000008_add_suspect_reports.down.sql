@@ -0,0 +1 @@
+ALTER TABLE queueReports DROP COLUMN suspect;
@@ -0,0 +1 @@
+ALTER TABLE queueReports ADD COLUMN suspect INTEGER NOT NULL DEFAULT 0;
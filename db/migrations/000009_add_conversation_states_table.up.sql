@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS conversationStates (
+id INTEGER NOT NULL PRIMARY KEY,
+reporterID INTEGER UNIQUE NOT NULL,
+keyboard INTEGER NOT NULL DEFAULT 0,
+flow TEXT NOT NULL DEFAULT '',
+step TEXT NOT NULL DEFAULT '',
+flowData TEXT NOT NULL DEFAULT '{}',
+expiresAt INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS pendingDeliveries (
+id INTEGER NOT NULL PRIMARY KEY,
+reporterID INTEGER NOT NULL,
+message TEXT NOT NULL,
+keyboard INTEGER NOT NULL DEFAULT 0,
+attempts INTEGER NOT NULL DEFAULT 0,
+notBefore INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1 @@
+ALTER TABLE mensaPreferences DROP COLUMN isActive;
@@ -0,0 +1 @@
+ALTER TABLE mensaPreferences ADD COLUMN isActive INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS graphCache (
+id INTEGER NOT NULL PRIMARY KEY,
+mensaID TEXT NOT NULL,
+timeWindow TEXT NOT NULL,
+generatedAt INTEGER NOT NULL,
+telegramFileID TEXT NOT NULL,
+forecastLine TEXT NOT NULL DEFAULT '',
+UNIQUE (mensaID, timeWindow)
+);
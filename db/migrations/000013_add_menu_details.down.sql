@@ -0,0 +1,6 @@
+ALTER TABLE mensaMenus DROP COLUMN guestPrice;
+ALTER TABLE mensaMenus DROP COLUMN staffPrice;
+ALTER TABLE mensaMenus DROP COLUMN studentPrice;
+ALTER TABLE mensaMenus DROP COLUMN additives;
+ALTER TABLE mensaMenus DROP COLUMN allergens;
+ALTER TABLE mensaMenus DROP COLUMN labels;
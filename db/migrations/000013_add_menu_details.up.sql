@@ -0,0 +1,6 @@
+ALTER TABLE mensaMenus ADD COLUMN labels TEXT NOT NULL DEFAULT '';
+ALTER TABLE mensaMenus ADD COLUMN allergens TEXT NOT NULL DEFAULT '';
+ALTER TABLE mensaMenus ADD COLUMN additives TEXT NOT NULL DEFAULT '';
+ALTER TABLE mensaMenus ADD COLUMN studentPrice INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE mensaMenus ADD COLUMN staffPrice INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE mensaMenus ADD COLUMN guestPrice INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+ALTER TABLE mensaPreferences DROP COLUMN excludedAllergens;
+ALTER TABLE mensaPreferences DROP COLUMN noPork;
+ALTER TABLE mensaPreferences DROP COLUMN diet;
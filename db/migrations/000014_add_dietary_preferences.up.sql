@@ -0,0 +1,3 @@
+ALTER TABLE mensaPreferences ADD COLUMN diet TEXT NOT NULL DEFAULT '';
+ALTER TABLE mensaPreferences ADD COLUMN noPork INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE mensaPreferences ADD COLUMN excludedAllergens TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE mensaMenus DROP COLUMN date;
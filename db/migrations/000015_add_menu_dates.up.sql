@@ -0,0 +1,2 @@
+ALTER TABLE mensaMenus ADD COLUMN date TEXT NOT NULL DEFAULT '';
+UPDATE mensaMenus SET date = date(time);
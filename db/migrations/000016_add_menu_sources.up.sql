@@ -0,0 +1 @@
+ALTER TABLE mensaMenus ADD COLUMN source TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+CREATE TABLE inactiveChats (reporterID INTEGER PRIMARY KEY);
@@ -0,0 +1,61 @@
+/*
+Implements a small key/value store for state of the bot itself, which
+isn't related to any user but should survive restarts
+*/
+package db_connectors
+
+import (
+	"database/sql"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+const POLLING_OFFSET_KEY = "pollingOffset"
+
+func getBotState(stateKey string) (string, error) {
+	queryString := "SELECT stateValue FROM botState WHERE stateKey = ?;"
+	db := GetDBHandle()
+	var stateValue string
+	err := db.QueryRow(queryString, stateKey).Scan(&stateValue)
+	return stateValue, err
+}
+
+func setBotState(stateKey string, stateValue string) error {
+	queryString := "INSERT INTO botState(stateKey, stateValue) VALUES (?,?) ON CONFLICT (stateKey) DO UPDATE SET stateValue=?;"
+	db := GetDBHandle()
+
+	DBMutex.Lock()
+	_, err := db.Exec(queryString, stateKey, stateValue, stateValue)
+	DBMutex.Unlock()
+	return err
+}
+
+/*
+GetPollingOffset returns the update_id of the next update we expect from getUpdates.
+Returns 0 if we never polled before, which makes telegram start with the
+oldest update it still has
+*/
+func GetPollingOffset() int {
+	offsetString, err := getBotState(POLLING_OFFSET_KEY)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			zap.S().Errorw("Error while querying for polling offset", "error", err)
+		}
+		return 0
+	}
+	offset, err := strconv.Atoi(offsetString)
+	if err != nil {
+		zap.S().Errorw("Stored polling offset is not a number", "offset", offsetString, "error", err)
+		return 0
+	}
+	return offset
+}
+
+func SavePollingOffset(offset int) error {
+	err := setBotState(POLLING_OFFSET_KEY, strconv.Itoa(offset))
+	if err != nil {
+		zap.S().Errorw("Error while saving polling offset", "offset", offset, "error", err)
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+/*
+Implements storage of conversation states: Which keyboard a user currently sees,
+and which multi-step flow (e.g. setting up queue alerts) they are in the middle of
+*/
+package db_connectors
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func init() {
+	registerUserDataTable("conversationStates")
+}
+
+/*
+ConversationState is where a single chat currently is. Keyboard is a
+telegram_connector.KeyboardIdentifier, 0 if we don't know the keyboard.
+Flow is empty if the user isn't in a flow, FlowData contains whatever the
+flow collected so far
+*/
+type ConversationState struct {
+	Keyboard  int
+	Flow      string
+	Step      string
+	FlowData  map[string]string
+	ExpiresAt time.Time
+}
+
+// HasPendingFlow returns true if the user is in the middle of a flow
+func (state ConversationState) HasPendingFlow() bool {
+	return state.Flow != ""
+}
+
+/*
+GetConversationState returns the conversation state of the given chat. Flows that
+expired before nowUTC are left out, but the keyboard is returned either way
+*/
+func GetConversationState(chatID int, nowUTC time.Time) (ConversationState, error) {
+	queryString := `SELECT keyboard, flow, step, flowData, expiresAt FROM conversationStates WHERE reporterID = ?;`
+	state := ConversationState{FlowData: make(map[string]string)}
+	var flowDataJSON string
+	var expiresAt int64
+
+	db := GetDBHandle()
+	if err := db.QueryRow(queryString, chatID).Scan(&state.Keyboard, &state.Flow, &state.Step, &flowDataJSON, &expiresAt); err != nil {
+		if err == sql.ErrNoRows {
+			return state, nil
+		}
+		zap.S().Errorw("Error while querying for conversation state", "error", err)
+		return state, err
+	}
+	state.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	if state.Flow != "" && nowUTC.After(state.ExpiresAt) {
+		zap.S().Infow("Flow of user expired", "flow", state.Flow)
+		state.Flow = ""
+		state.Step = ""
+		return state, nil
+	}
+	if err := json.Unmarshal([]byte(flowDataJSON), &state.FlowData); err != nil {
+		zap.S().Errorw("Can't read data of flow", "flow", state.Flow, "error", err)
+		return state, err
+	}
+	return state, nil
+}
+
+// SaveFlowOfConversation stores the flow part of the given state, and leaves the keyboard as it is
+func SaveFlowOfConversation(chatID int, state ConversationState) error {
+	queryString := `INSERT INTO conversationStates(reporterID, flow, step, flowData, expiresAt) VALUES (?,?,?,?,?)
+	ON CONFLICT (reporterID) DO UPDATE SET flow=?, step=?, flowData=?, expiresAt=?;`
+	if state.FlowData == nil {
+		state.FlowData = make(map[string]string)
+	}
+	flowDataJSON, err := json.Marshal(state.FlowData)
+	if err != nil {
+		return err
+	}
+	expiresAt := state.ExpiresAt.Unix()
+
+	db := GetDBHandle()
+	DBMutex.Lock()
+	_, err = db.Exec(queryString, chatID, state.Flow, state.Step, string(flowDataJSON), expiresAt,
+		state.Flow, state.Step, string(flowDataJSON), expiresAt)
+	DBMutex.Unlock()
+	return err
+}
+
+// EndFlowOfConversation forgets about the flow the user is in, if any
+func EndFlowOfConversation(chatID int) error {
+	return SaveFlowOfConversation(chatID, ConversationState{})
+}
+
+// SetCurrentKeyboard remembers which keyboard the user was sent last
+func SetCurrentKeyboard(chatID int, keyboard int) error {
+	queryString := `INSERT INTO conversationStates(reporterID, keyboard) VALUES (?,?)
+	ON CONFLICT (reporterID) DO UPDATE SET keyboard=?;`
+	db := GetDBHandle()
+	DBMutex.Lock()
+	_, err := db.Exec(queryString, chatID, keyboard, keyboard)
+	DBMutex.Unlock()
+	return err
+}
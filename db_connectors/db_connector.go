@@ -9,15 +9,19 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"go.uber.org/zap"
 
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/ADimeo/MensaQueueBot/report_consensus"
 	"github.com/ADimeo/MensaQueueBot/utils"
 )
 
 var globalPseudonymizationAttribute pseudonymizationAttribute
+var globalPseudonymizationAttributeMutex sync.Mutex
 
 type pseudonymizationAttribute struct {
 	Timestamp time.Time
@@ -25,7 +29,7 @@ type pseudonymizationAttribute struct {
 }
 
 /*Regenerates the global pseudonymization attribute. Fails silently if random
-  can't be accessed for some reason.
+  can't be accessed for some reason. Needs to be called with globalPseudonymizationAttributeMutex held
 */
 
 func initializeNewPseudonymizationAttribute(generationTime time.Time) {
@@ -43,6 +47,8 @@ func initializeNewPseudonymizationAttribute(generationTime time.Time) {
 
 // Returns an up to date pseudonymization attribute
 func getPseudonymizationAttribute() pseudonymizationAttribute {
+	globalPseudonymizationAttributeMutex.Lock()
+	defer globalPseudonymizationAttributeMutex.Unlock()
 	timestampNow := time.Now()
 	dateToday := timestampNow.YearDay()
 
@@ -54,16 +60,30 @@ func getPseudonymizationAttribute() pseudonymizationAttribute {
 	return globalPseudonymizationAttribute
 }
 
-// Returns the most recently reported queue length, as well as the reporting unix timestamp
-func GetLatestQueueLengthReport() (int, string) {
-	queryString := "SELECT queueLength, MAX(time) from queueReports"
+/*
+GetLatestQueueLengthReport returns the queue length that recent reports at the given mensa agree on,
+as well as the unix timestamp of the newest report supporting it. If there are no recent reports
+it returns the most recent report that isn't suspect
+*/
+func GetLatestQueueLengthReport(mensaID string) (int, string) {
+	mensa := mensas.GetMensaOrDefault(mensaID)
+	nowUTC := time.Now().UTC()
+	reports, suspects, err := getReportsForConsensus(mensa, nowUTC, report_consensus.CONSENSUS_WINDOW)
+	if err == nil {
+		if level, supportingReport, found := report_consensus.Consensus(nowUTC, reports, suspects); found {
+			zap.S().Infof("Consensus of %d recent reports is %s", len(reports), mensa.QueueLevels[level].Description)
+			return int(supportingReport.Time.Unix()), mensa.QueueLevels[level].Description
+		}
+	}
+
+	queryString := "SELECT queueLength, MAX(time) from queueReports WHERE mensaID = ? AND suspect = 0"
 
 	var retrievedReportTime int
 	var retrievedQueueLength string
 
 	zap.S().Info("Querying for latest queue length report")
 	db := GetDBHandle()
-	if err := db.QueryRow(queryString).Scan(&retrievedQueueLength, &retrievedReportTime); err != nil {
+	if err := db.QueryRow(queryString, mensaID).Scan(&retrievedQueueLength, &retrievedReportTime); err != nil {
 		if err == sql.ErrNoRows {
 			zap.S().Error("No rows returned when querying for latest queue length report")
 		} else {
@@ -102,16 +122,17 @@ func getLengthsAndTimesFromRows(rows *sql.Rows) ([]string, []time.Time, error) {
 }
 
 /*
-GetAllQueueLengthReportsInTimeframe returns all length reports that
+GetAllQueueLengthReportsInTimeframe returns all length reports for the given mensa that
 were made within timeframeIntoPast before now.
 Returns two slices: One with the report queue lengths,
 one with the times. Returns an err if no reports are
 available for that timeframe
 */
-func GetAllQueueLengthReportsInTimeframe(nowUTC time.Time, timeframeIntoPast time.Duration) ([]string, []time.Time, error) {
+func GetAllQueueLengthReportsInTimeframe(nowUTC time.Time, timeframeIntoPast time.Duration, mensaID string) ([]string, []time.Time, error) {
 	lowerLimit := nowUTC.Add(-timeframeIntoPast).Unix()
 
-	queryString := "SELECT queueLength, time FROM queueReports WHERE time > ? " + // Get reports more recent than timeframe
+	queryString := "SELECT queueLength, time FROM queueReports WHERE mensaID = ? AND suspect = 0 " +
+		"AND time > ? " + // Get reports more recent than timeframe
 		"AND strftime ('%s', queueReports.time, 'unixepoch') < strftime('%s', CAST(? AS TEXT)) " + // Data is not from the future, important for testing
 		"ORDER BY time ASC;"
 
@@ -125,7 +146,7 @@ func GetAllQueueLengthReportsInTimeframe(nowUTC time.Time, timeframeIntoPast tim
 		"nowTimeString", nowTimeString)
 
 	db := GetDBHandle()
-	rows, err := db.Query(queryString, lowerLimit, nowTimeString)
+	rows, err := db.Query(queryString, mensaID, lowerLimit, nowTimeString)
 	if err != nil {
 		zap.S().Errorf("Error while querying for reports in timeframe", err)
 		return queueLengths, times, err
@@ -189,7 +210,7 @@ func removeDataOutsideOfIntervalInCEST(nowTimeUTC time.Time,
 	return filteredLengths, filteredTimes
 }
 
-/*GetQueueLengthReportsByWeekdayAdndTimeframe returns the following reports:
+/*GetQueueLengthReportsByWeekdayAdndTimeframe returns the following reports for the given mensa:
 - created at most daysOfDataToConsider before nowTime
 - Create at most timeframeIntoPast before noTimes timestamp
 - Create at most timeframeIntoFuture after noTimes timestamp
@@ -202,7 +223,8 @@ in a pure UTC implementation.
 func GetQueueLengthReportsByWeekdayAndTimeframe(daysOfDataToConsider int8,
 	nowTimeUTC time.Time,
 	timeframeIntoPast time.Duration,
-	timeframeIntoFuture time.Duration) ([]string, []time.Time, error) {
+	timeframeIntoFuture time.Duration,
+	mensaID string) ([]string, []time.Time, error) {
 	// If daylight saving time changes 12:00 CEST can be
 	// represented by 11:00 UTC or 10:00 UTC. SQLITE lacks
 	// the awareness/information/built ins to have that distinction
@@ -213,7 +235,8 @@ func GetQueueLengthReportsByWeekdayAndTimeframe(daysOfDataToConsider int8,
 
 	// See https://www.sqlite.org/lang_datefunc.html for reference
 	queryString := "SELECT queueLength, time from queueReports " + // Return the usual tuple
-		"WHERE strftime('%s',  ? , 'unixepoch') - strftime('%s',queueReports.time, 'unixepoch', CAST(? AS TEXT)) < 0 " + // If it was created within the last 30 days
+		"WHERE mensaID = ? AND suspect = 0 " +
+		"AND strftime('%s',  ? , 'unixepoch') - strftime('%s',queueReports.time, 'unixepoch', CAST(? AS TEXT)) < 0 " + // If it was created within the last 30 days
 		"AND CAST(? AS TEXT) = strftime('%w', queueReports.time, 'unixepoch') " + // On the given weekday
 		"AND time(queueReports.time, 'unixepoch') > CAST(? AS TEXT) " + // Start of times we're interested in
 		"AND time(queueReports.time, 'unixepoch') < CAST(? AS TEXT) " + // End of times we're interested in
@@ -242,7 +265,7 @@ func GetQueueLengthReportsByWeekdayAndTimeframe(daysOfDataToConsider int8,
 	var times []time.Time
 
 	db := GetDBHandle()
-	rows, err := db.Query(queryString, nowTimestamp, timeFrameInDaysString, int(weekday), lowerTimeLimitString, upperTimeLimitString, nowDateUTCString, nowTimestamp)
+	rows, err := db.Query(queryString, mensaID, nowTimestamp, timeFrameInDaysString, int(weekday), lowerTimeLimitString, upperTimeLimitString, nowDateUTCString, nowTimestamp)
 
 	if err != nil {
 		zap.S().Errorf("Error while querying for reports in timeframe", err)
@@ -258,7 +281,11 @@ func GetQueueLengthReportsByWeekdayAndTimeframe(daysOfDataToConsider int8,
 	return filteredLengths, filteredTimes, nil
 }
 
-func WriteReportToDB(reporter string, time int, queueLength string) error {
+/*
+WriteReportToDB stores a new report, and re-evaluates which recent reports are suspect.
+Returns the ID of the new report
+*/
+func WriteReportToDB(reporter string, reportTime int, queueLength string, mensaID string) (int64, error) {
 	anonymizedReporter := pseudonymizeReporter(reporter)
 
 	db := GetDBHandle()
@@ -266,9 +293,70 @@ func WriteReportToDB(reporter string, time int, queueLength string) error {
 	zap.S().Debug("Writing new report into DB")
 	DBMutex.Lock()
 	// Nice try
-	_, err := db.Exec("INSERT INTO queueReports VALUES(NULL,?,?,?);", anonymizedReporter, time, queueLength)
+	result, err := db.Exec("INSERT INTO queueReports(reporter, time, queueLength, mensaID) VALUES(?,?,?,?);", anonymizedReporter, reportTime, queueLength, mensaID)
 	DBMutex.Unlock()
-	return err
+	if err != nil {
+		return 0, err
+	}
+	reportID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := updateSuspectReports(mensaID, time.Unix(int64(reportTime), 0).UTC()); err != nil {
+		zap.S().Errorw("Couldn't update suspect reports", "mensaID", mensaID, "error", err)
+	}
+	return reportID, nil
+}
+
+/*
+DeleteQueueLengthReport removes a single report, and re-evaluates which of the reports
+made around the same time are suspect. If takeBackPoint is set the reporter also loses
+the point they got for the report. Report and point are removed together, or not at all
+*/
+func DeleteQueueLengthReport(reportID int64, reporterID int, takeBackPoint bool) error {
+	var mensaID string
+	var reportTime time.Time
+	db := GetDBHandle()
+	if err := db.QueryRow("SELECT mensaID, time FROM queueReports WHERE id = ?;", reportID).Scan(&mensaID, &reportTime); err != nil {
+		return err
+	}
+
+	zap.S().Info("Deleting report from DB")
+	if err := deleteReportAndPoint(db, reportID, reporterID, takeBackPoint); err != nil {
+		return err
+	}
+	if err := updateSuspectReports(mensaID, reportTime.UTC()); err != nil {
+		zap.S().Errorw("Couldn't update suspect reports", "mensaID", mensaID, "error", err)
+	}
+	return nil
+}
+
+func deleteReportAndPoint(db *sql.DB, reportID int64, reporterID int, takeBackPoint bool) error {
+	DBMutex.Lock()
+	defer DBMutex.Unlock()
+	transaction, err := db.Begin()
+	if err != nil {
+		zap.S().Errorw("Can't start transaction for report deletion", "error", err)
+		return err
+	}
+	if _, err := transaction.Exec("DELETE FROM queueReports WHERE id = ?;", reportID); err != nil {
+		zap.S().Errorw("Can't delete report, rolling back", "error", err)
+		transaction.Rollback()
+		return err
+	}
+	if takeBackPoint {
+		zap.S().Info("Removing point from user") // Don't log user explicitly for anonymity
+		if _, err := transaction.Exec(REMOVE_INTERNET_POINT_QUERY, reporterID); err != nil {
+			zap.S().Errorw("Can't remove internetpoint, rolling back", "error", err)
+			transaction.Rollback()
+			return err
+		}
+	}
+	if err := transaction.Commit(); err != nil {
+		zap.S().Errorw("Can't commit report deletion", "error", err)
+		return err
+	}
+	return nil
 }
 
 // Returns a pseudonym for the given reporter. The pseudonym is transient, and contained within one day.
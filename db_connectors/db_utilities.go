@@ -14,10 +14,13 @@ import (
 
 const KEY_DB_BASE_PATH string = "MENSA_QUEUE_BOT_DB_PATH"
 const DB_NAME string = "queue_database.db"
-const DB_VERSION uint = 4
+const DB_VERSION uint = 17
 
 var globalDBHandle *sql.DB = nil
 
+// Guards globalDBHandle itself, since it is closed on shutdown while others may still ask for it
+var globalDBHandleMutex sync.RWMutex
+
 // Needs to be used by all outside functions that request a DB handle
 var DBMutex sync.Mutex
 
@@ -29,6 +32,15 @@ func GetDBHandle() *sql.DB {
 		zap.S().Panic("Fatal Error: Environment variable for personal key not set:", KEY_DB_BASE_PATH)
 	}
 
+	globalDBHandleMutex.RLock()
+	db := globalDBHandle
+	globalDBHandleMutex.RUnlock()
+	if db != nil {
+		return db
+	}
+
+	globalDBHandleMutex.Lock()
+	defer globalDBHandleMutex.Unlock()
 	if globalDBHandle == nil {
 		// init db
 		db, err := sql.Open("sqlite3", dbPath)
@@ -41,6 +53,23 @@ func GetDBHandle() *sql.DB {
 	return globalDBHandle
 }
 
+/*
+CloseDBHandle closes the DB, after writes that are in progress finished.
+Only used on shutdown, later calls to GetDBHandle would open the DB again
+*/
+func CloseDBHandle() error {
+	DBMutex.Lock()
+	defer DBMutex.Unlock()
+	globalDBHandleMutex.Lock()
+	defer globalDBHandleMutex.Unlock()
+	if globalDBHandle == nil {
+		return nil
+	}
+	err := globalDBHandle.Close()
+	globalDBHandle = nil
+	return err
+}
+
 // A separate DB, used only for testing
 func GetTestDBHandle(dbPath string) *sql.DB {
 	// Unlike with the actual DB, don't use a global handle.
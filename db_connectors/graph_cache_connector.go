@@ -0,0 +1,88 @@
+/*
+Implements storage of the queue graphs we uploaded to telegram. Telegram
+assigns a file_id to each uploaded graph, which can be sent again without
+uploading the graph again. Keeping them in the DB means we don't need to
+render a new graph for the first request after a restart
+*/
+package db_connectors
+
+import (
+	"database/sql"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+CachedGraph is a graph of the queue of a mensa that was uploaded to telegram.
+TimeWindow describes which timeframe the graph shows, ForecastLine is the forecast
+that was sent together with the graph
+*/
+type CachedGraph struct {
+	MensaID        string
+	TimeWindow     string
+	GeneratedAt    time.Time
+	TelegramFileID string
+	ForecastLine   string
+}
+
+/*
+GetCachedGraph returns the latest graph of the given mensa and time window.
+The bool is false if there is no such graph
+*/
+func GetCachedGraph(mensaID string, timeWindow string) (CachedGraph, bool, error) {
+	db := GetDBHandle()
+	return getCachedGraphWithDB(mensaID, timeWindow, db)
+}
+
+func getCachedGraphWithDB(mensaID string, timeWindow string, db *sql.DB) (CachedGraph, bool, error) {
+	queryString := "SELECT generatedAt, telegramFileID, forecastLine FROM graphCache WHERE mensaID = ? AND timeWindow = ?;"
+	graph := CachedGraph{MensaID: mensaID, TimeWindow: timeWindow}
+	var generatedAt int64
+	err := db.QueryRow(queryString, mensaID, timeWindow).Scan(&generatedAt, &graph.TelegramFileID, &graph.ForecastLine)
+	if err == sql.ErrNoRows {
+		return graph, false, nil
+	}
+	if err != nil {
+		zap.S().Errorw("Can't query cached graph", "mensa", mensaID, "error", err)
+		return graph, false, err
+	}
+	graph.GeneratedAt = time.Unix(generatedAt, 0).UTC()
+	return graph, true, nil
+}
+
+// SaveCachedGraph stores the given graph, replacing the previous graph of its mensa and time window
+func SaveCachedGraph(graph CachedGraph) error {
+	db := GetDBHandle()
+	return saveCachedGraphWithDB(graph, db)
+}
+
+func saveCachedGraphWithDB(graph CachedGraph, db *sql.DB) error {
+	queryString := `INSERT INTO graphCache(mensaID, timeWindow, generatedAt, telegramFileID, forecastLine) VALUES (?,?,?,?,?)
+	ON CONFLICT (mensaID, timeWindow) DO UPDATE SET generatedAt = excluded.generatedAt,
+	telegramFileID = excluded.telegramFileID, forecastLine = excluded.forecastLine;`
+	DBMutex.Lock()
+	_, err := db.Exec(queryString, graph.MensaID, graph.TimeWindow, graph.GeneratedAt.Unix(), graph.TelegramFileID, graph.ForecastLine)
+	DBMutex.Unlock()
+	if err != nil {
+		zap.S().Errorw("Can't store cached graph", "mensa", graph.MensaID, "error", err)
+	}
+	return err
+}
+
+// DeleteCachedGraphsOfMensa removes all graphs of the given mensa, e.g. because they show a report that was removed
+func DeleteCachedGraphsOfMensa(mensaID string) error {
+	db := GetDBHandle()
+	return deleteCachedGraphsOfMensaWithDB(mensaID, db)
+}
+
+func deleteCachedGraphsOfMensaWithDB(mensaID string, db *sql.DB) error {
+	queryString := "DELETE FROM graphCache WHERE mensaID = ?;"
+	DBMutex.Lock()
+	_, err := db.Exec(queryString, mensaID)
+	DBMutex.Unlock()
+	if err != nil {
+		zap.S().Errorw("Can't delete cached graphs", "mensa", mensaID, "error", err)
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package db_connectors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedGraphIsReplacedPerMensaAndWindow(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	db := GetTestDBHandle(TEST_DB_PATH)
+	generatedAt := time.Date(2022, 10, 10, 10, 0, 0, 0, time.UTC)
+
+	if _, found, err := getCachedGraphWithDB("griebnitzsee", "60m", db); found || err != nil {
+		t.Fatalf("Found graph in empty cache, err: %v", err)
+	}
+
+	saveCachedGraphWithDB(CachedGraph{MensaID: "griebnitzsee", TimeWindow: "60m", GeneratedAt: generatedAt, TelegramFileID: "old", ForecastLine: "calm"}, db)
+	saveCachedGraphWithDB(CachedGraph{MensaID: "griebnitzsee", TimeWindow: "60m", GeneratedAt: generatedAt.Add(time.Minute), TelegramFileID: "new"}, db)
+	saveCachedGraphWithDB(CachedGraph{MensaID: "griebnitzsee", TimeWindow: "30m", GeneratedAt: generatedAt, TelegramFileID: "other window"}, db)
+	saveCachedGraphWithDB(CachedGraph{MensaID: "neuespalais", TimeWindow: "60m", GeneratedAt: generatedAt, TelegramFileID: "other mensa"}, db)
+
+	graph, found, err := getCachedGraphWithDB("griebnitzsee", "60m", db)
+	if !found || err != nil {
+		t.Fatalf("Saved graph wasn't found, err: %v", err)
+	}
+	if graph.TelegramFileID != "new" || graph.ForecastLine != "" || !graph.GeneratedAt.Equal(generatedAt.Add(time.Minute)) {
+		t.Errorf("Graph wasn't replaced by newer graph: %v", graph)
+	}
+
+	deleteCachedGraphsOfMensaWithDB("griebnitzsee", db)
+	if _, found, _ := getCachedGraphWithDB("griebnitzsee", "30m", db); found {
+		t.Errorf("Graph of mensa wasn't deleted")
+	}
+	if _, found, _ := getCachedGraphWithDB("neuespalais", "60m", db); !found {
+		t.Errorf("Graph of other mensa was deleted")
+	}
+}
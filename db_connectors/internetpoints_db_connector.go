@@ -6,6 +6,10 @@ import (
 	"go.uber.org/zap"
 )
 
+func init() {
+	registerUserDataTable("internetpoints")
+}
+
 func UserIsCollectingPoints(userID int) bool {
 	if GetNumberOfPointsByUser(userID) == -1 {
 		return false
@@ -49,6 +53,9 @@ func AddInternetPoint(userID int) error {
 	return nil
 }
 
+// Takes back a point, e.g. for a report that was undone. Points never become negative
+const REMOVE_INTERNET_POINT_QUERY = "UPDATE internetpoints SET points = MAX(points - 1, 0) WHERE reporterID= ?;"
+
 func EnableCollectionOfPoints(userID int) error {
 	queryString := "INSERT INTO internetpoints VALUES (NULL, ?, 0) ON CONFLICT (reporterID) DO NOTHING;"
 	db := GetDBHandle()
@@ -66,7 +73,6 @@ func EnableCollectionOfPoints(userID int) error {
 }
 
 func DisableCollectionOfPoints(userID int) error {
-	// Note: If this is changed from deleting all user data also modify DeleteAllUserPointData for compliance
 	queryString := "DELETE FROM internetpoints WHERE reporterID = ?;"
 	db := GetDBHandle()
 
@@ -81,8 +87,3 @@ func DisableCollectionOfPoints(userID int) error {
 	}
 	return nil
 }
-
-func DeleteAllUserPointData(userID int) error {
-	// Deleting user data is exactly what happens when we call DisableCollectionOfPoints
-	return DisableCollectionOfPoints(userID)
-}
@@ -2,55 +2,180 @@ package db_connectors
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 
 	"github.com/ADimeo/MensaQueueBot/utils"
 	"go.uber.org/zap"
 )
 
+/*
+DBOfferInformation is a single offer of a mensa menu. Labels (e.g. vegan), allergens and additives
+are stored as given by mensa_scraper, see mensa_scraper.LABEL_VEGAN. Prices are in cents, and 0 if unknown.
+Time is when we scraped the offer, Date the day it is offered on, as 2006-01-02.
+Source is the name of the menu provider we got the offer from, all offers of a version share it
+*/
 type DBOfferInformation struct {
-	Title       string
-	Description string
-	Time        time.Time
-	Counter     int
+	Title               string
+	Description         string
+	Time                time.Time
+	Date                string
+	Counter             int
+	MensaID             string
+	Labels              []string
+	Allergens           []string
+	Additives           []string
+	StudentPriceInCents int
+	StaffPriceInCents   int
+	GuestPriceInCents   int
+	Source              string
+}
+
+// HasLabel returns true if the offer has the given label
+func (offer DBOfferInformation) HasLabel(label string) bool {
+	return containsString(offer.Labels, label)
+}
+
+// ContainsAllergen returns true if the offer contains the allergen with the given code
+func (offer DBOfferInformation) ContainsAllergen(allergen string) bool {
+	return containsString(offer.Allergens, allergen)
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Lists are stored comma separated, which is fine since none of the values contain commas
+func joinList(values []string) string {
+	return strings.Join(values, ",")
+}
+
+func splitList(joinedValues string) []string {
+	if joinedValues == "" {
+		return nil
+	}
+	return strings.Split(joinedValues, ",")
 }
 
 // time, title, decsription, counter
 
-// Returns latest mensa offers, but for today
-func GetLatestMensaOffersFromToday() ([]DBOfferInformation, error) {
-	queryString := `SELECT time, title, description, counter FROM mensaMenus 
-	WHERE date(time) == ? 
-	AND counter == (SELECT MAX(counter) FROM mensaMenus);`
+// Returns latest mensa offers of the given mensa, but for today
+func GetLatestMensaOffersFromToday(mensaID string) ([]DBOfferInformation, error) {
+	currentDate := time.Now().In(utils.GetLocalLocation()).Format("2006-01-02")
+	return GetLatestMensaOffersOfDate(mensaID, currentDate)
+}
+
+/*
+GetLatestMensaOffersOfDate returns the latest version of the menu of the given mensa
+on the given date (2006-01-02). Each date has its own versions, since menus of
+upcoming days are scraped along with the menu of today
+*/
+func GetLatestMensaOffersOfDate(mensaID string, date string) ([]DBOfferInformation, error) {
 	db := GetDBHandle()
+	return getLatestMensaOffersOfDateWithDB(mensaID, date, db)
+}
 
-	var latestOffers []DBOfferInformation
+func getLatestMensaOffersOfDateWithDB(mensaID string, date string, db *sql.DB) ([]DBOfferInformation, error) {
+	queryString := `SELECT time, date, title, description, counter, mensaID, labels, allergens, additives,
+	studentPrice, staffPrice, guestPrice, source FROM mensaMenus 
+	WHERE date == ? 
+	AND mensaID == ?
+	AND counter == (SELECT MAX(counter) FROM mensaMenus WHERE mensaID == ? AND date == ?);`
 
-	currentDate := time.Now().In(utils.GetLocalLocation()).Format("2006-01-02")
-	rows, err := db.Query(queryString, currentDate)
+	return queryMensaOffersWithDB(db, queryString, date, mensaID, mensaID, date)
+}
+
+/*
+GetLatestMensaOffersOfDateFromSource works like GetLatestMensaOffersOfDate, but only
+considers versions we got from the given menu provider. Sources differ in details, so
+only versions of the same source can be compared
+*/
+func GetLatestMensaOffersOfDateFromSource(mensaID string, date string, source string) ([]DBOfferInformation, error) {
+	db := GetDBHandle()
+	return getLatestMensaOffersOfDateFromSourceWithDB(mensaID, date, source, db)
+}
+
+func getLatestMensaOffersOfDateFromSourceWithDB(mensaID string, date string, source string, db *sql.DB) ([]DBOfferInformation, error) {
+	queryString := `SELECT time, date, title, description, counter, mensaID, labels, allergens, additives,
+	studentPrice, staffPrice, guestPrice, source FROM mensaMenus
+	WHERE date == ?
+	AND mensaID == ?
+	AND counter == (SELECT MAX(counter) FROM mensaMenus WHERE mensaID == ? AND date == ? AND source == ?);`
+
+	return queryMensaOffersWithDB(db, queryString, date, mensaID, mensaID, date, source)
+}
+
+/*
+GetPreviousMensaOffersOfDate returns the version of the menu of the given mensa and date
+that came right before the latest one. Returns no offers if there is only a single version
+*/
+func GetPreviousMensaOffersOfDate(mensaID string, date string) ([]DBOfferInformation, error) {
+	db := GetDBHandle()
+	return getPreviousMensaOffersOfDateWithDB(mensaID, date, db)
+}
+
+func getPreviousMensaOffersOfDateWithDB(mensaID string, date string, db *sql.DB) ([]DBOfferInformation, error) {
+	queryString := `SELECT time, date, title, description, counter, mensaID, labels, allergens, additives,
+	studentPrice, staffPrice, guestPrice, source FROM mensaMenus
+	WHERE date == ?
+	AND mensaID == ?
+	AND counter == (SELECT MAX(counter) FROM mensaMenus WHERE mensaID == ? AND date == ?
+		AND counter < (SELECT MAX(counter) FROM mensaMenus WHERE mensaID == ? AND date == ?));`
+
+	return queryMensaOffersWithDB(db, queryString, date, mensaID, mensaID, date, mensaID, date)
+}
+
+// queryMensaOffersWithDB runs a query that selects the columns of mensaMenus in the order of getLatestMensaOffersOfDateWithDB
+func queryMensaOffersWithDB(db *sql.DB, queryString string, args ...interface{}) ([]DBOfferInformation, error) {
+	var offers []DBOfferInformation
+
+	rows, err := db.Query(queryString, args...)
 	if err != nil {
-		zap.S().Errorf("Error while querying for latest mensa offers", err)
-		return latestOffers, err
+		zap.S().Errorf("Error while querying for mensa offers", err)
+		return offers, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var latestOffer DBOfferInformation
-		if err = rows.Scan(&latestOffer.Time, &latestOffer.Title, &latestOffer.Description, &latestOffer.Counter); err != nil {
-			zap.S().Errorf("Error scanning for latest mensa menus, likely data type mismatch", err)
+		var offer DBOfferInformation
+		var labels, allergens, additives string
+		if err = rows.Scan(&offer.Time, &offer.Date, &offer.Title, &offer.Description, &offer.Counter, &offer.MensaID,
+			&labels, &allergens, &additives,
+			&offer.StudentPriceInCents, &offer.StaffPriceInCents, &offer.GuestPriceInCents, &offer.Source); err != nil {
+			zap.S().Errorf("Error scanning for mensa menus, likely data type mismatch", err)
 		}
-		latestOffers = append(latestOffers, latestOffer)
+		offer.Labels = splitList(labels)
+		offer.Allergens = splitList(allergens)
+		offer.Additives = splitList(additives)
+		offers = append(offers, offer)
 	}
 
-	return latestOffers, nil
+	return offers, nil
 }
 
 func InsertMensaMenu(offerToInsert *DBOfferInformation) error {
-	queryString := "INSERT INTO mensaMenus(time, title, description, counter) VALUES(?,?,?,?);"
 	db := GetDBHandle()
+	return insertMensaMenuWithDB(offerToInsert, db)
+}
+
+func insertMensaMenuWithDB(offerToInsert *DBOfferInformation, db *sql.DB) error {
+	queryString := `INSERT INTO mensaMenus(time, date, title, description, counter, mensaID, labels, allergens, additives,
+	studentPrice, staffPrice, guestPrice, source) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?);`
+	date := offerToInsert.Date
+	if date == "" {
+		// Offered on the day it was scraped
+		date = offerToInsert.Time.In(utils.GetLocalLocation()).Format("2006-01-02")
+	}
 
 	DBMutex.Lock()
-	_, err := db.Exec(queryString, offerToInsert.Time, offerToInsert.Title, offerToInsert.Description, offerToInsert.Counter)
+	_, err := db.Exec(queryString, offerToInsert.Time, date, offerToInsert.Title, offerToInsert.Description, offerToInsert.Counter, offerToInsert.MensaID,
+		joinList(offerToInsert.Labels), joinList(offerToInsert.Allergens), joinList(offerToInsert.Additives),
+		offerToInsert.StudentPriceInCents, offerToInsert.StaffPriceInCents, offerToInsert.GuestPriceInCents, offerToInsert.Source)
 	DBMutex.Unlock()
 	return err
 }
@@ -0,0 +1,114 @@
+package db_connectors
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMenuDetailsAreStored(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	db := GetTestDBHandle(TEST_DB_PATH)
+	offerTime := time.Date(2023, 2, 21, 10, 0, 0, 0, time.UTC)
+
+	insertMensaMenuWithDB(&DBOfferInformation{
+		Title:               "Angebot 2",
+		Description:         "Bunte Nudeln mit Sojabolognese und Reibekäse",
+		Time:                offerTime,
+		Counter:             1,
+		MensaID:             "griebnitzsee",
+		Labels:              []string{"vegetarian", "regional"},
+		Allergens:           []string{"C", "Wei"},
+		Additives:           []string{"9"},
+		StudentPriceInCents: 250,
+		StaffPriceInCents:   480,
+		GuestPriceInCents:   480,
+	}, db)
+	insertMensaMenuWithDB(&DBOfferInformation{
+		Title:       "Angebot 4",
+		Description: "Without details",
+		Time:        offerTime,
+		Counter:     1,
+		MensaID:     "griebnitzsee",
+	}, db)
+
+	offers, err := getLatestMensaOffersOfDateWithDB("griebnitzsee", "2023-02-21", db)
+	if err != nil || len(offers) != 2 {
+		t.Fatalf("Expected both offers, got %v, %v", offers, err)
+	}
+	offer := offers[0]
+	if strings.Join(offer.Labels, ",") != "vegetarian,regional" || strings.Join(offer.Allergens, ",") != "C,Wei" || strings.Join(offer.Additives, ",") != "9" {
+		t.Errorf("Lists weren't stored as given: %v", offer)
+	}
+	if offer.StudentPriceInCents != 250 || offer.StaffPriceInCents != 480 || offer.GuestPriceInCents != 480 {
+		t.Errorf("Prices weren't stored as given: %v", offer)
+	}
+	if !offer.HasLabel("vegetarian") || offer.HasLabel("vegan") || !offer.ContainsAllergen("Wei") || offer.ContainsAllergen("G") {
+		t.Errorf("Labels or allergens can't be filtered for: %v", offer)
+	}
+	if offers[1].Labels != nil || offers[1].Allergens != nil || offers[1].StudentPriceInCents != 0 {
+		t.Errorf("Offer without details got some: %v", offers[1])
+	}
+}
+
+func TestMenusOfDatesHaveTheirOwnVersions(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	db := GetTestDBHandle(TEST_DB_PATH)
+	scrapeTime := time.Date(2023, 2, 21, 10, 0, 0, 0, time.UTC)
+
+	insertMensaMenuWithDB(&DBOfferInformation{Title: "Angebot 1", Description: "Old", Time: scrapeTime, Counter: 1, MensaID: "griebnitzsee"}, db)
+	insertMensaMenuWithDB(&DBOfferInformation{Title: "Angebot 1", Description: "Tomorrow", Time: scrapeTime, Date: "2023-02-22", Counter: 2, MensaID: "griebnitzsee"}, db)
+	insertMensaMenuWithDB(&DBOfferInformation{Title: "Angebot 1", Description: "New", Time: scrapeTime, Date: "2023-02-21", Counter: 3, MensaID: "griebnitzsee"}, db)
+	insertMensaMenuWithDB(&DBOfferInformation{Title: "Angebot 1", Description: "Golm", Time: scrapeTime, Date: "2023-02-22", Counter: 4, MensaID: "golm"}, db)
+
+	today, err := getLatestMensaOffersOfDateWithDB("griebnitzsee", "2023-02-21", db)
+	if err != nil || len(today) != 1 || today[0].Description != "New" || today[0].Date != "2023-02-21" {
+		t.Errorf("Expected latest version of today, got %v, %v", today, err)
+	}
+	// The newest version of the mensa belongs to another date
+	tomorrow, err := getLatestMensaOffersOfDateWithDB("griebnitzsee", "2023-02-22", db)
+	if err != nil || len(tomorrow) != 1 || tomorrow[0].Description != "Tomorrow" {
+		t.Errorf("Expected the menu of tomorrow, got %v, %v", tomorrow, err)
+	}
+}
+
+func TestPreviousVersionOfMenuIsFound(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	db := GetTestDBHandle(TEST_DB_PATH)
+	scrapeTime := time.Date(2023, 2, 21, 10, 0, 0, 0, time.UTC)
+
+	insertMensaMenuWithDB(&DBOfferInformation{Title: "Angebot 3", Description: "Currywurst", Time: scrapeTime, Date: "2023-02-21", Counter: 1, MensaID: "griebnitzsee"}, db)
+	previous, err := getPreviousMensaOffersOfDateWithDB("griebnitzsee", "2023-02-21", db)
+	if err != nil || len(previous) != 0 {
+		t.Errorf("Single version shouldn't have a previous one, got %v, %v", previous, err)
+	}
+
+	insertMensaMenuWithDB(&DBOfferInformation{Title: "Angebot 1", Description: "Tomorrow", Time: scrapeTime, Date: "2023-02-22", Counter: 2, MensaID: "griebnitzsee"}, db)
+	insertMensaMenuWithDB(&DBOfferInformation{Title: "Angebot 3", Description: "Gemüsepfanne", Time: scrapeTime, Date: "2023-02-21", Counter: 3, MensaID: "griebnitzsee"}, db)
+	previous, err = getPreviousMensaOffersOfDateWithDB("griebnitzsee", "2023-02-21", db)
+	if err != nil || len(previous) != 1 || previous[0].Description != "Currywurst" {
+		t.Errorf("Expected the version before the latest of that date, got %v, %v", previous, err)
+	}
+}
+
+func TestLatestVersionOfSourceIsFound(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	db := GetTestDBHandle(TEST_DB_PATH)
+	scrapeTime := time.Date(2023, 2, 21, 10, 0, 0, 0, time.UTC)
+
+	insertMensaMenuWithDB(&DBOfferInformation{Title: "Angebot 3", Description: "Currywurst", Time: scrapeTime, Date: "2023-02-21", Counter: 1, MensaID: "griebnitzsee", Source: "webspeiseplan"}, db)
+	insertMensaMenuWithDB(&DBOfferInformation{Title: "Angebot 3", Description: "Currywurst", Time: scrapeTime, Date: "2023-02-21", Counter: 2, MensaID: "griebnitzsee", Source: "stw xml"}, db)
+
+	offers, err := getLatestMensaOffersOfDateFromSourceWithDB("griebnitzsee", "2023-02-21", "webspeiseplan", db)
+	if err != nil || len(offers) != 1 || offers[0].Counter != 1 || offers[0].Source != "webspeiseplan" {
+		t.Errorf("Expected the latest version from webspeiseplan, got %v, %v", offers, err)
+	}
+	offers, err = getLatestMensaOffersOfDateFromSourceWithDB("griebnitzsee", "2023-02-21", "unknown", db)
+	if err != nil || len(offers) != 0 {
+		t.Errorf("Source without versions shouldn't have offers, got %v, %v", offers, err)
+	}
+}
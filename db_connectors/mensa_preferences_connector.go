@@ -6,10 +6,16 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/ADimeo/MensaQueueBot/mensas"
 	"github.com/ADimeo/MensaQueueBot/utils"
 	"go.uber.org/zap"
 )
 
+func init() {
+	registerUserDataTable("mensaPreferences")
+	registerUserDataTable("inactiveChats")
+}
+
 // Customise:
 // User has userID, times(start) (minutes), time(end) (minutes), Weekdays (binary and), wants_mensa_messages, temp_reported_today (date?)
 
@@ -18,6 +24,7 @@ type MensaPreferenceSettings struct {
 	FromTime      string `json:"fromTime"`
 	WeekdayBitmap int    `json:"weekdayBitmap"`
 	ToTime        string `json:"toTime"`
+	MensaID       string `json:"mensaID"`
 }
 
 func (settingsStruct *MensaPreferenceSettings) SetFromTimeFromCESTMinutes(cestMinutes int) {
@@ -38,6 +45,10 @@ func (settingsStruct *MensaPreferenceSettings) SetToTimeFromCESTMinutes(cestMinu
 
 func (settingsStruct *MensaPreferenceSettings) GetToTimeAsCESTMinute() (int, error) {
 	// We expect a format like 12:00
+	if len(settingsStruct.ToTime) != 5 {
+		zap.S().Errorw("ToTime string has unexpected format", "ToTime value", settingsStruct.ToTime)
+		return 840, fmt.Errorf("time %q isn't formatted like 12:00", settingsStruct.ToTime)
+	}
 	hour, err := strconv.Atoi(settingsStruct.ToTime[0:2])
 	if err != nil {
 		zap.S().Errorw("Can't convert ToTime string to actual int", "FromTime value", settingsStruct.ToTime, "error", err)
@@ -60,6 +71,10 @@ func (settingsStruct *MensaPreferenceSettings) GetToTimeAsCESTMinute() (int, err
 
 func (settingsStruct MensaPreferenceSettings) GetFromTimeAsCESTMinute() (int, error) {
 	// We expect a format like 12:00
+	if len(settingsStruct.FromTime) != 5 {
+		zap.S().Errorw("FromTime string has unexpected format", "FromTime value", settingsStruct.FromTime)
+		return 600, fmt.Errorf("time %q isn't formatted like 12:00", settingsStruct.FromTime)
+	}
 	hour, err := strconv.Atoi(settingsStruct.FromTime[0:2])
 	if err != nil {
 		zap.S().Errorw("Can't convert FromTime string to actual int", "FromTime value", settingsStruct.FromTime, "error", err)
@@ -79,9 +94,12 @@ func (settingsStruct MensaPreferenceSettings) GetFromTimeAsCESTMinute() (int, er
 	return cestMinute, nil
 }
 
-func GetUsersToSendMenuToByTimestamp(nowInUTC time.Time) ([]int, error) {
+// Returns all users of the given mensa that want to be informed about menu changes right now
+func GetUsersToSendMenuToByTimestamp(nowInUTC time.Time, mensaID string) ([]int, error) {
 	queryString := `SELECT reporterID FROM mensaPreferences
 		WHERE wantsMensaMessages = 1
+		AND isActive = 1
+		AND mensaID = ?
 		AND (lastReportDate IS NULL OR date(lastReportDate) != ?)
 		AND ? BETWEEN startTimeInCESTMinutes AND endTimeInCESTMinutes
 		AND ? & weekdayBitmap > 0;`
@@ -93,7 +111,7 @@ func GetUsersToSendMenuToByTimestamp(nowInUTC time.Time) ([]int, error) {
 	weekdayBitmap := getBitmapForToday(nowInUTC)
 
 	db := GetDBHandle()
-	rows, err := db.Query(queryString, currentDate, currentCESTMinute, weekdayBitmap)
+	rows, err := db.Query(queryString, mensaID, currentDate, currentCESTMinute, weekdayBitmap)
 	if err != nil {
 		zap.S().Errorf("Couldn't get users to send menu to", err)
 		return make([]int, 0), err
@@ -125,6 +143,7 @@ func GetCESTMinuteForNextIntroMessage(nowInUTC time.Time, cestMinuteOfLastRun in
 	queryString := `SELECT startTimeInCESTMinutes FROM mensaPreferences 
 	WHERE startTimeInCESTMinutes > ? 
 	AND wantsMensaMessages = 1
+	AND isActive = 1
 	AND (lastReportDate IS NULL OR date(lastReportDate) != ?)
 	AND ? & weekdayBitmap > 0
 	ORDER BY startTimeInCESTMinutes ASC 
@@ -158,7 +177,8 @@ func GetFirstCESTMinuteForIntroMessage() (int, error) {
 	// And getting this behaviour cleanly (so wrapping arround the weekday bitmap,
 	// etc.) just doesn't feel worth it at all.
 	queryString := `SELECT IFNULL(MIN(startTimeInCESTMinutes), 0) FROM mensaPreferences
-	WHERE wantsMensaMessages = 1;`
+	WHERE wantsMensaMessages = 1
+	AND isActive = 1;`
 	db := GetDBHandle()
 
 	var firstTime int
@@ -181,6 +201,7 @@ func GetUsersWithInitialMessageInTimeframe(nowInUTC time.Time, lowerBoundCESTMin
 	// and SQLites BETWEEN statement is inclusive of both upper and lower bound
 	queryString := `SELECT reporterID FROM mensaPreferences
 		WHERE wantsMensaMessages = 1
+		AND isActive = 1
 		AND (lastReportDate IS NULL OR date(lastReportDate) != ?)
 		AND startTimeInCESTMinutes BETWEEN ? + 1 AND ? 
 		AND ? & weekdayBitmap > 0;`
@@ -232,7 +253,7 @@ func UpdateUserPreferences(userID int, wantsMensaMessages bool, startTimeInCESTM
 // Returns preferences for single user. Sets preferences to default
 // And returns those if user doesn't have any associated preferences
 func GetUserPreferences(userID int) (MensaPreferenceSettings, error) {
-	queryString := `SELECT wantsMensaMessages, weekdayBitmap, startTimeInCESTMinutes, endTimeInCESTMinutes 
+	queryString := `SELECT wantsMensaMessages, weekdayBitmap, startTimeInCESTMinutes, endTimeInCESTMinutes, mensaID
 	FROM mensaPreferences
 	WHERE reporterID == ?;`
 
@@ -241,8 +262,9 @@ func GetUserPreferences(userID int) (MensaPreferenceSettings, error) {
 	var weekdayBitmap int
 	var startCESTMinutes int
 	var endCESTMinutes int
+	var mensaID string
 
-	if err := db.QueryRow(queryString, userID).Scan(&usersPreferences.ReportAtAll, &weekdayBitmap, &startCESTMinutes, &endCESTMinutes); err != nil {
+	if err := db.QueryRow(queryString, userID).Scan(&usersPreferences.ReportAtAll, &weekdayBitmap, &startCESTMinutes, &endCESTMinutes, &mensaID); err != nil {
 		if err == sql.ErrNoRows {
 			zap.S().Info("User doesn't have associated mensa settings yet")
 			usersPreferences, err = SetDefaultMensaPreferencesForUser(userID)
@@ -257,45 +279,77 @@ func GetUserPreferences(userID int) (MensaPreferenceSettings, error) {
 	usersPreferences.WeekdayBitmap = weekdayBitmap
 	usersPreferences.SetFromTimeFromCESTMinutes(startCESTMinutes)
 	usersPreferences.SetToTimeFromCESTMinutes(endCESTMinutes)
+	if mensaID == "" {
+		mensaID = mensas.DEFAULT_MENSA_ID
+	}
+	usersPreferences.MensaID = mensaID
 
 	return usersPreferences, nil
 }
-func SetDefaultMensaPreferencesForUser(userID int) (MensaPreferenceSettings, error) {
-	var err error
-	var usersPreferences MensaPreferenceSettings
-	usersPreferences.ReportAtAll = true
-	if utils.IsInDebugMode() {
-		err = UpdateUserPreferences(userID, true, 0, 1440, 0b0111110) // Default from 0:00 to 24:00
-		usersPreferences.WeekdayBitmap = 0b0111110
-		usersPreferences.SetFromTimeFromCESTMinutes(0)
-		usersPreferences.SetToTimeFromCESTMinutes(1440)
 
-	} else {
-		err = UpdateUserPreferences(userID, true, 600, 840, 0b0111110) // Default from 10:00 to 14:00
-		usersPreferences.WeekdayBitmap = 0b0111110
-		usersPreferences.SetFromTimeFromCESTMinutes(600)
-		usersPreferences.SetToTimeFromCESTMinutes(840)
-	}
+/*
+GetUserMensaID returns the ID of the users home mensa. Users without
+preferences, and users whose mensa doesn't exist anymore, get the default mensa
+*/
+func GetUserMensaID(userID int) string {
+	queryString := `SELECT mensaID FROM mensaPreferences WHERE reporterID == ?;`
+	db := GetDBHandle()
 
-	if err != nil {
-		zap.S().Errorf("Can't set default preferences for user %d", userID, err)
+	var mensaID string
+	if err := db.QueryRow(queryString, userID).Scan(&mensaID); err != nil {
+		if err != sql.ErrNoRows {
+			zap.S().Errorw("Error while querying for users mensa", "userID", userID, "error", err)
+		}
+		return mensas.DEFAULT_MENSA_ID
 	}
-	return usersPreferences, err
+	return mensas.GetMensaOrDefault(mensaID).ID
 }
 
-func DeleteAllUserMensaPreferences(userID int) error {
-	queryString := `DELETE FROM mensaPreferences WHERE reporterID == ?;`
+/*
+SetUserMensa changes the home mensa of the user. Users need to have
+preferences already, see UpdateUserPreferences
+*/
+func SetUserMensa(userID int, mensaID string) error {
+	if _, err := mensas.GetMensa(mensaID); err != nil {
+		return err
+	}
+	// Users without preferences get the default ones, with the given mensa
+	queryString := `INSERT INTO mensaPreferences(reporterID, wantsMensaMessages, startTimeInCESTMinutes, endTimeInCESTMinutes, weekdayBitmap, mensaID) VALUES (?,?,?,?,?,?)
+	ON CONFLICT (reporterID) DO UPDATE SET mensaID=?;`
 	db := GetDBHandle()
-	zap.S().Infof("Deleting mensa preferences for user %d", userID)
+	startTimeInCESTMinutes, endTimeInCESTMinutes, weekdayBitmap := getDefaultPreferenceTimes()
 
 	DBMutex.Lock()
-	_, err := db.Exec(queryString, userID)
+	_, err := db.Exec(queryString, userID, true, startTimeInCESTMinutes, endTimeInCESTMinutes, weekdayBitmap, mensaID, mensaID)
 	DBMutex.Unlock()
 	if err != nil {
-		zap.S().Errorf("Error while deleting mensa preferences of user %s", userID, err)
-		return err
+		zap.S().Errorw("Error while saving users mensa", "userID", userID, "mensaID", mensaID, "error", err)
 	}
-	return nil
+	return err
+}
+
+// getDefaultPreferenceTimes returns start and end minute as well as weekdays of the default preferences
+func getDefaultPreferenceTimes() (int, int, int) {
+	if utils.IsInDebugMode() {
+		return 0, 1440, 0b0111110 // Default from 0:00 to 24:00
+	}
+	return 600, 840, 0b0111110 // Default from 10:00 to 14:00
+}
+
+func SetDefaultMensaPreferencesForUser(userID int) (MensaPreferenceSettings, error) {
+	var usersPreferences MensaPreferenceSettings
+	usersPreferences.ReportAtAll = true
+	usersPreferences.MensaID = mensas.DEFAULT_MENSA_ID
+	startTimeInCESTMinutes, endTimeInCESTMinutes, weekdayBitmap := getDefaultPreferenceTimes()
+	err := UpdateUserPreferences(userID, true, startTimeInCESTMinutes, endTimeInCESTMinutes, weekdayBitmap)
+	usersPreferences.WeekdayBitmap = weekdayBitmap
+	usersPreferences.SetFromTimeFromCESTMinutes(startTimeInCESTMinutes)
+	usersPreferences.SetToTimeFromCESTMinutes(endTimeInCESTMinutes)
+
+	if err != nil {
+		zap.S().Errorf("Can't set default preferences for user %d", userID, err)
+	}
+	return usersPreferences, err
 }
 
 func SetUserToReportedOnDate(userID int, nowInUTC time.Time) error {
@@ -319,8 +373,131 @@ func SetUserToReportedOnDate(userID int, nowInUTC time.Time) error {
 	return nil
 }
 
+/*
+SetChatInactive marks a chat we can't reach anymore, e.g. because the user blocked us.
+Inactive chats are left out of all pushes, until SetChatActive is called.
+Never creates preferences, since this is also called for chats that deleted all their data.
+Chats that only set up alerts are marked in inactiveChats instead, which only
+happens while they still have alerts
+*/
+func SetChatInactive(chatID int) error {
+	preferencesQueryString := `UPDATE mensaPreferences SET isActive = 0 WHERE reporterID = ?;`
+	alertsOnlyQueryString := `INSERT OR IGNORE INTO inactiveChats(reporterID)
+	SELECT reporterID FROM queueAlerts WHERE reporterID = ?
+	AND reporterID NOT IN (SELECT reporterID FROM mensaPreferences);`
+	db := GetDBHandle()
+
+	DBMutex.Lock()
+	defer DBMutex.Unlock()
+	_, err := db.Exec(preferencesQueryString, chatID)
+	if err == nil {
+		_, err = db.Exec(alertsOnlyQueryString, chatID)
+	}
+	if err != nil {
+		zap.S().Errorw("Error while marking chat inactive", "error", err)
+	}
+	return err
+}
+
+/*
+SetChatActive marks the chat as reachable again, after it was marked inactive.
+Called whenever the chat writes to us, so it does nothing for chats that are active
+*/
+func SetChatActive(chatID int) error {
+	queryString := `UPDATE mensaPreferences SET isActive = 1 WHERE reporterID = ? AND isActive = 0;`
+	alertsOnlyQueryString := `DELETE FROM inactiveChats WHERE reporterID = ?;`
+	db := GetDBHandle()
+
+	DBMutex.Lock()
+	result, err := db.Exec(queryString, chatID)
+	var alertsOnlyResult sql.Result
+	if err == nil {
+		alertsOnlyResult, err = db.Exec(alertsOnlyQueryString, chatID)
+	}
+	DBMutex.Unlock()
+	if err != nil {
+		zap.S().Errorw("Error while marking chat active", "error", err)
+		return err
+	}
+	reactivatedRows, _ := result.RowsAffected()
+	reactivatedAlertsOnlyRows, _ := alertsOnlyResult.RowsAffected()
+	if reactivatedRows+reactivatedAlertsOnlyRows > 0 {
+		zap.S().Info("Inactive chat wrote to us, reactivating it")
+	}
+	return nil
+}
+
 func getBitmapForToday(nowInUTC time.Time) int {
 	weekdayNow := nowInUTC.Weekday() // Sunday is 0, Sunday is left, shift 6 for sunday
 	weekdayBitmap := 1 << (6 - weekdayNow)
 	return weekdayBitmap
 }
+
+// Diets users can choose. The values are the labels offers need to have, see mensa_scraper.LABEL_VEGAN
+const DIET_ANY = ""
+const DIET_VEGETARIAN = "vegetarian"
+const DIET_VEGAN = "vegan"
+
+/*
+DietaryPreferences corresponds with how the settings html in the static folder structures
+dietary preferences. ExcludedAllergens contains allergen codes, see mensa_scraper.ALLERGEN_NAMES
+*/
+type DietaryPreferences struct {
+	Diet              string   `json:"diet"`
+	NoPork            bool     `json:"noPork"`
+	ExcludedAllergens []string `json:"excludedAllergens"`
+}
+
+// IsFiltering returns true if the user doesn't want to see all offers
+func (preferences DietaryPreferences) IsFiltering() bool {
+	return preferences.Diet != DIET_ANY || preferences.NoPork || len(preferences.ExcludedAllergens) > 0
+}
+
+/*
+GetDietaryPreferences returns the dietary preferences of a single user. Users
+without preferences see all offers
+*/
+func GetDietaryPreferences(userID int) (DietaryPreferences, error) {
+	db := GetDBHandle()
+	return getDietaryPreferencesWithDB(userID, db)
+}
+
+func getDietaryPreferencesWithDB(userID int, db *sql.DB) (DietaryPreferences, error) {
+	queryString := `SELECT diet, noPork, excludedAllergens FROM mensaPreferences WHERE reporterID == ?;`
+
+	var preferences DietaryPreferences
+	var excludedAllergens string
+	if err := db.QueryRow(queryString, userID).Scan(&preferences.Diet, &preferences.NoPork, &excludedAllergens); err != nil {
+		if err == sql.ErrNoRows {
+			return preferences, nil
+		}
+		zap.S().Errorw("Error while querying for dietary preferences", "userID", userID, "error", err)
+		return preferences, err
+	}
+	preferences.ExcludedAllergens = splitList(excludedAllergens)
+	return preferences, nil
+}
+
+/*
+UpdateDietaryPreferences changes the dietary preferences of the user. Users need to have
+preferences already, see UpdateUserPreferences
+*/
+func UpdateDietaryPreferences(userID int, preferences DietaryPreferences) error {
+	db := GetDBHandle()
+	return updateDietaryPreferencesWithDB(userID, preferences, db)
+}
+
+func updateDietaryPreferencesWithDB(userID int, preferences DietaryPreferences, db *sql.DB) error {
+	if preferences.Diet != DIET_ANY && preferences.Diet != DIET_VEGETARIAN && preferences.Diet != DIET_VEGAN {
+		return fmt.Errorf("Unknown diet %q", preferences.Diet)
+	}
+	queryString := `UPDATE mensaPreferences SET diet = ?, noPork = ?, excludedAllergens = ? WHERE reporterID = ?;`
+
+	DBMutex.Lock()
+	_, err := db.Exec(queryString, preferences.Diet, preferences.NoPork, joinList(preferences.ExcludedAllergens), userID)
+	DBMutex.Unlock()
+	if err != nil {
+		zap.S().Errorw("Error while saving dietary preferences", "userID", userID, "error", err)
+	}
+	return err
+}
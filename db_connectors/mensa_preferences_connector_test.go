@@ -0,0 +1,31 @@
+package db_connectors
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDietaryPreferencesAreStored(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	db := GetTestDBHandle(TEST_DB_PATH)
+	userID := 42
+
+	preferences, err := getDietaryPreferencesWithDB(userID, db)
+	if err != nil || preferences.IsFiltering() {
+		t.Fatalf("User without preferences should see all offers: %v, %v", preferences, err)
+	}
+
+	insertRowForUser(t, "mensaPreferences", userID, db)
+	if err := updateDietaryPreferencesWithDB(userID, DietaryPreferences{Diet: "keto"}, db); err == nil {
+		t.Errorf("Unknown diet was accepted")
+	}
+	stored := DietaryPreferences{Diet: DIET_VEGETARIAN, NoPork: true, ExcludedAllergens: []string{"G", "A"}}
+	if err := updateDietaryPreferencesWithDB(userID, stored, db); err != nil {
+		t.Fatalf("Can't store dietary preferences: %s", err)
+	}
+	preferences, err = getDietaryPreferencesWithDB(userID, db)
+	if err != nil || preferences.Diet != DIET_VEGETARIAN || !preferences.NoPork || strings.Join(preferences.ExcludedAllergens, ",") != "G,A" {
+		t.Errorf("Dietary preferences weren't stored as given: %v, %v", preferences, err)
+	}
+}
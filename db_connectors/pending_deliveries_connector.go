@@ -0,0 +1,133 @@
+/*
+Implements storage of outbound messages that haven't been delivered yet,
+see telegram_connector.QueueMessage. Keeping them in the DB means pushes
+that are waiting for a rate limit or a retry survive restarts
+*/
+package db_connectors
+
+import (
+	"database/sql"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func init() {
+	registerUserDataTable("pendingDeliveries")
+}
+
+/*
+PendingDelivery is a single message that still needs to be sent. Keyboard is a
+telegram_connector.KeyboardIdentifier. Attempts counts failed attempts so far,
+the message shouldn't be sent before NotBefore
+*/
+type PendingDelivery struct {
+	ID        int
+	ChatID    int
+	Message   string
+	Keyboard  int
+	Attempts  int
+	NotBefore time.Time
+}
+
+// AddPendingDelivery stores a message that should be sent to the given chat once notBeforeUTC has passed
+func AddPendingDelivery(chatID int, message string, keyboard int, notBeforeUTC time.Time) error {
+	db := GetDBHandle()
+	return addPendingDeliveryWithDB(chatID, message, keyboard, notBeforeUTC, db)
+}
+
+func addPendingDeliveryWithDB(chatID int, message string, keyboard int, notBeforeUTC time.Time, db *sql.DB) error {
+	queryString := "INSERT INTO pendingDeliveries(reporterID, message, keyboard, notBefore) VALUES (?,?,?,?);"
+	DBMutex.Lock()
+	_, err := db.Exec(queryString, chatID, message, keyboard, notBeforeUTC.Unix())
+	DBMutex.Unlock()
+	if err != nil {
+		zap.S().Errorw("Can't store pending delivery", "error", err)
+	}
+	return err
+}
+
+/*
+GetDuePendingDeliveries returns up to limit deliveries that may be sent at nowUTC,
+those that were due first come first
+*/
+func GetDuePendingDeliveries(nowUTC time.Time, limit int) ([]PendingDelivery, error) {
+	db := GetDBHandle()
+	return getDuePendingDeliveriesWithDB(nowUTC, limit, db)
+}
+
+func getDuePendingDeliveriesWithDB(nowUTC time.Time, limit int, db *sql.DB) ([]PendingDelivery, error) {
+	queryString := `SELECT id, reporterID, message, keyboard, attempts, notBefore FROM pendingDeliveries
+	WHERE notBefore <= ? ORDER BY notBefore ASC, id ASC LIMIT ?;`
+	rows, err := db.Query(queryString, nowUTC.Unix(), limit)
+	if err != nil {
+		zap.S().Errorw("Can't query pending deliveries", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []PendingDelivery
+	for rows.Next() {
+		var delivery PendingDelivery
+		var notBefore int64
+		if err := rows.Scan(&delivery.ID, &delivery.ChatID, &delivery.Message, &delivery.Keyboard, &delivery.Attempts, &notBefore); err != nil {
+			zap.S().Errorw("Can't read pending delivery", "error", err)
+			return nil, err
+		}
+		delivery.NotBefore = time.Unix(notBefore, 0).UTC()
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+/*
+GetTimeOfNextPendingDelivery returns when the next pending delivery becomes due.
+The bool is false if there are no pending deliveries at all
+*/
+func GetTimeOfNextPendingDelivery() (time.Time, bool, error) {
+	queryString := "SELECT MIN(notBefore) FROM pendingDeliveries;"
+	db := GetDBHandle()
+	var notBefore sql.NullInt64
+	if err := db.QueryRow(queryString).Scan(&notBefore); err != nil {
+		zap.S().Errorw("Can't query time of next pending delivery", "error", err)
+		return time.Time{}, false, err
+	}
+	if !notBefore.Valid {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(notBefore.Int64, 0).UTC(), true, nil
+}
+
+// ReschedulePendingDelivery stores that the given delivery failed attempts times, and should be retried at notBeforeUTC
+func ReschedulePendingDelivery(deliveryID int, attempts int, notBeforeUTC time.Time) error {
+	db := GetDBHandle()
+	return reschedulePendingDeliveryWithDB(deliveryID, attempts, notBeforeUTC, db)
+}
+
+func reschedulePendingDeliveryWithDB(deliveryID int, attempts int, notBeforeUTC time.Time, db *sql.DB) error {
+	queryString := "UPDATE pendingDeliveries SET attempts = ?, notBefore = ? WHERE id = ?;"
+	DBMutex.Lock()
+	_, err := db.Exec(queryString, attempts, notBeforeUTC.Unix(), deliveryID)
+	DBMutex.Unlock()
+	if err != nil {
+		zap.S().Errorw("Can't reschedule pending delivery", "error", err)
+	}
+	return err
+}
+
+// DeletePendingDelivery removes a delivery that was sent, or that we gave up on
+func DeletePendingDelivery(deliveryID int) error {
+	db := GetDBHandle()
+	return deletePendingDeliveryWithDB(deliveryID, db)
+}
+
+func deletePendingDeliveryWithDB(deliveryID int, db *sql.DB) error {
+	queryString := "DELETE FROM pendingDeliveries WHERE id = ?;"
+	DBMutex.Lock()
+	_, err := db.Exec(queryString, deliveryID)
+	DBMutex.Unlock()
+	if err != nil {
+		zap.S().Errorw("Can't delete pending delivery", "error", err)
+	}
+	return err
+}
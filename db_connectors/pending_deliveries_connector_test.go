@@ -0,0 +1,60 @@
+package db_connectors
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingDeliveriesAreReturnedOnceDue(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	db := GetTestDBHandle(TEST_DB_PATH)
+	now := time.Date(2022, 10, 10, 10, 0, 0, 0, time.UTC)
+
+	addPendingDeliveryWithDB(1, "later", 0, now.Add(time.Minute), db)
+	addPendingDeliveryWithDB(2, "first", 3, now.Add(-time.Minute), db)
+	addPendingDeliveryWithDB(3, "second", 0, now, db)
+
+	deliveries, err := getDuePendingDeliveriesWithDB(now, 10, db)
+	if err != nil {
+		t.Fatalf("Can't get due deliveries: %s", err)
+	}
+	if len(deliveries) != 2 || deliveries[0].Message != "first" || deliveries[1].Message != "second" {
+		t.Fatalf("Expected the two due deliveries in order, got %v", deliveries)
+	}
+	if deliveries[0].ChatID != 2 || deliveries[0].Keyboard != 3 || deliveries[0].Attempts != 0 {
+		t.Errorf("Delivery wasn't stored as given: %v", deliveries[0])
+	}
+
+	limitedDeliveries, _ := getDuePendingDeliveriesWithDB(now, 1, db)
+	if len(limitedDeliveries) != 1 {
+		t.Errorf("Limit wasn't respected, got %d deliveries", len(limitedDeliveries))
+	}
+}
+
+func TestRescheduledDeliveryIsDueLater(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	db := GetTestDBHandle(TEST_DB_PATH)
+	now := time.Date(2022, 10, 10, 10, 0, 0, 0, time.UTC)
+
+	addPendingDeliveryWithDB(1, "retried", 0, now, db)
+	deliveries, _ := getDuePendingDeliveriesWithDB(now, 10, db)
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected one due delivery, got %d", len(deliveries))
+	}
+
+	reschedulePendingDeliveryWithDB(deliveries[0].ID, 2, now.Add(30*time.Second), db)
+	if dueNow, _ := getDuePendingDeliveriesWithDB(now, 10, db); len(dueNow) != 0 {
+		t.Errorf("Rescheduled delivery is still due")
+	}
+	dueLater, _ := getDuePendingDeliveriesWithDB(now.Add(30*time.Second), 10, db)
+	if len(dueLater) != 1 || dueLater[0].Attempts != 2 {
+		t.Fatalf("Rescheduled delivery isn't due after its new time: %v", dueLater)
+	}
+
+	deletePendingDeliveryWithDB(dueLater[0].ID, db)
+	if remaining, _ := getDuePendingDeliveriesWithDB(now.Add(time.Hour), 10, db); len(remaining) != 0 {
+		t.Errorf("Deleted delivery is still pending")
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Implements storage of queue alerts: Users can ask to be notified once a day when
+someone reports a queue that is at most as long as a level they chose, within a
+timeframe they chose
+*/
+package db_connectors
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/ADimeo/MensaQueueBot/utils"
+	"go.uber.org/zap"
+)
+
+func init() {
+	registerUserDataTable("queueAlerts")
+}
+
+/*
+QueueAlertSettings corresponds with how the settings html in the static folder
+structures queue alert settings. MaximumLevel is the number of the longest
+queue length (the 3 in "L3: Within first room") the user still wants to hear about
+*/
+type QueueAlertSettings struct {
+	AlertAtAll   bool   `json:"alertAtAll"`
+	MaximumLevel int    `json:"maximumLevel"`
+	FromTime     string `json:"fromTime"`
+	ToTime       string `json:"toTime"`
+}
+
+func (settingsStruct *QueueAlertSettings) GetFromTimeAsCESTMinute() (int, error) {
+	preferences := MensaPreferenceSettings{FromTime: settingsStruct.FromTime}
+	return preferences.GetFromTimeAsCESTMinute()
+}
+
+func (settingsStruct *QueueAlertSettings) GetToTimeAsCESTMinute() (int, error) {
+	preferences := MensaPreferenceSettings{ToTime: settingsStruct.ToTime}
+	return preferences.GetToTimeAsCESTMinute()
+}
+
+func formatCESTMinutes(cestMinutes int) string {
+	return fmt.Sprintf("%02d:%02d", cestMinutes/60, cestMinutes%60)
+}
+
+func UpdateQueueAlert(userID int, wantsQueueAlerts bool, maximumLevel int, startTimeInCESTMinutes int, endTimeInCESTMinutes int) error {
+	queryString := `INSERT INTO queueAlerts(reporterID, wantsQueueAlerts, maximumLevel, startTimeInCESTMinutes, endTimeInCESTMinutes) VALUES (?,?,?,?,?)
+	ON CONFLICT (reporterID) DO UPDATE SET wantsQueueAlerts=?, maximumLevel=?, startTimeInCESTMinutes=?, endTimeInCESTMinutes=?;`
+	db := GetDBHandle()
+	DBMutex.Lock()
+	_, err := db.Exec(queryString, userID, wantsQueueAlerts, maximumLevel, startTimeInCESTMinutes, endTimeInCESTMinutes,
+		wantsQueueAlerts, maximumLevel, startTimeInCESTMinutes, endTimeInCESTMinutes)
+	DBMutex.Unlock()
+	return err
+}
+
+/*
+GetQueueAlertSettings returns the queue alert of a single user. Users that never
+set up an alert get a disabled one, which isn't stored
+*/
+func GetQueueAlertSettings(userID int) (QueueAlertSettings, error) {
+	queryString := `SELECT wantsQueueAlerts, maximumLevel, startTimeInCESTMinutes, endTimeInCESTMinutes
+	FROM queueAlerts
+	WHERE reporterID == ?;`
+
+	db := GetDBHandle()
+	var alertSettings QueueAlertSettings
+	var startCESTMinutes int
+	var endCESTMinutes int
+
+	if err := db.QueryRow(queryString, userID).Scan(&alertSettings.AlertAtAll, &alertSettings.MaximumLevel, &startCESTMinutes, &endCESTMinutes); err != nil {
+		if err != sql.ErrNoRows {
+			zap.S().Errorw("Error while querying for queue alert", "userID", userID, "error", err)
+			return alertSettings, err
+		}
+		// Defaults for users without alerts: Lunch time, and a queue that's still in the first room
+		alertSettings.AlertAtAll = false
+		alertSettings.MaximumLevel = 3
+		startCESTMinutes = 660
+		endCESTMinutes = 840
+	}
+	alertSettings.FromTime = formatCESTMinutes(startCESTMinutes)
+	alertSettings.ToTime = formatCESTMinutes(endCESTMinutes)
+	return alertSettings, nil
+}
+
+/*
+GetUsersToAlertForReport returns all users that want to know about a report of
+the given level at the given time, and haven't been alerted on that day yet.
+Users are only alerted about reports from their home mensa
+*/
+func GetUsersToAlertForReport(reportTimeUTC time.Time, reportedLevel int, mensaID string) ([]int, error) {
+	queryString := `SELECT queueAlerts.reporterID FROM queueAlerts
+		LEFT JOIN mensaPreferences ON queueAlerts.reporterID = mensaPreferences.reporterID
+		WHERE wantsQueueAlerts = 1
+		AND IFNULL(mensaPreferences.isActive, 1) = 1
+		AND queueAlerts.reporterID NOT IN (SELECT reporterID FROM inactiveChats)
+		AND IFNULL(mensaPreferences.mensaID, ?) = ?
+		AND maximumLevel >= ?
+		AND (lastAlertDate IS NULL OR lastAlertDate != ?)
+		AND ? BETWEEN queueAlerts.startTimeInCESTMinutes AND queueAlerts.endTimeInCESTMinutes;`
+
+	reportTimeInCEST := reportTimeUTC.In(utils.GetLocalLocation())
+	currentCESTDate := reportTimeInCEST.Format("2006-01-02")
+	currentCESTMinute := reportTimeInCEST.Hour()*60 + reportTimeInCEST.Minute()
+
+	db := GetDBHandle()
+	rows, err := db.Query(queryString, mensas.DEFAULT_MENSA_ID, mensaID, reportedLevel, currentCESTDate, currentCESTMinute)
+	if err != nil {
+		zap.S().Errorw("Couldn't get users to alert", "error", err)
+		return make([]int, 0), err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err = rows.Scan(&userID); err != nil {
+			zap.S().Errorw("Couldn't put user ID into int, likely data type mismatch", "error", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err = rows.Err(); err != nil {
+		zap.S().Errorw("Error while scanning userids for queue alerts", "error", err)
+		return userIDs, err
+	}
+	return userIDs, nil
+}
+
+// SetUserToAlertedOnDate makes sure the user isn't alerted again on the same (CEST) day
+func SetUserToAlertedOnDate(userID int, alertTimeUTC time.Time) error {
+	queryString := `UPDATE queueAlerts
+		SET lastAlertDate = ?
+		WHERE reporterID = ?;`
+	db := GetDBHandle()
+
+	currentCESTDate := alertTimeUTC.In(utils.GetLocalLocation()).Format("2006-01-02")
+
+	DBMutex.Lock()
+	_, err := db.Exec(queryString, currentCESTDate, userID)
+	DBMutex.Unlock()
+	if err != nil {
+		zap.S().Errorw("Error while saving users alert date",
+			"userID", userID,
+			"currentCESTDate", currentCESTDate,
+			"error", err)
+	}
+	return err
+}
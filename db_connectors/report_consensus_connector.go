@@ -0,0 +1,87 @@
+/*
+Implements the consensus layer over queueReports: Marks reports that look like
+spam or mistakes as suspect, and decides which queue length users are shown.
+See report_consensus for the rules
+*/
+package db_connectors
+
+import (
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/ADimeo/MensaQueueBot/report_consensus"
+	"go.uber.org/zap"
+)
+
+/*
+getReportsForConsensus returns all reports of the given mensa made within timeframeIntoPast
+before nowUTC, as well as which of them are currently marked as suspect
+*/
+func getReportsForConsensus(mensa mensas.Mensa, nowUTC time.Time, timeframeIntoPast time.Duration) ([]report_consensus.Report, map[int64]bool, error) {
+	queryString := "SELECT id, reporter, time, queueLength, suspect FROM queueReports WHERE mensaID = ? AND time > ? AND time <= ? ORDER BY time ASC;"
+
+	var reports []report_consensus.Report
+	suspects := make(map[int64]bool)
+
+	db := GetDBHandle()
+	rows, err := db.Query(queryString, mensa.ID, nowUTC.Add(-timeframeIntoPast).Unix(), nowUTC.Unix())
+	if err != nil {
+		zap.S().Errorw("Error while querying for reports for consensus", "mensaID", mensa.ID, "error", err)
+		return reports, suspects, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var report report_consensus.Report
+		var queueLength string
+		var isSuspect bool
+		if err = rows.Scan(&report.ID, &report.Reporter, &report.Time, &queueLength, &isSuspect); err != nil {
+			zap.S().Errorw("Error scanning for reports for consensus, likely data type mismatch", "error", err)
+			continue
+		}
+		report.Level = mensa.GetLevelOfQueueLength(queueLength)
+		reports = append(reports, report)
+		if isSuspect {
+			suspects[report.ID] = true
+		}
+	}
+	return reports, suspects, rows.Err()
+}
+
+/*
+updateSuspectReports re-evaluates which recent reports of the given mensa are suspect,
+and updates those rows whose verdict changed. Called whenever a new report comes in
+*/
+func updateSuspectReports(mensaID string, nowUTC time.Time) error {
+	mensa := mensas.GetMensaOrDefault(mensaID)
+	reports, previousSuspects, err := getReportsForConsensus(mensa, nowUTC, report_consensus.CONSENSUS_WINDOW+report_consensus.CONTRADICTION_WINDOW)
+	if err != nil {
+		return err
+	}
+	suspects := report_consensus.FindSuspects(reports)
+
+	db := GetDBHandle()
+	DBMutex.Lock()
+	defer DBMutex.Unlock()
+	for _, report := range reports {
+		if suspects[report.ID] == previousSuspects[report.ID] {
+			continue
+		}
+		zap.S().Infow("Changing suspicion of report", "reportID", report.ID, "suspect", suspects[report.ID])
+		if _, err := db.Exec("UPDATE queueReports SET suspect = ? WHERE id = ?;", suspects[report.ID], report.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsReportSuspect returns true if the report with the given ID is currently marked as suspect
+func IsReportSuspect(reportID int64) bool {
+	var isSuspect bool
+	db := GetDBHandle()
+	if err := db.QueryRow("SELECT suspect FROM queueReports WHERE id = ?;", reportID).Scan(&isSuspect); err != nil {
+		zap.S().Errorw("Can't check whether report is suspect", "reportID", reportID, "error", err)
+		return false
+	}
+	return isSuspect
+}
@@ -0,0 +1,118 @@
+/*
+Implements access to everything we store about a single user, as needed for
+data exports (GDPR Art. 15) and account deletion (GDPR Art. 17).
+
+Every table that contains data about individual users needs to be keyed by their
+chat ID in the column reporterID, and needs to register itself via registerUserDataTable
+in an init function of the file that implements access to it. Registered tables
+are covered by /mydata and /forgetme
+*/
+package db_connectors
+
+import (
+	"database/sql"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+var userDataTables []string
+
+func registerUserDataTable(table string) {
+	userDataTables = append(userDataTables, table)
+}
+
+/*
+DeleteAllUserData deletes every row stored about the given user, from all registered
+tables. Either all rows are deleted, or none are
+*/
+func DeleteAllUserData(userID int) error {
+	db := GetDBHandle()
+	return deleteAllUserDataWithDB(userID, db)
+}
+
+func deleteAllUserDataWithDB(userID int, db *sql.DB) error {
+	zap.S().Info("Deleting all data of user") // Don't log user explicitly for anonymity
+
+	DBMutex.Lock()
+	defer DBMutex.Unlock()
+	transaction, err := db.Begin()
+	if err != nil {
+		zap.S().Errorw("Can't start transaction for user data deletion", "error", err)
+		return err
+	}
+	for _, table := range userDataTables {
+		// Table names can't be query parameters, but they only ever come from userDataTables
+		queryString := fmt.Sprintf("DELETE FROM %s WHERE reporterID = ?;", table)
+		if _, err := transaction.Exec(queryString, userID); err != nil {
+			zap.S().Errorw("Can't delete user data, rolling back", "table", table, "error", err)
+			transaction.Rollback()
+			return err
+		}
+	}
+	if err := transaction.Commit(); err != nil {
+		zap.S().Errorw("Can't commit user data deletion", "error", err)
+		return err
+	}
+	return nil
+}
+
+/*
+ExportUserData returns every row stored about the given user, grouped by table.
+Rows are maps from column name to value. Tables without rows for the user are
+contained as empty lists, so the export also shows what we don't know
+*/
+func ExportUserData(userID int) (map[string][]map[string]interface{}, error) {
+	db := GetDBHandle()
+	return exportUserDataWithDB(userID, db)
+}
+
+func exportUserDataWithDB(userID int, db *sql.DB) (map[string][]map[string]interface{}, error) {
+	export := make(map[string][]map[string]interface{})
+	for _, table := range userDataTables {
+		rows, err := exportRowsOfUser(table, userID, db)
+		if err != nil {
+			zap.S().Errorw("Can't export user data", "table", table, "error", err)
+			return nil, err
+		}
+		export[table] = rows
+	}
+	return export, nil
+}
+
+func exportRowsOfUser(table string, userID int, db *sql.DB) ([]map[string]interface{}, error) {
+	queryString := fmt.Sprintf("SELECT * FROM %s WHERE reporterID = ?;", table)
+
+	rows, err := db.Query(queryString, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	exportedRows := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		valuePointers := make([]interface{}, len(columns))
+		for i := range values {
+			valuePointers[i] = &values[i]
+		}
+		if err := rows.Scan(valuePointers...); err != nil {
+			return nil, err
+		}
+		exportedRow := make(map[string]interface{})
+		for i, column := range columns {
+			if asBytes, isBytes := values[i].([]byte); isBytes {
+				// TEXT columns may be returned as bytes, which would be base64 encoded in JSON
+				exportedRow[column] = string(asBytes)
+			} else {
+				exportedRow[column] = values[i]
+			}
+		}
+		exportedRows = append(exportedRows, exportedRow)
+	}
+	return exportedRows, rows.Err()
+}
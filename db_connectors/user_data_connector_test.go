@@ -0,0 +1,153 @@
+package db_connectors
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// tableColumn is a single row of PRAGMA table_info
+type tableColumn struct {
+	Name         string
+	IsNotNull    bool
+	DefaultValue sql.NullString
+	IsPrimaryKey bool
+}
+
+func getColumnsOfTable(t *testing.T, table string, db *sql.DB) []tableColumn {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		t.Fatalf("Can't get columns of %s: %s", table, err)
+	}
+	defer rows.Close()
+	var columns []tableColumn
+	for rows.Next() {
+		var column tableColumn
+		var position int
+		var columnType string
+		if err := rows.Scan(&position, &column.Name, &columnType, &column.IsNotNull, &column.DefaultValue, &column.IsPrimaryKey); err != nil {
+			t.Fatalf("Can't scan columns of %s: %s", table, err)
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+/*
+insertRowForUser inserts a row for the given user into the given table. Columns
+that need a value get 0, so that this works for any table keyed by reporterID
+*/
+func insertRowForUser(t *testing.T, table string, userID int, db *sql.DB) {
+	columnNames := []string{"reporterID"}
+	for _, column := range getColumnsOfTable(t, table, db) {
+		if column.Name != "reporterID" && column.IsNotNull && !column.DefaultValue.Valid && !column.IsPrimaryKey {
+			columnNames = append(columnNames, column.Name)
+		}
+	}
+	values := []interface{}{userID}
+	for len(values) < len(columnNames) {
+		values = append(values, 0)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columnNames)), ",")
+	queryString := fmt.Sprintf("INSERT INTO %s(%s) VALUES (%s);", table, strings.Join(columnNames, ","), placeholders)
+	if _, err := db.Exec(queryString, values...); err != nil {
+		t.Fatalf("Can't insert row into %s: %s", table, err)
+	}
+}
+
+func countRowsOfUser(t *testing.T, table string, userID int, db *sql.DB) int {
+	var count int
+	if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE reporterID = ?;", table), userID).Scan(&count); err != nil {
+		t.Fatalf("Can't count rows of %s: %s", table, err)
+	}
+	return count
+}
+
+func TestAllUserTablesAreRegistered(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	db := GetTestDBHandle(TEST_DB_PATH)
+
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table';")
+	if err != nil {
+		t.Fatalf("Can't list tables: %s", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		rows.Scan(&table)
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	registeredTables := make(map[string]bool)
+	for _, table := range userDataTables {
+		registeredTables[table] = true
+	}
+	for _, table := range tables {
+		for _, column := range getColumnsOfTable(t, table, db) {
+			if column.Name == "reporterID" && !registeredTables[table] {
+				t.Errorf("Table %s contains user data, but isn't registered via registerUserDataTable", table)
+			}
+		}
+	}
+}
+
+func TestDeletionOfAllUserData(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	userID := 12348
+	otherUserID := 12349
+	db := GetTestDBHandle(TEST_DB_PATH)
+
+	for _, table := range userDataTables {
+		insertRowForUser(t, table, userID, db)
+		insertRowForUser(t, table, otherUserID, db)
+	}
+	if err := deleteAllUserDataWithDB(userID, db); err != nil {
+		t.Fatalf("Deletion failed: %s", err)
+	}
+	for _, table := range userDataTables {
+		if count := countRowsOfUser(t, table, userID, db); count != 0 {
+			t.Errorf("%d rows of user survived in %s", count, table)
+		}
+		if count := countRowsOfUser(t, table, otherUserID, db); count != 1 {
+			t.Errorf("Deletion also removed rows of other users in %s", table)
+		}
+	}
+
+	export, err := exportUserDataWithDB(userID, db)
+	if err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+	for table, rows := range export {
+		if len(rows) != 0 {
+			t.Errorf("Export still contains rows of %s", table)
+		}
+	}
+}
+
+func TestFailedDeletionDeletesNothing(t *testing.T) {
+	initializeForTest()
+	defer resetTestDB()
+	userID := 12350
+	db := GetTestDBHandle(TEST_DB_PATH)
+
+	for _, table := range userDataTables {
+		insertRowForUser(t, table, userID, db)
+	}
+	registeredTables := userDataTables
+	defer func() { userDataTables = registeredTables }()
+	// Deleting from a table that doesn't exist fails after all real tables were handled
+	userDataTables = append(append([]string{}, registeredTables...), "doesNotExist")
+
+	if err := deleteAllUserDataWithDB(userID, db); err == nil {
+		t.Fatalf("Deletion from missing table didn't fail")
+	}
+	for _, table := range registeredTables {
+		if count := countRowsOfUser(t, table, userID, db); count != 1 {
+			t.Errorf("Failed deletion removed rows of %s", table)
+		}
+	}
+}
@@ -14,6 +14,10 @@ import (
 	"go.uber.org/zap"
 )
 
+func init() {
+	registerUserDataTable("changelogMessages")
+}
+
 type changelog struct {
 	Id   int
 	Text string
@@ -106,26 +110,6 @@ func saveNewChangelogForUserWithDB(userID int, changelogID int, db *sql.DB) erro
 	return nil
 }
 
-func DeleteAllUserChangelogData(userID int) error {
-	db := GetDBHandle()
-	return deleteAllUserChangelogDataWithDB(userID, db)
-}
-
-func deleteAllUserChangelogDataWithDB(userID int, db *sql.DB) error {
-	queryString := "DELETE FROM changelogMessages WHERE reporterID = ?;"
-	zap.S().Infof("Deleting changelog info for user %d", userID)
-	DBMutex.Lock()
-	_, err := db.Exec(queryString, userID)
-	DBMutex.Unlock()
-
-	if err != nil {
-		zap.S().Errorf("Error while deleting changelogs of user %s", userID, err)
-		return err
-	}
-
-	return nil
-}
-
 func GetIsUserABTester(userID int) bool {
 	db := GetDBHandle()
 	return getIsUserABTesterWithDB(userID, db)
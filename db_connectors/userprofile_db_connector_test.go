@@ -6,6 +6,7 @@ import (
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"go.uber.org/zap"
 )
 
@@ -22,7 +23,7 @@ func initializeTestDB() {
 	db_handle := GetTestDBHandle(TEST_DB_PATH)
 	// Let's just assume the migrations work...
 	driver, _ := sqlite3.WithInstance(db_handle, &sqlite3.Config{})
-	m, _ := migrate.NewWithDatabaseInstance("file://./db/migrations", "sqlite3", driver)
+	m, _ := migrate.NewWithDatabaseInstance("file://../db/migrations", "sqlite3", driver)
 	m.Migrate(DB_VERSION) // Variable from db_utilities
 	// Initialization done
 }
@@ -75,7 +76,7 @@ func TestDeletionOfUserChangelog(t *testing.T) {
 		t.Fail()
 	}
 
-	deleteAllUserChangelogDataWithDB(userID, db)
+	deleteAllUserDataWithDB(userID, db)
 
 	retrievedChangelogID = getLatestChangelogSentToUserWithDB(userID, db)
 	if retrievedChangelogID != -1 {
@@ -9,6 +9,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"github.com/ADimeo/MensaQueueBot/utils"
 	"go.uber.org/zap"
 )
 
@@ -55,20 +58,21 @@ func TestGenerateAWholeBunchOfGraphs(t *testing.T) {
 
 	for _, i := range interestingTimes {
 		queryTime, _ := time.ParseInLocation(formatString, i, loc)
-		graphFilepath, _ := generateGraphOfMensaTrendAsHTML(queryTime.UTC(), graphTimeframeIntoPast, graphTimeframeIntoFuture)
-		pathToPng, _ := renderHTMLGraphToPNG(graphFilepath)
-		chatIDString, doesExist := os.LookupEnv(KEY_DEBUG_MODE)
+		mensa := mensas.GetMensaOrDefault(mensas.DEFAULT_MENSA_ID)
+		forecast := getForecastForMensa(mensa, queryTime.UTC())
+		pathToPng, _ := generateGraphOfMensaTrendAsPNG(mensa, forecast, queryTime.UTC(), graphTimeframeIntoPast, graphTimeframeIntoFuture)
+		chatIDString, doesExist := os.LookupEnv(utils.KEY_DEBUG_MODE)
 		if !doesExist {
-			zap.S().Panicf("Fatal Error: Environment variable for dev to report to not set. Set to telegram ID of dev", KEY_DEBUG_MODE)
+			zap.S().Panicf("Fatal Error: Environment variable for dev to report to not set. Set %s to telegram ID of dev", utils.KEY_DEBUG_MODE)
 
 		}
 		chatID, err := strconv.Atoi(chatIDString)
 		if err != nil {
-			zap.S().Panicf("Fatal Error: Debug mode flag is not a telegram id", KEY_DEBUG_MODE)
+			zap.S().Panicf("Fatal Error: Debug mode flag %s is not a telegram id", utils.KEY_DEBUG_MODE)
 
 		}
 		stringReport := i
-		SendDynamicPhoto(chatID, pathToPng, stringReport)
+		telegram_connector.SendDynamicPhoto(chatID, pathToPng, stringReport, telegram_connector.NilKeyboard)
 	}
 	t.Errorf("Error to see logs")
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/graph_renderer"
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/ADimeo/MensaQueueBot/queue_forecast"
+	"github.com/ADimeo/MensaQueueBot/utils"
+	"go.uber.org/zap"
+)
+
+// How many days of same-weekday reports forecasts are based on
+const FORECAST_HISTORY_IN_DAYS = int8(30)
+
+/*
+getForecastForMensa forecasts the queue of the given mensa for the next two hours.
+Slots outside of the mensas opening hours are left out
+*/
+func getForecastForMensa(mensa mensas.Mensa, nowUTC time.Time) queue_forecast.Forecast {
+	// Today's reports are compared against what was usually reported at the same time, so we need history for those times as well
+	historicalLengths, historicalTimes, err := db_connectors.GetQueueLengthReportsByWeekdayAndTimeframe(FORECAST_HISTORY_IN_DAYS, nowUTC,
+		queue_forecast.TODAY_ADJUSTMENT_WINDOW+queue_forecast.SLOT_LENGTH, queue_forecast.FORECAST_HORIZON+queue_forecast.SLOT_LENGTH, mensa.ID)
+	if err != nil {
+		zap.S().Errorw("Can't get historical reports for forecast", "mensaID", mensa.ID, "error", err)
+	}
+	todaysLengths, todaysTimes, err := db_connectors.GetAllQueueLengthReportsInTimeframe(nowUTC, queue_forecast.TODAY_ADJUSTMENT_WINDOW, mensa.ID)
+	if err != nil {
+		zap.S().Errorw("Can't get todays reports for forecast", "mensaID", mensa.ID, "error", err)
+	}
+
+	forecast := queue_forecast.Compute(nowUTC,
+		convertReportsToForecastReports(historicalLengths, historicalTimes, mensa),
+		convertReportsToForecastReports(todaysLengths, todaysTimes, mensa),
+		len(mensa.QueueLevels), utils.GetLocalLocation())
+
+	var slotsWhileOpen []queue_forecast.Slot
+	for _, slot := range forecast.Slots {
+		if slot.End.After(mensa.GetOpeningTime(nowUTC)) && slot.Start.Before(mensa.GetClosingTime(nowUTC)) {
+			slotsWhileOpen = append(slotsWhileOpen, slot)
+		}
+	}
+	forecast.Slots = slotsWhileOpen
+	return forecast
+}
+
+func convertReportsToForecastReports(queueLengths []string, times []time.Time, mensa mensas.Mensa) []queue_forecast.Report {
+	var reports []queue_forecast.Report
+	for i, queueLength := range queueLengths {
+		level := mensa.GetLevelOfQueueLength(queueLength)
+		if level < 0 {
+			continue
+		}
+		reports = append(reports, queue_forecast.Report{Time: times[i], Level: level})
+	}
+	return reports
+}
+
+/*
+generateForecastString tells the user when it's best to go to the mensa.
+Returns an empty string if we don't know that
+*/
+func generateForecastString(forecast queue_forecast.Forecast, nowUTC time.Time) string {
+	bestSlot, found := forecast.BestSlot()
+	if !found {
+		return ""
+	}
+	bestTime := bestSlot.Start
+	if bestTime.Before(nowUTC) {
+		bestTime = nowUTC
+	}
+	return fmt.Sprintf("Best time to go in the next 2h: %s (likely L%.0f)",
+		bestTime.In(utils.GetLocalLocation()).Format("15:04"), bestSlot.Expected)
+}
+
+// convertForecastToGraphSlots returns all slots the graph renderer should draw
+func convertForecastToGraphSlots(forecast queue_forecast.Forecast) []graph_renderer.ForecastSlot {
+	var graphSlots []graph_renderer.ForecastSlot
+	for _, slot := range forecast.Slots {
+		if !slot.HasData {
+			continue
+		}
+		graphSlots = append(graphSlots, graph_renderer.ForecastSlot{
+			Start:    slot.Start,
+			End:      slot.End,
+			Expected: slot.Expected,
+			Lower:    slot.Lower,
+			Upper:    slot.Upper,
+		})
+	}
+	return graphSlots
+}
@@ -0,0 +1,220 @@
+package main
+
+/*
+Caches the queue graphs we send, so that we don't render a new graph for each request.
+
+Telegram assigns a file_id to each graph we upload, which we can send again without
+uploading the graph again. A graph stays current until a new report arrives, or until it
+is older than GRAPH_MAX_AGE, since it shows the current time. Graphs are cached per mensa
+and time window, and stored in the DB so they survive restarts.
+
+If multiple requests need the same graph while it isn't current, only the first one renders
+and uploads it, the others wait for that upload and send its file_id.
+*/
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/ADimeo/MensaQueueBot/queue_forecast"
+	"go.uber.org/zap"
+)
+
+// How long a graph stays current if no new reports arrive
+const GRAPH_MAX_AGE = time.Minute
+
+// The time window of the graphs we send in reply to "Queue?", far enough into the future to show the whole forecast
+var QUEUE_GRAPH_WINDOW = graphWindow{IntoPast: 60 * time.Minute, IntoFuture: queue_forecast.FORECAST_HORIZON}
+
+var globalGraphCache = newGraphCache(renderGraph)
+
+// graphWindow is the timeframe a graph shows, relative to the time it was generated at
+type graphWindow struct {
+	IntoPast   time.Duration
+	IntoFuture time.Duration
+}
+
+// String identifies the window in the DB
+func (window graphWindow) String() string {
+	return window.IntoPast.String() + "/" + window.IntoFuture.String()
+}
+
+type graphKey struct {
+	MensaID string
+	Window  graphWindow
+}
+
+// graphDetails describe a graph that was uploaded to telegram
+type graphDetails struct {
+	Timestamp          time.Time
+	TelegramAssignedID string
+	ForecastLine       string
+}
+
+// renderedGraph is a graph that was rendered, but not uploaded yet
+type renderedGraph struct {
+	PathToPng    string
+	ForecastLine string
+	GeneratedAt  time.Time
+}
+
+// graphFlight is a graph that is being rendered and uploaded. done is closed once details and err are set
+type graphFlight struct {
+	done    chan struct{}
+	details graphDetails
+	err     error
+}
+
+type graphCache struct {
+	mutex    sync.Mutex
+	graphs   map[graphKey]graphDetails
+	inFlight map[graphKey]*graphFlight
+	render   func(mensa mensas.Mensa, window graphWindow, nowUTC time.Time) (renderedGraph, error)
+}
+
+func newGraphCache(render func(mensas.Mensa, graphWindow, time.Time) (renderedGraph, error)) *graphCache {
+	return &graphCache{
+		graphs:   make(map[graphKey]graphDetails),
+		inFlight: make(map[graphKey]*graphFlight),
+		render:   render,
+	}
+}
+
+/*
+renderGraph renders the current graph of the given mensa to a new temporary file,
+which needs to be removed once it isn't needed anymore
+*/
+func renderGraph(mensa mensas.Mensa, window graphWindow, nowUTC time.Time) (renderedGraph, error) {
+	forecast := getForecastForMensa(mensa, nowUTC)
+	pathToPng, err := generateGraphOfMensaTrendAsPNG(mensa, forecast, nowUTC, window.IntoPast, window.IntoFuture)
+	return renderedGraph{
+		PathToPng:    pathToPng,
+		ForecastLine: generateForecastString(forecast, nowUTC),
+		GeneratedAt:  nowUTC,
+	}, err
+}
+
+/*
+isCurrent returns true if the given graph can still be sent. That is the case if it
+exists, is newer than the latest report, and isn't older than GRAPH_MAX_AGE
+*/
+func isCurrent(details graphDetails, timeOfLatestReport time.Time) bool {
+	if details.TelegramAssignedID == "" || details.Timestamp.Before(timeOfLatestReport) {
+		return false
+	}
+	return time.Since(details.Timestamp) <= GRAPH_MAX_AGE
+}
+
+// getCurrent returns the cached graph of key if it is current. Needs to be called with the mutex held
+func (cache *graphCache) getCurrent(key graphKey, timeOfLatestReport time.Time) (graphDetails, bool) {
+	details, found := cache.graphs[key]
+	if !found {
+		// Possibly cached before the last restart
+		cachedGraph, foundInDB, err := db_connectors.GetCachedGraph(key.MensaID, key.Window.String())
+		if err == nil && foundInDB {
+			details = graphDetails{
+				Timestamp:          cachedGraph.GeneratedAt,
+				TelegramAssignedID: cachedGraph.TelegramFileID,
+				ForecastLine:       cachedGraph.ForecastLine,
+			}
+			cache.graphs[key] = details
+		}
+	}
+	return details, isCurrent(details, timeOfLatestReport)
+}
+
+// hasCurrentGraph returns true if the graph of the given mensa and window wouldn't need to be rendered
+func (cache *graphCache) hasCurrentGraph(mensaID string, window graphWindow, timeOfLatestReport time.Time) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	_, found := cache.getCurrent(graphKey{MensaID: mensaID, Window: window}, timeOfLatestReport)
+	return found
+}
+
+/*
+getGraph returns the current graph of the given mensa and window. If there is none it renders one,
+and hands it to upload, which sends it to telegram and returns the file_id telegram assigned to it.
+Concurrent calls for the same graph wait for that upload instead of rendering their own graph.
+
+Returns true if upload was called by this call, in which case the graph was already sent.
+Otherwise the caller needs to send the returned graph
+*/
+func (cache *graphCache) getGraph(mensa mensas.Mensa, window graphWindow, timeOfLatestReport time.Time, upload func(renderedGraph) (string, error)) (graphDetails, bool, error) {
+	key := graphKey{MensaID: mensa.ID, Window: window}
+	cache.mutex.Lock()
+	if details, found := cache.getCurrent(key, timeOfLatestReport); found {
+		cache.mutex.Unlock()
+		return details, false, nil
+	}
+	if flight, found := cache.inFlight[key]; found {
+		cache.mutex.Unlock()
+		<-flight.done
+		return flight.details, false, flight.err
+	}
+	flight := &graphFlight{done: make(chan struct{})}
+	cache.inFlight[key] = flight
+	cache.mutex.Unlock()
+
+	uploadWasCalled := false
+	graph, err := cache.render(mensa, window, time.Now().UTC())
+	if graph.PathToPng != "" {
+		defer os.Remove(graph.PathToPng)
+	}
+	if err == nil {
+		uploadWasCalled = true
+		flight.details.Timestamp = graph.GeneratedAt
+		flight.details.ForecastLine = graph.ForecastLine
+		flight.details.TelegramAssignedID, err = upload(graph)
+	}
+	flight.err = err
+
+	cache.mutex.Lock()
+	// If the graph was invalidated in the meantime it may show outdated reports, so it's not cached.
+	// Stored while holding the mutex, so that invalidate can't run in between
+	if cache.inFlight[key] == flight {
+		delete(cache.inFlight, key)
+		if err == nil {
+			cache.graphs[key] = flight.details
+			zap.S().Debugf("Updated currently active graph of %s to %s", mensa.ID, flight.details.Timestamp.Format("15:04:05"))
+			db_connectors.SaveCachedGraph(db_connectors.CachedGraph{
+				MensaID:        key.MensaID,
+				TimeWindow:     key.Window.String(),
+				GeneratedAt:    flight.details.Timestamp,
+				TelegramFileID: flight.details.TelegramAssignedID,
+				ForecastLine:   flight.details.ForecastLine,
+			})
+		}
+	}
+	cache.mutex.Unlock()
+	close(flight.done)
+
+	return flight.details, uploadWasCalled, err
+}
+
+// invalidate makes sure that the next request for a graph of the given mensa renders a new graph
+func (cache *graphCache) invalidate(mensaID string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for key := range cache.graphs {
+		if key.MensaID == mensaID {
+			delete(cache.graphs, key)
+		}
+	}
+	for key := range cache.inFlight {
+		if key.MensaID == mensaID {
+			delete(cache.inFlight, key)
+		}
+	}
+	db_connectors.DeleteCachedGraphsOfMensa(mensaID)
+}
+
+/*
+invalidateGraphOfMensa makes sure that the next request for the given
+mensa generates a new graph, e.g. because a report was removed
+*/
+func invalidateGraphOfMensa(mensaID string) {
+	globalGraphCache.invalidate(mensaID)
+}
@@ -0,0 +1,139 @@
+package graph_renderer
+
+import (
+	"image"
+	"image/color"
+)
+
+/*
+canvas wraps an image.RGBA with the handful of drawing primitives
+that our graphs need. All primitives silently ignore pixels that
+fall outside of the clipping rectangle.
+*/
+type canvas struct {
+	img  *image.RGBA
+	clip image.Rectangle
+}
+
+func newCanvas(width int, height int, background color.NRGBA) *canvas {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	c := &canvas{img: img, clip: img.Bounds()}
+	c.fillRect(0, 0, width, height, background)
+	return c
+}
+
+// withClip returns a canvas that draws onto the same image, but only within clip
+func (c *canvas) withClip(clip image.Rectangle) *canvas {
+	return &canvas{img: c.img, clip: clip.Intersect(c.img.Bounds())}
+}
+
+/*
+blend draws a single pixel, honoring the alpha channel of the given color.
+Colors are non-premultiplied, which is easier to reason about when defining them.
+*/
+func (c *canvas) blend(x int, y int, col color.NRGBA) {
+	if !(image.Point{x, y}.In(c.clip)) {
+		return
+	}
+	if col.A == 0xff {
+		c.img.SetRGBA(x, y, color.RGBA{col.R, col.G, col.B, 0xff})
+		return
+	}
+	existing := c.img.RGBAAt(x, y)
+	alpha := uint32(col.A)
+	mix := func(newValue uint8, oldValue uint8) uint8 {
+		return uint8((uint32(newValue)*alpha + uint32(oldValue)*(0xff-alpha)) / 0xff)
+	}
+	c.img.SetRGBA(x, y, color.RGBA{
+		mix(col.R, existing.R),
+		mix(col.G, existing.G),
+		mix(col.B, existing.B),
+		0xff,
+	})
+}
+
+// fillRect fills the rectangle from (x0, y0) inclusive to (x1, y1) exclusive
+func (c *canvas) fillRect(x0 int, y0 int, x1 int, y1 int, col color.NRGBA) {
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			c.blend(x, y, col)
+		}
+	}
+}
+
+func (c *canvas) fillCircle(centerX int, centerY int, radius int, col color.NRGBA) {
+	for y := -radius; y <= radius; y++ {
+		for x := -radius; x <= radius; x++ {
+			if x*x+y*y <= radius*radius {
+				c.blend(centerX+x, centerY+y, col)
+			}
+		}
+	}
+}
+
+/*
+drawLine draws a straight line via Bresenham. Thickness is achieved by
+stamping a square at every step, so colors should be opaque - transparent
+colors would be blended multiple times on the same pixel.
+If dashLength is larger than 0 the line is drawn dashed, with gaps as long as the dashes.
+*/
+func (c *canvas) drawLine(x0 int, y0 int, x1 int, y1 int, thickness int, dashLength int, col color.NRGBA) {
+	deltaX := abs(x1 - x0)
+	deltaY := -abs(y1 - y0)
+	stepX := 1
+	if x0 > x1 {
+		stepX = -1
+	}
+	stepY := 1
+	if y0 > y1 {
+		stepY = -1
+	}
+	errorTerm := deltaX + deltaY
+	halfThickness := thickness / 2
+
+	for step := 0; ; step++ {
+		if dashLength <= 0 || (step/dashLength)%2 == 0 {
+			c.fillRect(x0-halfThickness, y0-halfThickness, x0-halfThickness+thickness, y0-halfThickness+thickness, col)
+		}
+		if x0 == x1 && y0 == y1 {
+			break
+		}
+		doubledError := 2 * errorTerm
+		if doubledError >= deltaY {
+			errorTerm += deltaY
+			x0 += stepX
+		}
+		if doubledError <= deltaX {
+			errorTerm += deltaX
+			y0 += stepY
+		}
+	}
+}
+
+/*
+drawText draws the text with its top left corner at (x, y), using the bitmap font
+defined in font.go. Each font pixel becomes a scale x scale square.
+*/
+func (c *canvas) drawText(x int, y int, text string, scale int, col color.NRGBA) {
+	cursorX := x
+	for _, r := range text {
+		glyph := glyphFor(r)
+		for column := 0; column < glyphWidth; column++ {
+			for row := 0; row < glyphHeight; row++ {
+				if glyph[column]&(1<<row) != 0 {
+					pixelX := cursorX + column*scale
+					pixelY := y + row*scale
+					c.fillRect(pixelX, pixelY, pixelX+scale, pixelY+scale, col)
+				}
+			}
+		}
+		cursorX += glyphAdvance * scale
+	}
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
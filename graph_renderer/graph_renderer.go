@@ -0,0 +1,325 @@
+/*
+Renders the queue length graphs that are sent for "Queue?" requests.
+Graphs are drawn directly onto an image and encoded as PNG, so rendering
+needs neither a browser nor anything outside of the go standard library.
+
+The layout mirrors what we used to render via echarts: A category axis
+with one entry per queue length, a time axis, a line for todays reports,
+a scatter series for historical reports and a mark line for "now".
+On top of that a forecast can be drawn as a band.
+*/
+package graph_renderer
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"time"
+)
+
+const graphWidth = 1200
+const graphHeight = 700
+
+const titleScale = 3
+const textScale = 2
+const outerPadding = 20
+
+var backgroundColor = color.NRGBA{0xff, 0xff, 0xff, 0xff}
+var textColor = color.NRGBA{0x33, 0x33, 0x33, 0xff}
+var subtleTextColor = color.NRGBA{0x6e, 0x70, 0x79, 0xff}
+var axisColor = color.NRGBA{0x6e, 0x70, 0x79, 0xff}
+var splitLineColor = color.NRGBA{0xe0, 0xe6, 0xf1, 0xff}
+
+// Same colors echarts uses for its first two series
+var todaySeriesColor = color.NRGBA{0x54, 0x70, 0xc6, 0xff}
+var historicalSeriesColor = color.NRGBA{0x91, 0xcc, 0x75, 0xb4}
+var forecastBandColor = color.NRGBA{0xfa, 0xc8, 0x58, 0x60}
+var forecastLineColor = color.NRGBA{0xee, 0x99, 0x00, 0xff}
+
+/*
+QueuePoint is a single report, as it is displayed in the graph.
+Level is the index of the reported queue length within QueueGraph.LevelLabels
+*/
+type QueuePoint struct {
+	Time  time.Time
+	Level int
+}
+
+/*
+ForecastSlot is the forecast for a single timeslot. Levels are indices within
+QueueGraph.LevelLabels, but don't need to be whole numbers
+*/
+type ForecastSlot struct {
+	Start    time.Time
+	End      time.Time
+	Expected float64
+	Lower    float64
+	Upper    float64
+}
+
+/*
+QueueGraph contains everything that is displayed in a graph.
+StartTime and EndTime define the visible part of the time axis,
+NowTime is where the "Now" mark line is drawn. Labels on the time
+axis are displayed in Location.
+*/
+type QueueGraph struct {
+	Title    string
+	Subtitle string
+
+	StartTime time.Time
+	EndTime   time.Time
+	NowTime   time.Time
+	Location  *time.Location
+
+	LevelLabels []string
+
+	TodaySeriesName      string
+	TodaySeries          []QueuePoint
+	HistoricalSeriesName string
+	HistoricalSeries     []QueuePoint
+	ForecastName         string
+	Forecast             []ForecastSlot
+}
+
+// plotArea describes where within the image data is drawn, and how data maps to pixels
+type plotArea struct {
+	bounds         image.Rectangle
+	startTime      time.Time
+	endTime        time.Time
+	numberOfLevels int
+}
+
+func (area plotArea) xForTime(t time.Time) int {
+	totalDuration := area.endTime.Sub(area.startTime)
+	offset := t.Sub(area.startTime)
+	return area.bounds.Min.X + int(float64(area.bounds.Dx())*float64(offset)/float64(totalDuration))
+}
+
+func (area plotArea) bandHeight() float64 {
+	return float64(area.bounds.Dy()) / float64(area.numberOfLevels)
+}
+
+// yForLevel returns the center of the band of the given level. Level 0 is at the bottom
+func (area plotArea) yForLevel(level int) int {
+	return area.yForLevelValue(float64(level))
+}
+
+// yForLevelValue is yForLevel for levels between two whole levels
+func (area plotArea) yForLevelValue(level float64) int {
+	return area.bounds.Max.Y - int((level+0.5)*area.bandHeight())
+}
+
+func (area plotArea) containsTime(t time.Time) bool {
+	return !t.Before(area.startTime) && !t.After(area.endTime)
+}
+
+/*
+RenderToPNG draws the given graph and writes it as PNG to the given writer.
+Returns an error if the graph definition can't be drawn, e.g. because
+it lacks level labels or has an empty time frame.
+*/
+func RenderToPNG(graph QueueGraph, writer io.Writer) error {
+	img, err := render(graph)
+	if err != nil {
+		return err
+	}
+	return png.Encode(writer, img)
+}
+
+/*
+RenderToFile draws the given graph and writes it to a PNG file at the given path
+*/
+func RenderToFile(graph QueueGraph, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = RenderToPNG(graph, file)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func render(graph QueueGraph) (*image.RGBA, error) {
+	if len(graph.LevelLabels) == 0 {
+		return nil, errors.New("Graph needs at least one level label")
+	}
+	if !graph.EndTime.After(graph.StartTime) {
+		return nil, errors.New("Graph end time needs to be after its start time")
+	}
+	if graph.Location == nil {
+		graph.Location = time.UTC
+	}
+
+	c := newCanvas(graphWidth, graphHeight, backgroundColor)
+	area := computePlotArea(graph)
+
+	drawLevelAxis(c, area, graph.LevelLabels)
+	drawTimeAxis(c, area, graph.Location)
+
+	plotCanvas := c.withClip(area.bounds.Inset(-6)) // Leave room for markers on the border
+	drawForecast(c.withClip(area.bounds), area, graph.Forecast)
+	drawHistoricalSeries(plotCanvas, area, graph.HistoricalSeries, len(graph.LevelLabels))
+	drawTodaySeries(plotCanvas, area, graph.TodaySeries, len(graph.LevelLabels))
+	drawNowMarkLine(c, area, graph.NowTime)
+
+	drawTitle(c, graph.Title, graph.Subtitle)
+	drawLegend(c, graph)
+	return c.img, nil
+}
+
+func computePlotArea(graph QueueGraph) plotArea {
+	widestLabel := 0
+	for _, label := range graph.LevelLabels {
+		if width := textWidth(label, textScale); width > widestLabel {
+			widestLabel = width
+		}
+	}
+	top := outerPadding + textHeight(titleScale) + 12 + textHeight(textScale) + 40
+	bottom := graphHeight - outerPadding - textHeight(textScale) - 16
+	left := outerPadding + widestLabel + 16
+	right := graphWidth - outerPadding - textWidth("00:00", textScale)/2
+
+	return plotArea{
+		bounds:         image.Rect(left, top, right, bottom),
+		startTime:      graph.StartTime,
+		endTime:        graph.EndTime,
+		numberOfLevels: len(graph.LevelLabels),
+	}
+}
+
+// drawLevelAxis draws the category axis on the left, including one split line per level boundary
+func drawLevelAxis(c *canvas, area plotArea, levelLabels []string) {
+	for i := 0; i <= len(levelLabels); i++ {
+		y := area.bounds.Max.Y - int(float64(i)*area.bandHeight())
+		c.drawLine(area.bounds.Min.X, y, area.bounds.Max.X, y, 1, 0, splitLineColor)
+	}
+	for level, label := range levelLabels {
+		labelX := area.bounds.Min.X - 12 - textWidth(label, textScale)
+		labelY := area.yForLevel(level) - textHeight(textScale)/2
+		c.drawText(labelX, labelY, label, textScale, subtleTextColor)
+	}
+	c.drawLine(area.bounds.Min.X, area.bounds.Min.Y, area.bounds.Min.X, area.bounds.Max.Y, 1, 0, axisColor)
+}
+
+/*
+drawTimeAxis draws the time axis at the bottom. Ticks are placed on every
+full quarter hour, in the given location
+*/
+func drawTimeAxis(c *canvas, area plotArea, location *time.Location) {
+	c.drawLine(area.bounds.Min.X, area.bounds.Max.Y, area.bounds.Max.X, area.bounds.Max.Y, 1, 0, axisColor)
+
+	tickInterval := 15 * time.Minute
+	localStart := area.startTime.In(location)
+	firstTick := time.Date(localStart.Year(), localStart.Month(), localStart.Day(),
+		localStart.Hour(), 0, 0, 0, location)
+	for firstTick.Before(area.startTime) {
+		firstTick = firstTick.Add(tickInterval)
+	}
+
+	for tick := firstTick; !tick.After(area.endTime); tick = tick.Add(tickInterval) {
+		x := area.xForTime(tick)
+		c.drawLine(x, area.bounds.Max.Y, x, area.bounds.Max.Y+5, 1, 0, axisColor)
+		label := tick.In(location).Format("15:04")
+		c.drawText(x-textWidth(label, textScale)/2, area.bounds.Max.Y+10, label, textScale, subtleTextColor)
+	}
+}
+
+func drawHistoricalSeries(c *canvas, area plotArea, points []QueuePoint, numberOfLevels int) {
+	for _, point := range points {
+		if !area.containsTime(point.Time) || point.Level < 0 || point.Level >= numberOfLevels {
+			continue
+		}
+		c.fillCircle(area.xForTime(point.Time), area.yForLevel(point.Level), 6, historicalSeriesColor)
+	}
+}
+
+// drawTodaySeries draws todays reports as a line, with a marker for each report
+func drawTodaySeries(c *canvas, area plotArea, points []QueuePoint, numberOfLevels int) {
+	var visiblePoints []image.Point
+	for _, point := range points {
+		if point.Level < 0 || point.Level >= numberOfLevels {
+			continue
+		}
+		visiblePoints = append(visiblePoints, image.Point{area.xForTime(point.Time), area.yForLevel(point.Level)})
+	}
+	for i := 1; i < len(visiblePoints); i++ {
+		from := visiblePoints[i-1]
+		to := visiblePoints[i]
+		c.drawLine(from.X, from.Y, to.X, to.Y, 3, 0, todaySeriesColor)
+	}
+	for _, point := range visiblePoints {
+		c.fillCircle(point.X, point.Y, 6, todaySeriesColor)
+		c.fillCircle(point.X, point.Y, 3, backgroundColor)
+	}
+}
+
+/*
+drawForecast draws one box per slot, spanning the confidence band, and connects
+the expected levels of consecutive slots with a dashed line
+*/
+func drawForecast(c *canvas, area plotArea, slots []ForecastSlot) {
+	var previousMiddle *image.Point
+	for _, slot := range slots {
+		c.fillRect(area.xForTime(slot.Start), area.yForLevelValue(slot.Upper),
+			area.xForTime(slot.End), area.yForLevelValue(slot.Lower), forecastBandColor)
+	}
+	for i, slot := range slots {
+		middle := image.Point{area.xForTime(slot.Start.Add(slot.End.Sub(slot.Start) / 2)), area.yForLevelValue(slot.Expected)}
+		if previousMiddle != nil && slots[i-1].End.Equal(slot.Start) {
+			c.drawLine(previousMiddle.X, previousMiddle.Y, middle.X, middle.Y, 2, 6, forecastLineColor)
+		}
+		previousMiddle = &middle
+	}
+}
+
+func drawNowMarkLine(c *canvas, area plotArea, nowTime time.Time) {
+	if !area.containsTime(nowTime) {
+		return
+	}
+	x := area.xForTime(nowTime)
+	c.drawLine(x, area.bounds.Min.Y, x, area.bounds.Max.Y, 2, 6, todaySeriesColor)
+	label := "Now"
+	c.drawText(x-textWidth(label, textScale)/2, area.bounds.Min.Y-textHeight(textScale)-6, label, textScale, todaySeriesColor)
+}
+
+func drawTitle(c *canvas, title string, subtitle string) {
+	c.drawText(outerPadding, outerPadding, title, titleScale, textColor)
+	c.drawText(outerPadding, outerPadding+textHeight(titleScale)+12, subtitle, textScale, subtleTextColor)
+}
+
+// drawLegend draws one entry per series into the top right corner, next to the subtitle
+func drawLegend(c *canvas, graph QueueGraph) {
+	type legendEntry struct {
+		name  string
+		color color.NRGBA
+	}
+	entries := []legendEntry{
+		{graph.TodaySeriesName, todaySeriesColor},
+		{graph.HistoricalSeriesName, historicalSeriesColor},
+	}
+	if len(graph.Forecast) > 0 {
+		entries = append(entries, legendEntry{graph.ForecastName, forecastLineColor})
+	}
+
+	swatchWidth := 25
+	x := graphWidth - outerPadding
+	y := outerPadding + textHeight(titleScale) + 12
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.name == "" {
+			continue
+		}
+		x -= textWidth(entry.name, textScale)
+		c.drawText(x, y, entry.name, textScale, textColor)
+		x -= 8 + swatchWidth
+		c.fillRect(x, y, x+swatchWidth, y+textHeight(textScale), entry.color)
+		x -= 20
+	}
+}
@@ -0,0 +1,86 @@
+package graph_renderer
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func getTestGraph() QueueGraph {
+	nowTime := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	return QueueGraph{
+		Title:       "Queue lengths for 13:00",
+		Subtitle:    "Generated by @MensaQueueBot",
+		StartTime:   nowTime.Add(-60 * time.Minute),
+		EndTime:     nowTime.Add(30 * time.Minute),
+		NowTime:     nowTime,
+		Location:    time.UTC,
+		LevelLabels: []string{"L0: Virtually empty", "L1: Within kitchen", "L2: Up to food trays"},
+
+		TodaySeriesName: "Reports from today",
+		TodaySeries: []QueuePoint{
+			{Time: nowTime.Add(-40 * time.Minute), Level: 0},
+			{Time: nowTime.Add(-10 * time.Minute), Level: 2},
+		},
+		HistoricalSeriesName: "Reports from last 30 days",
+		HistoricalSeries: []QueuePoint{
+			{Time: nowTime.Add(15 * time.Minute), Level: 1},
+		},
+	}
+}
+
+func TestRenderingProducesPNG(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := RenderToPNG(getTestGraph(), &buffer); err != nil {
+		t.Fatalf("Rendering failed: %s", err)
+	}
+	img, err := png.Decode(&buffer)
+	if err != nil {
+		t.Fatalf("Rendered graph is not a valid png: %s", err)
+	}
+	if img.Bounds().Dx() != graphWidth || img.Bounds().Dy() != graphHeight {
+		t.Errorf("Rendered graph has unexpected size %v", img.Bounds())
+	}
+}
+
+func TestRenderingDrawsSeries(t *testing.T) {
+	graph := getTestGraph()
+	img, err := render(graph)
+	if err != nil {
+		t.Fatalf("Rendering failed: %s", err)
+	}
+	area := computePlotArea(graph)
+
+	// The line between both reports of today is drawn in the series color
+	from := graph.TodaySeries[0]
+	to := graph.TodaySeries[1]
+	middleX := (area.xForTime(from.Time) + area.xForTime(to.Time)) / 2
+	middleY := (area.yForLevel(from.Level) + area.yForLevel(to.Level)) / 2
+	expected := color.RGBA{todaySeriesColor.R, todaySeriesColor.G, todaySeriesColor.B, 0xff}
+	if img.RGBAAt(middleX, middleY) != expected {
+		t.Errorf("Expected todays series at (%d, %d), found %v", middleX, middleY, img.RGBAAt(middleX, middleY))
+	}
+
+	// Historical reports are drawn, but are blended with the background
+	historical := graph.HistoricalSeries[0]
+	historicalPixel := img.RGBAAt(area.xForTime(historical.Time), area.yForLevel(historical.Level))
+	if historicalPixel == (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("Expected historical report to be drawn")
+	}
+}
+
+func TestRenderingRejectsInvalidGraphs(t *testing.T) {
+	graph := getTestGraph()
+	graph.LevelLabels = nil
+	if _, err := render(graph); err == nil {
+		t.Errorf("Graph without levels should not render")
+	}
+
+	graph = getTestGraph()
+	graph.EndTime = graph.StartTime
+	if _, err := render(graph); err == nil {
+		t.Errorf("Graph with empty timeframe should not render")
+	}
+}
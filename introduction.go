@@ -10,12 +10,9 @@ import (
 	"go.uber.org/zap"
 )
 
-// Used by SendTopViewOfMensa, static file link
-const TOP_VIEW_URL = "https://raw.githubusercontent.com/ADimeo/MensaQueueBot/master/queue_length_illustrations/top_view.jpg"
-
 /*
    Contains a number of messages that should be sent to users as an introduction.
-   Should be sent together with the image (links) defined in GetMensaLocationSlice.
+   Should be sent together with the top view of the users mensa.
 
    The specific logic of how these two interact is encoded within SendWelcomeMessage
 */
@@ -33,18 +30,23 @@ func getWelcomeMessageArray() [5]string {
 }
 
 /*
-SendTopViewOfMensa sends a single message which contains a top down view of the mensa
+SendTopViewOfMensa sends a single message which contains a top down view of the users mensa,
+if we have one
 */
 func SendTopViewOfMensa(chatID int) error {
 	const topViewText = "I'm an artist"
+	topViewURL := getUsersMensa(chatID).TopViewURL
+	if topViewURL == "" {
+		return nil
+	}
 	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.IMAGE_REQUEST, chatID)
-	err := telegram_connector.SendStaticWebPhoto(chatID, TOP_VIEW_URL, topViewText, keyboardIdentifier)
+	err := telegram_connector.SendStaticWebPhoto(chatID, topViewURL, topViewText, keyboardIdentifier)
 	return err
 }
 
 /*
 SendWelcomeMessage sends a number of messages to the specified user, explaining the base concept and instructing them on how to act
-Tightly coupled with getWelcomeMessageArray and GetMensaLocationSlice
+Tightly coupled with getWelcomeMessageArray and SendTopViewOfMensa
 */
 func SendWelcomeMessage(chatID int) {
 	messageArray := getWelcomeMessageArray()
@@ -54,7 +56,7 @@ func SendWelcomeMessage(chatID int) {
 	for i := 0; i < 2; i++ {
 		messageString := messageArray[i]
 		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.TUTORIAL_MESSAGE, chatID)
-		err = telegram_connector.SendMessage(chatID, messageString, keyboardIdentifier)
+		err = sendMessage(chatID, messageString, keyboardIdentifier)
 		if err != nil {
 			zap.S().Error("Error while sending first welcome messages.", err)
 		}
@@ -69,7 +71,7 @@ func SendWelcomeMessage(chatID int) {
 	for i := 2; i < 5; i++ {
 		messageString := messageArray[i]
 		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.TUTORIAL_MESSAGE, chatID)
-		err = telegram_connector.SendMessage(chatID, messageString, keyboardIdentifier)
+		err = sendMessage(chatID, messageString, keyboardIdentifier)
 		if err != nil {
 			zap.S().Error("Error while sending second welcome messages.", err)
 		}
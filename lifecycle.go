@@ -0,0 +1,117 @@
+package main
+
+/*
+Owns everything that keeps running after startup: the DB, the delivery queue, the
+schedulers of mensa_scraper, the timers of live messages and whatever receives updates
+(webhook server or long polling).
+
+Each component registers how it is stopped when it is started. On SIGINT or SIGTERM the
+components are stopped in reverse order, so that e.g. the schedulers can still queue
+messages while they finish their jobs, and the DB is closed last.
+*/
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"go.uber.org/zap"
+)
+
+// How long we wait for pending work when shutting down. Docker kills us after 10 seconds
+const SHUTDOWN_TIMEOUT = 8 * time.Second
+
+/*
+shutdownStep stops a single component. Stop gets the time that is left until the
+shutdown timeout, and returns false if the component didn't stop in time
+*/
+type shutdownStep struct {
+	Name string
+	Stop func(timeout time.Duration) bool
+}
+
+type application struct {
+	shutdownSteps []shutdownStep
+}
+
+// onShutdown registers how a component that was just started is stopped
+func (app *application) onShutdown(name string, stop func(timeout time.Duration) bool) {
+	app.shutdownSteps = append(app.shutdownSteps, shutdownStep{Name: name, Stop: stop})
+}
+
+// waitForShutdownSignal blocks until we are asked to shut down
+func (app *application) waitForShutdownSignal() {
+	shutdownSignals := make(chan os.Signal, 1)
+	signal.Notify(shutdownSignals, syscall.SIGINT, syscall.SIGTERM)
+	receivedSignal := <-shutdownSignals
+	signal.Stop(shutdownSignals)
+	zap.S().Infof("Received %s, shutting down...", receivedSignal)
+}
+
+/*
+shutdown stops all components, the one that was started last first. Components are
+stopped even if the ones before them didn't stop in time, since e.g. the DB should
+be closed regardless. Returns false if any component didn't stop in time
+*/
+func (app *application) shutdown(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	stoppedAllInTime := true
+	for i := len(app.shutdownSteps) - 1; i >= 0; i-- {
+		step := app.shutdownSteps[i]
+		if step.Stop(time.Until(deadline)) {
+			zap.S().Infof("Stopped %s", step.Name)
+		} else {
+			zap.S().Errorf("Couldn't stop %s in time", step.Name)
+			stoppedAllInTime = false
+		}
+	}
+	return stoppedAllInTime
+}
+
+// startWebhookServer receives updates via webhook until shutdown, see webhook.go
+func (app *application) startWebhookServer(personalURLPath string, webhookSecret string) {
+	startUpdateDispatcher()
+	app.onShutdown("update dispatcher", globalUpdateDispatcher.drain)
+
+	server := &http.Server{
+		Addr:    getListenAddress(),
+		Handler: newWebhookServer(personalURLPath, webhookSecret),
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			zap.S().Panic("Webhook server failed: ", err)
+		}
+	}()
+	app.onShutdown("webhook server", func(timeout time.Duration) bool {
+		// Waits for requests in progress, the updates they accepted are handled by the dispatcher
+		shutdownContext, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownContext); err != nil {
+			zap.S().Error("Webhook server didn't shut down cleanly", err)
+			return false
+		}
+		return true
+	})
+}
+
+// startLongPolling receives updates via long polling until shutdown, see update_poller.go
+func (app *application) startLongPolling() {
+	stop := make(chan struct{})
+	go runLongPolling(stop)
+	app.onShutdown("long polling", func(timeout time.Duration) bool {
+		return stopLongPolling(stop, timeout)
+	})
+}
+
+// closeDatabase is the shutdown step of the DB
+func closeDatabase(timeout time.Duration) bool {
+	if err := db_connectors.CloseDBHandle(); err != nil {
+		zap.S().Error("Couldn't close DB", err)
+		return false
+	}
+	return true
+}
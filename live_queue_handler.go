@@ -0,0 +1,329 @@
+package main
+
+/*
+Live queue messages: Users can ask for a queue graph they received to keep itself
+up to date. For LIVE_DURATION after that, every new report at their mensa edits
+caption and graph of that message, instead of them having to ask again.
+
+Edits of a single message are rate limited to one per LIVE_EDIT_INTERVAL. Reports
+that arrive in between are collected into one delayed edit. Like the latest graphs,
+live messages are only kept in memory, and stop being updated after a restart.
+On shutdown their timers are stopped before the DB is closed, see StopLiveMessages.
+*/
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/command_router"
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"github.com/ADimeo/MensaQueueBot/utils"
+	"go.uber.org/zap"
+)
+
+// How long a queue message keeps updating itself
+const LIVE_DURATION = 20 * time.Minute
+
+// Minimal time between two edits of the same live message
+const LIVE_EDIT_INTERVAL = time.Minute
+
+// Callback action of the buttons below queue graphs, see command_router.HandleCallback
+const LIVE_CALLBACK = "live"
+const LIVE_START = "start"
+const LIVE_STOP = "stop"
+
+// Live messages by chat. Each chat has at most one, starting another one replaces it
+var globalLiveMessages = make(map[int]*liveMessage)
+var globalLiveMessagesMutex sync.Mutex
+
+// Set on shutdown, timers that fire afterwards do nothing
+var globalLiveMessagesStopped bool
+
+// Timer functions that are currently running, shutdown waits for them
+var globalRunningLiveTimers sync.WaitGroup
+
+type liveMessage struct {
+	ChatID     int
+	MessageID  int
+	MensaID    string
+	ExpiresAt  time.Time
+	LastEditAt time.Time
+	// Caption of the last edit, without the live line. Stopping only needs to edit the caption
+	Caption string
+	// Set while a delayed edit is waiting for LIVE_EDIT_INTERVAL to pass
+	EditScheduled bool
+	// Stops the message once it expires. Stopped early if the message is stopped or replaced
+	expiryTimer *time.Timer
+	// Runs the delayed edit, if one is scheduled
+	editTimer *time.Timer
+}
+
+// stopTimers stops all timers of the message. Needs globalLiveMessagesMutex
+func (message *liveMessage) stopTimers() {
+	message.expiryTimer.Stop()
+	if message.editTimer != nil {
+		message.editTimer.Stop()
+	}
+}
+
+/*
+afterLiveFunc works like time.AfterFunc, but doesn't run the function once live messages
+were stopped, and lets StopLiveMessages wait for it while it runs
+*/
+func afterLiveFunc(delay time.Duration, timerFunction func()) *time.Timer {
+	return time.AfterFunc(delay, func() {
+		globalLiveMessagesMutex.Lock()
+		if globalLiveMessagesStopped {
+			globalLiveMessagesMutex.Unlock()
+			return
+		}
+		globalRunningLiveTimers.Add(1)
+		globalLiveMessagesMutex.Unlock()
+		defer globalRunningLiveTimers.Done()
+		timerFunction()
+	})
+}
+
+/*
+StopLiveMessages is the shutdown step of live messages: It stops all their timers, and
+waits for the ones that are already running, since those still use the DB.
+Returns false if they didn't finish within timeout
+*/
+func StopLiveMessages(timeout time.Duration) bool {
+	globalLiveMessagesMutex.Lock()
+	globalLiveMessagesStopped = true
+	for _, message := range globalLiveMessages {
+		message.stopTimers()
+	}
+	globalLiveMessages = make(map[int]*liveMessage)
+	globalLiveMessagesMutex.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		globalRunningLiveTimers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func getGoLiveKeyboard() telegram_connector.InlineKeyboardMarkup {
+	liveMinutes := int(LIVE_DURATION.Minutes())
+	return telegram_connector.NewInlineKeyboard([]telegram_connector.InlineKeyboardButton{
+		telegram_connector.NewCallbackButton(fmt.Sprintf("🔴 Keep this updated for %d minutes", liveMinutes), LIVE_CALLBACK, LIVE_START),
+	})
+}
+
+func getStopLiveKeyboard() telegram_connector.InlineKeyboardMarkup {
+	return telegram_connector.NewInlineKeyboard([]telegram_connector.InlineKeyboardButton{
+		telegram_connector.NewCallbackButton("Stop updating", LIVE_CALLBACK, LIVE_STOP),
+	})
+}
+
+/*
+HandleLiveCallback reacts to the buttons below queue graphs: It either makes the
+graph a live message, or stops it from being one
+*/
+func HandleLiveCallback(request *command_router.Request) {
+	if request.Arguments == LIVE_START {
+		startLiveMessage(request.ChatID, request.MessageID, getUsersMensa(request.ChatID), time.Now())
+	} else {
+		stopLiveMessage(request.ChatID, request.MessageID)
+	}
+}
+
+func startLiveMessage(chatID int, messageID int, mensa mensas.Mensa, now time.Time) {
+	message := liveMessage{
+		ChatID:     chatID,
+		MessageID:  messageID,
+		MensaID:    mensa.ID,
+		ExpiresAt:  now.Add(LIVE_DURATION),
+		LastEditAt: now,
+	}
+	globalLiveMessagesMutex.Lock()
+	previousMessage, hadPreviousMessage := globalLiveMessages[chatID]
+	if hadPreviousMessage {
+		previousMessage.stopTimers()
+	}
+	message.expiryTimer = afterLiveFunc(LIVE_DURATION, func() {
+		stopExpiredLiveMessage(chatID, messageID)
+	})
+	globalLiveMessages[chatID] = &message
+	globalLiveMessagesMutex.Unlock()
+
+	if hadPreviousMessage && previousMessage.MessageID != messageID {
+		stopEditingLiveMessage(*previousMessage)
+	}
+	zap.S().Info("Starting live queue message")
+	caption, err := editLiveMessage(message, true)
+	if err != nil {
+		forgetLiveMessage(chatID)
+		return
+	}
+	rememberCaptionOfLiveMessage(message, caption)
+}
+
+// stopExpiredLiveMessage stops the given message, unless it was restarted since and hasn't expired yet
+func stopExpiredLiveMessage(chatID int, messageID int) {
+	globalLiveMessagesMutex.Lock()
+	message, found := globalLiveMessages[chatID]
+	isExpired := found && !time.Now().Before(message.ExpiresAt)
+	globalLiveMessagesMutex.Unlock()
+	if isExpired {
+		stopLiveMessage(chatID, messageID)
+	}
+}
+
+// stopLiveMessage stops updating the given message, and offers to start again
+func stopLiveMessage(chatID int, messageID int) {
+	globalLiveMessagesMutex.Lock()
+	message, found := globalLiveMessages[chatID]
+	if !found || message.MessageID != messageID {
+		// Already stopped, or replaced by a newer message
+		globalLiveMessagesMutex.Unlock()
+		return
+	}
+	message.stopTimers()
+	delete(globalLiveMessages, chatID)
+	globalLiveMessagesMutex.Unlock()
+
+	zap.S().Info("Stopping live queue message")
+	stopEditingLiveMessage(*message)
+}
+
+/*
+stopEditingLiveMessage removes the live line from a message that isn't live anymore, and
+offers to start again. The graph stays as it is, so usually only the caption is edited
+*/
+func stopEditingLiveMessage(message liveMessage) {
+	if message.Caption == "" {
+		// The first edit hasn't finished yet, so we don't know what the message shows
+		editLiveMessage(message, false)
+		return
+	}
+	keyboard := getGoLiveKeyboard()
+	if err := telegram_connector.EditMessageCaption(message.ChatID, message.MessageID, message.Caption, &keyboard); err != nil {
+		zap.S().Errorw("Can't edit caption of stopped live queue message", "error", err)
+	}
+}
+
+// forgetLiveMessage stops updating the live message of the given chat, without touching the message itself
+func forgetLiveMessage(chatID int) {
+	globalLiveMessagesMutex.Lock()
+	if message, found := globalLiveMessages[chatID]; found {
+		message.stopTimers()
+	}
+	delete(globalLiveMessages, chatID)
+	globalLiveMessagesMutex.Unlock()
+}
+
+// rememberCaptionOfLiveMessage stores the caption of the last edit of the message, if it is still live
+func rememberCaptionOfLiveMessage(editedMessage liveMessage, caption string) {
+	globalLiveMessagesMutex.Lock()
+	defer globalLiveMessagesMutex.Unlock()
+	if message, found := globalLiveMessages[editedMessage.ChatID]; found && message.MessageID == editedMessage.MessageID {
+		message.Caption = caption
+	}
+}
+
+/*
+refreshLiveMessagesOfMensa updates all live messages of the given mensa, e.g. after a new report.
+Messages that were edited less than LIVE_EDIT_INTERVAL ago are updated once the interval has passed
+*/
+func refreshLiveMessagesOfMensa(mensaID string, now time.Time) {
+	var dueMessages []liveMessage
+	globalLiveMessagesMutex.Lock()
+	for chatID, message := range globalLiveMessages {
+		if message.MensaID != mensaID || message.EditScheduled || !now.Before(message.ExpiresAt) {
+			continue
+		}
+		timeUntilNextEdit := message.LastEditAt.Add(LIVE_EDIT_INTERVAL).Sub(now)
+		if timeUntilNextEdit <= 0 {
+			message.LastEditAt = now
+			dueMessages = append(dueMessages, *message)
+		} else {
+			message.EditScheduled = true
+			scheduledChatID, scheduledMessageID := chatID, message.MessageID
+			message.editTimer = afterLiveFunc(timeUntilNextEdit, func() {
+				runScheduledLiveEdit(scheduledChatID, scheduledMessageID)
+			})
+		}
+	}
+	globalLiveMessagesMutex.Unlock()
+
+	for _, message := range dueMessages {
+		caption, err := editLiveMessage(message, true)
+		if err != nil {
+			// Most likely the user deleted the message, or blocked us
+			forgetLiveMessage(message.ChatID)
+			continue
+		}
+		rememberCaptionOfLiveMessage(message, caption)
+	}
+}
+
+func runScheduledLiveEdit(chatID int, messageID int) {
+	now := time.Now()
+	globalLiveMessagesMutex.Lock()
+	message, found := globalLiveMessages[chatID]
+	if !found || message.MessageID != messageID || !now.Before(message.ExpiresAt) {
+		globalLiveMessagesMutex.Unlock()
+		return
+	}
+	message.EditScheduled = false
+	message.editTimer = nil
+	message.LastEditAt = now
+	messageToEdit := *message
+	globalLiveMessagesMutex.Unlock()
+
+	caption, err := editLiveMessage(messageToEdit, true)
+	if err != nil {
+		forgetLiveMessage(chatID)
+		return
+	}
+	rememberCaptionOfLiveMessage(messageToEdit, caption)
+}
+
+/*
+editLiveMessage replaces graph and caption of the given message with the current ones, and
+returns the new caption without the live line.
+Reuses the latest graph of the mensa if it is still current, see graph_cache.go
+*/
+func editLiveMessage(message liveMessage, isLive bool) (string, error) {
+	mensa := mensas.GetMensaOrDefault(message.MensaID)
+	timeOfLatestReport, reportedQueueLength := db_connectors.GetLatestQueueLengthReport(mensa.ID)
+
+	var baseCaption string
+	getCaption := func(forecastLine string) (string, telegram_connector.InlineKeyboardMarkup) {
+		baseCaption = appendForecastLine(generateSimpleLengthReportString(timeOfLatestReport, reportedQueueLength), forecastLine)
+		caption := baseCaption
+		keyboard := getGoLiveKeyboard()
+		if isLive {
+			caption += "\n🔴 Live until " + message.ExpiresAt.In(utils.GetLocalLocation()).Format("15:04")
+			keyboard = getStopLiveKeyboard()
+		}
+		return caption, keyboard
+	}
+	editWithNewGraph := func(graph renderedGraph) (string, error) {
+		caption, keyboard := getCaption(graph.ForecastLine)
+		return telegram_connector.EditMessagePhoto(message.ChatID, message.MessageID, telegram_connector.InputPhoto{FilePath: graph.PathToPng}, caption, &keyboard)
+	}
+
+	graph, wasEdited, err := globalGraphCache.getGraph(mensa, QUEUE_GRAPH_WINDOW, time.Unix(int64(timeOfLatestReport), 0).UTC(), editWithNewGraph)
+	if !wasEdited && err == nil {
+		caption, keyboard := getCaption(graph.ForecastLine)
+		_, err = telegram_connector.EditMessagePhoto(message.ChatID, message.MessageID, telegram_connector.InputPhoto{FileID: graph.TelegramAssignedID}, caption, &keyboard)
+	}
+	if err != nil {
+		zap.S().Errorw("Can't edit live queue message", "error", err)
+		return "", err
+	}
+	return baseCaption, nil
+}
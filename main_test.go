@@ -0,0 +1,1301 @@
+package main
+
+// End-to-end tests that drive reactToRequest with fake telegram updates, and
+// assert on what the bot sends to a fake bot API
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensa_scraper"
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"github.com/ADimeo/MensaQueueBot/utils"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+var testBotAPI *telegram_connector.FakeBotAPI
+
+// update_id of the last update sent via sendUpdateBody
+var lastTestUpdateID = 100000
+
+func TestMain(m *testing.M) {
+	logger, _ := zap.NewDevelopment()
+	zap.ReplaceGlobals(logger)
+	gin.SetMode(gin.TestMode)
+
+	dbDirectory, err := os.MkdirTemp("", "mensa_queue_bot_test")
+	if err != nil {
+		zap.S().Panic("Can't create directory for test DB", err)
+	}
+	os.Setenv(db_connectors.KEY_DB_BASE_PATH, dbDirectory+"/")
+	os.Setenv(utils.KEY_DEBUG_MODE, "1") // Allows reports at any time
+	initDatabases()
+
+	testBotAPI = telegram_connector.NewFakeBotAPI()
+	telegram_connector.SetClient(telegram_connector.NewHTTPClient(testBotAPI.URL, "test-token"))
+	// Tests send more messages per chat than any user would, the limits themselves are tested in telegram_connector
+	telegram_connector.SetRateLimits(10000, 10000, 10000)
+	telegram_connector.StartDeliveryQueue()
+	startUpdateDispatcher()
+
+	exitCode := m.Run()
+
+	testBotAPI.Close()
+	os.RemoveAll(dbDirectory)
+	os.Exit(exitCode)
+}
+
+// sendUpdate lets reactToRequest handle an update with the given text, as if telegram had sent it
+func sendUpdate(t *testing.T, chatID int, text string) {
+	update := telegram_connector.WebhookRequestBody{}
+	update.Message.Text = text
+	update.Message.Chat.ID = chatID
+	update.Message.Date = int(time.Now().Unix())
+	sendUpdateBody(t, update)
+}
+
+// sendReport opens the report keyboard and reports the given queue length, like a user would
+func sendReport(t *testing.T, chatID int, queueLength string) {
+	sendUpdate(t, chatID, "Report!")
+	sendUpdate(t, chatID, queueLength)
+}
+
+// sendUpdateBody works like sendUpdate, and numbers updates like telegram if they have no update_id yet
+func sendUpdateBody(t *testing.T, update telegram_connector.WebhookRequestBody) {
+	if update.UpdateID == 0 {
+		lastTestUpdateID++
+		update.UpdateID = lastTestUpdateID
+	}
+	body, err := json.Marshal(update)
+	if err != nil {
+		t.Fatalf("Can't marshal update: %s", err)
+	}
+	recorder := httptest.NewRecorder()
+	ginContext, _ := gin.CreateTestContext(recorder)
+	ginContext.Request = httptest.NewRequest("POST", "/token/", bytes.NewReader(body))
+	ginContext.Request.Header.Set("Content-Type", "application/json")
+
+	reactToRequest(ginContext)
+	if recorder.Code != 200 {
+		t.Errorf("Webhook answered with %d", recorder.Code)
+	}
+	globalUpdateDispatcher.waitUntilIdle()
+}
+
+// lastMessageTo fails the test if the chat hasn't received any messages
+func lastMessageTo(t *testing.T, chatID int) telegram_connector.RecordedMessage {
+	messages := testBotAPI.MessagesTo(chatID)
+	if len(messages) == 0 {
+		t.Fatalf("Chat %d didn't receive any messages", chatID)
+	}
+	return messages[len(messages)-1]
+}
+
+// waitForDeliveries waits until the delivery queue sent (or gave up on) all queued messages
+func waitForDeliveries(t *testing.T) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, hasPendingDeliveries, _ := db_connectors.GetTimeOfNextPendingDelivery(); !hasPendingDeliveries {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Delivery queue didn't send all queued messages")
+}
+
+// pressInlineButton sends a press of the button with the given callback data, below the given message
+func pressInlineButton(t *testing.T, chatID int, messageID int, callbackData string, messageSentAt time.Time) {
+	update := telegram_connector.WebhookRequestBody{}
+	update.CallbackQuery.ID = fmt.Sprintf("callback-%d", messageID)
+	update.CallbackQuery.Data = callbackData
+	update.CallbackQuery.Message.MessageID = messageID
+	update.CallbackQuery.Message.Chat.ID = chatID
+	update.CallbackQuery.Message.Date = int(messageSentAt.Unix())
+	sendUpdateBody(t, update)
+}
+
+func keyboardContains(markup *telegram_connector.RecordedReplyMarkup, buttonText string) bool {
+	if markup == nil {
+		return false
+	}
+	for _, row := range markup.Keyboard {
+		for _, button := range row {
+			if button.Text == buttonText {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+getNoonOfToday returns noon of today in local time. Menus are looked up by their local
+date, which is the same in UTC at noon, no matter when the tests run
+*/
+func getNoonOfToday() time.Time {
+	now := time.Now().In(utils.GetLocalLocation())
+	return time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, now.Location())
+}
+
+func TestStartSendsWelcomeWithMainKeyboard(t *testing.T) {
+	chatID := 1001
+	testBotAPI.Reset()
+	sendUpdate(t, chatID, "/start")
+
+	if len(testBotAPI.MessagesTo(chatID)) < len(getWelcomeMessageArray()) {
+		t.Errorf("Expected all welcome messages, got %d messages", len(testBotAPI.MessagesTo(chatID)))
+	}
+	sentMainKeyboard := false
+	for _, message := range testBotAPI.MessagesTo(chatID) {
+		sentMainKeyboard = sentMainKeyboard || keyboardContains(message.ReplyMarkup, "Queue?")
+	}
+	if !sentMainKeyboard {
+		t.Errorf("Welcome messages don't set the main keyboard")
+	}
+	if len(testBotAPI.Photos()) != 1 || testBotAPI.Photos()[0].Photo != getUsersMensa(chatID).TopViewURL {
+		t.Errorf("Expected top view of mensa to be sent")
+	}
+}
+
+func TestReportFlow(t *testing.T) {
+	chatID := 1002
+	sendUpdate(t, chatID, "/start")
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "Report!")
+	if !keyboardContains(lastMessageTo(t, chatID).ReplyMarkup, "L3: Within first room") {
+		t.Errorf("'Report!' doesn't lead to report keyboard")
+	}
+
+	sendUpdate(t, chatID, "L3: Within first room")
+	thankYou := lastMessageTo(t, chatID)
+	if !strings.Contains(thankYou.Text, "You reported length L3: Within first room") {
+		t.Errorf("Unexpected reply to report: %s", thankYou.Text)
+	}
+	if !keyboardContains(thankYou.ReplyMarkup, "Queue?") {
+		t.Errorf("Report doesn't lead back to main keyboard")
+	}
+
+	_, latestQueueLength := db_connectors.GetLatestQueueLengthReport(mensas.DEFAULT_MENSA_ID)
+	if latestQueueLength != "L3: Within first room" {
+		t.Errorf("Report wasn't stored, latest length is %s", latestQueueLength)
+	}
+}
+
+func TestQueueRequestSendsGraph(t *testing.T) {
+	chatID := 1003
+	sendUpdate(t, chatID, "/start")
+	sendReport(t, chatID, "L1: Within kitchen")
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "Queue?")
+	photos := testBotAPI.Photos()
+	if len(photos) != 1 {
+		t.Fatalf("Expected exactly one graph, got %d photos", len(photos))
+	}
+	if photos[0].ChatID != chatID || len(photos[0].UploadedBytes) == 0 {
+		t.Errorf("Graph wasn't uploaded to the requesting chat")
+	}
+	timeOfLatestReport, latestQueueLength := db_connectors.GetLatestQueueLengthReport(mensas.DEFAULT_MENSA_ID)
+	if !strings.HasPrefix(photos[0].Caption, generateSimpleLengthReportString(timeOfLatestReport, latestQueueLength)) {
+		t.Errorf("Graph caption doesn't describe latest report: %s", photos[0].Caption)
+	}
+}
+
+func TestMenuRequestSendsLatestMenu(t *testing.T) {
+	chatID := 1004
+	sendUpdate(t, chatID, "/start")
+	counter, _ := db_connectors.GetMensaMenuCounter()
+	db_connectors.InsertMensaMenu(&db_connectors.DBOfferInformation{
+		Title:       "Angebot 1",
+		Description: "Kartoffeln mit Quark",
+		Time:        getNoonOfToday(),
+		Counter:     counter + 1,
+		MensaID:     mensas.DEFAULT_MENSA_ID,
+	})
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "Menu?")
+	menuMessage := testBotAPI.MessagesTo(chatID)[0]
+	if !strings.Contains(menuMessage.Text, "Kartoffeln mit Quark") {
+		t.Errorf("Menu message doesn't contain offer: %s", menuMessage.Text)
+	}
+}
+
+func TestForgetMeRemovesKeyboard(t *testing.T) {
+	chatID := 1005
+	sendUpdate(t, chatID, "/start")
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "/forgetme")
+	prompt := lastMessageTo(t, chatID)
+	if prompt.ReplyMarkup == nil || len(prompt.ReplyMarkup.InlineKeyboard) == 0 {
+		t.Fatalf("Account deletion wasn't confirmed via inline keyboard: %s", prompt.Text)
+	}
+	if !db_connectors.UserHasBeenMigrated(chatID) {
+		t.Fatalf("Account was deleted before confirmation")
+	}
+
+	pressInlineButton(t, prompt.ChatID, prompt.MessageID, ACCOUNT_DELETION_CALLBACK+":"+ACCOUNT_DELETION_CONFIRM, time.Now())
+	if editedPrompt := testBotAPI.MessagesTo(chatID)[0]; editedPrompt.ReplyMarkup != nil {
+		t.Errorf("Buttons of the prompt weren't removed after confirming")
+	}
+	lastMessage := lastMessageTo(t, chatID)
+	if lastMessage.ReplyMarkup == nil || !lastMessage.ReplyMarkup.RemoveKeyboard {
+		t.Errorf("Account deletion doesn't remove keyboard")
+	}
+	if db_connectors.UserHasBeenMigrated(chatID) {
+		t.Errorf("Mensa preferences survived account deletion")
+	}
+	if len(testBotAPI.CallbackAnswers()) != 1 {
+		t.Errorf("Button press wasn't answered")
+	}
+}
+
+func TestForgetMeCanBeCancelledAndExpires(t *testing.T) {
+	chatID := 1015
+	sendUpdate(t, chatID, "/start")
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "/forgetme")
+	prompt := lastMessageTo(t, chatID)
+	pressInlineButton(t, prompt.ChatID, prompt.MessageID, ACCOUNT_DELETION_CALLBACK+":"+ACCOUNT_DELETION_CANCEL, time.Now())
+	if !db_connectors.UserHasBeenMigrated(chatID) {
+		t.Errorf("Cancelling deleted the account")
+	}
+	editedPrompt := lastMessageTo(t, chatID)
+	if editedPrompt.MessageID != prompt.MessageID || editedPrompt.ReplyMarkup != nil || !strings.Contains(editedPrompt.Text, "keep remembering") {
+		t.Errorf("Prompt wasn't edited in place after cancelling: %v", editedPrompt)
+	}
+	// Telegram refuses edits that don't change anything, which shouldn't lead to extra messages
+	numberOfMessages := len(testBotAPI.MessagesTo(chatID))
+	pressInlineButton(t, prompt.ChatID, prompt.MessageID, ACCOUNT_DELETION_CALLBACK+":"+ACCOUNT_DELETION_CANCEL, time.Now())
+	if len(testBotAPI.MessagesTo(chatID)) != numberOfMessages {
+		t.Errorf("Pressing cancel twice sent another message")
+	}
+
+	sendUpdate(t, chatID, "/forgetme")
+	prompt = lastMessageTo(t, chatID)
+	pressInlineButton(t, prompt.ChatID, prompt.MessageID, ACCOUNT_DELETION_CALLBACK+":"+ACCOUNT_DELETION_CONFIRM, time.Now().Add(-FLOW_EXPIRY-time.Minute))
+	if !db_connectors.UserHasBeenMigrated(chatID) {
+		t.Errorf("Confirming an expired prompt deleted the account")
+	}
+	if !strings.Contains(lastMessageTo(t, chatID).Text, "a bit old") {
+		t.Errorf("Expired prompt wasn't replaced: %s", lastMessageTo(t, chatID).Text)
+	}
+}
+
+func TestMyDataExportsStoredData(t *testing.T) {
+	chatID := 1016
+	sendUpdate(t, chatID, "/start")
+	db_connectors.EnableCollectionOfPoints(chatID)
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "/mydata")
+	documents := testBotAPI.Documents()
+	if len(documents) != 1 || documents[0].ChatID != chatID {
+		t.Fatalf("Expected one document to chat %d, got %v", chatID, documents)
+	}
+	var export UserDataExport
+	if err := json.Unmarshal(documents[0].Content, &export); err != nil {
+		t.Fatalf("Export isn't valid JSON: %s", err)
+	}
+	if len(export.Tables["internetpoints"]) != 1 || len(export.Tables["mensaPreferences"]) != 1 {
+		t.Errorf("Export is missing points or preferences: %s", documents[0].Content)
+	}
+	preferences := export.Tables["mensaPreferences"][0]
+	if _, exported := preferences["lastReportDate"]; !exported {
+		t.Errorf("Export is missing lastReportDate: %v", preferences)
+	}
+	if len(export.Tables["queueAlerts"]) != 0 {
+		t.Errorf("Export contains alerts the user never set up: %v", export.Tables["queueAlerts"])
+	}
+}
+
+func TestPollingHandlesUpdatesAndAdvancesOffset(t *testing.T) {
+	chatID := 1006
+	testBotAPI.Reset()
+	update := telegram_connector.WebhookRequestBody{UpdateID: 10}
+	update.Message.Text = "/start"
+	update.Message.Chat.ID = chatID
+	update.Message.Date = int(time.Now().Unix())
+	testBotAPI.QueueUpdate(update)
+
+	offset, err := pollUpdatesOnce(db_connectors.GetPollingOffset(), 0, nil)
+	if err != nil {
+		t.Fatalf("Polling failed: %s", err)
+	}
+	if offset != 11 || db_connectors.GetPollingOffset() != 11 {
+		t.Errorf("Offset wasn't advanced past handled update, is %d", offset)
+	}
+	if len(testBotAPI.MessagesTo(chatID)) == 0 {
+		t.Errorf("Polled update wasn't handled")
+	}
+
+	// Confirmed updates aren't handled again
+	testBotAPI.Reset()
+	pollUpdatesOnce(offset, 0, nil)
+	if len(testBotAPI.MessagesTo(chatID)) != 0 {
+		t.Errorf("Update was handled twice")
+	}
+}
+
+func TestQueueAlertIsSentOncePerDay(t *testing.T) {
+	subscriberID := 1007
+	reporterID := 1008
+	sendUpdate(t, subscriberID, "/start")
+	sendUpdate(t, reporterID, "/start")
+
+	// Subscribe via the settings page, like a user would
+	settingsUpdate := telegram_connector.WebhookRequestBody{}
+	settingsUpdate.Message.Chat.ID = subscriberID
+	settingsUpdate.Message.Date = int(time.Now().Unix())
+	settingsUpdate.Message.WebAppData.ButtonText = "Change Settings"
+	settingsUpdate.Message.WebAppData.Data = `{"mensaPreferences":{"reportAtall":false,"weekdayBitmap":62,"fromTime":"00:00","toTime":"23:59"},"points":true,
+		"queueAlerts":{"alertAtAll":true,"maximumLevel":3,"fromTime":"00:00","toTime":"23:59"}}`
+	sendUpdateBody(t, settingsUpdate)
+	testBotAPI.Reset()
+
+	sendReport(t, reporterID, "L5: Past first desk")
+	waitForDeliveries(t)
+	if len(testBotAPI.MessagesTo(subscriberID)) != 0 {
+		t.Errorf("Subscriber was alerted about a queue longer than their level")
+	}
+
+	sendReport(t, reporterID, "L2: Up to food trays")
+	waitForDeliveries(t)
+	alerts := testBotAPI.MessagesTo(subscriberID)
+	if len(alerts) != 1 || !strings.Contains(alerts[0].Text, "L2: Up to food trays") {
+		t.Fatalf("Expected exactly one alert about L2, got %v", alerts)
+	}
+
+	sendReport(t, reporterID, "L1: Within kitchen")
+	waitForDeliveries(t)
+	if len(testBotAPI.MessagesTo(subscriberID)) != 1 {
+		t.Errorf("Subscriber was alerted twice on the same day")
+	}
+
+	sendUpdate(t, subscriberID, "/forgetme")
+	pressInlineButton(t, subscriberID, lastMessageTo(t, subscriberID).MessageID, ACCOUNT_DELETION_CALLBACK+":"+ACCOUNT_DELETION_CONFIRM, time.Now())
+	if alertSettings, _ := db_connectors.GetQueueAlertSettings(subscriberID); alertSettings.AlertAtAll {
+		t.Errorf("Queue alert survived account deletion")
+	}
+}
+
+func TestSettingsWithMalformedTimeAreNotSaved(t *testing.T) {
+	chatID := 1030
+	sendUpdate(t, chatID, "/start")
+	testBotAPI.Reset()
+
+	settingsUpdate := telegram_connector.WebhookRequestBody{}
+	settingsUpdate.Message.Chat.ID = chatID
+	settingsUpdate.Message.Date = int(time.Now().Unix())
+	settingsUpdate.Message.WebAppData.ButtonText = "Change Settings"
+	settingsUpdate.Message.WebAppData.Data = `{"mensaPreferences":{"reportAtall":true,"weekdayBitmap":62,"fromTime":"11:00","toTime":"14:00"},"points":true,
+		"queueAlerts":{"alertAtAll":true,"maximumLevel":3,"fromTime":"noon","toTime":"14:00"}}`
+	sendUpdateBody(t, settingsUpdate)
+
+	if !strings.Contains(lastMessageTo(t, chatID).Text, "didn't save") {
+		t.Errorf("User wasn't told that the settings weren't saved: %s", lastMessageTo(t, chatID).Text)
+	}
+	if alertSettings, _ := db_connectors.GetQueueAlertSettings(chatID); alertSettings.AlertAtAll {
+		t.Errorf("Alert with malformed time was saved: %+v", alertSettings)
+	}
+	if db_connectors.UserIsCollectingPoints(chatID) {
+		t.Errorf("Other settings were saved despite the malformed time")
+	}
+}
+
+func TestSettingsWithInvalidQueueAlertAreNotSaved(t *testing.T) {
+	invalidSettings := map[int]string{
+		// Golm has fewer queue levels than Griebnitzsee
+		1036: `{"mensaPreferences":{"reportAtall":true,"weekdayBitmap":62,"fromTime":"11:00","toTime":"14:00","mensaID":"golm"},"points":true,
+		"queueAlerts":{"alertAtAll":true,"maximumLevel":6,"fromTime":"11:00","toTime":"14:00"}}`,
+		1037: `{"mensaPreferences":{"reportAtall":true,"weekdayBitmap":62,"fromTime":"11:00","toTime":"14:00"},"points":true,
+		"queueAlerts":{"alertAtAll":true,"maximumLevel":3,"fromTime":"14:00","toTime":"11:00"}}`,
+	}
+	for chatID, settingsJSON := range invalidSettings {
+		sendUpdate(t, chatID, "/start")
+		testBotAPI.Reset()
+
+		settingsUpdate := telegram_connector.WebhookRequestBody{}
+		settingsUpdate.Message.Chat.ID = chatID
+		settingsUpdate.Message.Date = int(time.Now().Unix())
+		settingsUpdate.Message.WebAppData.ButtonText = "Change Settings"
+		settingsUpdate.Message.WebAppData.Data = settingsJSON
+		sendUpdateBody(t, settingsUpdate)
+
+		if !strings.Contains(lastMessageTo(t, chatID).Text, "didn't save") {
+			t.Errorf("User %d wasn't told that the settings weren't saved: %s", chatID, lastMessageTo(t, chatID).Text)
+		}
+		if alertSettings, _ := db_connectors.GetQueueAlertSettings(chatID); alertSettings.AlertAtAll {
+			t.Errorf("Invalid alert of user %d was saved: %+v", chatID, alertSettings)
+		}
+		if db_connectors.UserIsCollectingPoints(chatID) {
+			t.Errorf("Other settings of user %d were saved despite the invalid alert", chatID)
+		}
+	}
+}
+
+func TestUsersOfOtherMensasAreServedSeparately(t *testing.T) {
+	chatID := 1009
+	sendUpdate(t, chatID, "/start")
+	settingsUpdate := telegram_connector.WebhookRequestBody{}
+	settingsUpdate.Message.Chat.ID = chatID
+	settingsUpdate.Message.Date = int(time.Now().Unix())
+	settingsUpdate.Message.WebAppData.ButtonText = "Change Settings"
+	settingsUpdate.Message.WebAppData.Data = `{"mensaPreferences":{"reportAtall":false,"weekdayBitmap":62,"fromTime":"11:00","toTime":"14:00","mensaID":"golm"},"points":true}`
+	sendUpdateBody(t, settingsUpdate)
+	if db_connectors.GetUserMensaID(chatID) != "golm" {
+		t.Fatalf("Mensa wasn't changed via settings")
+	}
+	golm, _ := mensas.GetMensa("golm")
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "Report!")
+	if !keyboardContains(lastMessageTo(t, chatID).ReplyMarkup, golm.QueueLevels[1].Description) {
+		t.Errorf("Report keyboard doesn't contain queue lengths of the users mensa")
+	}
+	sendUpdate(t, chatID, golm.QueueLevels[1].Description)
+	_, latestAtGolm := db_connectors.GetLatestQueueLengthReport("golm")
+	if latestAtGolm != golm.QueueLevels[1].Description {
+		t.Errorf("Report wasn't stored for users mensa, latest length is %s", latestAtGolm)
+	}
+	_, latestAtGriebnitzsee := db_connectors.GetLatestQueueLengthReport(mensas.DEFAULT_MENSA_ID)
+	if latestAtGriebnitzsee == golm.QueueLevels[1].Description {
+		t.Errorf("Report leaked into default mensa")
+	}
+
+	// We don't know where to get the menu of Golm from
+	for _, menuRequest := range []string{"Menu?", "Menu tomorrow?", "/menu week"} {
+		testBotAPI.Reset()
+		sendUpdate(t, chatID, menuRequest)
+		if strings.Contains(lastMessageTo(t, chatID).Text, "Kartoffeln") {
+			t.Errorf("Users of Golm received the menu of Griebnitzsee")
+		}
+		if !strings.Contains(lastMessageTo(t, chatID).Text, "no menu available for Golm") {
+			t.Errorf("Users of Golm weren't told that there is no menu for %s: %s", menuRequest, lastMessageTo(t, chatID).Text)
+		}
+	}
+}
+
+func TestReportOfLevelTheMensaDoesntHaveIsRejected(t *testing.T) {
+	chatID := 1031
+	sendUpdate(t, chatID, "/start")
+	if err := db_connectors.SetUserMensa(chatID, "golm"); err != nil {
+		t.Fatalf("Can't set mensa: %s", err)
+	}
+	testBotAPI.Reset()
+
+	for _, report := range []string{"L7: Up to stairs", "L9: x"} {
+		sendUpdate(t, chatID, "Report!")
+		sendUpdate(t, chatID, report)
+		if !strings.Contains(lastMessageTo(t, chatID).Text, "are you sure") {
+			t.Errorf("Report %s wasn't rejected: %s", report, lastMessageTo(t, chatID).Text)
+		}
+		if _, latestAtGolm := db_connectors.GetLatestQueueLengthReport("golm"); latestAtGolm == report {
+			t.Errorf("Report %s was stored", report)
+		}
+	}
+}
+
+func TestForecastRecommendsShortQueueOfPastWeeks(t *testing.T) {
+	neuesPalais, _ := mensas.GetMensa("neues_palais")
+	levelLabels := neuesPalais.GetLevelLabels()
+	location := utils.GetLocalLocation()
+	now := time.Date(2022, 11, 16, 12, 0, 0, 0, location).UTC()
+
+	// On the last two wednesdays it was busy at noon, but quiet half an hour later
+	for _, weeksAgo := range []int{1, 2} {
+		day := now.AddDate(0, 0, -7*weeksAgo)
+		db_connectors.WriteReportToDB("forecast-test", int(day.Unix()), levelLabels[4], neuesPalais.ID)
+		db_connectors.WriteReportToDB("forecast-test", int(day.Add(35*time.Minute).Unix()), levelLabels[0], neuesPalais.ID)
+	}
+
+	forecastLine := generateForecastString(getForecastForMensa(neuesPalais, now), now)
+	if forecastLine != "Best time to go in the next 2h: 12:30 (likely L0)" {
+		t.Errorf("Unexpected forecast: %s", forecastLine)
+	}
+}
+
+func TestOutlierDoesNotChangeReportedLength(t *testing.T) {
+	neuesPalais, _ := mensas.GetMensa("neues_palais")
+	levelLabels := neuesPalais.GetLevelLabels()
+	now := time.Now()
+
+	db_connectors.WriteReportToDB("outlier-test-1", int(now.Add(-8*time.Minute).Unix()), levelLabels[0], neuesPalais.ID)
+	db_connectors.WriteReportToDB("outlier-test-2", int(now.Add(-5*time.Minute).Unix()), levelLabels[1], neuesPalais.ID)
+	outlierID, err := db_connectors.WriteReportToDB("outlier-test-3", int(now.Add(-1*time.Minute).Unix()), levelLabels[4], neuesPalais.ID)
+	if err != nil {
+		t.Fatalf("Can't write report: %s", err)
+	}
+
+	if !db_connectors.IsReportSuspect(outlierID) {
+		t.Errorf("Report contradicting everybody else isn't suspect")
+	}
+	if _, queueLength := db_connectors.GetLatestQueueLengthReport(neuesPalais.ID); queueLength == levelLabels[4] {
+		t.Errorf("Outlier is shown as current queue length")
+	}
+}
+
+func TestUndoRemovesReportAndPoint(t *testing.T) {
+	chatID := 1010
+	sendUpdate(t, chatID, "/start")
+	settingsUpdate := telegram_connector.WebhookRequestBody{}
+	settingsUpdate.Message.Chat.ID = chatID
+	settingsUpdate.Message.Date = int(time.Now().Unix())
+	settingsUpdate.Message.WebAppData.ButtonText = "Change Settings"
+	settingsUpdate.Message.WebAppData.Data = `{"mensaPreferences":{"reportAtall":false,"weekdayBitmap":62,"fromTime":"11:00","toTime":"14:00"},"points":true}`
+	sendUpdateBody(t, settingsUpdate)
+
+	sendReport(t, chatID, "L7: Up to stairs")
+	if db_connectors.GetNumberOfPointsByUser(chatID) != 1 {
+		t.Fatalf("Report didn't award a point")
+	}
+	reportID := globalUndoableReports[chatID].ReportID
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "/undo")
+	if !keyboardContains(lastMessageTo(t, chatID).ReplyMarkup, "L3: Within first room") {
+		t.Errorf("Undo doesn't offer to report again")
+	}
+	if db_connectors.GetNumberOfPointsByUser(chatID) != 0 {
+		t.Errorf("Undo didn't take back the point")
+	}
+	var numberOfReports int
+	db_connectors.GetDBHandle().QueryRow("SELECT COUNT(*) FROM queueReports WHERE id = ?", reportID).Scan(&numberOfReports)
+	if numberOfReports != 0 {
+		t.Errorf("Undone report is still stored")
+	}
+
+	sendUpdate(t, chatID, "/undo")
+	if !strings.Contains(lastMessageTo(t, chatID).Text, "no report of yours") {
+		t.Errorf("Second undo should have nothing left to undo: %s", lastMessageTo(t, chatID).Text)
+	}
+}
+
+func TestLegacyCommandIsRoutedAndUpgradesKeyboard(t *testing.T) {
+	chatID := 1011
+	testBotAPI.Reset()
+	sendUpdate(t, chatID, "/jetze@MensaQueueBot")
+
+	if len(testBotAPI.Photos()) != 1 {
+		t.Errorf("Legacy /jetze wasn't answered with a graph")
+	}
+	if !keyboardContains(lastMessageTo(t, chatID).ReplyMarkup, "Queue?") {
+		t.Errorf("Legacy user didn't receive the main keyboard")
+	}
+	if !db_connectors.UserHasBeenMigrated(chatID) {
+		t.Errorf("Legacy user wasn't migrated")
+	}
+}
+
+func TestAlertSetupFlow(t *testing.T) {
+	chatID := 1012
+	sendUpdate(t, chatID, "/start")
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "/alerts")
+	if !keyboardContains(lastMessageTo(t, chatID).ReplyMarkup, "At most L2") {
+		t.Fatalf("Alert setup doesn't offer levels")
+	}
+	sendUpdate(t, chatID, "Whatever")
+	if !keyboardContains(lastMessageTo(t, chatID).ReplyMarkup, "At most L2") {
+		t.Errorf("Invalid answer doesn't repeat the question")
+	}
+	sendUpdate(t, chatID, "At most L2")
+	if !keyboardContains(lastMessageTo(t, chatID).ReplyMarkup, "11:00 - 14:00") {
+		t.Fatalf("Alert setup doesn't ask for timeframe")
+	}
+	sendUpdate(t, chatID, "11:15 - 13:45")
+	if !keyboardContains(lastMessageTo(t, chatID).ReplyMarkup, "Queue?") {
+		t.Errorf("Alert setup doesn't lead back to the main keyboard")
+	}
+
+	alertSettings, _ := db_connectors.GetQueueAlertSettings(chatID)
+	if !alertSettings.AlertAtAll || alertSettings.MaximumLevel != 2 || alertSettings.FromTime != "11:15" || alertSettings.ToTime != "13:45" {
+		t.Errorf("Alert wasn't saved as set up: %+v", alertSettings)
+	}
+	if state, _ := db_connectors.GetConversationState(chatID, time.Now().UTC()); state.HasPendingFlow() {
+		t.Errorf("Flow is still pending after it was done")
+	}
+}
+
+func TestAlertSetupCanBeCancelledAndExpires(t *testing.T) {
+	chatID := 1013
+	sendUpdate(t, chatID, "/start")
+
+	sendUpdate(t, chatID, "/alerts")
+	sendUpdate(t, chatID, "Cancel")
+	if alertSettings, _ := db_connectors.GetQueueAlertSettings(chatID); alertSettings.AlertAtAll {
+		t.Errorf("Cancelled setup saved an alert")
+	}
+
+	sendUpdate(t, chatID, "/alerts")
+	state, _ := db_connectors.GetConversationState(chatID, time.Now().UTC())
+	state.ExpiresAt = time.Now().Add(-time.Minute)
+	db_connectors.SaveFlowOfConversation(chatID, state)
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "At most L2")
+	if !strings.Contains(lastMessageTo(t, chatID).Text, "too long") {
+		t.Errorf("Expired flow wasn't explained: %s", lastMessageTo(t, chatID).Text)
+	}
+	if alertSettings, _ := db_connectors.GetQueueAlertSettings(chatID); alertSettings.AlertAtAll {
+		t.Errorf("Expired setup saved an alert")
+	}
+}
+
+func TestButtonOfStaleKeyboardIsRejected(t *testing.T) {
+	chatID := 1014
+	sendUpdate(t, chatID, "/start")
+	testBotAPI.Reset()
+
+	// The welcome messages left the user at the main keyboard, which has no "Can't tell"
+	sendUpdate(t, chatID, "Can't tell")
+	reply := lastMessageTo(t, chatID)
+	if !strings.Contains(reply.Text, "ignoring") || !keyboardContains(reply.ReplyMarkup, "Queue?") {
+		t.Errorf("Stale button wasn't rejected with the current keyboard: %s", reply.Text)
+	}
+
+	// Old report keyboards may still be around, e.g. further up in the chat
+	reportsBefore, _, _ := db_connectors.GetAllQueueLengthReportsInTimeframe(time.Now().UTC(), time.Hour, mensas.DEFAULT_MENSA_ID)
+	sendUpdate(t, chatID, "L2: Up to food trays")
+	if !strings.Contains(lastMessageTo(t, chatID).Text, "ignoring") {
+		t.Errorf("Report from stale keyboard wasn't rejected: %s", lastMessageTo(t, chatID).Text)
+	}
+	if reportsAfter, _, _ := db_connectors.GetAllQueueLengthReportsInTimeframe(time.Now().UTC(), time.Hour, mensas.DEFAULT_MENSA_ID); len(reportsAfter) != len(reportsBefore) {
+		t.Errorf("Report from stale keyboard was stored")
+	}
+
+	sendUpdate(t, chatID, "Report!")
+	sendUpdate(t, chatID, "Can't tell")
+	if lastMessageTo(t, chatID).Text != "Alrighty" {
+		t.Errorf("Button of current keyboard was rejected: %s", lastMessageTo(t, chatID).Text)
+	}
+}
+
+func TestLiveQueueMessageUpdatesOnNewReports(t *testing.T) {
+	chatID := 1017
+	reporterID := 1018
+	sendUpdate(t, chatID, "/start")
+	sendUpdate(t, reporterID, "/start")
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "Queue?")
+	photos := testBotAPI.Photos()
+	if len(photos) != 1 || photos[0].ReplyMarkup == nil || len(photos[0].ReplyMarkup.InlineKeyboard) == 0 {
+		t.Fatalf("Queue graph doesn't offer live updates: %v", photos)
+	}
+	graph := photos[0]
+	pressInlineButton(t, chatID, graph.MessageID, LIVE_CALLBACK+":"+LIVE_START, time.Now())
+	if caption := testBotAPI.Photos()[0].Caption; !strings.Contains(caption, "Live until") {
+		t.Errorf("Live message doesn't say so: %s", caption)
+	}
+	numberOfEdits := len(testBotAPI.Edits())
+
+	// Pretend the last edit was long enough ago
+	globalLiveMessagesMutex.Lock()
+	globalLiveMessages[chatID].LastEditAt = time.Now().Add(-LIVE_EDIT_INTERVAL)
+	globalLiveMessagesMutex.Unlock()
+	sendReport(t, reporterID, "L3: Within first room")
+	edits := testBotAPI.Edits()
+	if len(edits) != numberOfEdits+1 || edits[len(edits)-1].MessageID != graph.MessageID || edits[len(edits)-1].Photo == "" {
+		t.Fatalf("New report didn't update graph of live message: %v", edits)
+	}
+
+	// Reports within LIVE_EDIT_INTERVAL are collected into one later edit
+	sendReport(t, reporterID, "L2: Up to food trays")
+	if len(testBotAPI.Edits()) != numberOfEdits+1 {
+		t.Errorf("Live message was edited twice within the edit interval")
+	}
+
+	pressInlineButton(t, chatID, graph.MessageID, LIVE_CALLBACK+":"+LIVE_STOP, time.Now())
+	stoppedGraph := testBotAPI.Photos()[0]
+	if strings.Contains(stoppedGraph.Caption, "Live until") || !strings.Contains(stoppedGraph.ReplyMarkup.InlineKeyboard[0][0].CallbackData, LIVE_START) {
+		t.Errorf("Stopped live message still looks live: %v", stoppedGraph)
+	}
+	if lastEdit := testBotAPI.Edits()[len(testBotAPI.Edits())-1]; lastEdit.Method != "editMessageCaption" {
+		t.Errorf("Stopping edited more than the caption: %s", lastEdit.Method)
+	}
+
+	// The timer of the first session mustn't end the restarted one
+	pressInlineButton(t, chatID, graph.MessageID, LIVE_CALLBACK+":"+LIVE_START, time.Now())
+	stopExpiredLiveMessage(chatID, graph.MessageID)
+	if caption := testBotAPI.Photos()[0].Caption; !strings.Contains(caption, "Live until") {
+		t.Errorf("Restarted live message was stopped early: %s", caption)
+	}
+	forgetLiveMessage(chatID)
+}
+
+func TestStoppedLiveMessagesDontRunTimers(t *testing.T) {
+	chatID := 1033
+	defer func() {
+		globalLiveMessagesMutex.Lock()
+		globalLiveMessagesStopped = false
+		globalLiveMessagesMutex.Unlock()
+	}()
+	timerRan := make(chan struct{}, 2)
+	globalLiveMessagesMutex.Lock()
+	globalLiveMessages[chatID] = &liveMessage{
+		ChatID:      chatID,
+		MessageID:   1,
+		expiryTimer: afterLiveFunc(20*time.Millisecond, func() { timerRan <- struct{}{} }),
+		editTimer:   afterLiveFunc(20*time.Millisecond, func() { timerRan <- struct{}{} }),
+	}
+	globalLiveMessagesMutex.Unlock()
+
+	if !StopLiveMessages(time.Second) {
+		t.Fatalf("Live messages didn't stop in time")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(timerRan) != 0 {
+		t.Errorf("Timer of live message ran after shutdown")
+	}
+	// Neither do timers that are created after shutdown
+	afterLiveFunc(0, func() { timerRan <- struct{}{} })
+	time.Sleep(20 * time.Millisecond)
+	if len(timerRan) != 0 {
+		t.Errorf("Timer created after shutdown ran")
+	}
+	globalLiveMessagesMutex.Lock()
+	defer globalLiveMessagesMutex.Unlock()
+	if len(globalLiveMessages) != 0 {
+		t.Errorf("Live messages are still kept after shutdown")
+	}
+}
+
+func TestQueuedMessagesAreRetried(t *testing.T) {
+	chatID := 1019
+	testBotAPI.Reset()
+	testBotAPI.FailNextRequest("sendMessage", http.StatusTooManyRequests, 1)
+	testBotAPI.FailNextRequest("sendMessage", http.StatusBadGateway, 0)
+
+	queuedAt := time.Now()
+	if err := telegram_connector.QueueMessage(chatID, "Today there's pasta", telegram_connector.NilKeyboard); err != nil {
+		t.Fatalf("Can't queue message: %s", err)
+	}
+	waitForDeliveries(t)
+	if testBotAPI.PendingFailures("sendMessage") != 0 {
+		t.Errorf("Queue didn't retry after failures")
+	}
+	messages := testBotAPI.MessagesTo(chatID)
+	if len(messages) != 1 || messages[0].Text != "Today there's pasta" {
+		t.Fatalf("Expected the queued message exactly once, got %v", messages)
+	}
+	if time.Since(queuedAt) < time.Second {
+		t.Errorf("Queue didn't wait for retry_after before retrying")
+	}
+
+	// Errors that won't go away, like users that blocked us, aren't retried
+	testBotAPI.FailNextRequest("sendMessage", http.StatusForbidden, 0)
+	telegram_connector.QueueMessage(chatID, "Today there's rice", telegram_connector.NilKeyboard)
+	waitForDeliveries(t)
+	if len(testBotAPI.MessagesTo(chatID)) != 1 {
+		t.Errorf("Message that telegram refused was retried")
+	}
+}
+
+func TestBlockedChatIsSkippedUntilItWritesAgain(t *testing.T) {
+	subscriberID := 1020
+	reporterID := 1021
+	sendUpdate(t, subscriberID, "/start")
+	sendUpdate(t, reporterID, "/start")
+	settingsUpdate := telegram_connector.WebhookRequestBody{}
+	settingsUpdate.Message.Chat.ID = subscriberID
+	settingsUpdate.Message.Date = int(time.Now().Unix())
+	settingsUpdate.Message.WebAppData.ButtonText = "Change Settings"
+	settingsUpdate.Message.WebAppData.Data = `{"mensaPreferences":{"reportAtall":false,"weekdayBitmap":62,"fromTime":"00:00","toTime":"23:59"},"points":true,
+		"queueAlerts":{"alertAtAll":true,"maximumLevel":3,"fromTime":"00:00","toTime":"23:59"}}`
+	sendUpdateBody(t, settingsUpdate)
+	testBotAPI.Reset()
+	defer testBotAPI.UnblockChat(subscriberID)
+
+	isAlertedTomorrow := func() bool {
+		usersToAlert, _ := db_connectors.GetUsersToAlertForReport(time.Now().Add(24*time.Hour), 0, mensas.DEFAULT_MENSA_ID)
+		for _, userID := range usersToAlert {
+			if userID == subscriberID {
+				return true
+			}
+		}
+		return false
+	}
+	if !isAlertedTomorrow() {
+		t.Fatalf("Subscriber isn't alerted to begin with")
+	}
+
+	testBotAPI.BlockChat(subscriberID)
+	sendReport(t, reporterID, "L2: Up to food trays")
+	waitForDeliveries(t)
+	if len(testBotAPI.MessagesTo(subscriberID)) != 0 {
+		t.Fatalf("Blocked chat received a message")
+	}
+	if isAlertedTomorrow() {
+		t.Errorf("Blocked chat is still selected for pushes")
+	}
+
+	testBotAPI.UnblockChat(subscriberID)
+	sendUpdate(t, subscriberID, "Queue?")
+	if !isAlertedTomorrow() {
+		t.Errorf("Chat wasn't reactivated after writing to the bot")
+	}
+}
+
+func TestBlockedChatWithoutPreferencesIsSkipped(t *testing.T) {
+	chatID := 1032
+	if err := db_connectors.UpdateQueueAlert(chatID, true, 3, 0, 1439); err != nil {
+		t.Fatalf("Can't subscribe to alerts: %s", err)
+	}
+	isAlerted := func() bool {
+		usersToAlert, _ := db_connectors.GetUsersToAlertForReport(time.Now(), 0, mensas.DEFAULT_MENSA_ID)
+		for _, userID := range usersToAlert {
+			if userID == chatID {
+				return true
+			}
+		}
+		return false
+	}
+	// The chat has alerts, but never wrote to us, so it has no preferences
+	if !isAlerted() {
+		t.Fatalf("Subscriber isn't alerted to begin with")
+	}
+
+	db_connectors.SetChatInactive(chatID)
+	if isAlerted() {
+		t.Errorf("Inactive chat without preferences is still selected for alerts")
+	}
+	if db_connectors.UserHasBeenMigrated(chatID) {
+		t.Errorf("Marking chat inactive created preferences")
+	}
+	db_connectors.SetChatActive(chatID)
+	if !isAlerted() {
+		t.Errorf("Chat without preferences wasn't reactivated")
+	}
+}
+
+func TestBlockedChatAfterDeletionGetsNoData(t *testing.T) {
+	chatID := 1035
+	sendUpdate(t, chatID, "/start")
+	db_connectors.UpdateQueueAlert(chatID, true, 3, 0, 1439)
+	if err := db_connectors.DeleteAllUserData(chatID); err != nil {
+		t.Fatalf("Can't delete user data: %s", err)
+	}
+
+	// e.g. a push that was still queued fails because the user blocked us afterwards
+	db_connectors.SetChatInactive(chatID)
+	if db_connectors.UserHasBeenMigrated(chatID) {
+		t.Errorf("Marking deleted chat inactive recreated its preferences")
+	}
+	export, err := db_connectors.ExportUserData(chatID)
+	if err != nil {
+		t.Fatalf("Can't export user data: %s", err)
+	}
+	for table, rows := range export {
+		if len(rows) != 0 {
+			t.Errorf("Marking deleted chat inactive stored data in %s", table)
+		}
+	}
+}
+
+func TestWebhookRefusesMissingSecretAndRepeatedUpdates(t *testing.T) {
+	chatID := 1022
+	testBotAPI.Reset()
+	server := newWebhookServer("/token/", "webhook-secret")
+	postUpdate := func(secret string, updateID int) int {
+		update := telegram_connector.WebhookRequestBody{UpdateID: updateID}
+		update.Message.Text = "/start"
+		update.Message.Chat.ID = chatID
+		update.Message.Date = int(time.Now().Unix())
+		body, _ := json.Marshal(update)
+		request := httptest.NewRequest("POST", "/token/", bytes.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			request.Header.Set(telegram_connector.WEBHOOK_SECRET_HEADER, secret)
+		}
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		globalUpdateDispatcher.waitUntilIdle()
+		return recorder.Code
+	}
+
+	if code := postUpdate("", 500001); code != http.StatusUnauthorized {
+		t.Errorf("Request without secret was answered with %d", code)
+	}
+	if code := postUpdate("wrong-secret", 500001); code != http.StatusUnauthorized {
+		t.Errorf("Request with wrong secret was answered with %d", code)
+	}
+	if len(testBotAPI.MessagesTo(chatID)) != 0 {
+		t.Fatalf("Update without valid secret was handled")
+	}
+
+	if code := postUpdate("webhook-secret", 500001); code != http.StatusOK {
+		t.Fatalf("Valid update was answered with %d", code)
+	}
+	handledMessages := len(testBotAPI.MessagesTo(chatID))
+	if handledMessages == 0 {
+		t.Fatalf("Valid update wasn't handled")
+	}
+	// Telegram expects 200 for repeated updates too, otherwise it keeps repeating them
+	if code := postUpdate("webhook-secret", 500001); code != http.StatusOK {
+		t.Errorf("Repeated update was answered with %d", code)
+	}
+	if len(testBotAPI.MessagesTo(chatID)) != handledMessages {
+		t.Errorf("Repeated update was handled twice")
+	}
+	if code := postUpdate("webhook-secret", 0); code != http.StatusBadRequest {
+		t.Errorf("Update without update_id was answered with %d", code)
+	}
+}
+
+func TestWebhookIsRegisteredWithSecret(t *testing.T) {
+	testBotAPI.Reset()
+	os.Setenv(utils.KEY_WEBHOOK_URL, "https://mensa.example.com/")
+	defer os.Unsetenv(utils.KEY_WEBHOOK_URL)
+
+	webhookSecret := setUpWebhook("/token/")
+	webhook := testBotAPI.Webhook()
+	if webhook.URL != "https://mensa.example.com/token/" {
+		t.Errorf("Webhook was registered at %s", webhook.URL)
+	}
+	if webhookSecret == "" || webhook.SecretToken != webhookSecret {
+		t.Errorf("Webhook wasn't registered with the secret we check for")
+	}
+	if strings.Join(webhook.AllowedUpdates, ",") != strings.Join(telegram_connector.ALLOWED_UPDATES, ",") {
+		t.Errorf("Webhook was registered for updates %v", webhook.AllowedUpdates)
+	}
+}
+
+func TestUpdateDeduplicatorForgetsOldestUpdates(t *testing.T) {
+	deduplicator := newUpdateDeduplicator(2)
+	for _, updateID := range []int{1, 2, 3} {
+		if !deduplicator.isNew(updateID) {
+			t.Fatalf("Update %d wasn't new", updateID)
+		}
+	}
+	if deduplicator.isNew(3) || deduplicator.isNew(2) {
+		t.Errorf("Recent update was handled twice")
+	}
+	if !deduplicator.isNew(1) {
+		t.Errorf("Oldest update wasn't forgotten")
+	}
+}
+
+func TestUpdateDeduplicatorForgetFreesSlot(t *testing.T) {
+	deduplicator := newUpdateDeduplicator(2)
+	deduplicator.isNew(1)
+	deduplicator.isNew(2)
+	deduplicator.forget(2)
+	// Remembering 2 again mustn't push out 1, and neither may any other ID
+	if !deduplicator.isNew(2) {
+		t.Fatalf("Forgotten update wasn't new")
+	}
+	if deduplicator.isNew(1) || deduplicator.isNew(2) {
+		t.Errorf("Forgetting an update made another one count as new")
+	}
+	if !deduplicator.isNew(3) || deduplicator.isNew(2) || !deduplicator.isNew(1) {
+		t.Errorf("Ring didn't forget the oldest update after forget")
+	}
+}
+
+func TestWebhookRefusesToStartWithoutSecret(t *testing.T) {
+	os.Unsetenv(utils.KEY_WEBHOOK_URL)
+	os.Unsetenv(utils.KEY_WEBHOOK_SECRET)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Webhook was set up without secret")
+		}
+	}()
+	setUpWebhook("/token/")
+}
+
+func TestDispatcherKeepsOrderOfChatsAndRefusesWhenFull(t *testing.T) {
+	var mutex sync.Mutex
+	handledTexts := make(map[int][]string)
+	unblockWorkers := make(chan struct{})
+	dispatcher := newUpdateDispatcher(2, 3, func(update *telegram_connector.WebhookRequestBody) {
+		<-unblockWorkers
+		mutex.Lock()
+		handledTexts[update.Message.Chat.ID] = append(handledTexts[update.Message.Chat.ID], update.Message.Text)
+		mutex.Unlock()
+	})
+	newUpdate := func(chatID int, text string) *telegram_connector.WebhookRequestBody {
+		update := &telegram_connector.WebhookRequestBody{}
+		update.Message.Chat.ID = chatID
+		update.Message.Text = text
+		return update
+	}
+
+	// Chat 2 and 4 share a worker, which takes the first update and queues the next three
+	for i, text := range []string{"first", "second", "third"} {
+		if !dispatcher.dispatch(newUpdate(2, text)) {
+			t.Fatalf("Update %d was refused", i)
+		}
+	}
+	dispatcher.dispatch(newUpdate(4, "other chat"))
+	// The worker may not have taken the first update yet, so the queue might be full already
+	dispatcher.dispatch(newUpdate(4, "maybe refused"))
+	if dispatcher.dispatch(newUpdate(2, "refused")) {
+		t.Errorf("Update was accepted although queue was full")
+	}
+	if !dispatcher.dispatch(newUpdate(1, "other worker")) {
+		t.Errorf("Full queue of one worker refused updates for another worker")
+	}
+	if stats := dispatcher.getStats(); stats.Refused == 0 || stats.Pending == 0 {
+		t.Errorf("Stats don't show the refused and pending updates: %+v", stats)
+	}
+
+	close(unblockWorkers)
+	if !dispatcher.drain(5 * time.Second) {
+		t.Fatalf("Dispatcher didn't drain")
+	}
+	if strings.Join(handledTexts[2], ",") != "first,second,third" {
+		t.Errorf("Updates of chat were handled out of order: %v", handledTexts[2])
+	}
+	if dispatcher.dispatch(newUpdate(1, "after drain")) {
+		t.Errorf("Drained dispatcher accepted an update")
+	}
+	if stats := dispatcher.getStats(); stats.Pending != 0 {
+		t.Errorf("Drained dispatcher still has pending updates: %+v", stats)
+	}
+}
+
+func TestConcurrentQueueRequestsShareOneGraph(t *testing.T) {
+	chatIDs := []int{1023, 1024, 1025, 1026}
+	for _, chatID := range chatIDs {
+		sendUpdate(t, chatID, "/start")
+	}
+	invalidateGraphOfMensa(mensas.DEFAULT_MENSA_ID)
+	testBotAPI.Reset()
+
+	var requests sync.WaitGroup
+	for _, chatID := range chatIDs {
+		requests.Add(1)
+		go func(chatID int) {
+			defer requests.Done()
+			GenerateAndSendGraphicQueueLengthReport(chatID)
+		}(chatID)
+	}
+	requests.Wait()
+
+	photos := testBotAPI.Photos()
+	if len(photos) != len(chatIDs) {
+		t.Fatalf("Expected one graph per request, got %d photos", len(photos))
+	}
+	var uploadedFileID string
+	for _, photo := range photos {
+		if len(photo.UploadedBytes) > 0 {
+			if uploadedFileID != "" {
+				t.Fatalf("Graph was rendered and uploaded more than once")
+			}
+			uploadedFileID = fmt.Sprintf("fake-file-id-%d", photo.MessageID)
+		}
+	}
+	for _, photo := range photos {
+		if len(photo.UploadedBytes) == 0 && photo.Photo != uploadedFileID {
+			t.Errorf("Request didn't reuse uploaded graph %s: %s", uploadedFileID, photo.Photo)
+		}
+	}
+
+	// A new cache, as after a restart, reuses the stored graph instead of rendering
+	restartedCache := newGraphCache(func(mensas.Mensa, graphWindow, time.Time) (renderedGraph, error) {
+		t.Errorf("Restarted cache rendered a new graph")
+		return renderedGraph{}, fmt.Errorf("shouldn't render")
+	})
+	timeOfLatestReport, _ := db_connectors.GetLatestQueueLengthReport(mensas.DEFAULT_MENSA_ID)
+	graph, wasUploaded, err := restartedCache.getGraph(mensas.GetMensaOrDefault(mensas.DEFAULT_MENSA_ID), QUEUE_GRAPH_WINDOW,
+		time.Unix(int64(timeOfLatestReport), 0), nil)
+	if err != nil || wasUploaded || graph.TelegramAssignedID != uploadedFileID {
+		t.Errorf("Restarted cache didn't return stored graph %s: %v, %v", uploadedFileID, graph, err)
+	}
+}
+
+func TestShutdownStopsComponentsInReverseOrder(t *testing.T) {
+	app := &application{}
+	var stopped []string
+	app.onShutdown("database", func(timeout time.Duration) bool {
+		stopped = append(stopped, "database")
+		return true
+	})
+	app.onShutdown("slow", func(timeout time.Duration) bool {
+		stopped = append(stopped, "slow")
+		time.Sleep(timeout)
+		return false
+	})
+	app.onShutdown("server", func(timeout time.Duration) bool {
+		stopped = append(stopped, "server")
+		return true
+	})
+
+	if app.shutdown(10 * time.Millisecond) {
+		t.Errorf("Shutdown reported success although a component didn't stop in time")
+	}
+	if strings.Join(stopped, ",") != "server,slow,database" {
+		t.Errorf("Components weren't stopped in reverse order, or some were skipped: %v", stopped)
+	}
+}
+
+func TestStoppedPollingDoesntHandleUpdates(t *testing.T) {
+	chatID := 1027
+	testBotAPI.Reset()
+	offset := db_connectors.GetPollingOffset()
+	update := telegram_connector.WebhookRequestBody{UpdateID: offset + 5}
+	update.Message.Text = "/start"
+	update.Message.Chat.ID = chatID
+	update.Message.Date = int(time.Now().Unix())
+	testBotAPI.QueueUpdate(update)
+
+	stop := make(chan struct{})
+	if !stopLongPolling(stop, time.Second) {
+		t.Fatalf("Polling without update in progress didn't stop")
+	}
+	newOffset, err := pollUpdatesOnce(offset, 0, stop)
+	if err != nil || newOffset != offset || db_connectors.GetPollingOffset() != offset {
+		t.Errorf("Offset was advanced after polling was stopped: %d, %v", newOffset, err)
+	}
+	if len(testBotAPI.MessagesTo(chatID)) != 0 {
+		t.Errorf("Update was handled after polling was stopped")
+	}
+}
+
+func TestMenuIsFilteredByDietFromSettings(t *testing.T) {
+	chatID := 1028
+	sendUpdate(t, chatID, "/start")
+	settingsUpdate := telegram_connector.WebhookRequestBody{}
+	settingsUpdate.Message.Chat.ID = chatID
+	settingsUpdate.Message.Date = int(time.Now().Unix())
+	settingsUpdate.Message.WebAppData.ButtonText = "Change Settings"
+	settingsUpdate.Message.WebAppData.Data = `{"mensaPreferences":{"reportAtall":false,"weekdayBitmap":62,"fromTime":"00:00","toTime":"23:59"},"points":true,
+		"dietaryPreferences":{"diet":"vegan","noPork":false,"excludedAllergens":["G"]}}`
+	sendUpdateBody(t, settingsUpdate)
+	if overview := lastMessageTo(t, chatID).Text; !strings.Contains(overview, "You only see vegan offers that don't contain Milk") {
+		t.Errorf("Settings overview doesn't show diet: %s", overview)
+	}
+
+	counter, _ := db_connectors.GetMensaMenuCounter()
+	for _, offer := range []db_connectors.DBOfferInformation{
+		{Title: "Angebot 1", Description: "Schweineschnitzel", Labels: []string{mensa_scraper.LABEL_PORK}},
+		{Title: "Angebot 4", Description: "Mini-Kartoffelklöße", Labels: []string{mensa_scraper.LABEL_VEGAN}},
+	} {
+		offer.Time = getNoonOfToday()
+		offer.Counter = counter + 1
+		offer.MensaID = mensas.DEFAULT_MENSA_ID
+		db_connectors.InsertMensaMenu(&offer)
+	}
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "Menu?")
+	menuMessage := lastMessageTo(t, chatID).Text
+	if strings.Contains(menuMessage, "Schweineschnitzel") || !strings.Contains(menuMessage, "Mini-Kartoffelklöße") {
+		t.Errorf("Menu wasn't filtered for vegan user: %s", menuMessage)
+	}
+}
+
+func TestMenuDaysAreParsed(t *testing.T) {
+	wednesday := time.Date(2023, 2, 22, 12, 0, 0, 0, utils.GetLocalLocation())
+	for dayName, expectedDate := range map[string]string{
+		"":          "2023-02-22",
+		"tomorrow":  "2023-02-23",
+		"Wednesday": "2023-02-22",
+		"tue":       "2023-02-28",
+		"monday":    "2023-02-27",
+	} {
+		day, isDay := getMenuDay(dayName, wednesday)
+		if !isDay || day.Format("2006-01-02") != expectedDate {
+			t.Errorf("%q was parsed as %s, expected %s", dayName, day.Format("2006-01-02"), expectedDate)
+		}
+	}
+	for _, dayName := range []string{"mo", "someday"} {
+		if _, isDay := getMenuDay(dayName, wednesday); isDay {
+			t.Errorf("%q was parsed as a day", dayName)
+		}
+	}
+	if week := getWeekOf(wednesday); week.Format("2006-01-02") != "2023-02-20" {
+		t.Errorf("Week of wednesday starts at %s", week.Format("2006-01-02"))
+	}
+	if week := getWeekOf(wednesday.AddDate(0, 0, 3)); week.Format("2006-01-02") != "2023-02-27" {
+		t.Errorf("On saturdays the week should be the next one, got %s", week.Format("2006-01-02"))
+	}
+}
+
+func TestMenuOfTomorrowSkipsClosedWeekend(t *testing.T) {
+	chatID := 1034
+	sendUpdate(t, chatID, "/start")
+	friday := time.Date(2023, 3, 10, 12, 0, 0, 0, utils.GetLocalLocation())
+	counter, _ := db_connectors.GetMensaMenuCounter()
+	for _, offer := range []db_connectors.DBOfferInformation{
+		{Title: "Angebot 1", Description: "Montagsgulasch", Date: "2023-03-13", Counter: counter + 1},
+		{Title: "Tagesangebot", Description: "Samstagssuppe", Date: "2023-03-18", Counter: counter + 2},
+	} {
+		offer.Time = friday
+		offer.MensaID = mensas.DEFAULT_MENSA_ID
+		db_connectors.InsertMensaMenu(&offer)
+	}
+
+	message := getMenuMessageOfTomorrow(chatID, friday)
+	if !strings.Contains(message, "closed tomorrow") || !strings.Contains(message, "Montagsgulasch") {
+		t.Errorf("Menu of tomorrow on friday doesn't skip to monday: %s", message)
+	}
+	// Saturdays with a menu are shown as they are
+	message = getMenuMessageOfTomorrow(chatID, friday.AddDate(0, 0, 7))
+	if strings.Contains(message, "closed") || !strings.Contains(message, "Samstagssuppe") {
+		t.Errorf("Menu of saturday with offers wasn't shown: %s", message)
+	}
+}
+
+func TestMenusOfOtherDaysCanBeRequested(t *testing.T) {
+	chatID := 1029
+	sendUpdate(t, chatID, "/start")
+	now := time.Now().In(utils.GetLocalLocation())
+	nextWeek := getWeekOf(now).AddDate(0, 0, 7)
+	counter, _ := db_connectors.GetMensaMenuCounter()
+	for _, offer := range []db_connectors.DBOfferInformation{
+		{Title: "Angebot 1", Description: "Morgiges Gulasch", Date: now.AddDate(0, 0, 1).Format("2006-01-02"), Counter: counter + 1},
+		{Title: "Angebot 1", Description: "Nächstwöchige Nudeln", Date: nextWeek.Format("2006-01-02"), Counter: counter + 2},
+	} {
+		offer.Time = now
+		offer.MensaID = mensas.DEFAULT_MENSA_ID
+		db_connectors.InsertMensaMenu(&offer)
+	}
+	testBotAPI.Reset()
+
+	sendUpdate(t, chatID, "Menu tomorrow?")
+	if message := lastMessageTo(t, chatID).Text; !strings.Contains(message, "Morgiges Gulasch") {
+		t.Errorf("Menu of tomorrow wasn't sent: %s", message)
+	}
+	if now.Weekday() >= time.Tuesday && now.Weekday() <= time.Friday {
+		// Otherwise the next monday isn't in the next week
+		sendUpdate(t, chatID, "/menu monday")
+		if message := lastMessageTo(t, chatID).Text; !strings.Contains(message, "Nächstwöchige Nudeln") {
+			t.Errorf("Menu of weekday wasn't sent: %s", message)
+		}
+	}
+
+	sendUpdate(t, chatID, "Menu this week?")
+	weekView := lastMessageTo(t, chatID)
+	if weekView.ReplyMarkup == nil || len(weekView.ReplyMarkup.InlineKeyboard) != 2 || len(weekView.ReplyMarkup.InlineKeyboard[0]) != 5 {
+		t.Fatalf("Week view doesn't have buttons for weekdays and weeks: %v", weekView.ReplyMarkup)
+	}
+	nextWeekButton := weekView.ReplyMarkup.InlineKeyboard[1][0]
+	if nextWeekButton.Text != "Next week »" {
+		t.Fatalf("Expected a button for next week, got %s", nextWeekButton.Text)
+	}
+	pressInlineButton(t, chatID, weekView.MessageID, nextWeekButton.CallbackData, now)
+	edits := testBotAPI.Edits()
+	if len(edits) == 0 || !strings.Contains(edits[len(edits)-1].Text, "Nächstwöchige Nudeln") {
+		t.Fatalf("Week view didn't switch to next week: %v", edits)
+	}
+	if edits[len(edits)-1].ReplyMarkup.InlineKeyboard[1][0].Text != "« This week" {
+		t.Errorf("Week view of next week can't go back to this week")
+	}
+}
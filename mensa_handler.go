@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensas"
 	"github.com/ADimeo/MensaQueueBot/utils"
 	"go.uber.org/zap"
 )
@@ -21,3 +22,8 @@ func ABTestHandler(userID int) {
 	}
 
 }
+
+// getUsersMensa returns the home mensa of the given user
+func getUsersMensa(chatID int) mensas.Mensa {
+	return mensas.GetMensaOrDefault(db_connectors.GetUserMensaID(chatID))
+}
@@ -0,0 +1,104 @@
+package mensa_scraper
+
+/*
+Filters menus by the dietary preferences of users, see db_connectors.DietaryPreferences.
+
+Only some sources know labels and allergens, see offer_details.go. If a menu has none at
+all we can't tell what fits a diet, so users get the whole menu instead of an empty one.
+*/
+
+import (
+	"strings"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+)
+
+/*
+Allergens that are also listed under a more specific code, e.g. wheat instead of gluten.
+Users that exclude an allergen also exclude its specific codes
+*/
+var ALLERGEN_SUBCODES = map[string][]string{
+	// Grains that contain gluten
+	"A": {"Wei", "Rog", "Ger", "Haf", "Din", "Kam"},
+	// Tree nuts
+	"H": {"Man", "Has", "Wal", "Kas", "Pek", "Par", "Pis", "Mac"},
+}
+
+// canEat returns true if the offer fits the dietary preferences of the user
+func canEat(preferences db_connectors.DietaryPreferences, offer db_connectors.DBOfferInformation) bool {
+	switch preferences.Diet {
+	case db_connectors.DIET_VEGAN:
+		if !offer.HasLabel(LABEL_VEGAN) {
+			return false
+		}
+	case db_connectors.DIET_VEGETARIAN:
+		if !offer.HasLabel(LABEL_VEGAN) && !offer.HasLabel(LABEL_VEGETARIAN) {
+			return false
+		}
+	}
+	if preferences.NoPork && offer.HasLabel(LABEL_PORK) {
+		return false
+	}
+	for _, allergen := range preferences.ExcludedAllergens {
+		if offer.ContainsAllergen(allergen) {
+			return false
+		}
+		for _, subcode := range ALLERGEN_SUBCODES[allergen] {
+			if offer.ContainsAllergen(subcode) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hasDetails returns true if any offer of the menu has labels or allergens
+func hasDetails(offers []db_connectors.DBOfferInformation) bool {
+	for _, offer := range offers {
+		if len(offer.Labels) > 0 || len(offer.Allergens) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+filterOffers returns the offers that fit the dietary preferences of the user. Returns
+false, and all offers, if the menu doesn't contain what we'd need to filter it
+*/
+func filterOffers(preferences db_connectors.DietaryPreferences, offers []db_connectors.DBOfferInformation) ([]db_connectors.DBOfferInformation, bool) {
+	if !preferences.IsFiltering() || !hasDetails(offers) {
+		return offers, false
+	}
+	var edibleOffers []db_connectors.DBOfferInformation
+	for _, offer := range offers {
+		if canEat(preferences, offer) {
+			edibleOffers = append(edibleOffers, offer)
+		}
+	}
+	return edibleOffers, true
+}
+
+/*
+getEdibleMenuDiff returns what differs between the offers the user can eat in the two
+versions of a menu. Changes to offers the user can't eat don't concern them
+*/
+func getEdibleMenuDiff(preferences db_connectors.DietaryPreferences, previousOffers []db_connectors.DBOfferInformation, latestOffers []db_connectors.DBOfferInformation) MenuDiff {
+	previousEdibleOffers, _ := filterOffers(preferences, previousOffers)
+	latestEdibleOffers, _ := filterOffers(preferences, latestOffers)
+	return diffMenus(previousEdibleOffers, latestEdibleOffers)
+}
+
+// getOfferKey identifies an offer by everything users see of it
+func getOfferKey(offer db_connectors.DBOfferInformation) string {
+	return strings.Join([]string{
+		offer.Title,
+		offer.Description,
+		strings.Join(offer.Labels, ","),
+		strings.Join(offer.Allergens, ","),
+		strings.Join(offer.Additives, ","),
+		formatPrice(offer.StudentPriceInCents),
+		formatPrice(offer.StaffPriceInCents),
+		formatPrice(offer.GuestPriceInCents),
+	}, "\n")
+}
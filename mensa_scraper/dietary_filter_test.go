@@ -0,0 +1,90 @@
+package mensa_scraper
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+)
+
+var testMenu = []db_connectors.DBOfferInformation{
+	{Title: "Angebot 1", Description: "Schnitzel", Labels: []string{LABEL_PORK}, Allergens: []string{"Wei"}},
+	{Title: "Angebot 2", Description: "Bunte Nudeln", Labels: []string{LABEL_VEGETARIAN}, Allergens: []string{"C", "G"}},
+	{Title: "Angebot 4", Description: "Mini-Kartoffelklöße", Labels: []string{LABEL_VEGAN}, Allergens: []string{"Kas"}},
+}
+
+func getTitles(offers []db_connectors.DBOfferInformation) string {
+	var titles []string
+	for _, offer := range offers {
+		titles = append(titles, offer.Title)
+	}
+	return strings.Join(titles, ",")
+}
+
+func TestOffersAreFilteredByDiet(t *testing.T) {
+	cases := []struct {
+		preferences    db_connectors.DietaryPreferences
+		expectedTitles string
+	}{
+		{db_connectors.DietaryPreferences{}, "Angebot 1,Angebot 2,Angebot 4"},
+		{db_connectors.DietaryPreferences{Diet: db_connectors.DIET_VEGETARIAN}, "Angebot 2,Angebot 4"},
+		{db_connectors.DietaryPreferences{Diet: db_connectors.DIET_VEGAN}, "Angebot 4"},
+		{db_connectors.DietaryPreferences{NoPork: true}, "Angebot 2,Angebot 4"},
+		// Wheat contains gluten, cashews are nuts
+		{db_connectors.DietaryPreferences{ExcludedAllergens: []string{"A", "G"}}, "Angebot 4"},
+		{db_connectors.DietaryPreferences{ExcludedAllergens: []string{"H"}}, "Angebot 1,Angebot 2"},
+	}
+	for _, c := range cases {
+		offers, _ := filterOffers(c.preferences, testMenu)
+		if titles := getTitles(offers); titles != c.expectedTitles {
+			t.Errorf("Filtering for %v returned %s, expected %s", c.preferences, titles, c.expectedTitles)
+		}
+	}
+
+	grainsAndNuts := []db_connectors.DBOfferInformation{
+		{Title: "Angebot 1", Description: "Roggenbrot", Labels: []string{LABEL_VEGAN}, Allergens: []string{"Rog"}},
+		{Title: "Angebot 2", Description: "Haferbrei", Labels: []string{LABEL_VEGAN}, Allergens: []string{"Haf"}},
+		{Title: "Angebot 3", Description: "Mandelpudding", Labels: []string{LABEL_VEGAN}, Allergens: []string{"Man"}},
+		{Title: "Angebot 4", Description: "Pistazieneis", Labels: []string{LABEL_VEGAN}, Allergens: []string{"Pis"}},
+	}
+	if offers, _ := filterOffers(db_connectors.DietaryPreferences{ExcludedAllergens: []string{"A"}}, grainsAndNuts); getTitles(offers) != "Angebot 3,Angebot 4" {
+		t.Errorf("Excluding gluten didn't exclude all grains: %s", getTitles(offers))
+	}
+	if offers, _ := filterOffers(db_connectors.DietaryPreferences{ExcludedAllergens: []string{"H"}}, grainsAndNuts); getTitles(offers) != "Angebot 1,Angebot 2" {
+		t.Errorf("Excluding nuts didn't exclude all tree nuts: %s", getTitles(offers))
+	}
+
+	withoutDetails := []db_connectors.DBOfferInformation{{Title: "Angebot 1", Description: "Schnitzel"}}
+	offers, wasFiltered := filterOffers(db_connectors.DietaryPreferences{Diet: db_connectors.DIET_VEGAN}, withoutDetails)
+	if wasFiltered || len(offers) != 1 {
+		t.Errorf("Menu without details was filtered: %v", offers)
+	}
+}
+
+func TestOnlyEdibleChangesConcernUsers(t *testing.T) {
+	vegan := db_connectors.DietaryPreferences{Diet: db_connectors.DIET_VEGAN}
+	soldOutSchnitzel := []db_connectors.DBOfferInformation{testMenu[1], testMenu[2]}
+	if !getEdibleMenuDiff(vegan, testMenu, soldOutSchnitzel).IsEmpty() {
+		t.Errorf("Vegan user is concerned by sold out schnitzel")
+	}
+	if getEdibleMenuDiff(db_connectors.DietaryPreferences{}, testMenu, soldOutSchnitzel).IsEmpty() {
+		t.Errorf("User without diet isn't concerned by sold out schnitzel")
+	}
+	if getEdibleMenuDiff(vegan, testMenu, testMenu[:2]).IsEmpty() {
+		t.Errorf("Vegan user isn't concerned by sold out vegan offer")
+	}
+	if getEdibleMenuDiff(vegan, nil, testMenu).IsEmpty() {
+		t.Errorf("Vegan user isn't concerned by the first menu of the day")
+	}
+}
+
+func TestMenuMessageIsFilteredForUser(t *testing.T) {
+	message := buildMessageFrom("Griebnitzsee", testMenu, db_connectors.DietaryPreferences{Diet: db_connectors.DIET_VEGETARIAN})
+	if strings.Contains(message, "Schnitzel") || !strings.Contains(message, "Bunte Nudeln") || !strings.Contains(message, "Hiding 1 offer that") {
+		t.Errorf("Message wasn't filtered for vegetarians: %s", message)
+	}
+	message = buildMessageFrom("Griebnitzsee", testMenu, db_connectors.DietaryPreferences{ExcludedAllergens: []string{"Wei", "G", "H"}})
+	if !strings.HasPrefix(message, "None of the 3 offers") {
+		t.Errorf("Message doesn't say that nothing fits: %s", message)
+	}
+}
@@ -3,9 +3,13 @@ package mensa_scraper
 import (
 	"errors"
 	"fmt"
+	"html"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensas"
 	"github.com/ADimeo/MensaQueueBot/telegram_connector"
 	"github.com/ADimeo/MensaQueueBot/utils"
 	"github.com/go-co-op/gocron"
@@ -15,10 +19,18 @@ import (
 
 var globalLastInitialMessageCESTMinute int
 
-// Please only modify in scheduleNextInitialMessage
-// Gets overridden regularly
+// How days are shown in menu messages, e.g. "Tuesday, 21.02."
+const MENU_DAY_FORMAT = "Monday, 02.01."
+
+/*
+Runs the next initial message job. Created once by ScheduleDailyInitialMessageJob,
+its single job is replaced by scheduleNextInitialMessage
+*/
 var globalInitialMessageScheduler *gocron.Scheduler
 
+// Needs to be held while the job of globalInitialMessageScheduler is replaced
+var globalInitialMessageSchedulerMutex sync.Mutex
+
 /*
 Responsible for initialising first of two regular jobs.
 "DailyInitialMessageJob" sends the initial message to users,
@@ -30,6 +42,9 @@ for when it should next run, and schedules a new task for that point in time.
 
 */
 func ScheduleDailyInitialMessageJob() {
+	globalInitialMessageScheduler = gocron.NewScheduler(utils.GetLocalLocation())
+	globalInitialMessageScheduler.StartAsync()
+
 	nowInUTC := time.Now().UTC()
 	nowInLocal := nowInUTC.In(utils.GetLocalLocation())
 
@@ -71,7 +86,14 @@ since underlying functions should be idempotent if run at the same time with
 the same db state
 */
 func RescheduleNextInitialMessageJobIfNeeded(insertedTimeStringInCEST string) {
-	if globalInitialMessageScheduler.Len() == 0 {
+	if globalInitialMessageScheduler == nil {
+		// Not scheduled yet, ScheduleDailyInitialMessageJob will take the new settings into account
+		return
+	}
+	globalInitialMessageSchedulerMutex.Lock()
+	jobs := globalInitialMessageScheduler.Jobs()
+	globalInitialMessageSchedulerMutex.Unlock()
+	if len(jobs) == 0 {
 		// Scheduler has no jobs at all
 		// This should not happen, but let's schedule a job to fix it
 		zap.S().Error("Initial job scheduler had no jobs during settings change")
@@ -82,7 +104,7 @@ func RescheduleNextInitialMessageJobIfNeeded(insertedTimeStringInCEST string) {
 		return
 	}
 
-	nextInitialJob := globalInitialMessageScheduler.Jobs()[0]
+	nextInitialJob := jobs[0]
 	jobTimeInCEST := nextInitialJob.ScheduledAtTime() // Returns 10:00 string
 	jobTimeAsTime, _ := time.Parse("15:04", jobTimeInCEST)
 	newTimeAsTime, _ := time.Parse("15:04", insertedTimeStringInCEST)
@@ -102,7 +124,6 @@ func RescheduleNextInitialMessageJobIfNeeded(insertedTimeStringInCEST string) {
 			zap.S().Info("Rescheduling initial menu job during settings change")
 			// This is would be the next job for today,
 			// We need to reschedule
-			globalInitialMessageScheduler.Clear()
 			nowCESTMinute := nowInCEST.Hour()*60 + nowInCEST.Minute()
 			scheduleNextInitialMessage(nowInUTC, nowCESTMinute)
 		}
@@ -129,11 +150,16 @@ func scheduleNextInitialMessage(nowInUTC time.Time, nowCESTMinute int) error {
 	cestMinutesForJob := cestMinuteForNextJob % 60
 	timestampString := fmt.Sprintf("%02d:%02d", cestHoursForJob, cestMinutesForJob)
 
-	globalInitialMessageScheduler = gocron.NewScheduler(utils.GetLocalLocation())
-	globalInitialMessageScheduler.Every(1).Day().At(timestampString).LimitRunsTo(1).Do(initialMessageJob)
+	// Replaces the previous job, which may be the one calling this
+	globalInitialMessageSchedulerMutex.Lock()
+	globalInitialMessageScheduler.Clear()
+	_, err = globalInitialMessageScheduler.Every(1).Day().At(timestampString).LimitRunsTo(1).Do(initialMessageJob)
+	globalInitialMessageSchedulerMutex.Unlock()
+	if err != nil {
+		zap.S().Error("Couldn't schedule next initial messages", err)
+		return err
+	}
 	zap.S().Infof("Next initial message scheduled for %s", timestampString)
-
-	globalInitialMessageScheduler.StartAsync()
 	return nil
 }
 
@@ -152,71 +178,220 @@ func sendInitialMessagesThatShouldBeSentAt(nowInUTC time.Time, nowCESTMinute int
 		return err
 	}
 
-	return sendLatestMenuToUsers(users)
+	return sendLatestMenuToUsers(users, telegram_connector.QueueMessage)
 }
 
 /*
-SendLatestMenuToUsersCurrentlyListening gets a list of all users which want to be advised about a mensa change right now,
-and sends them a message of the current menu.
+SendMenuChangeToUsersCurrentlyListening gets a list of all users of the given mensa which want to be advised
+about a mensa change right now, and tells them what changed since the previous version of todays menu.
 Via the queries this calls it keeps in mind additional requirements (weekday, send at all flag),
-previously reported on this date)
+previously reported on this date). Users only get the message if an offer they can eat changed,
+see getEdibleMenuDiff. For the first menu of the day they get the full menu instead
 */
-func SendLatestMenuToUsersCurrentlyListening() error {
+func SendMenuChangeToUsersCurrentlyListening(mensaID string) error {
 	// Called by menu scraper
 	nowInUTC := time.Now().UTC()
-	idsOfInterestedUsers, err := db_connectors.GetUsersToSendMenuToByTimestamp(nowInUTC)
+	idsOfInterestedUsers, err := db_connectors.GetUsersToSendMenuToByTimestamp(nowInUTC, mensaID)
+	if err != nil {
+		return err
+	}
+	todayString := nowInUTC.In(utils.GetLocalLocation()).Format("2006-01-02")
+	latestOffers, err := db_connectors.GetLatestMensaOffersOfDate(mensaID, todayString)
+	if err != nil {
+		return err
+	}
+	previousOffers, err := db_connectors.GetPreviousMensaOffersOfDate(mensaID, todayString)
 	if err != nil {
 		return err
 	}
-	return sendLatestMenuToUsers(idsOfInterestedUsers)
+	mensa := mensas.GetMensaOrDefault(mensaID)
+
+	var idsOfUsersWithoutMenu []int
+	var errorsForAllSends error
+	for _, userID := range idsOfInterestedUsers {
+		preferences, err := db_connectors.GetDietaryPreferences(userID)
+		if err != nil {
+			zap.S().Warnw("Sending unfiltered menu change", "error", err)
+		}
+		diff := getEdibleMenuDiff(preferences, previousOffers, latestOffers)
+		if diff.IsEmpty() {
+			continue
+		}
+		if len(previousOffers) == 0 {
+			// Nothing to compare to, so users get to see the whole menu
+			idsOfUsersWithoutMenu = append(idsOfUsersWithoutMenu, userID)
+			continue
+		}
+		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PUSH_MESSAGE, userID)
+		if err = telegram_connector.QueueMessage(userID, buildMenuChangeMessage(mensa.Name, diff), keyboardIdentifier); err != nil {
+			errorsForAllSends = multierror.Append(errorsForAllSends, err)
+		}
+	}
+	if len(idsOfUsersWithoutMenu) > 0 {
+		if err := sendLatestMenuOfMensaToUsers(mensa, idsOfUsersWithoutMenu, telegram_connector.QueueMessage); err != nil {
+			errorsForAllSends = multierror.Append(errorsForAllSends, err)
+		}
+	}
+	return errorsForAllSends
 }
 
 /*
-SendLatestMenuToSingleUser sends tha most recently added menu to the given user
-
+SendLatestMenuToSingleUser sends tha most recently added menu of the users mensa to the given user
+Used for replies, so the menu is sent right away instead of being queued
 */
 func SendLatestMenuToSingleUser(userID int) error {
 	sliceOfUserID := []int{userID}
 
-	return sendLatestMenuToUsers(sliceOfUserID)
+	return sendLatestMenuToUsers(sliceOfUserID, telegram_connector.SendMessage)
 }
 
-func sendLatestMenuToUsers(idsOfInterestedUsers []int) error {
+// messageSender is either telegram_connector.SendMessage or telegram_connector.QueueMessage
+type messageSender func(chatID int, message string, keyboardIdentifier telegram_connector.KeyboardIdentifier) error
+
+/*
+sendLatestMenuToUsers sends each user the latest menu of their own mensa. Pushes to
+many users should use telegram_connector.QueueMessage as send, to respect rate limits
+*/
+func sendLatestMenuToUsers(idsOfInterestedUsers []int, send messageSender) error {
 	if len(idsOfInterestedUsers) == 0 {
 		zap.S().Infof("Tried to send latest menu to empty list of users")
 		return nil
 	}
-	latestOffersInDB, err := db_connectors.GetLatestMensaOffersFromToday()
+	usersByMensaID := make(map[string][]int)
+	for _, userID := range idsOfInterestedUsers {
+		mensaID := db_connectors.GetUserMensaID(userID)
+		usersByMensaID[mensaID] = append(usersByMensaID[mensaID], userID)
+	}
+
+	var errorsForAllSends error
+	for mensaID, usersOfMensa := range usersByMensaID {
+		mensa := mensas.GetMensaOrDefault(mensaID)
+		if !mensa.HasMenuSource() {
+			// Users of mensas without menus only get queue reports
+			continue
+		}
+		if err := sendLatestMenuOfMensaToUsers(mensa, usersOfMensa, send); err != nil {
+			errorsForAllSends = multierror.Append(errorsForAllSends, err)
+		}
+	}
+	return errorsForAllSends
+}
+
+func sendLatestMenuOfMensaToUsers(mensa mensas.Mensa, idsOfInterestedUsers []int, send messageSender) error {
+	latestOffersInDB, err := db_connectors.GetLatestMensaOffersFromToday(mensa.ID)
 	if err != nil {
 		return err
 	}
 	if len(latestOffersInDB) == 0 {
 		return errors.New("No menu from today available")
 	}
-	formattedMessage := buildMessageFrom(latestOffersInDB)
 
 	var errorsForAllSends error
 	for _, userID := range idsOfInterestedUsers {
+		preferences, err := db_connectors.GetDietaryPreferences(userID)
+		if err != nil {
+			// Better too many offers than none
+			zap.S().Warnw("Sending unfiltered menu", "error", err)
+		}
+		formattedMessage := buildMessageFrom(mensa.Name, latestOffersInDB, preferences)
 		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PUSH_MESSAGE, userID)
-		if err = telegram_connector.SendMessage(userID, formattedMessage, keyboardIdentifier); err != nil {
+		if err = send(userID, formattedMessage, keyboardIdentifier); err != nil {
 			errorsForAllSends = multierror.Append(errorsForAllSends, err)
 		}
 	}
 	return errorsForAllSends
 }
 
-func buildMessageFrom(offerSlice []db_connectors.DBOfferInformation) string {
+/*
+GetMenuMessageOfDay returns the latest menu of the users mensa on the day of the given time,
+filtered by their dietary preferences. Returns false if we don't know the menu of that day
+*/
+func GetMenuMessageOfDay(userID int, day time.Time) (string, bool, error) {
+	mensa := mensas.GetMensaOrDefault(db_connectors.GetUserMensaID(userID))
+	offers, err := db_connectors.GetLatestMensaOffersOfDate(mensa.ID, day.Format("2006-01-02"))
+	if err != nil {
+		return "", false, err
+	}
+	if len(offers) == 0 {
+		return "", false, nil
+	}
+	preferences, err := db_connectors.GetDietaryPreferences(userID)
+	if err != nil {
+		zap.S().Warnw("Sending unfiltered menu", "error", err)
+	}
+	header := fmt.Sprintf("<b>%s Menu for %s:</b>\n", html.EscapeString(mensa.Name), day.Format(MENU_DAY_FORMAT))
+	return buildMenuMessage(header, mensa.Name, offers, preferences), true, nil
+}
+
+/*
+buildMessageFrom builds the message with the current menu of a single user, which only
+contains the offers that fit their dietary preferences
+*/
+func buildMessageFrom(mensaName string, offerSlice []db_connectors.DBOfferInformation, preferences db_connectors.DietaryPreferences) string {
 	if len(offerSlice) == 0 {
-		return "Griebnitzsee currently offers no menus"
+		return mensaName + " currently offers no menus"
+	}
+	return buildMenuMessage("<b>Current "+html.EscapeString(mensaName)+" Menu:</b>\n", mensaName, offerSlice, preferences)
+}
+
+/*
+buildMenuMessage lists the offers that fit the dietary preferences below the given header.
+Messages are sent as HTML, so everything we got from upstream is escaped
+*/
+func buildMenuMessage(baseMessage string, mensaName string, offerSlice []db_connectors.DBOfferInformation, preferences db_connectors.DietaryPreferences) string {
+	edibleOffers, wasFiltered := filterOffers(preferences, offerSlice)
+	if len(edibleOffers) == 0 {
+		return fmt.Sprintf("None of the %d offers at %s fit your diet 😔", len(offerSlice), html.EscapeString(mensaName))
 	}
 
-	baseMessage := "<b>Current Griebnitzsee Menu:</b>\n"
 	baseForSingleOffer := "<i>%s:</i> %s\n"
 
 	actualMessage := "" + baseMessage
 
-	for _, offer := range offerSlice {
-		actualMessage = actualMessage + fmt.Sprintf(baseForSingleOffer, offer.Title, offer.Description)
+	for _, offer := range edibleOffers {
+		actualMessage = actualMessage + fmt.Sprintf(baseForSingleOffer, html.EscapeString(offer.Title), html.EscapeString(offer.Description)+getLabelIcons(offer))
+		actualMessage = actualMessage + getDetailLines(offer)
+	}
+	if hiddenOffers := len(offerSlice) - len(edibleOffers); wasFiltered && hiddenOffers == 1 {
+		actualMessage = actualMessage + "<i>Hiding 1 offer that doesn't fit your diet</i>\n"
+	} else if wasFiltered && hiddenOffers > 1 {
+		actualMessage = actualMessage + fmt.Sprintf("<i>Hiding %d offers that don't fit your diet</i>\n", hiddenOffers)
+	} else if !wasFiltered && preferences.IsFiltering() {
+		actualMessage = actualMessage + "<i>I don't know which of these offers fit your diet</i>\n"
 	}
 	return actualMessage
 }
+
+// getLabelIcons returns the icons of all labels of the offer, see LABEL_ICONS
+func getLabelIcons(offer db_connectors.DBOfferInformation) string {
+	icons := ""
+	for _, labelIcon := range LABEL_ICONS {
+		if offer.HasLabel(labelIcon.Label) {
+			icons += labelIcon.Icon
+		}
+	}
+	if icons == "" {
+		return ""
+	}
+	return " " + icons
+}
+
+// getDetailLines returns lines for prices, allergens and additives of the offer, as far as we know them
+func getDetailLines(offer db_connectors.DBOfferInformation) string {
+	detailLines := ""
+	if offer.StudentPriceInCents > 0 {
+		detailLines += "💶 " + formatPrice(offer.StudentPriceInCents)
+		if offer.StaffPriceInCents > 0 && offer.GuestPriceInCents > 0 {
+			detailLines += fmt.Sprintf(" (staff %s, guests %s)", formatPrice(offer.StaffPriceInCents), formatPrice(offer.GuestPriceInCents))
+		}
+		detailLines += "\n"
+	}
+	// Unknown codes are shown as we got them
+	if len(offer.Allergens) > 0 {
+		detailLines += "⚠️ Contains " + html.EscapeString(strings.Join(getNames(offer.Allergens, ALLERGEN_NAMES), ", ")) + "\n"
+	}
+	if len(offer.Additives) > 0 {
+		detailLines += "🧪 " + html.EscapeString(strings.Join(getNames(offer.Additives, ADDITIVE_NAMES), ", ")) + "\n"
+	}
+	return detailLines
+}
@@ -1,162 +1,164 @@
 package mensa_scraper
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"time"
 
 	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensas"
 	"github.com/ADimeo/MensaQueueBot/utils"
 	"github.com/go-co-op/gocron"
 	"go.uber.org/zap"
 )
 
-const MENSA_URL string = "https://swp.webspeiseplan.de/index.php?token=55ed21609e26bbf68ba2b19390bf7961&model=menu&location=9601&languagetype=1&_=1696321056188" // Please be static token, pleeaaaaase!
-const MENSA_TITLE_URL string = "https://swp.webspeiseplan.de/index.php?token=55ed21609e26bbf68ba2b19390bf7961&model=mealCategory&location=9601&languagetype=1&_=1696589384933"
-
-// Structs for representing the menu/title in json
-type EssensTitle struct {
-	Name                string `json:"name"`
-	GerichtskategorieID int    `json:"gerichtkategorieID"`
-}
-
-type EssensTitleRoot struct {
-	Success bool          `json:"success"`
-	Content []EssensTitle `json:"content"`
-}
-
-type SpeiseplanAdvancedGericht struct {
-	Aktiv              bool   `json:"aktiv"`
-	Datum              string `json:"datum"`
-	GerichtKategorieID int    `json:"gerichtkategorieID"`
-	Gerichtname        string `json:"gerichtname"`
-	GerichtTitle       string `json:"enrichThisManually,omitempty"` // Enriched manually
-}
-
-type SpeiseplanAdvancedGerichtData struct {
-	Gericht SpeiseplanAdvancedGericht `json:"SpeiseplanAdvancedGericht"`
-}
-
-// This contains two objects, one for each week - but we only need the Gericht
-type SpeiseplanWeek struct {
-	SpeiseplanGerichtData []SpeiseplanAdvancedGerichtData `json:"speiseplanGerichtData"`
-}
-
-type MenuRoot struct {
-	Success bool             `json:"success"`
-	Content []SpeiseplanWeek `json:"content"`
-}
+// Runs ScrapeAndAdviseUsers, see ScheduleScrapeJob
+var globalScrapeScheduler *gocron.Scheduler
 
 func ScheduleScrapeJob() {
-	schedulerInMensaTimezone := gocron.NewScheduler(utils.GetLocalLocation())
+	globalScrapeScheduler = gocron.NewScheduler(utils.GetLocalLocation())
 	cronBaseSyntax := "*/10 %d-%d * * 1-5" // Run every 10 minutes, every weekday, between two timestamps
-	// which should be filled in from mensa opening and closing time
-
-	mensaOpeningHours := utils.GetMensaOpeningTime().Hour()
-	mensaClosingHours := utils.GetMensaClosingTime().Hour()
+	// which should be filled in from the earliest opening and the latest closing time of mensas with menus
+
+	today := time.Now()
+	mensaOpeningHours := 23
+	mensaClosingHours := 0
+	for _, mensa := range mensas.GetAllMensas() {
+		if !mensa.HasMenuSource() {
+			continue
+		}
+		if openingHour := mensa.GetOpeningTime(today).Hour(); openingHour < mensaOpeningHours {
+			mensaOpeningHours = openingHour
+		}
+		if closingHour := mensa.GetClosingTime(today).Hour(); closingHour > mensaClosingHours {
+			mensaClosingHours = closingHour
+		}
+	}
 	formattedCronString := fmt.Sprintf(cronBaseSyntax, mensaOpeningHours, mensaClosingHours)
 
 	if utils.IsInDebugMode() {
 		formattedCronString = "*/1 * * * *"
 	}
-	schedulerInMensaTimezone.Cron(formattedCronString).Do(ScrapeAndAdviseUsers)
+	globalScrapeScheduler.Cron(formattedCronString).Do(ScrapeAndAdviseUsers)
 
-	schedulerInMensaTimezone.StartAsync()
-	// Don't need to care about shutdown, shutdown happens when the container shuts down,
-	// and startup happens when the container starts up
+	globalScrapeScheduler.StartAsync()
+	// Stopped via StopScheduledJobs
+}
 
+/*
+StopScheduledJobs stops the scrape job and the initial message job, and waits for up to
+timeout for runs of them that are in progress. Returns false if they didn't finish in time
+*/
+func StopScheduledJobs(timeout time.Duration) bool {
+	jobsStopped := make(chan struct{})
+	go func() {
+		// Stop waits for running jobs
+		if globalScrapeScheduler != nil {
+			globalScrapeScheduler.Stop()
+		}
+		if globalInitialMessageScheduler != nil {
+			globalInitialMessageScheduler.Stop()
+		}
+		close(jobsStopped)
+	}()
+	select {
+	case <-jobsStopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 func ScrapeAndAdviseUsers() {
 	zap.S().Info("Running mensa scrape job")
-	shouldUsersBeNotified := scrapeAndInsertIfMensaMenuIsOld()
-	if shouldUsersBeNotified {
-		err := SendLatestMenuToUsersCurrentlyListening()
-		if err != nil {
-			zap.S().Error("Couldn't send menu to interested users", err)
+	for _, mensa := range mensas.GetAllMensas() {
+		if !mensa.HasMenuSource() {
+			continue
+		}
+		shouldUsersBeNotified := scrapeAndInsertIfMensaMenuIsOld(mensa)
+		if shouldUsersBeNotified {
+			err := SendMenuChangeToUsersCurrentlyListening(mensa.ID)
+			if err != nil {
+				zap.S().Errorw("Couldn't send menu to interested users", "mensaID", mensa.ID, "error", err)
+			}
 		}
 	}
 }
 
-// Returns true if something was inserted
-func scrapeAndInsertIfMensaMenuIsOld() bool {
-	menu, err := getMensaMenuFromWeb()
+/*
+Stores the menus of today and all upcoming days the menu source knows. Each date gets
+a new version if its menu changed. Returns true if the menu of today changed, since
+users are only notified about those changes
+*/
+func scrapeAndInsertIfMensaMenuIsOld(mensa mensas.Mensa) bool {
+	menuProvider, err := getMenuProviderOf(mensa)
 	if err != nil {
-		zap.S().Errorf("Can't get menu from interweb", err)
+		zap.S().Errorw("Can't scrape menu", "mensaID", mensa.ID, "error", err)
 		return false
 	}
 	today := time.Now().In(utils.GetLocalLocation())
-	mealsForToday := getMealsForToday(menu, today)
-	if len(mealsForToday) == 0 {
-		zap.S().Errorf("Can't find meals for today", err)
+	upcomingOffers, err := menuProvider.GetUpcomingOffers(today)
+	if err != nil {
+		zap.S().Errorf("Can't get menu from interweb", err)
 		return false
 	}
-	todaysInformationWithTitles, err := enrichWithTitleData(mealsForToday)
-
-	if isDateInformationFresh(todaysInformationWithTitles) {
-		zap.S().Debug("Mensa menu is stale")
-		// No changes in menu, nothing to insert or do.
+	if len(upcomingOffers) == 0 {
+		zap.S().Errorf("Can't find meals for today or upcoming days")
 		return false
 	}
-	insertDateOffersIntoDBWithFreshCounter(today, todaysInformationWithTitles)
-	zap.S().Debug("Succesfully inserted new menu into DB")
-	return true
-}
-
-func enrichWithTitleData(todaysInformation []SpeiseplanAdvancedGericht) ([]SpeiseplanAdvancedGericht, error) {
-	mensaEnrichmentClient := &http.Client{}
-	mensaEnrichmentRequest, _ := http.NewRequest("GET", MENSA_TITLE_URL, nil)
-	mensaEnrichmentRequest.Header.Set("Referer", "https://swp.webspeiseplan.de/Menu")
-
-	response, err := mensaEnrichmentClient.Do(mensaEnrichmentRequest)
-
-	if err != nil {
-		zap.S().Warn("Can't reach json with meal<->Essen N mapping. Is their service down?", err)
-		return todaysInformation, err
-	}
-
-	defer response.Body.Close()
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		zap.S().Warn("Can't read json with meal<-> essen mapping. Is their service working?", err)
-		return todaysInformation, err
-	}
 
-	titleRoot, err := parseTitleJSON(body)
-	if err != nil {
-		zap.S().Error("Can't parse title json. Did the format change?", err)
-		return todaysInformation, err
+	todayString := today.Format("2006-01-02")
+	insertedToday := false
+	dates, offersByDate := groupOffersByDate(upcomingOffers)
+	for _, date := range dates {
+		if isDateInformationFresh(mensa.ID, date, offersByDate[date]) {
+			// No changes in menu, nothing to insert or do.
+			continue
+		}
+		insertDateOffersIntoDBWithFreshCounter(mensa.ID, today, offersByDate[date])
+		zap.S().Debugw("Succesfully inserted new menu into DB", "mensaID", mensa.ID, "date", date)
+		if date == todayString {
+			insertedToday = true
+		}
 	}
+	return insertedToday
+}
 
-	for index, meal := range todaysInformation {
-		mealID := meal.GerichtKategorieID
-
-		for _, titleObject := range titleRoot.Content {
-			if titleObject.GerichtskategorieID == mealID {
-				meal.GerichtTitle = titleObject.Name
-				todaysInformation[index] = meal
-				break
-			}
+// groupOffersByDate returns the dates of the given offers in the order they appear in, and the offers of each date
+func groupOffersByDate(offers []MenuOffer) ([]string, map[string][]MenuOffer) {
+	var dates []string
+	offersByDate := make(map[string][]MenuOffer)
+	for _, offer := range offers {
+		if _, found := offersByDate[offer.Date]; !found {
+			dates = append(dates, offer.Date)
 		}
+		offersByDate[offer.Date] = append(offersByDate[offer.Date], offer)
 	}
-	return todaysInformation, nil
+	return dates, offersByDate
 }
 
-func insertDateOffersIntoDBWithFreshCounter(scrapeTimestamp time.Time, todaysInformationWithTitles []SpeiseplanAdvancedGericht) {
+// Inserts the offers of a single date as a new version of the menu of that date
+func insertDateOffersIntoDBWithFreshCounter(mensaID string, scrapeTimestamp time.Time, dateOffers []MenuOffer) {
 	counterValue, err := db_connectors.GetMensaMenuCounter()
 	if err != nil {
 		zap.S().Error("Couldn't insert new menus: Unable to get counter value", err)
 		return
 	}
 
-	for _, downOffer := range todaysInformationWithTitles {
+	for _, downOffer := range dateOffers {
 		offerToInsert := new(db_connectors.DBOfferInformation)
 		offerToInsert.Counter = counterValue + 1
-		offerToInsert.Title = downOffer.GerichtTitle
-		offerToInsert.Description = downOffer.Gerichtname
+		offerToInsert.Title = downOffer.Title
+		offerToInsert.Description = downOffer.Description
+		offerToInsert.Labels = downOffer.Labels
+		offerToInsert.Allergens = downOffer.Allergens
+		offerToInsert.Additives = downOffer.Additives
+		offerToInsert.StudentPriceInCents = downOffer.StudentPriceInCents
+		offerToInsert.StaffPriceInCents = downOffer.StaffPriceInCents
+		offerToInsert.GuestPriceInCents = downOffer.GuestPriceInCents
 		offerToInsert.Time = scrapeTimestamp
+		offerToInsert.Date = downOffer.Date
+		offerToInsert.MensaID = mensaID
+		offerToInsert.Source = downOffer.Source
 
 		// Few enough that not batching is fine, I think
 		// But batching this is something we could do
@@ -164,16 +166,33 @@ func insertDateOffersIntoDBWithFreshCounter(scrapeTimestamp time.Time, todaysInf
 	}
 }
 
-// Return true if the offers within this date information are the same as the
-// ones we last stored in the DB
-func isDateInformationFresh(mealsForToday []SpeiseplanAdvancedGericht) bool {
+/*
+Return true if the offers within this date information are the same as the
+ones we last stored in the DB for that mensa and date.
+Sources differ in details like labels and prices, so we compare with the last version
+from the same source. If we never got that date from this source we compare with the
+last version of any source, but only by title and description. That way a source
+going down and the next one taking over doesn't count as a change
+*/
+func isDateInformationFresh(mensaID string, date string, mealsForToday []MenuOffer) bool {
 	// Query DB for latest menus
-	dbOffers, err := db_connectors.GetLatestMensaOffersFromToday()
+	source := mealsForToday[0].Source
+	dbOffers, err := db_connectors.GetLatestMensaOffersOfDateFromSource(mensaID, date, source)
+	compareDetails := true
+	if err == nil && len(dbOffers) == 0 {
+		dbOffers, err = db_connectors.GetLatestMensaOffersOfDate(mensaID, date)
+		compareDetails = false
+	}
 	if err != nil {
 		zap.S().Errorf("Can not determine freshness of queried menu, defaulting to don't insert", err)
 		return true
 
 	}
+	return isSameMenu(dbOffers, mealsForToday, compareDetails)
+}
+
+// isSameMenu returns true if both contain the same offers, in any order. Details are only compared if compareDetails is set
+func isSameMenu(dbOffers []db_connectors.DBOfferInformation, mealsForToday []MenuOffer, compareDetails bool) bool {
 	if len(mealsForToday) != len(dbOffers) {
 		return false
 	}
@@ -186,10 +205,10 @@ func isDateInformationFresh(mealsForToday []SpeiseplanAdvancedGericht) bool {
 	// that is more complicated than necessary.
 	for downIndex, downOffer := range mealsForToday {
 		for dbIndex, dbOffer := range dbOffers {
-			if dbOffer.Title == downOffer.GerichtTitle &&
-				dbOffer.Description == downOffer.Gerichtname {
-				dbDayString := dbOffer.Time.Format("2006-01-02")
-				if dbDayString == downOffer.Datum {
+			if dbOffer.Title == downOffer.Title &&
+				dbOffer.Description == downOffer.Description &&
+				(!compareDetails || hasSameDetails(dbOffer, downOffer)) {
+				if dbOffer.Date == downOffer.Date {
 					// Elements are the same, including dates.
 					// Mark this by marking true/deleting element.
 					// We don't want to delete elements of the array
@@ -199,6 +218,7 @@ func isDateInformationFresh(mealsForToday []SpeiseplanAdvancedGericht) bool {
 					// Yes, this is not elegant.
 					comparisonResultsSlice[downIndex] = true
 					dbOffers = append(dbOffers[:dbIndex], dbOffers[dbIndex+1:]...)
+					break
 				}
 			}
 		}
@@ -214,69 +234,24 @@ func isDateInformationFresh(mealsForToday []SpeiseplanAdvancedGericht) bool {
 	return true
 }
 
-func parseJSON(body []byte) (MenuRoot, error) {
-	// This wants to be its own function so we can
-	// tets that the unmarshalling works well.
-	// TODO point a test to this
-	menu := MenuRoot{}
-	err := json.Unmarshal(body, &menu)
-	return menu, err
-}
-
-func parseTitleJSON(body []byte) (EssensTitleRoot, error) {
-	titleRoot := EssensTitleRoot{}
-	err := json.Unmarshal(body, &titleRoot)
-	return titleRoot, err
-
+// hasSameDetails returns true if labels, allergens, additives and prices of both offers are the same
+func hasSameDetails(dbOffer db_connectors.DBOfferInformation, downOffer MenuOffer) bool {
+	return isSameList(dbOffer.Labels, downOffer.Labels) &&
+		isSameList(dbOffer.Allergens, downOffer.Allergens) &&
+		isSameList(dbOffer.Additives, downOffer.Additives) &&
+		dbOffer.StudentPriceInCents == downOffer.StudentPriceInCents &&
+		dbOffer.StaffPriceInCents == downOffer.StaffPriceInCents &&
+		dbOffer.GuestPriceInCents == downOffer.GuestPriceInCents
 }
 
-func getMensaMenuFromWeb() (MenuRoot, error) {
-	// We need to set the referer header, or this won't work
-	mensaMenuClient := &http.Client{}
-	mensaMenuRequest, _ := http.NewRequest("GET", MENSA_URL, nil)
-	mensaMenuRequest.Header.Set("Referer", "https://swp.webspeiseplan.de/Menu")
-
-	response, err := mensaMenuClient.Do(mensaMenuRequest)
-
-	if err != nil {
-		zap.S().Warn("Can't reach mensa json. Is their service down?", err)
-		return MenuRoot{}, err
-	}
-	defer response.Body.Close()
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		zap.S().Warn("Can't read mensa json response body. Is their service working?", err)
-		return MenuRoot{}, err
-	}
-	menu, err := parseJSON(body)
-	if err != nil {
-		zap.S().Error("Can't parse mensa json. Did the format change?", err)
-		return MenuRoot{}, err
+func isSameList(first []string, second []string) bool {
+	if len(first) != len(second) {
+		return false
 	}
-	return menu, nil
-}
-
-func getMealsForToday(menu MenuRoot, day time.Time) []SpeiseplanAdvancedGericht {
-	todayString := day.Format("2006-01-02")
-
-	var todaysMenu []SpeiseplanAdvancedGericht
-
-	for _, week := range menu.Content {
-		for _, potentialMeal := range week.SpeiseplanGerichtData {
-			if potentialMeal.Gericht.Aktiv == false {
-				continue
-			}
-			potentialMealDate := potentialMeal.Gericht.Datum[:10] // is iso-formatted, this returns the day part
-			if potentialMealDate == todayString {
-				// We want less date precision in our db
-				potentialMeal.Gericht.Datum = potentialMeal.Gericht.Datum[:10]
-				todaysMenu = append(todaysMenu, potentialMeal.Gericht)
-			}
-		}
-		if len(todaysMenu) > 0 {
-			// if we found meals for today in one week we won't find them in a different week
-			break
+	for i := range first {
+		if first[i] != second[i] {
+			return false
 		}
 	}
-	return todaysMenu
+	return true
 }
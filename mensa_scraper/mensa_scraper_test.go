@@ -0,0 +1,23 @@
+package mensa_scraper
+
+import (
+	"testing"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+)
+
+func TestMenusOfDifferentSourcesAreComparedWithoutDetails(t *testing.T) {
+	stored := []db_connectors.DBOfferInformation{{Title: "Angebot 2", Description: "Bunte Nudeln", Date: "2023-02-21", StudentPriceInCents: 250}}
+	scraped := []MenuOffer{{Title: "Angebot 2", Description: "Bunte Nudeln", Date: "2023-02-21", Labels: []string{LABEL_VEGETARIAN}}}
+
+	if isSameMenu(stored, scraped, true) {
+		t.Errorf("Offers with different details are the same")
+	}
+	if !isSameMenu(stored, scraped, false) {
+		t.Errorf("Offers with same title and description aren't the same when ignoring details")
+	}
+	scraped[0].Description = "Currywurst"
+	if isSameMenu(stored, scraped, false) {
+		t.Errorf("Offers with different descriptions are the same")
+	}
+}
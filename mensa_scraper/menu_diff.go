@@ -0,0 +1,172 @@
+package mensa_scraper
+
+/*
+Compares two versions of the menu of a date, see the counter of db_connectors.DBOfferInformation.
+
+Offers that are exactly the same in both versions didn't change. Of the others, offers
+with the same dish (description) in both versions changed, e.g. their price. What is left
+was removed from the previous version, which usually means it's sold out, or added to
+the latest one.
+*/
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+)
+
+// MenuDiff contains everything that differs between two versions of a menu
+type MenuDiff struct {
+	Added   []db_connectors.DBOfferInformation
+	Removed []db_connectors.DBOfferInformation
+	Changed []OfferChange
+}
+
+// OfferChange is an offer that is in both versions of a menu, but with different details
+type OfferChange struct {
+	Previous db_connectors.DBOfferInformation
+	Latest   db_connectors.DBOfferInformation
+}
+
+// IsEmpty returns true if both versions of the menu are the same
+func (diff MenuDiff) IsEmpty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0
+}
+
+// diffMenus returns what differs between the previous and the latest version of a menu
+func diffMenus(previousOffers []db_connectors.DBOfferInformation, latestOffers []db_connectors.DBOfferInformation) MenuDiff {
+	// Offers may be the same multiple times, so we count them
+	unchangedCounts := make(map[string]int)
+	for _, offer := range previousOffers {
+		unchangedCounts[getOfferKey(offer)]++
+	}
+	var addedOrChanged []db_connectors.DBOfferInformation
+	for _, offer := range latestOffers {
+		key := getOfferKey(offer)
+		if unchangedCounts[key] > 0 {
+			unchangedCounts[key]--
+		} else {
+			addedOrChanged = append(addedOrChanged, offer)
+		}
+	}
+	var removedOrChanged []db_connectors.DBOfferInformation
+	for _, offer := range previousOffers {
+		key := getOfferKey(offer)
+		if unchangedCounts[key] > 0 {
+			unchangedCounts[key]--
+			removedOrChanged = append(removedOrChanged, offer)
+		}
+	}
+
+	var diff MenuDiff
+	for _, latestOffer := range addedOrChanged {
+		previousIndex := -1
+		for i, previousOffer := range removedOrChanged {
+			if previousOffer.Description == latestOffer.Description {
+				previousIndex = i
+				break
+			}
+		}
+		if previousIndex == -1 {
+			diff.Added = append(diff.Added, latestOffer)
+			continue
+		}
+		diff.Changed = append(diff.Changed, OfferChange{Previous: removedOrChanged[previousIndex], Latest: latestOffer})
+		removedOrChanged = append(removedOrChanged[:previousIndex], removedOrChanged[previousIndex+1:]...)
+	}
+	diff.Removed = removedOrChanged
+	return diff
+}
+
+/*
+buildMenuChangeMessage builds the message that tells users what changed in the menu of their
+mensa. It only contains the changes, the full menu is sent when users ask for it.
+Like menus it is sent as HTML, so everything we got from upstream is escaped
+*/
+func buildMenuChangeMessage(mensaName string, diff MenuDiff) string {
+	message := "<b>The " + html.EscapeString(mensaName) + " menu changed:</b>\n"
+	for _, offer := range diff.Removed {
+		message += "❌ Sold out: " + getOfferName(offer) + "\n"
+	}
+	for _, offer := range diff.Added {
+		message += "✅ New: " + getOfferName(offer) + getLabelIcons(offer) + "\n"
+		message += getDetailLines(offer)
+	}
+	for _, change := range diff.Changed {
+		message += "✏️ Changed: " + getOfferName(change.Latest) + getLabelIcons(change.Latest) + "\n"
+		message += "<i>" + html.EscapeString(strings.Join(describeChanges(change), ", ")) + "</i>\n"
+	}
+	return message + "Send \"Menu?\" for the full menu"
+}
+
+// getOfferName returns how offers are called in change messages, e.g. "Currywurst (Angebot 3)". Escaped for HTML
+func getOfferName(offer db_connectors.DBOfferInformation) string {
+	if offer.Description == "" {
+		return html.EscapeString(offer.Title)
+	}
+	if offer.Title == "" {
+		return html.EscapeString(offer.Description)
+	}
+	return html.EscapeString(fmt.Sprintf("%s (%s)", offer.Description, offer.Title))
+}
+
+// describeChanges returns a short description of each detail that changed
+func describeChanges(change OfferChange) []string {
+	previous, latest := change.Previous, change.Latest
+	var descriptions []string
+	if previous.Title != latest.Title {
+		descriptions = append(descriptions, "now "+latest.Title)
+	}
+	if previous.StudentPriceInCents != latest.StudentPriceInCents {
+		descriptions = append(descriptions, describePriceChange(previous.StudentPriceInCents, latest.StudentPriceInCents))
+	} else if previous.StaffPriceInCents != latest.StaffPriceInCents || previous.GuestPriceInCents != latest.GuestPriceInCents {
+		descriptions = append(descriptions, "prices for staff and guests changed")
+	}
+	if !isSameList(previous.Labels, latest.Labels) {
+		descriptions = append(descriptions, "labels changed")
+	}
+	if addedAllergens := getMissingCodes(latest.Allergens, previous.Allergens); len(addedAllergens) > 0 {
+		descriptions = append(descriptions, "now contains "+strings.Join(getNames(addedAllergens, ALLERGEN_NAMES), ", "))
+	}
+	if removedAllergens := getMissingCodes(previous.Allergens, latest.Allergens); len(removedAllergens) > 0 {
+		descriptions = append(descriptions, "no longer contains "+strings.Join(getNames(removedAllergens, ALLERGEN_NAMES), ", "))
+	}
+	if !isSameList(previous.Additives, latest.Additives) {
+		descriptions = append(descriptions, "additives changed")
+	}
+	if len(descriptions) == 0 {
+		// e.g. only the order of allergens changed
+		descriptions = append(descriptions, "details changed")
+	}
+	return descriptions
+}
+
+func describePriceChange(previousPriceInCents int, latestPriceInCents int) string {
+	if previousPriceInCents == 0 {
+		return "💶 " + formatPrice(latestPriceInCents)
+	}
+	if latestPriceInCents == 0 {
+		return "price unknown"
+	}
+	return "💶 " + formatPrice(previousPriceInCents) + " → " + formatPrice(latestPriceInCents)
+}
+
+// getMissingCodes returns the codes that are in codes, but not in otherCodes
+func getMissingCodes(codes []string, otherCodes []string) []string {
+	var missingCodes []string
+	for _, code := range codes {
+		isMissing := true
+		for _, otherCode := range otherCodes {
+			if code == otherCode {
+				isMissing = false
+				break
+			}
+		}
+		if isMissing {
+			missingCodes = append(missingCodes, code)
+		}
+	}
+	return missingCodes
+}
@@ -0,0 +1,83 @@
+package mensa_scraper
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+)
+
+func TestMenuChangesAreClassified(t *testing.T) {
+	previousMenu := []db_connectors.DBOfferInformation{
+		{Title: "Angebot 1", Description: "Schnitzel", StudentPriceInCents: 350},
+		{Title: "Angebot 2", Description: "Bunte Nudeln", StudentPriceInCents: 250},
+		{Title: "Angebot 3", Description: "Currywurst", StudentPriceInCents: 300},
+		{Title: "Angebot 3", Description: "Currywurst", StudentPriceInCents: 300},
+	}
+	latestMenu := []db_connectors.DBOfferInformation{
+		{Title: "Angebot 1", Description: "Schnitzel", StudentPriceInCents: 390},
+		{Title: "Angebot 2", Description: "Bunte Nudeln", StudentPriceInCents: 250},
+		{Title: "Angebot 3", Description: "Currywurst", StudentPriceInCents: 300},
+		{Title: "Angebot 3", Description: "Gemüsepfanne", Labels: []string{LABEL_VEGAN}},
+	}
+
+	diff := diffMenus(previousMenu, latestMenu)
+	if len(diff.Removed) != 1 || diff.Removed[0].Description != "Currywurst" {
+		t.Errorf("Expected one sold out currywurst, got %v", diff.Removed)
+	}
+	if len(diff.Added) != 1 || diff.Added[0].Description != "Gemüsepfanne" {
+		t.Errorf("Expected new gemüsepfanne, got %v", diff.Added)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Previous.StudentPriceInCents != 350 || diff.Changed[0].Latest.StudentPriceInCents != 390 {
+		t.Errorf("Expected schnitzel with new price, got %v", diff.Changed)
+	}
+	if !diffMenus(previousMenu, previousMenu).IsEmpty() {
+		t.Errorf("Same menus have differences")
+	}
+
+	message := buildMenuChangeMessage("Griebnitzsee", diff)
+	for _, expected := range []string{
+		"❌ Sold out: Currywurst (Angebot 3)",
+		"✅ New: Gemüsepfanne (Angebot 3) 🌱",
+		"✏️ Changed: Schnitzel (Angebot 1)",
+		"💶 3.50€ → 3.90€",
+	} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("Change message doesn't contain %q: %s", expected, message)
+		}
+	}
+	if strings.Contains(message, "Bunte Nudeln") {
+		t.Errorf("Change message contains unchanged offer: %s", message)
+	}
+}
+
+func TestAllergenChangesAreDescribed(t *testing.T) {
+	change := OfferChange{
+		Previous: db_connectors.DBOfferInformation{Title: "Angebot 2", Description: "Bunte Nudeln", Allergens: []string{"A", "C"}},
+		Latest:   db_connectors.DBOfferInformation{Title: "Angebot 4", Description: "Bunte Nudeln", Allergens: []string{"A", "G"}},
+	}
+	if description := strings.Join(describeChanges(change), ", "); description != "now Angebot 4, now contains Milk, no longer contains Eggs" {
+		t.Errorf("Unexpected description of changes: %s", description)
+	}
+}
+
+func TestMenuChangeMessageEscapesUpstreamText(t *testing.T) {
+	diff := MenuDiff{
+		Added:   []db_connectors.DBOfferInformation{{Title: "Angebot <1>", Description: "Fish & Chips"}},
+		Removed: []db_connectors.DBOfferInformation{{Title: "Angebot 2", Description: "Mac & Cheese"}},
+		Changed: []OfferChange{{
+			Previous: db_connectors.DBOfferInformation{Title: "Angebot 3", Description: "Pasta"},
+			Latest:   db_connectors.DBOfferInformation{Title: "Angebot <3>", Description: "Pasta"},
+		}},
+	}
+	message := buildMenuChangeMessage("Griebnitzsee", diff)
+	for _, expected := range []string{
+		"✅ New: Fish &amp; Chips (Angebot &lt;1&gt;)",
+		"❌ Sold out: Mac &amp; Cheese (Angebot 2)",
+		"<i>now Angebot &lt;3&gt;</i>",
+	} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("Change message doesn't contain %q: %s", expected, message)
+		}
+	}
+}
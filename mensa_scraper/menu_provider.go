@@ -0,0 +1,109 @@
+package mensa_scraper
+
+/*
+Menus can come from multiple upstream sources, each of which is a MenuProvider.
+Each mensa asks all sources it has configured in mensas.json, in order, until one
+of them has a menu. That way we still get menus if one source is down or changed
+its format.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/hashicorp/go-multierror"
+	"go.uber.org/zap"
+)
+
+// How long we wait for a single request to a menu source
+const MENU_REQUEST_TIMEOUT = 20 * time.Second
+
+// Used for all requests to menu sources
+var menuHTTPClient = &http.Client{Timeout: MENU_REQUEST_TIMEOUT}
+
+/*
+MenuOffer is a single offer of a mensa, regardless of where we got it from.
+Date is formatted as 2006-01-02. Not all sources know labels, allergens,
+additives and prices, see offer_details.go. Source is the name of the provider
+the offer came from, see fallbackMenuProvider
+*/
+type MenuOffer struct {
+	Date                string
+	Title               string
+	Description         string
+	Labels              []string // LABEL_ constants
+	Allergens           []string // Codes, see ALLERGEN_NAMES
+	Additives           []string // Codes, see ADDITIVE_NAMES
+	StudentPriceInCents int      // 0 if unknown
+	StaffPriceInCents   int
+	GuestPriceInCents   int
+	Source              string
+}
+
+// MenuProvider gets the menu of a single mensa from a single source
+type MenuProvider interface {
+	// Name identifies the source in logs
+	Name() string
+	/*
+		GetUpcomingOffers returns all offers on the day of the given time and the days after it,
+		as far as the source knows them. Returns no offers without error if the source has
+		no menu for those days, e.g. during holidays
+	*/
+	GetUpcomingOffers(from time.Time) ([]MenuOffer, error)
+}
+
+// fallbackMenuProvider asks its providers in order, until one of them has offers
+type fallbackMenuProvider struct {
+	providers []MenuProvider
+}
+
+func (provider fallbackMenuProvider) Name() string {
+	return "fallback"
+}
+
+/*
+GetUpcomingOffers returns the offers of the first provider that has any, with their Source set
+to its name. Returns an error only if all providers failed
+*/
+func (provider fallbackMenuProvider) GetUpcomingOffers(from time.Time) ([]MenuOffer, error) {
+	var errorsOfAllProviders error
+	failedProviders := 0
+	for _, fallback := range provider.providers {
+		offers, err := fallback.GetUpcomingOffers(from)
+		if err != nil {
+			zap.S().Warnw("Menu source failed, trying next one", "source", fallback.Name(), "error", err)
+			errorsOfAllProviders = multierror.Append(errorsOfAllProviders, fmt.Errorf("%s: %w", fallback.Name(), err))
+			failedProviders++
+			continue
+		}
+		if len(offers) > 0 {
+			for i := range offers {
+				offers[i].Source = fallback.Name()
+			}
+			return offers, nil
+		}
+		zap.S().Debugw("Menu source has no offers", "source", fallback.Name())
+	}
+	if failedProviders == len(provider.providers) {
+		return nil, errorsOfAllProviders
+	}
+	return nil, nil
+}
+
+/*
+getMenuProviderOf returns a provider that asks all menu sources of the given mensa,
+see mensas.Mensa.HasMenuSource
+*/
+func getMenuProviderOf(mensa mensas.Mensa) (MenuProvider, error) {
+	var providers []MenuProvider
+	if mensa.MenuLocationID != "" {
+		providers = append(providers, webspeiseplanProvider{mensa: mensa})
+	}
+	if len(providers) == 0 {
+		return nil, errors.New("Mensa has no menu source")
+	}
+	return fallbackMenuProvider{providers: providers}, nil
+}
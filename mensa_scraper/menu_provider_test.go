@@ -0,0 +1,59 @@
+package mensa_scraper
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// staticMenuProvider returns the same offers or error on each request
+type staticMenuProvider struct {
+	offers []MenuOffer
+	err    error
+	calls  *int
+}
+
+func (provider staticMenuProvider) Name() string {
+	return "static"
+}
+
+func (provider staticMenuProvider) GetUpcomingOffers(from time.Time) ([]MenuOffer, error) {
+	*provider.calls++
+	return provider.offers, provider.err
+}
+
+func TestFallbackAsksProvidersUntilOneHasOffers(t *testing.T) {
+	var failingCalls, emptyCalls, workingCalls, unusedCalls int
+	offers := []MenuOffer{{Date: "2023-02-21", Title: "Angebot 2", Description: "Bunte Nudeln"}}
+	provider := fallbackMenuProvider{providers: []MenuProvider{
+		staticMenuProvider{err: errors.New("format changed"), calls: &failingCalls},
+		staticMenuProvider{calls: &emptyCalls},
+		staticMenuProvider{offers: offers, calls: &workingCalls},
+		staticMenuProvider{offers: offers, calls: &unusedCalls},
+	}}
+
+	receivedOffers, err := provider.GetUpcomingOffers(time.Now())
+	if err != nil || len(receivedOffers) != 1 || receivedOffers[0].Title != offers[0].Title {
+		t.Fatalf("Didn't get offers of working provider: %v, %v", receivedOffers, err)
+	}
+	if receivedOffers[0].Source != "static" {
+		t.Errorf("Offers don't know which provider they came from: %s", receivedOffers[0].Source)
+	}
+	if failingCalls != 1 || emptyCalls != 1 || workingCalls != 1 || unusedCalls != 0 {
+		t.Errorf("Providers weren't asked in order: %d, %d, %d, %d", failingCalls, emptyCalls, workingCalls, unusedCalls)
+	}
+}
+
+func TestFallbackOnlyFailsIfAllProvidersFail(t *testing.T) {
+	var calls int
+	failing := staticMenuProvider{err: errors.New("down"), calls: &calls}
+	empty := staticMenuProvider{calls: &calls}
+
+	if _, err := (fallbackMenuProvider{providers: []MenuProvider{failing, failing}}).GetUpcomingOffers(time.Now()); err == nil {
+		t.Errorf("No error although all providers failed")
+	}
+	offers, err := (fallbackMenuProvider{providers: []MenuProvider{failing, empty}}).GetUpcomingOffers(time.Now())
+	if err != nil || len(offers) != 0 {
+		t.Errorf("Expected no offers without error if a provider has no menu, got %v, %v", offers, err)
+	}
+}
@@ -0,0 +1,139 @@
+package mensa_scraper
+
+/*
+Labels, allergens and additives of offers. Each source names them differently, so
+labels are normalized to the LABEL_ constants. Allergens and additives are kept as
+the codes that are printed on the menus in the mensa (e.g. "G" for milk)
+*/
+
+import (
+	"strconv"
+	"strings"
+)
+
+const LABEL_VEGAN = "vegan"
+const LABEL_VEGETARIAN = "vegetarian"
+const LABEL_REGIONAL = "regional"
+const LABEL_PORK = "pork"
+const LABEL_FISH = "fish"
+const LABEL_ALCOHOL = "alcohol"
+const LABEL_GARLIC = "garlic"
+
+// Shown next to offers with these labels, in this order
+var LABEL_ICONS = []struct {
+	Label string
+	Icon  string
+}{
+	{LABEL_VEGAN, "🌱"},
+	{LABEL_VEGETARIAN, "🥕"},
+	{LABEL_REGIONAL, "📍"},
+	{LABEL_PORK, "🐖"},
+	{LABEL_FISH, "🐟"},
+	{LABEL_ALCOHOL, "🍷"},
+	{LABEL_GARLIC, "🧄"},
+}
+
+// Labels of the Studentenwerk xml feed
+var xmlLabelNames = map[string]string{
+	"vegan":       LABEL_VEGAN,
+	"vegetarisch": LABEL_VEGETARIAN,
+	"regional":    LABEL_REGIONAL,
+	"schwein":     LABEL_PORK,
+	"fisch":       LABEL_FISH,
+	"alkohol":     LABEL_ALCOHOL,
+	"knoblauch":   LABEL_GARLIC,
+}
+
+// Names of allergens, by the code used on the menus. Unknown codes are shown as they are
+var ALLERGEN_NAMES = map[string]string{
+	"A":   "Gluten",
+	"B":   "Crustaceans",
+	"C":   "Eggs",
+	"D":   "Fish",
+	"E":   "Peanuts",
+	"F":   "Soy",
+	"G":   "Milk",
+	"H":   "Nuts",
+	"I":   "Celery",
+	"J":   "Mustard",
+	"K":   "Sesame",
+	"L":   "Sulphites",
+	"M":   "Lupin",
+	"N":   "Molluscs",
+	"Wei": "Wheat",
+	"Rog": "Rye",
+	"Ger": "Barley",
+	"Haf": "Oats",
+	"Din": "Spelt",
+	"Kam": "Kamut",
+	"Man": "Almonds",
+	"Has": "Hazelnuts",
+	"Wal": "Walnuts",
+	"Kas": "Cashews",
+	"Pek": "Pecans",
+	"Par": "Brazil nuts",
+	"Pis": "Pistachios",
+	"Mac": "Macadamia nuts",
+}
+
+// Names of additives, by the code used on the menus. Unknown codes are shown as they are
+var ADDITIVE_NAMES = map[string]string{
+	"1":   "Colouring",
+	"2":   "Preservatives",
+	"3":   "Antioxidants",
+	"5":   "Sulphurised",
+	"9":   "Sweeteners",
+	"AL":  "Alcohol",
+	"KNO": "Garlic",
+}
+
+// normalizeXMLLabel returns the LABEL_ constant for a label of the xml feed
+func normalizeXMLLabel(xmlLabel string) string {
+	lowercaseLabel := strings.ToLower(strings.TrimSpace(xmlLabel))
+	if label, isKnown := xmlLabelNames[lowercaseLabel]; isKnown {
+		return label
+	}
+	return lowercaseLabel
+}
+
+// parsePriceInCents parses prices like "2.50" or "2,50". Returns 0 for prices that can't be parsed
+func parsePriceInCents(price string) int {
+	euros, cents, hasCents := strings.Cut(strings.ReplaceAll(strings.TrimSpace(price), ",", "."), ".")
+	eurosValue, err := strconv.Atoi(euros)
+	if err != nil || eurosValue < 0 {
+		return 0
+	}
+	centsValue := 0
+	if hasCents {
+		if len(cents) == 1 {
+			cents += "0"
+		}
+		if centsValue, err = strconv.Atoi(cents); err != nil || len(cents) != 2 || centsValue < 0 {
+			return 0
+		}
+	}
+	return eurosValue*100 + centsValue
+}
+
+// formatPrice formats a price in cents as shown in menus, e.g. 2.50€
+func formatPrice(priceInCents int) string {
+	return strconv.Itoa(priceInCents/100) + "." + strconv.Itoa(priceInCents%100/10) + strconv.Itoa(priceInCents%10) + "€"
+}
+
+// GetAllergenNames returns the names of the given allergen codes
+func GetAllergenNames(codes []string) []string {
+	return getNames(codes, ALLERGEN_NAMES)
+}
+
+// getNames returns the names of the given codes, and the codes themselves if they have no name
+func getNames(codes []string, names map[string]string) []string {
+	var namesOfCodes []string
+	for _, code := range codes {
+		if name, isKnown := names[code]; isKnown {
+			namesOfCodes = append(namesOfCodes, name)
+		} else {
+			namesOfCodes = append(namesOfCodes, code)
+		}
+	}
+	return namesOfCodes
+}
@@ -0,0 +1,322 @@
+package mensa_scraper
+
+/*
+Gets menus from webspeiseplan, which serves the menu of the next two weeks as json.
+Titles of offers (e.g. "Angebot 1") need to be requested separately. So do the codes of
+allergens, additives and labels, since offers only reference them by ID
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"go.uber.org/zap"
+)
+
+// Both need to be filled in with the MenuLocationID of a mensa
+const MENSA_URL string = "https://swp.webspeiseplan.de/index.php?token=55ed21609e26bbf68ba2b19390bf7961&model=menu&location=%s&languagetype=1&_=1696321056188" // Please be static token, pleeaaaaase!
+const MENSA_TITLE_URL string = "https://swp.webspeiseplan.de/index.php?token=55ed21609e26bbf68ba2b19390bf7961&model=mealCategory&location=%s&languagetype=1&_=1696589384933"
+const MENSA_ALLERGENS_URL string = "https://swp.webspeiseplan.de/index.php?token=55ed21609e26bbf68ba2b19390bf7961&model=allergens&location=%s&languagetype=1"
+const MENSA_ADDITIVES_URL string = "https://swp.webspeiseplan.de/index.php?token=55ed21609e26bbf68ba2b19390bf7961&model=additives&location=%s&languagetype=1"
+const MENSA_FEATURES_URL string = "https://swp.webspeiseplan.de/index.php?token=55ed21609e26bbf68ba2b19390bf7961&model=features&location=%s&languagetype=1"
+
+// Structs for representing the menu/title in json
+type EssensTitle struct {
+	Name                string `json:"name"`
+	GerichtskategorieID int    `json:"gerichtkategorieID"`
+}
+
+type EssensTitleRoot struct {
+	Success bool          `json:"success"`
+	Content []EssensTitle `json:"content"`
+}
+
+type SpeiseplanAdvancedGericht struct {
+	Aktiv              bool   `json:"aktiv"`
+	Datum              string `json:"datum"`
+	GerichtKategorieID int    `json:"gerichtkategorieID"`
+	Gerichtname        string `json:"gerichtname"`
+	GerichtTitle       string `json:"enrichThisManually,omitempty"` // Enriched manually
+}
+
+// Prices are in euros, and missing if unknown
+type Zusatzinformationen struct {
+	StudentPrice float64 `json:"price3Decimal2"`
+	StaffPrice   float64 `json:"mitarbeiterpreisDecimal2"`
+	GuestPrice   float64 `json:"gaestepreisDecimal2"`
+}
+
+// The IDs are comma separated, see getWebspeiseplanCodes
+type SpeiseplanAdvancedGerichtData struct {
+	Gericht             SpeiseplanAdvancedGericht `json:"SpeiseplanAdvancedGericht"`
+	Zusatzinformationen Zusatzinformationen       `json:"zusatzinformationen"`
+	AllergeneIDs        string                    `json:"allergeneIds"`
+	ZusatzstoffeIDs     string                    `json:"zusatzstoffeIds"`
+	GerichtmerkmaleIDs  string                    `json:"gerichtmerkmaleIds"`
+}
+
+// An allergen, additive or label (gerichtmerkmal). Only one of the IDs is set, depending on what it is
+type WebspeiseplanCode struct {
+	AllergenID       int    `json:"allergenID"`
+	ZusatzstoffID    int    `json:"zusatzstoffID"`
+	GerichtmerkmalID int    `json:"gerichtmerkmalID"`
+	Kuerzel          string `json:"kuerzel"`
+	Name             string `json:"name"`
+}
+
+type WebspeiseplanCodeRoot struct {
+	Success bool                `json:"success"`
+	Content []WebspeiseplanCode `json:"content"`
+}
+
+// webspeiseplanCodes maps the IDs offers reference to what we store, see offer_details.go
+type webspeiseplanCodes struct {
+	allergens map[int]string
+	additives map[int]string
+	labels    map[int]string
+}
+
+// This contains two objects, one for each week - but we only need the Gericht
+type SpeiseplanWeek struct {
+	SpeiseplanGerichtData []SpeiseplanAdvancedGerichtData `json:"speiseplanGerichtData"`
+}
+
+type MenuRoot struct {
+	Success bool             `json:"success"`
+	Content []SpeiseplanWeek `json:"content"`
+}
+
+// webspeiseplanProvider gets the menu of a mensa with a MenuLocationID from webspeiseplan
+type webspeiseplanProvider struct {
+	mensa mensas.Mensa
+}
+
+func (provider webspeiseplanProvider) Name() string {
+	return "webspeiseplan"
+}
+
+func (provider webspeiseplanProvider) GetUpcomingOffers(from time.Time) ([]MenuOffer, error) {
+	menu, err := getMensaMenuFromWeb(provider.mensa)
+	if err != nil {
+		return nil, err
+	}
+	upcomingMeals := getUpcomingMeals(menu, from)
+	if len(upcomingMeals) == 0 {
+		return nil, nil
+	}
+	// Without titles or codes the offers are still worth sending, so errors are only logged
+	mealsWithTitles, _ := enrichWithTitleData(provider.mensa, upcomingMeals)
+	codes := getWebspeiseplanCodes(provider.mensa)
+
+	var offers []MenuOffer
+	for _, meal := range mealsWithTitles {
+		offers = append(offers, toMenuOffer(meal, codes))
+	}
+	return offers, nil
+}
+
+// toMenuOffer converts a meal of webspeiseplan, whose IDs are looked up in the given codes
+func toMenuOffer(meal SpeiseplanAdvancedGerichtData, codes webspeiseplanCodes) MenuOffer {
+	return MenuOffer{
+		Date:                meal.Gericht.Datum,
+		Title:               meal.Gericht.GerichtTitle,
+		Description:         meal.Gericht.Gerichtname,
+		Labels:              lookUpCodes(meal.GerichtmerkmaleIDs, codes.labels),
+		Allergens:           lookUpCodes(meal.AllergeneIDs, codes.allergens),
+		Additives:           lookUpCodes(meal.ZusatzstoffeIDs, codes.additives),
+		StudentPriceInCents: toCents(meal.Zusatzinformationen.StudentPrice),
+		StaffPriceInCents:   toCents(meal.Zusatzinformationen.StaffPrice),
+		GuestPriceInCents:   toCents(meal.Zusatzinformationen.GuestPrice),
+	}
+}
+
+// lookUpCodes returns the codes of comma separated IDs like "1,5,20". IDs we don't know are skipped
+func lookUpCodes(commaSeparatedIDs string, codesByID map[int]string) []string {
+	var codes []string
+	for _, idString := range strings.Split(commaSeparatedIDs, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(idString))
+		if err != nil {
+			continue
+		}
+		if code, isKnown := codesByID[id]; isKnown {
+			codes = append(codes, code)
+		} else {
+			zap.S().Debugw("Unknown webspeiseplan ID", "id", id)
+		}
+	}
+	return codes
+}
+
+func toCents(priceInEuros float64) int {
+	if priceInEuros <= 0 {
+		return 0
+	}
+	return int(math.Round(priceInEuros * 100))
+}
+
+/*
+getWebspeiseplanCodes requests allergens, additives and labels of the mensa. Each list that
+can't be requested stays empty, so that offers still have everything else
+*/
+func getWebspeiseplanCodes(mensa mensas.Mensa) webspeiseplanCodes {
+	codes := webspeiseplanCodes{
+		allergens: make(map[int]string),
+		additives: make(map[int]string),
+		labels:    make(map[int]string),
+	}
+	for _, code := range requestWebspeiseplanCodes(MENSA_ALLERGENS_URL, mensa) {
+		codes.allergens[code.AllergenID] = code.Kuerzel
+	}
+	for _, code := range requestWebspeiseplanCodes(MENSA_ADDITIVES_URL, mensa) {
+		codes.additives[code.ZusatzstoffID] = code.Kuerzel
+	}
+	for _, code := range requestWebspeiseplanCodes(MENSA_FEATURES_URL, mensa) {
+		// Labels are named like in the xml feed
+		codes.labels[code.GerichtmerkmalID] = normalizeXMLLabel(code.Name)
+	}
+	return codes
+}
+
+func requestWebspeiseplanCodes(urlTemplate string, mensa mensas.Mensa) []WebspeiseplanCode {
+	codeRequest, _ := http.NewRequest("GET", fmt.Sprintf(urlTemplate, mensa.MenuLocationID), nil)
+	codeRequest.Header.Set("Referer", "https://swp.webspeiseplan.de/Menu")
+
+	response, err := menuHTTPClient.Do(codeRequest)
+	if err != nil {
+		zap.S().Warnw("Can't reach webspeiseplan codes. Is their service down?", "url", urlTemplate, "error", err)
+		return nil
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		zap.S().Warnw("Can't read webspeiseplan codes. Is their service working?", "url", urlTemplate, "error", err)
+		return nil
+	}
+	codeRoot, err := parseCodeJSON(body)
+	if err != nil {
+		zap.S().Errorw("Can't parse webspeiseplan codes. Did the format change?", "url", urlTemplate, "error", err)
+		return nil
+	}
+	return codeRoot.Content
+}
+
+func enrichWithTitleData(mensa mensas.Mensa, todaysInformation []SpeiseplanAdvancedGerichtData) ([]SpeiseplanAdvancedGerichtData, error) {
+	mensaEnrichmentRequest, _ := http.NewRequest("GET", fmt.Sprintf(MENSA_TITLE_URL, mensa.MenuLocationID), nil)
+	mensaEnrichmentRequest.Header.Set("Referer", "https://swp.webspeiseplan.de/Menu")
+
+	response, err := menuHTTPClient.Do(mensaEnrichmentRequest)
+
+	if err != nil {
+		zap.S().Warn("Can't reach json with meal<->Essen N mapping. Is their service down?", err)
+		return todaysInformation, err
+	}
+
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		zap.S().Warn("Can't read json with meal<-> essen mapping. Is their service working?", err)
+		return todaysInformation, err
+	}
+
+	titleRoot, err := parseTitleJSON(body)
+	if err != nil {
+		zap.S().Error("Can't parse title json. Did the format change?", err)
+		return todaysInformation, err
+	}
+
+	for index, meal := range todaysInformation {
+		mealID := meal.Gericht.GerichtKategorieID
+
+		for _, titleObject := range titleRoot.Content {
+			if titleObject.GerichtskategorieID == mealID {
+				meal.Gericht.GerichtTitle = titleObject.Name
+				todaysInformation[index] = meal
+				break
+			}
+		}
+	}
+	return todaysInformation, nil
+}
+
+func parseJSON(body []byte) (MenuRoot, error) {
+	// This wants to be its own function so we can
+	// tets that the unmarshalling works well.
+	// TODO point a test to this
+	menu := MenuRoot{}
+	err := json.Unmarshal(body, &menu)
+	return menu, err
+}
+
+func parseTitleJSON(body []byte) (EssensTitleRoot, error) {
+	titleRoot := EssensTitleRoot{}
+	err := json.Unmarshal(body, &titleRoot)
+	return titleRoot, err
+
+}
+
+func parseCodeJSON(body []byte) (WebspeiseplanCodeRoot, error) {
+	codeRoot := WebspeiseplanCodeRoot{}
+	err := json.Unmarshal(body, &codeRoot)
+	return codeRoot, err
+}
+
+func getMensaMenuFromWeb(mensa mensas.Mensa) (MenuRoot, error) {
+	// We need to set the referer header, or this won't work
+	mensaMenuRequest, _ := http.NewRequest("GET", fmt.Sprintf(MENSA_URL, mensa.MenuLocationID), nil)
+	mensaMenuRequest.Header.Set("Referer", "https://swp.webspeiseplan.de/Menu")
+
+	response, err := menuHTTPClient.Do(mensaMenuRequest)
+
+	if err != nil {
+		zap.S().Warn("Can't reach mensa json. Is their service down?", err)
+		return MenuRoot{}, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		zap.S().Warn("Can't read mensa json response body. Is their service working?", err)
+		return MenuRoot{}, err
+	}
+	menu, err := parseJSON(body)
+	if err != nil {
+		zap.S().Error("Can't parse mensa json. Did the format change?", err)
+		return MenuRoot{}, err
+	}
+	return menu, nil
+}
+
+/*
+getUpcomingMeals returns the active meals of both weeks in the menu that are offered
+on the day of the given time, or on a later day
+*/
+func getUpcomingMeals(menu MenuRoot, from time.Time) []SpeiseplanAdvancedGerichtData {
+	fromString := from.Format("2006-01-02")
+
+	var upcomingMeals []SpeiseplanAdvancedGerichtData
+
+	for _, week := range menu.Content {
+		for _, potentialMeal := range week.SpeiseplanGerichtData {
+			if potentialMeal.Gericht.Aktiv == false {
+				continue
+			}
+			if len(potentialMeal.Gericht.Datum) < 10 {
+				zap.S().Warnw("Meal has unexpected date format", "datum", potentialMeal.Gericht.Datum)
+				continue
+			}
+			potentialMealDate := potentialMeal.Gericht.Datum[:10] // is iso-formatted, this returns the day part
+			if potentialMealDate >= fromString {
+				// We want less date precision in our db
+				potentialMeal.Gericht.Datum = potentialMealDate
+				upcomingMeals = append(upcomingMeals, potentialMeal)
+			}
+		}
+	}
+	return upcomingMeals
+}
@@ -0,0 +1,46 @@
+package mensa_scraper
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const exampleWebspeiseplanJSON = `{"success": true, "content": [{"speiseplanGerichtData": [
+	{
+		"speiseplanAdvancedGericht": {"aktiv": true, "datum": "2023-02-21T00:00:00.000Z", "gerichtkategorieID": 2, "gerichtname": "Bunte Nudeln mit Sojabolognese"},
+		"zusatzinformationen": {"price3Decimal2": 2.5, "mitarbeiterpreisDecimal2": 4.8, "gaestepreisDecimal2": null},
+		"allergeneIds": "1,7",
+		"zusatzstoffeIds": "",
+		"gerichtmerkmaleIds": "3,99"
+	},
+	{
+		"speiseplanAdvancedGericht": {"aktiv": true, "datum": "2023-02-20T00:00:00.000Z", "gerichtkategorieID": 1, "gerichtname": "Yesterday"}
+	}
+]}]}`
+
+func TestWebspeiseplanOffersHaveDetails(t *testing.T) {
+	menu, err := parseJSON([]byte(exampleWebspeiseplanJSON))
+	if err != nil {
+		t.Fatalf("Can't parse example json: %s", err)
+	}
+	meals := getUpcomingMeals(menu, time.Date(2023, 2, 21, 10, 0, 0, 0, time.UTC))
+	if len(meals) != 1 {
+		t.Fatalf("Expected only the meal of today, got %v", meals)
+	}
+	codes := webspeiseplanCodes{
+		allergens: map[int]string{1: "A", 7: "G"},
+		additives: map[int]string{},
+		labels:    map[int]string{3: normalizeXMLLabel("Vegetarisch")},
+	}
+	offer := toMenuOffer(meals[0], codes)
+	if offer.Date != "2023-02-21" || offer.Description != "Bunte Nudeln mit Sojabolognese" {
+		t.Errorf("Offer has wrong date or description: %v", offer)
+	}
+	if strings.Join(offer.Allergens, ",") != "A,G" || strings.Join(offer.Labels, ",") != LABEL_VEGETARIAN || offer.Additives != nil {
+		t.Errorf("Codes weren't looked up, or unknown ones weren't skipped: %v", offer)
+	}
+	if offer.StudentPriceInCents != 250 || offer.StaffPriceInCents != 480 || offer.GuestPriceInCents != 0 {
+		t.Errorf("Prices weren't converted to cents: %v", offer)
+	}
+}
@@ -0,0 +1,156 @@
+package mensa_scraper
+
+/*
+Parses menus in the xml format of the Studentenwerk Potsdam, see example.xml.
+The feed contains the menus of the current and the next week, one <datum> per day.
+We don't know a public URL of the feed, so there is no MenuProvider for it yet.
+Labels of offers aren't reliable, e.g. not all offers with pork have one. Instead each
+offer lists what it is free of in <negativfilter>, see XML_NEGATIVE_FILTER_LABELS
+*/
+
+import (
+	"encoding/xml"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Format of the index attribute of <datum>
+const XML_DATE_FORMAT = "02.01.2006"
+
+// Offers that lack one of these negative filters get its label
+var XML_NEGATIVE_FILTER_LABELS = []struct {
+	Filter string
+	Label  string
+}{
+	{"ohne-schweinefleisch", LABEL_PORK},
+	{"ohne-fisch", LABEL_FISH},
+	{"ohne-alkohol", LABEL_ALCOHOL},
+	{"ohne-knoblauch", LABEL_GARLIC},
+}
+
+// Structs for representing the menu in xml, only containing what we need
+type XMLMenu struct {
+	Dates []XMLDate `xml:"datum"`
+}
+
+type XMLDate struct {
+	Weekday string     `xml:"wochentag,attr"`
+	Index   string     `xml:"index,attr"` // The date, as XML_DATE_FORMAT
+	Offers  []XMLOffer `xml:"angebotnr"`
+}
+
+type XMLOffer struct {
+	Index        string     `xml:"index,attr"`
+	Titel        string     `xml:"titel"`
+	Beschreibung string     `xml:"beschreibung"`
+	Labels       []XMLLabel `xml:"labels>label"`
+	// What the offer is free of, e.g. "ohne-schweinefleisch"
+	NegativeFilters []XMLLabel `xml:"filteroptionen>negativfilter>filter"`
+	Allergens       []XMLCode  `xml:"additives-allergens>allergens>allergen"`
+	Additives       []XMLCode  `xml:"additives-allergens>additives>additive"`
+	PreisS          string     `xml:"preis_s"` // Students
+	PreisM          string     `xml:"preis_m"` // Staff
+	PreisG          string     `xml:"preis_g"` // Guests
+}
+
+type XMLLabel struct {
+	Name string `xml:"name,attr"`
+}
+
+type XMLCode struct {
+	Kennzeichen string `xml:"ke"`
+	Begriff     string `xml:"be"`
+}
+
+func parseXML(data []byte) (XMLMenu, error) {
+	menu := XMLMenu{}
+	err := xml.Unmarshal(data, &menu)
+	return menu, err
+}
+
+/*
+getUpcomingXMLOffers returns all offers in the menu that are offered on the day of
+the given time, or on a later day
+*/
+func getUpcomingXMLOffers(menu XMLMenu, from time.Time) []MenuOffer {
+	fromString := from.Format("2006-01-02")
+	var offers []MenuOffer
+	for _, date := range menu.Dates {
+		day, err := time.Parse(XML_DATE_FORMAT, date.Index)
+		if err != nil {
+			zap.S().Warnw("Date in mensa xml has unexpected format", "index", date.Index)
+			continue
+		}
+		dayString := day.Format("2006-01-02")
+		if dayString < fromString {
+			continue
+		}
+		for _, offer := range date.Offers {
+			offers = append(offers, MenuOffer{
+				Date:                dayString,
+				Title:               strings.TrimSpace(offer.Titel),
+				Description:         strings.TrimSpace(offer.Beschreibung),
+				Labels:              getXMLLabels(offer.Labels, offer.NegativeFilters),
+				Allergens:           getXMLCodes(offer.Allergens),
+				Additives:           getXMLCodes(offer.Additives),
+				StudentPriceInCents: parsePriceInCents(offer.PreisS),
+				StaffPriceInCents:   parsePriceInCents(offer.PreisM),
+				GuestPriceInCents:   parsePriceInCents(offer.PreisG),
+			})
+		}
+	}
+	return offers
+}
+
+/*
+getXMLLabels returns the labels of an offer. Offers are treated as containing pork, fish,
+alcohol or garlic unless their negative filters say otherwise, since users that avoid
+them are better off missing an offer than eating it
+*/
+func getXMLLabels(xmlLabels []XMLLabel, negativeFilters []XMLLabel) []string {
+	var labels []string
+	addLabel := func(label string) {
+		if !containsLabel(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+	for _, xmlLabel := range xmlLabels {
+		if xmlLabel.Name != "" {
+			addLabel(normalizeXMLLabel(xmlLabel.Name))
+		}
+	}
+	for _, filterLabel := range XML_NEGATIVE_FILTER_LABELS {
+		isFreeOf := false
+		for _, negativeFilter := range negativeFilters {
+			if strings.TrimSpace(negativeFilter.Name) == filterLabel.Filter {
+				isFreeOf = true
+				break
+			}
+		}
+		if !isFreeOf {
+			addLabel(filterLabel.Label)
+		}
+	}
+	return labels
+}
+
+func containsLabel(labels []string, label string) bool {
+	for _, candidate := range labels {
+		if candidate == label {
+			return true
+		}
+	}
+	return false
+}
+
+func getXMLCodes(xmlCodes []XMLCode) []string {
+	var codes []string
+	for _, xmlCode := range xmlCodes {
+		if code := strings.TrimSpace(xmlCode.Kennzeichen); code != "" {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
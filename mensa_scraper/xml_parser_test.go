@@ -3,8 +3,11 @@ package mensa_scraper
 import (
 	"io"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
 	"go.uber.org/zap"
 )
 
@@ -29,3 +32,133 @@ func TestParser(t *testing.T) {
 		t.Errorf("First offer has unexpected titel")
 	}
 }
+
+func TestUpcomingXMLOffersAreFound(t *testing.T) {
+	data, _ := os.ReadFile("example.xml")
+	menu, err := parseXML(data)
+	if err != nil {
+		t.Fatalf("Parse went wrong %s", err)
+	}
+
+	day := time.Date(2023, 2, 21, 12, 0, 0, 0, time.UTC)
+	offers := getUpcomingXMLOffers(menu, day)
+	if len(offers) != 18 {
+		t.Fatalf("Expected the 18 offers of both weeks, got %d", len(offers))
+	}
+	if offers[1].Title != "Angebot 4" || offers[1].Date != "2023-02-21" || !strings.HasPrefix(offers[1].Description, "Mini-Kartoffelklöße") {
+		t.Errorf("Offer wasn't converted as expected: %v", offers[1])
+	}
+	if offers[2].Date != "2023-02-22" || offers[17].Date != "2023-03-03" {
+		t.Errorf("Offers of later days have unexpected dates: %s, %s", offers[2].Date, offers[17].Date)
+	}
+
+	if offers := getUpcomingXMLOffers(menu, time.Date(2023, 3, 3, 12, 0, 0, 0, time.UTC)); len(offers) != 1 {
+		t.Errorf("Expected only the offer of the last day with offers, got %v", offers)
+	}
+	if offers := getUpcomingXMLOffers(menu, time.Date(2023, 3, 4, 12, 0, 0, 0, time.UTC)); len(offers) != 0 {
+		t.Errorf("Found offers after the last day with offers: %v", offers)
+	}
+}
+
+func TestXMLOffersHaveDetails(t *testing.T) {
+	data, _ := os.ReadFile("example.xml")
+	menu, err := parseXML(data)
+	if err != nil {
+		t.Fatalf("Parse went wrong %s", err)
+	}
+
+	offers := getUpcomingXMLOffers(menu, time.Date(2023, 2, 21, 12, 0, 0, 0, time.UTC))
+	if len(offers) < 2 {
+		t.Fatalf("Expected the two offers of 21.02.2023, got %v", offers)
+	}
+	firstOffer := offers[0]
+	if !isSameList(firstOffer.Labels, []string{LABEL_VEGETARIAN, LABEL_REGIONAL}) {
+		t.Errorf("Labels weren't normalized: %v", firstOffer.Labels)
+	}
+	if !isSameList(firstOffer.Allergens, []string{"C", "Wei", "F", "I", "G"}) || !isSameList(firstOffer.Additives, []string{"9"}) {
+		t.Errorf("Unexpected allergens or additives: %v, %v", firstOffer.Allergens, firstOffer.Additives)
+	}
+	if firstOffer.StudentPriceInCents != 250 || firstOffer.StaffPriceInCents != 480 || firstOffer.GuestPriceInCents != 480 {
+		t.Errorf("Unexpected prices: %v", firstOffer)
+	}
+	if !isSameList(offers[1].Labels, []string{LABEL_VEGAN}) || len(offers[1].Additives) != 0 {
+		t.Errorf("Unexpected details of second offer: %v", offers[1])
+	}
+}
+
+func TestXMLOffersWithoutNegativeFilterGetItsLabel(t *testing.T) {
+	data, _ := os.ReadFile("example.xml")
+	menu, err := parseXML(data)
+	if err != nil {
+		t.Fatalf("Parse went wrong %s", err)
+	}
+
+	offersByDescription := make(map[string]MenuOffer)
+	for _, offer := range getUpcomingXMLOffers(menu, time.Date(2023, 2, 21, 12, 0, 0, 0, time.UTC)) {
+		offersByDescription[offer.Description[:12]] = offer
+	}
+	cases := []struct {
+		description    string
+		expectedLabels []string
+	}{
+		{"Bunte Nudeln", []string{LABEL_VEGETARIAN, LABEL_REGIONAL}},
+		{"Frikadelle m", []string{LABEL_PORK}},
+		{"Linsen-Dal v", []string{LABEL_VEGAN, LABEL_GARLIC}},
+		{"Kabeljaufile", []string{LABEL_FISH}},
+		{"Szegediner T", []string{LABEL_VEGAN, LABEL_ALCOHOL}},
+	}
+	for _, c := range cases {
+		if offer := offersByDescription[c.description]; !isSameList(offer.Labels, c.expectedLabels) {
+			t.Errorf("Expected labels %v for %s, got %v", c.expectedLabels, c.description, offer.Labels)
+		}
+	}
+
+	withoutFilters := getXMLLabels([]XMLLabel{{Name: "vegan"}}, nil)
+	if !isSameList(withoutFilters, []string{LABEL_VEGAN, LABEL_PORK, LABEL_FISH, LABEL_ALCOHOL, LABEL_GARLIC}) {
+		t.Errorf("Offer without negative filters isn't treated as containing everything: %v", withoutFilters)
+	}
+}
+
+func TestPricesAreParsedToCents(t *testing.T) {
+	for price, expectedCents := range map[string]int{"2.50": 250, "4,8": 480, " 3 ": 300, "": 0, "gratis": 0, "1.234": 0} {
+		if cents := parsePriceInCents(price); cents != expectedCents {
+			t.Errorf("Parsed %q to %d, expected %d", price, cents, expectedCents)
+		}
+	}
+	if formatted := formatPrice(205); formatted != "2.05€" {
+		t.Errorf("Formatted 205 cents as %s", formatted)
+	}
+}
+
+func TestMenuMessageShowsDetails(t *testing.T) {
+	message := buildMessageFrom("Griebnitzsee", []db_connectors.DBOfferInformation{{
+		Title:               "Angebot 4",
+		Description:         "Mini-Kartoffelklöße",
+		Labels:              []string{LABEL_REGIONAL, LABEL_VEGAN},
+		Allergens:           []string{"Kas", "X"},
+		StudentPriceInCents: 350,
+		StaffPriceInCents:   550,
+		GuestPriceInCents:   550,
+	}}, db_connectors.DietaryPreferences{})
+	for _, expected := range []string{"Mini-Kartoffelklöße 🌱📍\n", "💶 3.50€ (staff 5.50€, guests 5.50€)", "Contains Cashews, X"} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("Message doesn't contain %q: %s", expected, message)
+		}
+	}
+	if strings.Contains(message, "🧪") {
+		t.Errorf("Message shows additives of offer without any: %s", message)
+	}
+}
+
+func TestMenuMessageEscapesUpstreamText(t *testing.T) {
+	message := buildMessageFrom("Griebnitzsee", []db_connectors.DBOfferInformation{{
+		Title:       "Angebot <1>",
+		Description: "Fish & Chips",
+		Allergens:   []string{"<X>"},
+	}}, db_connectors.DietaryPreferences{})
+	for _, expected := range []string{"<i>Angebot &lt;1&gt;:</i> Fish &amp; Chips", "Contains &lt;X&gt;"} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("Message doesn't contain %q: %s", expected, message)
+		}
+	}
+}
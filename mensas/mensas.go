@@ -0,0 +1,188 @@
+/*
+Defines the mensas the bot knows about. Each mensa has its own queue
+lengths (including illustrations), opening hours and menu source, all of
+which are read from mensas.json.
+
+Reports, menus and user preferences are keyed by the ID of a mensa.
+*/
+package mensas
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/utils"
+	"go.uber.org/zap"
+)
+
+const MENSAS_JSON_LOCATION string = "./mensas.json"
+
+// Users that never chose a mensa, as well as all data from before we knew about more than one mensa, belong here
+const DEFAULT_MENSA_ID string = "griebnitzsee"
+
+// Hours used for mensas whose opening hours we don't know. Wide enough to cover lunch at any mensa
+const DEFAULT_OPENING_HOUR = 8
+const DEFAULT_CLOSING_HOUR = 18
+
+/*
+QueueLevel is a single queue length that can be reported for a mensa.
+Descriptions need to match REPORT_REGEX (e.g. "L3: Within first room").
+PhotoURL may be empty if there is no illustration
+*/
+type QueueLevel struct {
+	Description string `json:"description"`
+	PhotoURL    string `json:"photo_url"`
+}
+
+/*
+Mensa describes a single mensa. MenuLocationID is the location of the mensa
+within webspeiseplan, and may be empty if we don't know where to get its menu,
+see mensa_scraper.getMenuProviderOf.
+Opening and closing times are given as "15:04" in local time. They are empty for mensas
+whose hours we don't know, which are treated as open from DEFAULT_OPENING_HOUR to
+DEFAULT_CLOSING_HOUR
+*/
+type Mensa struct {
+	ID             string       `json:"id"`
+	Name           string       `json:"name"`
+	MenuLocationID string       `json:"menu_location_id"`
+	OpeningTime    string       `json:"opening_time"`
+	ClosingTime    string       `json:"closing_time"`
+	TopViewURL     string       `json:"top_view_url"`
+	QueueLevels    []QueueLevel `json:"queue_levels"`
+}
+
+var globalMensas []Mensa
+var globalMensasOnce sync.Once
+
+/*
+GetAllMensas returns all mensas, in the order in which they are defined in mensas.json.
+The file is read once, and we panic if it can't be read: Nothing works without it
+*/
+func GetAllMensas() []Mensa {
+	globalMensasOnce.Do(func() {
+		globalMensas = readMensasFromFile(MENSAS_JSON_LOCATION)
+	})
+	return globalMensas
+}
+
+func readMensasFromFile(jsonPath string) []Mensa {
+	var mensas []Mensa
+	jsonFile, err := os.Open(jsonPath)
+	if err != nil {
+		zap.S().Panicf("Can't access mensas json file at %s", jsonPath)
+	}
+	defer jsonFile.Close()
+
+	jsonAsBytes, err := ioutil.ReadAll(jsonFile)
+	if err != nil {
+		zap.S().Panicf("Can't read mensas json file at %s", jsonPath)
+	}
+	if err = json.Unmarshal(jsonAsBytes, &mensas); err != nil {
+		zap.S().Panicf("Mensas json file is malformed, at %s: %s", jsonPath, err)
+	}
+	return mensas
+}
+
+// GetMensa returns the mensa with the given ID, or an error if we don't know it
+func GetMensa(mensaID string) (Mensa, error) {
+	for _, mensa := range GetAllMensas() {
+		if mensa.ID == mensaID {
+			return mensa, nil
+		}
+	}
+	return Mensa{}, fmt.Errorf("Unknown mensa %s", mensaID)
+}
+
+/*
+GetMensaOrDefault returns the mensa with the given ID, and falls back to the
+default mensa for unknown IDs, e.g. because a mensa was removed from mensas.json
+*/
+func GetMensaOrDefault(mensaID string) Mensa {
+	mensa, err := GetMensa(mensaID)
+	if err != nil {
+		zap.S().Warnw("Falling back to default mensa", "mensaID", mensaID)
+		mensa, _ = GetMensa(DEFAULT_MENSA_ID)
+	}
+	return mensa
+}
+
+/*
+GetLevelLabels returns the descriptions of all queue levels, from shortest to longest
+*/
+func (mensa Mensa) GetLevelLabels() []string {
+	var levelLabels []string
+	for _, level := range mensa.QueueLevels {
+		levelLabels = append(levelLabels, level.Description)
+	}
+	return levelLabels
+}
+
+/*
+GetLevelOfQueueLength returns the level of the reported queue length at this mensa.
+Reports are stored with their full text ("L3: Within first room"), so usually this
+is an exact match. If the descriptions changed since the report was made we fall
+back to the number after the L. Returns -1 if neither works.
+*/
+func (mensa Mensa) GetLevelOfQueueLength(queueLength string) int {
+	for i, level := range mensa.QueueLevels {
+		if level.Description == queueLength {
+			return i
+		}
+	}
+	if len(queueLength) >= 2 && queueLength[0] == 'L' {
+		if level, err := strconv.Atoi(queueLength[1:2]); err == nil && level < len(mensa.QueueLevels) {
+			return level
+		}
+	}
+	zap.S().Warnf("Can't map queue length %s to a level", queueLength)
+	return -1
+}
+
+// HasMenuSource returns true if we know where to scrape the menu of this mensa from
+func (mensa Mensa) HasMenuSource() bool {
+	return mensa.MenuLocationID != ""
+}
+
+// GetOpeningTime returns when the mensa opens on the day of the given time
+func (mensa Mensa) GetOpeningTime(day time.Time) time.Time {
+	return timeOnDay(day, mensa.OpeningTime, DEFAULT_OPENING_HOUR)
+}
+
+// GetClosingTime returns when the mensa closes on the day of the given time
+func (mensa Mensa) GetClosingTime(day time.Time) time.Time {
+	return timeOnDay(day, mensa.ClosingTime, DEFAULT_CLOSING_HOUR)
+}
+
+/*
+timeOnDay combines the date of day with a "15:04" time string, in local time.
+Falls back to defaultHour if the time string is empty or malformed
+*/
+func timeOnDay(day time.Time, timeString string, defaultHour int) time.Time {
+	location := utils.GetLocalLocation()
+	localDay := day.In(location)
+	hour, minute := defaultHour, 0
+	if timeString == "" {
+		// We don't know the hours of this mensa
+		return time.Date(localDay.Year(), localDay.Month(), localDay.Day(), hour, minute, 0, 0, location)
+	}
+	hourAndMinute := strings.Split(timeString, ":")
+	if len(hourAndMinute) == 2 {
+		parsedHour, hourErr := strconv.Atoi(hourAndMinute[0])
+		parsedMinute, minuteErr := strconv.Atoi(hourAndMinute[1])
+		if hourErr == nil && minuteErr == nil {
+			hour, minute = parsedHour, parsedMinute
+		} else {
+			zap.S().Errorw("Malformed time in mensas json", "time", timeString)
+		}
+	} else {
+		zap.S().Errorw("Malformed time in mensas json", "time", timeString)
+	}
+	return time.Date(localDay.Year(), localDay.Month(), localDay.Day(), hour, minute, 0, 0, location)
+}
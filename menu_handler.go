@@ -0,0 +1,233 @@
+package main
+
+/*
+Menus of other days than today: Users can ask for the menu of tomorrow, of a specific
+weekday, or browse the menus of a whole week. The scraper stores the menus of all
+upcoming days its menu sources know, which is usually this and next week.
+
+The week view is a single message with one page per weekday. Its buttons edit the
+message to show another day, or the other week
+*/
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/command_router"
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensa_scraper"
+	"github.com/ADimeo/MensaQueueBot/mensas"
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"github.com/ADimeo/MensaQueueBot/utils"
+	"go.uber.org/zap"
+)
+
+// A message that matches this regex asks for the menu of another day, e.g. "Menu tomorrow?"
+const MENU_DAY_REGEX string = `(?i)^menu (tomorrow|monday|tuesday|wednesday|thursday|friday|saturday|sunday)\??$`
+
+// Callback action of the buttons below the week view. The argument is the day to show, as 2006-01-02
+const MENU_WEEK_CALLBACK = "menuweek"
+
+var menuDayExpression = regexp.MustCompile(MENU_DAY_REGEX)
+
+/*
+getMenuDay returns the day the user asks for with "today", "tomorrow" or the name of a weekday.
+Weekdays are the next day with that name, which may be today
+*/
+func getMenuDay(dayName string, now time.Time) (time.Time, bool) {
+	dayName = strings.ToLower(strings.TrimSpace(dayName))
+	switch dayName {
+	case "", "today":
+		return now, true
+	case "tomorrow":
+		return now.AddDate(0, 0, 1), true
+	}
+	for daysAhead := 0; daysAhead < 7; daysAhead++ {
+		day := now.AddDate(0, 0, daysAhead)
+		weekdayName := strings.ToLower(day.Weekday().String())
+		if dayName == weekdayName || (len(dayName) >= 3 && strings.HasPrefix(weekdayName, dayName)) {
+			return day, true
+		}
+	}
+	return now, false
+}
+
+// handleMenuDayRequest answers messages matching MENU_DAY_REGEX
+func handleMenuDayRequest(request *command_router.Request) {
+	dayName := menuDayExpression.FindStringSubmatch(request.Text)[1]
+	now := time.Now().In(utils.GetLocalLocation())
+	if strings.ToLower(dayName) == "tomorrow" {
+		sendMenuOfTomorrow(request.ChatID, now)
+		return
+	}
+	day, _ := getMenuDay(dayName, now)
+	sendMenuOfDay(request.ChatID, day)
+}
+
+// handleMenuCommand answers /menu, which takes "week", "tomorrow" or a weekday as argument
+func handleMenuCommand(request *command_router.Request) {
+	now := time.Now().In(utils.GetLocalLocation())
+	argument := strings.ToLower(request.Arguments)
+	if argument == "" || argument == "today" {
+		handleMenuRequest(request)
+		return
+	}
+	if argument == "week" || argument == "this week" {
+		sendWeekMenu(request.ChatID, now)
+		return
+	}
+	if argument == "tomorrow" {
+		sendMenuOfTomorrow(request.ChatID, now)
+		return
+	}
+	day, isDay := getMenuDay(argument, now)
+	if !isDay {
+		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.INFO_REQUEST, request.ChatID)
+		sendMessage(request.ChatID, "I don't know which day you mean. Try /menu tomorrow, /menu friday or /menu week", keyboardIdentifier)
+		return
+	}
+	sendMenuOfDay(request.ChatID, day)
+}
+
+func handleWeekMenuRequest(request *command_router.Request) {
+	sendWeekMenu(request.ChatID, time.Now().In(utils.GetLocalLocation()))
+}
+
+func sendMenuOfDay(chatID int, day time.Time) {
+	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.INFO_REQUEST, chatID)
+	sendMessage(chatID, getMenuMessageOfDay(chatID, day), keyboardIdentifier)
+}
+
+func sendMenuOfTomorrow(chatID int, now time.Time) {
+	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.INFO_REQUEST, chatID)
+	sendMessage(chatID, getMenuMessageOfTomorrow(chatID, now), keyboardIdentifier)
+}
+
+/*
+getMenuMessageOfTomorrow returns the menu of tomorrow. On weekends the mensa is usually
+closed, so unless there is a menu for tomorrow anyway we say so, and show the menu of monday
+*/
+func getMenuMessageOfTomorrow(chatID int, now time.Time) string {
+	if message, hasNoMenu := getNoMenuMessage(chatID); hasNoMenu {
+		return message
+	}
+	tomorrow := now.AddDate(0, 0, 1)
+	if tomorrow.Weekday() != time.Saturday && tomorrow.Weekday() != time.Sunday {
+		return getMenuMessageOfDay(chatID, tomorrow)
+	}
+	if message, found, err := mensa_scraper.GetMenuMessageOfDay(chatID, tomorrow); err == nil && found {
+		return message
+	}
+	return "The mensa is closed tomorrow 😴\n\n" + getMenuMessageOfDay(chatID, getWeekOf(tomorrow))
+}
+
+// getMenuMessageOfDay returns the menu of the given day, or explains why there is none
+func getMenuMessageOfDay(chatID int, day time.Time) string {
+	if message, hasNoMenu := getNoMenuMessage(chatID); hasNoMenu {
+		return message
+	}
+	message, found, err := mensa_scraper.GetMenuMessageOfDay(chatID, day)
+	if err != nil {
+		zap.S().Errorw("Can't get menu of day", "day", day.Format("2006-01-02"), "error", err)
+		return "I'm so sorry, I can't find the menu 🤕"
+	}
+	if !found {
+		return fmt.Sprintf("I don't know the menu of %s yet 🤷", day.Format(mensa_scraper.MENU_DAY_FORMAT))
+	}
+	return message
+}
+
+/*
+getNoMenuMessage returns a message that explains that we don't have menus for the mensa of
+the user, see mensas.Mensa.HasMenuSource. Returns false if we do have menus for it
+*/
+func getNoMenuMessage(chatID int) (string, bool) {
+	mensa := mensas.GetMensaOrDefault(db_connectors.GetUserMensaID(chatID))
+	if mensa.HasMenuSource() {
+		return "", false
+	}
+	return fmt.Sprintf("There is no menu available for %s, I only know about its queue 🤷", mensa.Name), true
+}
+
+/*
+getWeekOf returns the monday of the week the user most likely means with "this week".
+On weekends that's the next week, since the mensa is closed
+*/
+func getWeekOf(now time.Time) time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch today.Weekday() {
+	case time.Saturday:
+		return today.AddDate(0, 0, 2)
+	case time.Sunday:
+		return today.AddDate(0, 0, 1)
+	}
+	return today.AddDate(0, 0, -int(today.Weekday()-time.Monday))
+}
+
+// sendWeekMenu sends the week view, showing the menu of today, or of monday on weekends
+func sendWeekMenu(chatID int, now time.Time) {
+	if message, hasNoMenu := getNoMenuMessage(chatID); hasNoMenu {
+		// No point in browsing days without menus
+		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.INFO_REQUEST, chatID)
+		sendMessage(chatID, message, keyboardIdentifier)
+		return
+	}
+	day := now
+	if thisWeek := getWeekOf(now); thisWeek.After(now) {
+		day = thisWeek
+	}
+	if _, err := telegram_connector.SendMessageWithInlineKeyboard(chatID, getMenuMessageOfDay(chatID, day), getWeekMenuKeyboard(day, now)); err != nil {
+		zap.S().Errorw("Can't send week menu", "error", err)
+	}
+}
+
+/*
+getWeekMenuKeyboard returns the buttons below the week view while it shows the given day:
+One for each weekday of its week, and one to switch between this and next week
+*/
+func getWeekMenuKeyboard(shownDay time.Time, now time.Time) telegram_connector.InlineKeyboardMarkup {
+	shownWeek := getWeekOf(shownDay)
+	var dayButtons []telegram_connector.InlineKeyboardButton
+	for weekday := 0; weekday < 5; weekday++ {
+		day := shownWeek.AddDate(0, 0, weekday)
+		label := day.Format("Mon")
+		argument := day.Format("2006-01-02")
+		if argument == shownDay.Format("2006-01-02") {
+			// Pressing the day that is shown already does nothing
+			label = "· " + label + " ·"
+			argument = ""
+		}
+		dayButtons = append(dayButtons, telegram_connector.NewCallbackButton(label, MENU_WEEK_CALLBACK, argument))
+	}
+
+	thisWeek := getWeekOf(now)
+	weekButton := telegram_connector.NewCallbackButton("Next week »", MENU_WEEK_CALLBACK, thisWeek.AddDate(0, 0, 7).Format("2006-01-02"))
+	if !shownWeek.Equal(thisWeek) {
+		// Also brings views that were sent in earlier weeks back to this week
+		firstDayOfThisWeek := thisWeek
+		if now.After(thisWeek) {
+			firstDayOfThisWeek = now
+		}
+		weekButton = telegram_connector.NewCallbackButton("« This week", MENU_WEEK_CALLBACK, firstDayOfThisWeek.Format("2006-01-02"))
+	}
+	return telegram_connector.NewInlineKeyboard(dayButtons, []telegram_connector.InlineKeyboardButton{weekButton})
+}
+
+// HandleWeekMenuCallback shows another day in the week view whose button was pressed
+func HandleWeekMenuCallback(request *command_router.Request) {
+	if request.Arguments == "" {
+		return
+	}
+	now := time.Now().In(utils.GetLocalLocation())
+	day, err := time.ParseInLocation("2006-01-02", request.Arguments, utils.GetLocalLocation())
+	if err != nil {
+		zap.S().Warnw("Week menu button has unexpected day", "argument", request.Arguments)
+		return
+	}
+	keyboard := getWeekMenuKeyboard(day, now)
+	if err := telegram_connector.EditMessageText(request.ChatID, request.MessageID, getMenuMessageOfDay(request.ChatID, day), &keyboard); err != nil {
+		zap.S().Errorw("Can't edit week menu", "error", err)
+	}
+}
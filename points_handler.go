@@ -22,7 +22,7 @@ func SendPointsHelpMessages(chatID int) {
 	for i := 0; i < len(messageArray); i++ {
 		messageString := messageArray[i]
 		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.SETTINGS_INTERACTION, chatID)
-		err := telegram_connector.SendMessage(chatID, messageString, keyboardIdentifier)
+		err := sendMessage(chatID, messageString, keyboardIdentifier)
 		if err != nil {
 			zap.S().Error("Error while sending help message for point", err)
 		}
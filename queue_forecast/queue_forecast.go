@@ -0,0 +1,199 @@
+/*
+Forecasts queue lengths for the near future, based on what was reported on
+the same weekday in past weeks and on what was reported today.
+
+The forecast is split into slots of 15 minutes. For each slot the expected
+level is the mean of all historical reports made at that time of day, where
+recent weeks weigh more than older ones. The confidence band is one (weighted)
+standard deviation around that mean. If today's queue is longer or shorter
+than it usually is, the forecast is shifted accordingly, with that shift fading
+out the further we look into the future.
+*/
+package queue_forecast
+
+import (
+	"math"
+	"time"
+)
+
+const SLOT_LENGTH = 15 * time.Minute
+const FORECAST_HORIZON = 2 * time.Hour
+
+// Historical reports lose half of their weight every RECENCY_HALF_LIFE
+const RECENCY_HALF_LIFE = 7 * 24 * time.Hour
+
+// Reports from today that are older than this don't influence the forecast
+const TODAY_ADJUSTMENT_WINDOW = 60 * time.Minute
+
+// The influence of today's reports halves every TODAY_ADJUSTMENT_HALF_LIFE into the future
+const TODAY_ADJUSTMENT_HALF_LIFE = 60 * time.Minute
+
+// Bands are at least this wide in each direction, a single report doesn't make us certain
+const MINIMAL_BAND_HALF_WIDTH = 0.5
+
+// Report is a single queue length report. Level is the number of the queue length, e.g. 3 for L3
+type Report struct {
+	Time  time.Time
+	Level int
+}
+
+/*
+Slot is the forecast for a single timeslot. Expected, Lower and Upper are
+levels, but not necessarily whole ones. Slots without historical reports
+have HasData set to false, and no meaningful levels
+*/
+type Slot struct {
+	Start    time.Time
+	End      time.Time
+	Expected float64
+	Lower    float64
+	Upper    float64
+	HasData  bool
+}
+
+type Forecast struct {
+	Slots []Slot
+}
+
+/*
+Compute forecasts the FORECAST_HORIZON after now. historicalReports should be
+from earlier days, todaysReports from today. numberOfLevels is used to keep the
+forecast within the existing levels. Times of day are compared in location.
+*/
+func Compute(now time.Time, historicalReports []Report, todaysReports []Report, numberOfLevels int, location *time.Location) Forecast {
+	var forecast Forecast
+	if numberOfLevels <= 0 {
+		return forecast
+	}
+	offset := computeTodaysOffset(now, historicalReports, todaysReports, location)
+	highestLevel := float64(numberOfLevels - 1)
+
+	for slotStart := firstSlotStart(now, location); slotStart.Before(now.Add(FORECAST_HORIZON)); slotStart = slotStart.Add(SLOT_LENGTH) {
+		slot := Slot{Start: slotStart, End: slotStart.Add(SLOT_LENGTH)}
+		mean, deviation, totalWeight := weightedStatistics(now, historicalReports, slot.Start, slot.End, location)
+		if totalWeight > 0 {
+			slotMiddle := slot.Start.Add(SLOT_LENGTH / 2)
+			fading := math.Pow(0.5, float64(slotMiddle.Sub(now))/float64(TODAY_ADJUSTMENT_HALF_LIFE))
+			if fading > 1 {
+				fading = 1
+			}
+			expected := mean + offset*fading
+			halfWidth := math.Max(deviation, MINIMAL_BAND_HALF_WIDTH)
+
+			slot.HasData = true
+			slot.Expected = clamp(expected, 0, highestLevel)
+			slot.Lower = clamp(expected-halfWidth, 0, highestLevel)
+			slot.Upper = clamp(expected+halfWidth, 0, highestLevel)
+		}
+		forecast.Slots = append(forecast.Slots, slot)
+	}
+	return forecast
+}
+
+/*
+BestSlot returns the slot with the shortest expected queue. On ties the
+earlier slot wins, since going earlier leaves more options. Returns false
+if no slot has data
+*/
+func (forecast Forecast) BestSlot() (Slot, bool) {
+	var bestSlot Slot
+	found := false
+	for _, slot := range forecast.Slots {
+		if !slot.HasData {
+			continue
+		}
+		if !found || math.Round(slot.Expected) < math.Round(bestSlot.Expected) {
+			bestSlot = slot
+			found = true
+		}
+	}
+	return bestSlot, found
+}
+
+// firstSlotStart returns the start of the slot that contains now
+func firstSlotStart(now time.Time, location *time.Location) time.Time {
+	localNow := now.In(location)
+	midnight := time.Date(localNow.Year(), localNow.Month(), localNow.Day(), 0, 0, 0, 0, location)
+	return midnight.Add(localNow.Sub(midnight).Truncate(SLOT_LENGTH))
+}
+
+// timeOfDay returns how long after local midnight t is
+func timeOfDay(t time.Time, location *time.Location) time.Duration {
+	localTime := t.In(location)
+	return time.Duration(localTime.Hour())*time.Hour +
+		time.Duration(localTime.Minute())*time.Minute +
+		time.Duration(localTime.Second())*time.Second
+}
+
+/*
+weightedStatistics returns weighted mean and standard deviation of all reports
+whose time of day is within [start, end), as well as the sum of their weights
+*/
+func weightedStatistics(now time.Time, reports []Report, start time.Time, end time.Time, location *time.Location) (float64, float64, float64) {
+	startOfDay := timeOfDay(start, location)
+	endOfDay := timeOfDay(end, location)
+	if endOfDay <= startOfDay {
+		// Slot crosses midnight, nothing to forecast there
+		endOfDay = 24 * time.Hour
+	}
+
+	var totalWeight, weightedSum float64
+	var weights []float64
+	var levels []float64
+	for _, report := range reports {
+		reportTimeOfDay := timeOfDay(report.Time, location)
+		if reportTimeOfDay < startOfDay || reportTimeOfDay >= endOfDay {
+			continue
+		}
+		age := now.Sub(report.Time)
+		if age < 0 {
+			age = 0
+		}
+		weight := math.Pow(0.5, float64(age)/float64(RECENCY_HALF_LIFE))
+		totalWeight += weight
+		weightedSum += weight * float64(report.Level)
+		weights = append(weights, weight)
+		levels = append(levels, float64(report.Level))
+	}
+	if totalWeight == 0 {
+		return 0, 0, 0
+	}
+	mean := weightedSum / totalWeight
+
+	var weightedSquaredDeviations float64
+	for i, level := range levels {
+		weightedSquaredDeviations += weights[i] * (level - mean) * (level - mean)
+	}
+	return mean, math.Sqrt(weightedSquaredDeviations / totalWeight), totalWeight
+}
+
+/*
+computeTodaysOffset returns how much longer (positive) or shorter (negative)
+today's queue is compared to what was historically reported at the same times.
+Only reports within TODAY_ADJUSTMENT_WINDOW before now count, newer ones more
+*/
+func computeTodaysOffset(now time.Time, historicalReports []Report, todaysReports []Report, location *time.Location) float64 {
+	var totalWeight, weightedSum float64
+	for _, report := range todaysReports {
+		age := now.Sub(report.Time)
+		if age < 0 || age > TODAY_ADJUSTMENT_WINDOW {
+			continue
+		}
+		historicalMean, _, historicalWeight := weightedStatistics(now, historicalReports,
+			report.Time.Add(-SLOT_LENGTH/2), report.Time.Add(SLOT_LENGTH/2), location)
+		if historicalWeight == 0 {
+			continue
+		}
+		weight := math.Pow(0.5, float64(age)/float64(TODAY_ADJUSTMENT_WINDOW/2))
+		totalWeight += weight
+		weightedSum += weight * (float64(report.Level) - historicalMean)
+	}
+	if totalWeight == 0 {
+		return 0
+	}
+	return weightedSum / totalWeight
+}
+
+func clamp(value float64, lowest float64, highest float64) float64 {
+	return math.Max(lowest, math.Min(highest, value))
+}
@@ -0,0 +1,100 @@
+package queue_forecast
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+// weeksAgo returns a report from the same weekday, the given number of weeks ago, at hh:mm
+func weeksAgo(weeks int, hour int, minute int, level int) Report {
+	day := testNow.AddDate(0, 0, -7*weeks)
+	return Report{Time: time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, time.UTC), Level: level}
+}
+
+func slotAt(t *testing.T, forecast Forecast, hour int, minute int) Slot {
+	for _, slot := range forecast.Slots {
+		if slot.Start.Hour() == hour && slot.Start.Minute() == minute {
+			return slot
+		}
+	}
+	t.Fatalf("Forecast has no slot at %02d:%02d", hour, minute)
+	return Slot{}
+}
+
+func TestForecastCoversTwoHoursInSlots(t *testing.T) {
+	forecast := Compute(testNow.Add(5*time.Minute), nil, nil, 9, time.UTC)
+	if len(forecast.Slots) != 9 {
+		t.Fatalf("Expected 9 slots from 12:00 to 14:15, got %d", len(forecast.Slots))
+	}
+	if forecast.Slots[0].Start != testNow || forecast.Slots[0].End != testNow.Add(SLOT_LENGTH) {
+		t.Errorf("First slot should contain now, is %v to %v", forecast.Slots[0].Start, forecast.Slots[0].End)
+	}
+	if _, found := forecast.BestSlot(); found {
+		t.Errorf("Forecast without data shouldn't have a best slot")
+	}
+}
+
+func TestRecentWeeksWeighMore(t *testing.T) {
+	historical := []Report{weeksAgo(1, 12, 20, 4), weeksAgo(4, 12, 20, 0)}
+	forecast := Compute(testNow, historical, nil, 9, time.UTC)
+
+	slot := slotAt(t, forecast, 12, 15)
+	if !slot.HasData || slot.Expected <= 2 || slot.Expected >= 4 {
+		t.Errorf("Expected level between 2 and 4, leaning to the newer report, got %f", slot.Expected)
+	}
+	if slot.Lower >= slot.Expected || slot.Upper <= slot.Expected {
+		t.Errorf("Band %f to %f doesn't contain expected level %f", slot.Lower, slot.Upper, slot.Expected)
+	}
+	if slotAt(t, forecast, 13, 0).HasData {
+		t.Errorf("Slot without reports shouldn't have data")
+	}
+}
+
+func TestTodaysReportsShiftForecast(t *testing.T) {
+	historical := []Report{
+		weeksAgo(1, 11, 50, 2), weeksAgo(2, 11, 50, 2),
+		weeksAgo(1, 12, 35, 2), weeksAgo(2, 12, 35, 2),
+		weeksAgo(1, 13, 50, 2), weeksAgo(2, 13, 50, 2),
+	}
+	today := []Report{{Time: testNow.Add(-10 * time.Minute), Level: 5}}
+	forecast := Compute(testNow, historical, today, 9, time.UTC)
+
+	soon := slotAt(t, forecast, 12, 30)
+	later := slotAt(t, forecast, 13, 45)
+	if soon.Expected <= 2 {
+		t.Errorf("Long queue today should lengthen forecast, got %f", soon.Expected)
+	}
+	if later.Expected >= soon.Expected || later.Expected <= 2 {
+		t.Errorf("Influence of today should fade, got %f soon and %f later", soon.Expected, later.Expected)
+	}
+}
+
+func TestBestSlotPrefersShortestThenEarliest(t *testing.T) {
+	historical := []Report{
+		weeksAgo(1, 12, 5, 3),
+		weeksAgo(1, 12, 50, 1),
+		weeksAgo(1, 13, 20, 1),
+		weeksAgo(1, 13, 35, 4),
+	}
+	forecast := Compute(testNow, historical, nil, 9, time.UTC)
+	best, found := forecast.BestSlot()
+	if !found {
+		t.Fatalf("Expected a best slot")
+	}
+	if best.Start != testNow.Add(45*time.Minute) || math.Round(best.Expected) != 1 {
+		t.Errorf("Expected 12:45 with L1 to be best, got %v with %f", best.Start, best.Expected)
+	}
+}
+
+func TestForecastStaysWithinLevels(t *testing.T) {
+	historical := []Report{weeksAgo(1, 12, 5, 2), weeksAgo(2, 12, 5, 2)}
+	today := []Report{{Time: testNow.Add(-time.Minute), Level: 20}}
+	forecast := Compute(testNow, historical, today, 3, time.UTC)
+	slot := slotAt(t, forecast, 12, 0)
+	if slot.Expected > 2 || slot.Upper > 2 || slot.Lower < 0 {
+		t.Errorf("Forecast leaves existing levels: %f (%f to %f)", slot.Expected, slot.Lower, slot.Upper)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Decides what the queue length currently is, given a number of possibly
+conflicting reports.
+
+Reporters are only known by their daily pseudonym. That is enough to spot
+two kinds of suspect reports:
+  - Floods: A pseudonym that reports more than FLOOD_LIMIT times within FLOOD_WINDOW
+  - Contradictions: A report that several other pseudonyms disagree with, within CONTRADICTION_WINDOW
+
+The consensus is the weighted median of all reports that aren't suspect.
+Recent reports weigh more, and pseudonyms that report often share their weight
+between their reports, so that no single reporter can outvote everybody else.
+*/
+package report_consensus
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Only reports from within this window influence the consensus
+const CONSENSUS_WINDOW = 20 * time.Minute
+
+// Reports lose half of their weight every RECENCY_HALF_LIFE
+const RECENCY_HALF_LIFE = 5 * time.Minute
+
+// A pseudonym may report FLOOD_LIMIT times within FLOOD_WINDOW, every further report is suspect
+const FLOOD_LIMIT = 3
+const FLOOD_WINDOW = 10 * time.Minute
+
+// Reports that differ by at least CONTRADICTION_DISTANCE levels contradict each other
+const CONTRADICTION_DISTANCE = 3
+const CONTRADICTION_WINDOW = 10 * time.Minute
+
+// A report is suspect if at least this many other pseudonyms contradict it, and fewer agree
+const MINIMAL_CONTRADICTING_REPORTERS = 2
+
+/*
+Report is a single queue length report. Reporter is the daily pseudonym,
+Level is the number of the queue length, e.g. 3 for L3
+*/
+type Report struct {
+	ID       int64
+	Reporter string
+	Time     time.Time
+	Level    int
+}
+
+/*
+FindSuspects returns the IDs of all reports that are either part of a flood,
+or contradicted by several other reporters. Reports don't need to be sorted
+*/
+func FindSuspects(reports []Report) map[int64]bool {
+	sortedReports := sortedByTime(reports)
+	suspects := make(map[int64]bool)
+
+	for i, report := range sortedReports {
+		reportsWithinFloodWindow := 0
+		for _, earlierReport := range sortedReports[:i+1] {
+			if earlierReport.Reporter == report.Reporter && report.Time.Sub(earlierReport.Time) <= FLOOD_WINDOW {
+				reportsWithinFloodWindow++
+			}
+		}
+		if reportsWithinFloodWindow > FLOOD_LIMIT {
+			suspects[report.ID] = true
+		}
+	}
+
+	for _, report := range sortedReports {
+		if suspects[report.ID] {
+			continue
+		}
+		contradictingReporters := make(map[string]bool)
+		agreeingReporters := make(map[string]bool)
+		for _, otherReport := range sortedReports {
+			if otherReport.Reporter == report.Reporter || suspects[otherReport.ID] {
+				continue
+			}
+			if math.Abs(float64(otherReport.Time.Sub(report.Time))) > float64(CONTRADICTION_WINDOW) {
+				continue
+			}
+			if absoluteDistance(otherReport.Level, report.Level) >= CONTRADICTION_DISTANCE {
+				contradictingReporters[otherReport.Reporter] = true
+			} else {
+				agreeingReporters[otherReport.Reporter] = true
+			}
+		}
+		if len(contradictingReporters) >= MINIMAL_CONTRADICTING_REPORTERS && len(contradictingReporters) > len(agreeingReporters) {
+			suspects[report.ID] = true
+		}
+	}
+	return suspects
+}
+
+/*
+Consensus returns the level the given reports agree on at time now, and the newest
+report that supports it. Suspect reports and reports outside of the CONSENSUS_WINDOW
+are ignored. Returns false if no reports are left
+*/
+func Consensus(now time.Time, reports []Report, suspects map[int64]bool) (int, Report, bool) {
+	var consideredReports []Report
+	reportsPerReporter := make(map[string]int)
+	for _, report := range reports {
+		age := now.Sub(report.Time)
+		if suspects[report.ID] || report.Level < 0 || age < 0 || age > CONSENSUS_WINDOW {
+			continue
+		}
+		consideredReports = append(consideredReports, report)
+		reportsPerReporter[report.Reporter]++
+	}
+	if len(consideredReports) == 0 {
+		return 0, Report{}, false
+	}
+
+	weightPerLevel := make(map[int]float64)
+	totalWeight := 0.0
+	for _, report := range consideredReports {
+		weight := math.Pow(0.5, float64(now.Sub(report.Time))/float64(RECENCY_HALF_LIFE)) / float64(reportsPerReporter[report.Reporter])
+		weightPerLevel[report.Level] += weight
+		totalWeight += weight
+	}
+
+	// Weighted median
+	var levels []int
+	for level := range weightPerLevel {
+		levels = append(levels, level)
+	}
+	sort.Ints(levels)
+	consensusLevel := levels[len(levels)-1]
+	accumulatedWeight := 0.0
+	for _, level := range levels {
+		accumulatedWeight += weightPerLevel[level]
+		if accumulatedWeight >= totalWeight/2 {
+			consensusLevel = level
+			break
+		}
+	}
+
+	var newestSupportingReport Report
+	for _, report := range consideredReports {
+		if report.Level == consensusLevel && !report.Time.Before(newestSupportingReport.Time) {
+			newestSupportingReport = report
+		}
+	}
+	return consensusLevel, newestSupportingReport, true
+}
+
+func sortedByTime(reports []Report) []Report {
+	sortedReports := append([]Report{}, reports...)
+	sort.SliceStable(sortedReports, func(i, j int) bool {
+		return sortedReports[i].Time.Before(sortedReports[j].Time)
+	})
+	return sortedReports
+}
+
+func absoluteDistance(a int, b int) int {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
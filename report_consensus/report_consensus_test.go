@@ -0,0 +1,72 @@
+package report_consensus
+
+import (
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+// minutesAgo returns a report by the given reporter, made the given number of minutes before testNow
+func minutesAgo(id int64, reporter string, minutes int, level int) Report {
+	return Report{ID: id, Reporter: reporter, Time: testNow.Add(-time.Duration(minutes) * time.Minute), Level: level}
+}
+
+func TestSingleOutlierIsSuspectAndIgnored(t *testing.T) {
+	reports := []Report{
+		minutesAgo(1, "a", 8, 1),
+		minutesAgo(2, "b", 5, 2),
+		minutesAgo(3, "c", 1, 8),
+	}
+	suspects := FindSuspects(reports)
+	if !suspects[3] || len(suspects) != 1 {
+		t.Fatalf("Expected only the L8 report to be suspect, got %v", suspects)
+	}
+	level, supportingReport, found := Consensus(testNow, reports, suspects)
+	if !found || level == 8 {
+		t.Errorf("Outlier decided the consensus: %d", level)
+	}
+	if supportingReport.Level != level {
+		t.Errorf("Supporting report %v doesn't have the consensus level %d", supportingReport, level)
+	}
+}
+
+func TestFloodingReporterIsDiscounted(t *testing.T) {
+	reports := []Report{
+		minutesAgo(1, "honest", 3, 1),
+		minutesAgo(2, "spammer", 5, 7),
+		minutesAgo(3, "spammer", 4, 7),
+		minutesAgo(4, "spammer", 2, 7),
+		minutesAgo(5, "spammer", 1, 7),
+	}
+	suspects := FindSuspects(reports)
+	if !suspects[5] || suspects[1] {
+		t.Errorf("Expected only the report after the flood limit to be suspect, got %v", suspects)
+	}
+	level, _, _ := Consensus(testNow, reports, suspects)
+	if level != 1 {
+		t.Errorf("Flooding reporter outvoted the other reporter, consensus is %d", level)
+	}
+}
+
+func TestQueueGrowingIsNotSuspect(t *testing.T) {
+	reports := []Report{
+		minutesAgo(1, "a", 18, 1),
+		minutesAgo(2, "b", 6, 4),
+		minutesAgo(3, "c", 2, 5),
+	}
+	if suspects := FindSuspects(reports); len(suspects) != 0 {
+		t.Errorf("Reports that are too far apart to contradict each other were marked as suspect: %v", suspects)
+	}
+	level, supportingReport, _ := Consensus(testNow, reports, nil)
+	if level < 4 || supportingReport.ID == 1 {
+		t.Errorf("Old report outweighed newer ones, consensus is %d", level)
+	}
+}
+
+func TestNoConsensusWithoutRecentReports(t *testing.T) {
+	reports := []Report{minutesAgo(1, "a", 30, 2)}
+	if _, _, found := Consensus(testNow, reports, nil); found {
+		t.Errorf("Found consensus with only outdated reports")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensas"
 	"github.com/ADimeo/MensaQueueBot/telegram_connector"
 	"github.com/ADimeo/MensaQueueBot/utils"
 	"go.uber.org/zap"
@@ -23,7 +24,7 @@ func HandleNavigationToReportKeyboard(sentMessage string, chatID int) {
 	db_connectors.SetUserToReportedOnDate(chatID, nowInUTCTime)
 
 	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_REPORT, chatID)
-	telegram_connector.SendMessage(chatID, message, keyboardIdentifier)
+	sendMessage(chatID, message, keyboardIdentifier)
 }
 
 /*
@@ -31,13 +32,27 @@ HandleLengthReport is the function called on the actual Lx length report. It han
 and storage of the given report, as well as the feedback message.
 */
 func HandleLengthReport(sentMessage string, messageUnixTime int, chatID int) {
-	if reportAppearsValid(sentMessage) {
-		errorWhileSaving := saveQueueLength(sentMessage, messageUnixTime, chatID)
+	usersMensa := getUsersMensa(chatID)
+	if reportAppearsValid(sentMessage, usersMensa) {
+		reportID, errorWhileSaving := saveQueueLength(sentMessage, messageUnixTime, chatID, usersMensa.ID)
 		if errorWhileSaving == nil {
+			awardedPoint := false
 			if db_connectors.UserIsCollectingPoints(chatID) {
-				db_connectors.AddInternetPoint(chatID)
+				awardedPoint = db_connectors.AddInternetPoint(chatID) == nil
 			}
+			rememberUndoableReport(chatID, undoableReport{
+				ReportID:     reportID,
+				MensaID:      usersMensa.ID,
+				QueueLength:  sentMessage,
+				ReportedAt:   time.Now(),
+				AwardedPoint: awardedPoint,
+			})
 			sendThankYouMessage(chatID, sentMessage)
+			// Nobody wants to be sent to the mensa because of spam
+			if !db_connectors.IsReportSuspect(reportID) {
+				SendQueueAlertsForReport(chatID, messageUnixTime, sentMessage, usersMensa)
+				refreshLiveMessagesOfMensa(usersMensa.ID, time.Now())
+			}
 		}
 	} else {
 		sendNoThanksMessage(chatID, sentMessage)
@@ -50,12 +65,12 @@ func HandleLengthReport(sentMessage string, messageUnixTime int, chatID int) {
 */
 func sendThankYouMessage(chatID int, textSentByUser string) {
 	emojiRune := GetRandomAcceptableEmoji()
-	baseMessage := "You reported length %s, thanks " + string(emojiRune)
+	baseMessage := "You reported length %s, thanks " + string(emojiRune) + "\nMis-tapped? Send /undo within " + fmt.Sprintf("%.0f", UNDO_WINDOW.Minutes()) + " minutes to take it back"
 
 	zap.S().Infof("Sending thank you for %s", textSentByUser)
 
 	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.LENGTH_REPORT, chatID)
-	err := telegram_connector.SendMessage(chatID, fmt.Sprintf(baseMessage, textSentByUser), keyboardIdentifier)
+	err := sendMessage(chatID, fmt.Sprintf(baseMessage, textSentByUser), keyboardIdentifier)
 	if err != nil {
 		zap.S().Error("Error while sending thank you message.", err)
 	}
@@ -68,21 +83,26 @@ func sendNoThanksMessage(chatID int, textSentByUser string) {
 	zap.S().Infof("Sending no thanks for %s", textSentByUser)
 
 	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.LENGTH_REPORT, chatID)
-	err := telegram_connector.SendMessage(chatID, baseMessage, keyboardIdentifier)
+	err := sendMessage(chatID, baseMessage, keyboardIdentifier)
 	if err != nil {
 		zap.S().Error("Error while sending no thanks message.", err)
 	}
 }
 
 /*
-   Writes the given queue length to the database
+   Writes the given queue length at the given mensa to the database, and returns the ID of the report
 */
-func saveQueueLength(queueLength string, unixTimestamp int, chatID int) error {
+func saveQueueLength(queueLength string, unixTimestamp int, chatID int, mensaID string) (int64, error) {
 	chatIDString := strconv.Itoa(chatID)
-	return db_connectors.WriteReportToDB(chatIDString, unixTimestamp, queueLength)
+	return db_connectors.WriteReportToDB(chatIDString, unixTimestamp, queueLength, mensaID)
 }
 
-func reportAppearsValid(reportText string) bool {
+func reportAppearsValid(reportText string, mensa mensas.Mensa) bool {
+	// Checking length: Buttons of old keyboards may offer levels this mensa doesn't have
+	if mensa.GetLevelOfQueueLength(reportText) < 0 {
+		zap.S().Infow("Report isn't a queue length of the mensa", "mensa", mensa.ID)
+		return false
+	}
 	// Checking time: It's not on the weekend
 	if utils.IsInDebugMode() {
 		zap.S().Info("Running in Debug mode, skipping report validity check")
@@ -96,8 +116,8 @@ func reportAppearsValid(reportText string) bool {
 		return false
 	}
 
-	if utils.GetMensaOpeningTime().After(today) ||
-		utils.GetMensaClosingTime().Before(today) {
+	if mensa.GetOpeningTime(today).After(today) ||
+		mensa.GetClosingTime(today).Before(today) {
 		zap.S().Info("Report is outside of mensa hours")
 		// Outside of mensa closing times
 		return false
@@ -0,0 +1,224 @@
+package main
+
+/*
+Defines which messages we react to, and how. See command_router for how
+messages are matched to handlers.
+*/
+
+import (
+	"runtime/debug"
+	"sync"
+
+	"github.com/ADimeo/MensaQueueBot/command_router"
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensa_scraper"
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"go.uber.org/zap"
+)
+
+const PLATYPUS_URL = "https://upload.wikimedia.org/wikipedia/commons/4/4a/%22Nam_Sang_Woo_Safety_Matches%22_platypus_matchbox_label_art_-_from%2C_Collectie_NMvWereldculturen%2C_TM-6477-76%2C_Etiketten_van_luciferdoosjes%2C_1900-1949_%28cropped%29.jpg"
+
+// Legacy users that use one of these routes don't get a new keyboard otherwise, so we send one
+var legacyRoutesWithoutKeyboard = map[string]bool{
+	"/jetze":    true,
+	"/platypus": true,
+}
+
+var globalRouter *command_router.Router
+var globalRouterOnce sync.Once
+
+func getRouter() *command_router.Router {
+	globalRouterOnce.Do(func() {
+		globalRouter = newRouter()
+	})
+	return globalRouter
+}
+
+func newRouter() *command_router.Router {
+	router := command_router.NewRouter()
+	router.Use(answerCallbackQueries, recoverFromPanics, logRequests, reactivateChats, migrateLegacyUsers, continuePendingFlows)
+	router.SetFallback(handleUnknownMessage)
+
+	// CASES FROM MAIN KEYBOARD
+	router.HandleText("Queue?", handleQueueRequest).With(deliverChangelog)
+	router.HandleText("Menu?", handleMenuRequest).With(deliverChangelog)
+	router.HandleText("Menu this week?", handleWeekMenuRequest).With(deliverChangelog)
+	router.HandleRegex(MENU_DAY_REGEX, handleMenuDayRequest).With(deliverChangelog)
+	router.HandleCallback(MENU_WEEK_CALLBACK, HandleWeekMenuCallback)
+	router.HandleCallback(LIVE_CALLBACK, HandleLiveCallback)
+	router.HandleText("Report!", func(request *command_router.Request) {
+		HandleNavigationToReportKeyboard(request.Text, request.ChatID)
+	})
+	// CASES FROM REPORT KEYBOARD
+	router.HandleRegex(REPORT_REGEX, handleLengthReportRequest).With(expectsKeyboard(telegram_connector.ReportKeyboard), deliverChangelog)
+	router.HandleText("Can't tell", handleCantTellRequest).With(expectsKeyboard(telegram_connector.ReportKeyboard), deliverChangelog)
+	router.HandleCommand("/undo", func(request *command_router.Request) {
+		HandleUndoRequest(request.ChatID)
+	})
+	// CASES FROM SETTINGS KEYBOARD
+	router.HandleCommand("/settings", handleSettingsRequest)
+	router.HandleRegex(POINTS_REGEX, handleSettingsRequest)
+	router.HandleText("General Help", handleHelpRequest)
+	router.HandleText("Points Help", func(request *command_router.Request) {
+		SendPointsHelpMessages(request.ChatID)
+	})
+	router.HandleWebApp("Change Settings", func(request *command_router.Request) {
+		HandleSettingsChange(request.ChatID, request.Update.Message.WebAppData)
+	})
+	router.HandleText("Account Deletion", handleAccountDeletionInfoRequest)
+	router.HandleText("Back", handleBackRequest).With(expectsKeyboard(telegram_connector.SettingsKeyboard), deliverChangelog)
+	// OTHER CASES
+	router.HandleCommand("/start", func(request *command_router.Request) {
+		SendWelcomeMessage(request.ChatID)
+	}).With(deliverChangelog)
+	router.HandleCommand("/help", handleHelpRequest)
+	router.HandleCommand("/menu", handleMenuCommand)
+	router.HandleCommand("/length_illustrations", func(request *command_router.Request) {
+		sendQueueLengthExamples(request.ChatID)
+	})
+	router.HandleCommand("/alerts", func(request *command_router.Request) {
+		StartAlertSetup(request.ChatID)
+	})
+	router.HandleCommand("/forgetme", func(request *command_router.Request) {
+		HandleAccountDeletionRequest(request.ChatID)
+	})
+	router.HandleCallback(ACCOUNT_DELETION_CALLBACK, HandleAccountDeletionCallback)
+	router.HandleCommand("/mydata", func(request *command_router.Request) {
+		HandleDataExport(request.ChatID)
+	})
+	router.HandleCommand("/joinABTesters", func(request *command_router.Request) {
+		HandleABTestJoining(request.ChatID)
+	})
+	router.HandleCommand("/platypus", handlePlatypusRequest)
+	// Predates the main keyboard
+	router.HandleCommand("/jetze", handleQueueRequest)
+	return router
+}
+
+// answerCallbackQueries stops the loading indicator of pressed inline keyboard buttons, even if handling them fails
+func answerCallbackQueries(next command_router.HandlerFunc) command_router.HandlerFunc {
+	return func(request *command_router.Request) {
+		if request.IsCallback() {
+			defer func() {
+				if err := telegram_connector.AnswerCallbackQuery(request.CallbackQueryID, ""); err != nil {
+					zap.S().Errorw("Can't answer callback query", "error", err)
+				}
+			}()
+		}
+		next(request)
+	}
+}
+
+// recoverFromPanics makes sure that a single broken request doesn't take down the bot
+func recoverFromPanics(next command_router.HandlerFunc) command_router.HandlerFunc {
+	return func(request *command_router.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				zap.S().Errorw("Handler panicked", "route", request.RouteName, "panic", recovered, "stack", string(debug.Stack()))
+			}
+		}()
+		next(request)
+	}
+}
+
+func logRequests(next command_router.HandlerFunc) command_router.HandlerFunc {
+	return func(request *command_router.Request) {
+		if request.RouteName == "" {
+			zap.S().Infof("Received unknown message: %s", request.Text)
+		} else {
+			zap.S().Infof("Received a '%s' request", request.RouteName)
+		}
+		next(request)
+	}
+}
+
+/*
+reactivateChats includes chats in pushes again if they were marked inactive, e.g. because
+the user blocked us at some point. Writing to us means they unblocked us
+*/
+func reactivateChats(next command_router.HandlerFunc) command_router.HandlerFunc {
+	return func(request *command_router.Request) {
+		db_connectors.SetChatActive(request.ChatID)
+		next(request)
+	}
+}
+
+/*
+migrateLegacyUsers updates users that haven't used the bot since before
+keyboards were introduced, before their request is handled
+*/
+func migrateLegacyUsers(next command_router.HandlerFunc) command_router.HandlerFunc {
+	return func(request *command_router.Request) {
+		if db_connectors.UserHasBeenMigrated(request.ChatID) {
+			next(request)
+			return
+		}
+		zap.S().Infof("Migrating user from legacy: %d", request.ChatID)
+		updateUserFromLegacy(request.ChatID)
+		next(request)
+		if legacyRoutesWithoutKeyboard[request.RouteName] {
+			sendMessage(request.ChatID, "Upgrading your keyboard...", telegram_connector.MainKeyboard)
+		}
+	}
+}
+
+// deliverChangelog sends the latest changelog after the request was handled, if the user hasn't seen it yet
+func deliverChangelog(next command_router.HandlerFunc) command_router.HandlerFunc {
+	return func(request *command_router.Request) {
+		next(request)
+		sendChangelogIfNecessary(request.ChatID)
+	}
+}
+
+func handleQueueRequest(request *command_router.Request) {
+	GenerateAndSendGraphicQueueLengthReport(request.ChatID)
+}
+
+func handleMenuRequest(request *command_router.Request) {
+	if message, hasNoMenu := getNoMenuMessage(request.ChatID); hasNoMenu {
+		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.INFO_REQUEST, request.ChatID)
+		sendMessage(request.ChatID, message, keyboardIdentifier)
+		return
+	}
+	if err := mensa_scraper.SendLatestMenuToSingleUser(request.ChatID); err != nil {
+		message := "I'm so sorry, I can't find the current menu for today 🤕"
+		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.INFO_REQUEST, request.ChatID)
+		sendMessage(request.ChatID, message, keyboardIdentifier)
+	}
+}
+
+func handleLengthReportRequest(request *command_router.Request) {
+	zap.S().Infof("Received a new report: %s", request.Text)
+	HandleLengthReport(request.Text, request.Update.Message.Date, request.ChatID)
+}
+
+func handleCantTellRequest(request *command_router.Request) {
+	message := "Alrighty"
+	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.LENGTH_REPORT, request.ChatID)
+	sendMessage(request.ChatID, message, keyboardIdentifier)
+}
+
+func handleSettingsRequest(request *command_router.Request) {
+	SendSettingsOverviewMessage(request.ChatID, false)
+}
+
+func handleHelpRequest(request *command_router.Request) {
+	SendHelpMessage(request.ChatID)
+}
+
+func handleAccountDeletionInfoRequest(request *command_router.Request) {
+	message := "To delete all data about you from MensaQueueBot type /forgetme in the chat. Be advised that this action is destructive, and nonreversible. If you ever decide to come back you will be an entirely new user. To see everything I know about you, type /mydata"
+	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.SETTINGS_INTERACTION, request.ChatID)
+	sendMessage(request.ChatID, message, keyboardIdentifier)
+}
+
+func handleBackRequest(request *command_router.Request) {
+	message := "Back to my purpose " + string(GetRandomAcceptableEmoji())
+	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_MAIN, request.ChatID)
+	sendMessage(request.ChatID, message, keyboardIdentifier)
+}
+
+func handlePlatypusRequest(request *command_router.Request) {
+	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.TUTORIAL_MESSAGE, request.ChatID) // Not technically correct, but eh
+	telegram_connector.SendStaticWebPhoto(request.ChatID, PLATYPUS_URL, "So cute ❤️", keyboardIdentifier)
+}
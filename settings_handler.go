@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/ADimeo/MensaQueueBot/command_router"
 	"github.com/ADimeo/MensaQueueBot/db_connectors"
 	"github.com/ADimeo/MensaQueueBot/mensa_scraper"
+	"github.com/ADimeo/MensaQueueBot/mensas"
 	"github.com/ADimeo/MensaQueueBot/telegram_connector"
 	"go.uber.org/zap"
 )
@@ -18,23 +22,125 @@ structures its uploads
 type PreferenceSettings struct {
 	MensaPreferences db_connectors.MensaPreferenceSettings `json:"mensaPreferences"`
 	Points           bool                                  `json:"points"`
+	// nil if the user has an old settings page open, which doesn't know about alerts
+	QueueAlerts *db_connectors.QueueAlertSettings `json:"queueAlerts"`
+	// nil if the user has an old settings page open, which doesn't know about diets
+	DietaryPreferences *db_connectors.DietaryPreferences `json:"dietaryPreferences"`
+}
+
+// Callback action of the buttons below the /forgetme prompt, see command_router.HandleCallback
+const ACCOUNT_DELETION_CALLBACK = "forgetme"
+const ACCOUNT_DELETION_CONFIRM = "confirm"
+const ACCOUNT_DELETION_CANCEL = "cancel"
+
+// Returned by saveNewSettings for queue alerts that can never fire
+var errInvalidQueueAlert = errors.New("Queue alert doesn't fit the mensa")
+
+const USER_DATA_EXPORT_FILE_NAME = "mensa_queue_bot_data.json"
+
+/*
+UserDataExport is what users receive via /mydata: Everything we store about them, by table
+*/
+type UserDataExport struct {
+	ChatID     int                                 `json:"chatID"`
+	ExportedAt time.Time                           `json:"exportedAt"`
+	Tables     map[string][]map[string]interface{} `json:"tables"`
+	Notes      []string                            `json:"notes"`
+}
+
+/*
+HandleAccountDeletionRequest asks the user to confirm that they want to be forgotten.
+The actual deletion happens in HandleAccountDeletionCallback, once they do
+*/
+func HandleAccountDeletionRequest(chatID int) {
+	message := "Do you really want me to forget everything about you? This can't be undone. If you want to see what I know about you first, use /mydata"
+	keyboard := telegram_connector.NewInlineKeyboard([]telegram_connector.InlineKeyboardButton{
+		telegram_connector.NewCallbackButton("Yes, forget me", ACCOUNT_DELETION_CALLBACK, ACCOUNT_DELETION_CONFIRM),
+		telegram_connector.NewCallbackButton("Cancel", ACCOUNT_DELETION_CALLBACK, ACCOUNT_DELETION_CANCEL),
+	})
+	if _, err := telegram_connector.SendMessageWithInlineKeyboard(chatID, message, keyboard); err != nil {
+		zap.S().Error("Error while sending account deletion prompt", err)
+	}
+}
+
+/*
+HandleAccountDeletionCallback reacts to the buttons of the prompt sent by HandleAccountDeletionRequest.
+Prompts that are older than FLOW_EXPIRY can't confirm anymore, so that a forgotten prompt
+doesn't delete accounts by accident. Either way the buttons are removed from the prompt
+*/
+func HandleAccountDeletionCallback(request *command_router.Request) {
+	if request.Arguments != ACCOUNT_DELETION_CONFIRM {
+		editAccountDeletionPrompt(request, "Alright, I'll keep remembering you")
+		return
+	}
+	promptSentAt := time.Unix(int64(request.Update.CallbackQuery.Message.Date), 0)
+	if time.Since(promptSentAt) > FLOW_EXPIRY {
+		zap.S().Info("Ignoring confirmation of expired account deletion prompt")
+		editAccountDeletionPrompt(request, "That question is a bit old, so I'd rather ask again. Send /forgetme if you still want me to forget you")
+		return
+	}
+	if err := telegram_connector.EditMessageReplyMarkup(request.ChatID, request.MessageID, nil); err != nil {
+		zap.S().Errorw("Can't remove buttons from account deletion prompt", "error", err)
+	}
+	HandleAccountDeletion(request.ChatID)
+}
+
+// editAccountDeletionPrompt replaces the prompt with the given message, or sends it if the prompt can't be edited
+func editAccountDeletionPrompt(request *command_router.Request, message string) {
+	if err := telegram_connector.EditMessageText(request.ChatID, request.MessageID, message, nil); err != nil {
+		zap.S().Errorw("Can't edit account deletion prompt", "error", err)
+		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.SETTINGS_INTERACTION, request.ChatID)
+		sendMessage(request.ChatID, message, keyboardIdentifier)
+	}
+}
+
+/*
+HandleDataExport sends the user a JSON file that contains everything we store about them
+*/
+func HandleDataExport(chatID int) {
+	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.SETTINGS_INTERACTION, chatID)
+	tables, err := db_connectors.ExportUserData(chatID)
+	if err != nil {
+		sendMessage(chatID, "Something went wrong collecting your data. Contact @adimeo for details and fixes", keyboardIdentifier)
+		return
+	}
+	export := UserDataExport{
+		ChatID:     chatID,
+		ExportedAt: time.Now().UTC(),
+		Tables:     tables,
+		Notes: []string{
+			"Queue reports are stored under a pseudonym that changes every day, and not under your chat ID. They can't be attributed to you, so they aren't part of this export",
+			"Undoing your last report works via a handle that is only kept in memory for a few minutes, and is never written to disk",
+			"Queue graphs you asked to keep updated are tracked in memory for a few minutes, and are never written to disk",
+		},
+	}
+	exportAsJSON, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		zap.S().Errorw("Can't marshal user data export", "error", err)
+		sendMessage(chatID, "Something went wrong collecting your data. Contact @adimeo for details and fixes", keyboardIdentifier)
+		return
+	}
+	if err := telegram_connector.SendDocument(chatID, USER_DATA_EXPORT_FILE_NAME, exportAsJSON, "This is everything I know about you"); err != nil {
+		zap.S().Errorw("Can't send user data export", "error", err)
+		sendMessage(chatID, "I'm so sorry, I couldn't send you your data 🤕 Please try again later", keyboardIdentifier)
+	}
 }
 
 /*
 Deletes the accounts with the given chatID from the DB, and sends a confirmation message
 */
 func HandleAccountDeletion(chatID int) {
-	err1 := db_connectors.DeleteAllUserPointData(chatID)
-	err2 := db_connectors.DeleteAllUserChangelogData(chatID)
-	err3 := db_connectors.DeleteAllUserMensaPreferences(chatID)
-	if err1 != nil || err2 != nil || err3 != nil {
+	err := db_connectors.DeleteAllUserData(chatID)
+	forgetUndoableReport(chatID)
+	forgetLiveMessage(chatID)
+	if err != nil {
 		zap.S().Infof("Sending error message to user")
 		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.SETTINGS_INTERACTION, chatID)
-		telegram_connector.SendMessage(chatID, "Something went wrong deleting your data. Contact @adimeo for details and fixes", keyboardIdentifier)
-		zap.S().Warn("Error in forgetme: ", err1, err2, err3)
+		sendMessage(chatID, "Something went wrong deleting your data, nothing was deleted. Contact @adimeo for details and fixes", keyboardIdentifier)
+		zap.S().Warn("Error in forgetme: ", err)
 	} else {
 		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.ACCOUNT_DELETION, chatID)
-		telegram_connector.SendMessage(chatID, "Who are you again? I have completely forgotten you exist. Remind me with /start, please?", keyboardIdentifier)
+		sendMessage(chatID, "Who are you again? I have completely forgotten you exist. Remind me with /start, please?", keyboardIdentifier)
 	}
 }
 
@@ -46,18 +152,50 @@ func HandleABTestJoining(chatID int) {
 	ABTestHandler(chatID)
 	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_MAIN, chatID)
 	if err != nil {
-		telegram_connector.SendMessage(chatID, "Something went wrong, please try again later ", keyboardIdentifier)
+		sendMessage(chatID, "Something went wrong, please try again later ", keyboardIdentifier)
 		zap.S().Warn("Error in A/B opt in: ", err)
 	} else {
-		telegram_connector.SendMessage(chatID, "Welcome to the test crew 🫡", keyboardIdentifier)
+		sendMessage(chatID, "Welcome to the test crew 🫡", keyboardIdentifier)
 	}
 }
 
-func saveNewSettings(chatID int, settings PreferenceSettings, mensaSettings db_connectors.MensaPreferenceSettings) bool {
-	settingsUpdated := true
-	startCESTMinutes, _ := mensaSettings.GetFromTimeAsCESTMinute() // These functions default to acceptable values, even on errors
-	endCESTMinutes, _ := mensaSettings.GetToTimeAsCESTMinute()
+/*
+saveNewSettings writes the settings to the DB. Returns an error without saving
+anything if one of the times can't be parsed, or if the queue alert uses a level
+the mensa doesn't have or doesn't start before it ends. Otherwise, returns false
+if some setting couldn't be saved
+*/
+func saveNewSettings(chatID int, settings PreferenceSettings, mensaSettings db_connectors.MensaPreferenceSettings) (bool, error) {
+	startCESTMinutes, err := mensaSettings.GetFromTimeAsCESTMinute()
+	if err != nil {
+		return false, err
+	}
+	endCESTMinutes, err := mensaSettings.GetToTimeAsCESTMinute()
+	if err != nil {
+		return false, err
+	}
+	var alertStartCESTMinutes, alertEndCESTMinutes int
+	if settings.QueueAlerts != nil {
+		if alertStartCESTMinutes, err = settings.QueueAlerts.GetFromTimeAsCESTMinute(); err != nil {
+			return false, err
+		}
+		if alertEndCESTMinutes, err = settings.QueueAlerts.GetToTimeAsCESTMinute(); err != nil {
+			return false, err
+		}
+		if alertStartCESTMinutes >= alertEndCESTMinutes {
+			return false, fmt.Errorf("%w: starts at %d, ends at %d", errInvalidQueueAlert, alertStartCESTMinutes, alertEndCESTMinutes)
+		}
+		mensaID := mensaSettings.MensaID
+		if mensaID == "" {
+			mensaID = db_connectors.GetUserMensaID(chatID)
+		}
+		mensa := mensas.GetMensaOrDefault(mensaID)
+		if maximumLevel := settings.QueueAlerts.MaximumLevel; maximumLevel < 0 || maximumLevel >= len(mensa.QueueLevels) {
+			return false, fmt.Errorf("%w: %s has no level %d", errInvalidQueueAlert, mensa.ID, maximumLevel)
+		}
+	}
 
+	settingsUpdated := true
 	if err := db_connectors.UpdateUserPreferences(chatID, mensaSettings.ReportAtAll, startCESTMinutes, endCESTMinutes, mensaSettings.WeekdayBitmap); err != nil {
 		zap.S().Errorw("Can't update user mensa preferences", "chatID", chatID, err)
 		settingsUpdated = false
@@ -65,7 +203,27 @@ func saveNewSettings(chatID int, settings PreferenceSettings, mensaSettings db_c
 	if err := changePointSettings(settings.Points, chatID); err != nil {
 		settingsUpdated = false
 	}
-	return settingsUpdated
+	if mensaSettings.MensaID != "" {
+		// Old settings pages don't send a mensa
+		if err := db_connectors.SetUserMensa(chatID, mensaSettings.MensaID); err != nil {
+			zap.S().Errorw("Can't update user mensa", "chatID", chatID, err)
+			settingsUpdated = false
+		}
+	}
+	if settings.QueueAlerts != nil {
+		alertSettings := settings.QueueAlerts
+		if err := db_connectors.UpdateQueueAlert(chatID, alertSettings.AlertAtAll, alertSettings.MaximumLevel, alertStartCESTMinutes, alertEndCESTMinutes); err != nil {
+			zap.S().Errorw("Can't update user queue alert", "chatID", chatID, err)
+			settingsUpdated = false
+		}
+	}
+	if settings.DietaryPreferences != nil {
+		if err := db_connectors.UpdateDietaryPreferences(chatID, *settings.DietaryPreferences); err != nil {
+			zap.S().Errorw("Can't update user dietary preferences", "chatID", chatID, err)
+			settingsUpdated = false
+		}
+	}
+	return settingsUpdated, nil
 }
 
 func callReschedulerForInitialMensaMessageJob(mensaSettings db_connectors.MensaPreferenceSettings) {
@@ -90,13 +248,23 @@ func HandleSettingsChange(chatID int, webAppData telegram_connector.WebhookReque
 			zap.S().Errorw("Can't unmarshal the settings json we got as WebAppData", "json", jsonString, "error", err)
 		}
 		mensaSettings := settings.MensaPreferences
-		settingsUpdated := saveNewSettings(chatID, settings, mensaSettings)
+		settingsUpdated, err := saveNewSettings(chatID, settings, mensaSettings)
 
 		// Feedback messages to user
-		if settingsUpdated {
+		if errors.Is(err, errInvalidQueueAlert) {
+			zap.S().Errorw("Refusing settings with invalid queue alert", "chatID", chatID, "error", err)
+			message := "I didn't save your settings, since your queue alert can't work. Please pick a queue length your mensa has, and a start that is before the end"
+			keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_SETTINGS, chatID)
+			sendMessage(chatID, message, keyboardIdentifier)
+		} else if err != nil {
+			zap.S().Errorw("Refusing settings with malformed times", "chatID", chatID, "error", err)
+			message := "I didn't save your settings, since I don't understand one of the times. Please use times like 12:00"
+			keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_SETTINGS, chatID)
+			sendMessage(chatID, message, keyboardIdentifier)
+		} else if settingsUpdated {
 			message := "Successfully saved your settings"
 			keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_SETTINGS, chatID)
-			telegram_connector.SendMessage(chatID, message, keyboardIdentifier)
+			sendMessage(chatID, message, keyboardIdentifier)
 			// Display updated settings to the user
 			SendSettingsOverviewMessage(chatID, true)
 			// Reschedule initial mensa message job, if needed
@@ -104,7 +272,7 @@ func HandleSettingsChange(chatID int, webAppData telegram_connector.WebhookReque
 		} else {
 			message := "Error saving settings, please try again later"
 			keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_SETTINGS, chatID)
-			telegram_connector.SendMessage(chatID, message, keyboardIdentifier)
+			sendMessage(chatID, message, keyboardIdentifier)
 		}
 
 	} else {
@@ -133,20 +301,30 @@ an overview over settings, which makes it slightly fiddly to generate
 */
 func SendSettingsOverviewMessage(chatID int, endInMainMenu bool) error {
 	baseMessage := `<b>Settings</b>`
+	var mensaMessage string
 	var lengthReportMessage string
 	var pointsReportMessage string
+	var queueAlertMessage string
+	var dietMessage string
 	var abTesterMessage string
 
 	userPreferences, err := db_connectors.GetUserPreferences(chatID)
 	if err != nil {
 		zap.S().Errorw("User couldn't quey their settings", "userID", chatID, "error", err)
 		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_SETTINGS, chatID)
-		return telegram_connector.SendMessage(chatID, "I'm sorry, something went wrong. Please complain @adimeo", keyboardIdentifier)
+		return sendMessage(chatID, "I'm sorry, something went wrong. Please complain @adimeo", keyboardIdentifier)
+	}
+	mensa := mensas.GetMensaOrDefault(userPreferences.MensaID)
+	mensaMessage = fmt.Sprintf("Your mensa is %s.", mensa.Name)
+	if !mensa.HasMenuSource() {
+		mensaMessage += " There are no menus for it, only queue reports."
 	}
 	lengthReportMessage = buildLengthReportMessage(userPreferences)
 	pointsReportMessage = buildPointsReportMessage(chatID)
+	queueAlertMessage = buildQueueAlertMessage(chatID)
+	dietMessage = buildDietMessage(chatID)
 
-	message := baseMessage + "\n\n" + lengthReportMessage + "\n\n" + pointsReportMessage
+	message := baseMessage + "\n\n" + mensaMessage + "\n\n" + lengthReportMessage + "\n\n" + dietMessage + "\n\n" + queueAlertMessage + "\n\n" + pointsReportMessage
 
 	if db_connectors.GetIsUserABTester(chatID) {
 		abTesterMessage = buildABTesterMessage(chatID)
@@ -158,7 +336,7 @@ func SendSettingsOverviewMessage(chatID int, endInMainMenu bool) error {
 	} else {
 		keyboardIdentifier = telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_SETTINGS, chatID)
 	}
-	return telegram_connector.SendMessage(chatID, message, keyboardIdentifier)
+	return sendMessage(chatID, message, keyboardIdentifier)
 }
 
 func buildLengthReportMessage(userPreferences db_connectors.MensaPreferenceSettings) string {
@@ -211,6 +389,38 @@ func buildLengthReportMessage(userPreferences db_connectors.MensaPreferenceSetti
 	}
 }
 
+func buildQueueAlertMessage(chatID int) string {
+	alertSettings, err := db_connectors.GetQueueAlertSettings(chatID)
+	if err != nil || !alertSettings.AlertAtAll {
+		return "You are not receiving queue alerts."
+	}
+	levelDescription := fmt.Sprintf("L%d", alertSettings.MaximumLevel)
+	levelLabels := getUsersMensa(chatID).GetLevelLabels()
+	if alertSettings.MaximumLevel >= 0 && alertSettings.MaximumLevel < len(levelLabels) {
+		levelDescription = levelLabels[alertSettings.MaximumLevel]
+	}
+	return fmt.Sprintf("You are alerted once a day when someone reports %s or shorter, from %s to %s", levelDescription, alertSettings.FromTime, alertSettings.ToTime)
+}
+
+func buildDietMessage(chatID int) string {
+	preferences, err := db_connectors.GetDietaryPreferences(chatID)
+	if err != nil || !preferences.IsFiltering() {
+		return "You see all offers of the menu."
+	}
+	offerDescription := "offers"
+	if preferences.Diet != db_connectors.DIET_ANY {
+		offerDescription = preferences.Diet + " offers"
+	}
+	if preferences.NoPork {
+		offerDescription += " without pork"
+	}
+	if len(preferences.ExcludedAllergens) > 0 {
+		allergenNames := mensa_scraper.GetAllergenNames(preferences.ExcludedAllergens)
+		offerDescription += " that don't contain " + strings.Join(allergenNames, ", ")
+	}
+	return fmt.Sprintf("You only see %s.", offerDescription)
+}
+
 func buildPointsReportMessage(chatID int) string {
 	pointsMessage := GetPointsRequestResponseText(chatID)
 	return pointsMessage
@@ -0,0 +1,416 @@
+package telegram_connector
+
+/*
+Outbound rate limiting, and a delivery queue for pushes.
+
+Telegram allows bots roughly 30 messages per second overall, and about one
+message per second per chat, https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+Every message we send to a chat, and every edit of one, goes through callRateLimited
+and waits for globalRateLimiter. It enforces both limits via token buckets, and
+stops all sends for as long as telegram asks us to if we get a 429 anyway.
+
+Pushes that go out to many users at once (menus, queue alerts) are sent via QueueMessage
+instead. Queued messages are stored in the DB, and sent one after another by a
+single worker, see StartDeliveryQueue. Messages that fail because of rate limits are
+retried after retry_after, those that fail on telegrams side are retried with
+exponential backoff. Since the queue lives in the DB, it survives restarts, and
+StopDeliveryQueue only needs to wait for the message that is being sent.
+If the DB fails us, the queue waits at least DELIVERY_POLL_INTERVAL before it tries
+again, and remembers which messages it already sent, so that they aren't sent twice.
+*/
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"go.uber.org/zap"
+)
+
+const GLOBAL_MESSAGES_PER_SECOND = 30
+const PER_CHAT_MESSAGES_PER_SECOND = 1
+
+// Short bursts above the per chat limit are fine, e.g. a reply that consists of multiple messages
+const PER_CHAT_BURST = 5
+
+// Buckets of chats are forgotten once they are full again, but only if we track more than this many
+const MAX_TRACKED_CHATS = 1000
+
+// Failed attempts (not counting rate limits) after which we give up on a queued message
+const MAX_DELIVERY_ATTEMPTS = 8
+const INITIAL_DELIVERY_BACKOFF = time.Second
+const MAX_DELIVERY_BACKOFF = 10 * time.Minute
+
+// How many due messages are read from the DB at once
+const DELIVERY_BATCH_SIZE = 50
+
+// How long the queue waits if it can't tell when the next message is due, e.g. because of DB errors
+const DELIVERY_POLL_INTERVAL = time.Minute
+
+// Longest wait after repeated DB errors
+const MAX_DELIVERY_QUEUE_ERROR_BACKOFF = 30 * time.Minute
+
+var globalRateLimiter = newRateLimiter(GLOBAL_MESSAGES_PER_SECOND, PER_CHAT_MESSAGES_PER_SECOND, PER_CHAT_BURST, time.Now())
+
+// Receives a value whenever a new message is queued. Buffered, so queueing never blocks
+var globalDeliveryWakeup = make(chan struct{}, 1)
+var globalDeliveryQueueOnce sync.Once
+
+// Closed by StopDeliveryQueue, and by the queue once it stopped
+var globalDeliveryQueueStop = make(chan struct{})
+var globalDeliveryQueueStopped = make(chan struct{})
+var globalDeliveryQueueStopOnce sync.Once
+
+/*
+IDs of queued messages that were sent or dropped, but couldn't be removed from the DB.
+They are never sent again, only their removal is retried. Only used by the queue worker
+*/
+var globalFinishedDeliveries = make(map[int]bool)
+
+/*
+tokenBucket allows up to capacity events at once, and refills at tokensPerSecond.
+Tokens may go negative, which means that events have been promised a slot in the future
+*/
+type tokenBucket struct {
+	capacity        float64
+	tokens          float64
+	tokensPerSecond float64
+	lastRefill      time.Time
+}
+
+func newTokenBucket(capacity float64, tokensPerSecond float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity:        capacity,
+		tokens:          capacity,
+		tokensPerSecond: tokensPerSecond,
+		lastRefill:      now,
+	}
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	if now.Before(bucket.lastRefill) {
+		return
+	}
+	elapsedSeconds := now.Sub(bucket.lastRefill).Seconds()
+	bucket.tokens = math.Min(bucket.capacity, bucket.tokens+elapsedSeconds*bucket.tokensPerSecond)
+	bucket.lastRefill = now
+}
+
+// reserve takes a token, and returns how long the caller needs to wait until it may use it
+func (bucket *tokenBucket) reserve(now time.Time) time.Duration {
+	bucket.refill(now)
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.tokensPerSecond * float64(time.Second))
+}
+
+// isFull returns true if the bucket hasn't been used for long enough to have refilled completely
+func (bucket *tokenBucket) isFull(now time.Time) bool {
+	bucket.refill(now)
+	return bucket.tokens >= bucket.capacity
+}
+
+// rateLimiter combines a global token bucket with one bucket per chat
+type rateLimiter struct {
+	mutex                    sync.Mutex
+	global                   *tokenBucket
+	perChat                  map[int]*tokenBucket
+	perChatMessagesPerSecond float64
+	perChatBurst             float64
+	pausedUntil              time.Time
+}
+
+func newRateLimiter(globalMessagesPerSecond float64, perChatMessagesPerSecond float64, perChatBurst float64, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		global:                   newTokenBucket(globalMessagesPerSecond, globalMessagesPerSecond, now),
+		perChat:                  make(map[int]*tokenBucket),
+		perChatMessagesPerSecond: perChatMessagesPerSecond,
+		perChatBurst:             perChatBurst,
+	}
+}
+
+/*
+SetRateLimits replaces the limits all sends and edits wait for, e.g. so that tests
+against a FakeBotAPI don't need to wait. Defaults to telegrams limits
+*/
+func SetRateLimits(globalMessagesPerSecond float64, perChatMessagesPerSecond float64, perChatBurst float64) {
+	limiter := newRateLimiter(globalMessagesPerSecond, perChatMessagesPerSecond, perChatBurst, time.Now())
+	globalRateLimiter.mutex.Lock()
+	defer globalRateLimiter.mutex.Unlock()
+	globalRateLimiter.global = limiter.global
+	globalRateLimiter.perChat = limiter.perChat
+	globalRateLimiter.perChatMessagesPerSecond = perChatMessagesPerSecond
+	globalRateLimiter.perChatBurst = perChatBurst
+}
+
+// reserve returns how long a message to the given chat needs to wait before it can be sent
+func (limiter *rateLimiter) reserve(chatID int, now time.Time) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	chatBucket, found := limiter.perChat[chatID]
+	if !found {
+		if len(limiter.perChat) >= MAX_TRACKED_CHATS {
+			limiter.forgetIdleChats(now)
+		}
+		chatBucket = newTokenBucket(limiter.perChatBurst, limiter.perChatMessagesPerSecond, now)
+		limiter.perChat[chatID] = chatBucket
+	}
+
+	waitTime := limiter.pausedUntil.Sub(now)
+	if globalWaitTime := limiter.global.reserve(now); globalWaitTime > waitTime {
+		waitTime = globalWaitTime
+	}
+	if chatWaitTime := chatBucket.reserve(now); chatWaitTime > waitTime {
+		waitTime = chatWaitTime
+	}
+	if waitTime < 0 {
+		return 0
+	}
+	return waitTime
+}
+
+// forgetIdleChats drops buckets that are full, since a new bucket would behave the same
+func (limiter *rateLimiter) forgetIdleChats(now time.Time) {
+	for chatID, bucket := range limiter.perChat {
+		if bucket.isFull(now) {
+			delete(limiter.perChat, chatID)
+		}
+	}
+}
+
+/*
+pause stops all messages until duration has passed. Telegram doesn't tell us whether
+retry_after applies to a single chat or to the whole bot, so we assume the worst
+*/
+func (limiter *rateLimiter) pause(duration time.Duration, now time.Time) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if pausedUntil := now.Add(duration); pausedUntil.After(limiter.pausedUntil) {
+		limiter.pausedUntil = pausedUntil
+	}
+}
+
+// wait blocks until a message to the given chat may be sent
+func (limiter *rateLimiter) wait(chatID int) {
+	if waitTime := limiter.reserve(chatID, time.Now()); waitTime > 0 {
+		time.Sleep(waitTime)
+	}
+}
+
+// pauseIfRateLimited pauses the global rate limiter if err says that we are sending too much
+func pauseIfRateLimited(err error) {
+	var apiError *APIError
+	if errors.As(err, &apiError) && apiError.IsTooManyRequests() {
+		zap.S().Warnw("Hit telegram rate limit, pausing all messages", "retryAfter", apiError.RetryAfter)
+		globalRateLimiter.pause(apiError.RetryAfter, time.Now())
+	}
+}
+
+/*
+QueueMessage stores the given message, to be sent by the delivery queue as soon as
+rate limits allow. Use this instead of SendMessage for pushes that aren't a reply
+to the user. Only returns an error if the message couldn't be queued
+*/
+func QueueMessage(chatID int, message string, keyboardIdentifier KeyboardIdentifier) error {
+	if err := db_connectors.AddPendingDelivery(chatID, message, int(keyboardIdentifier), time.Now().UTC()); err != nil {
+		return err
+	}
+	select {
+	case globalDeliveryWakeup <- struct{}{}:
+	default:
+		// The queue already knows it has work to do
+	}
+	return nil
+}
+
+/*
+StartDeliveryQueue starts the worker that sends queued messages, including those
+that were queued before a restart. Calling it more than once has no effect
+*/
+func StartDeliveryQueue() {
+	globalDeliveryQueueOnce.Do(func() {
+		zap.S().Info("Starting delivery queue")
+		go runDeliveryQueue()
+	})
+}
+
+/*
+StopDeliveryQueue stops the delivery queue once the message it is sending was sent, and
+waits for up to timeout for that. Messages that are still queued are sent after the next start.
+Returns false if the queue didn't stop in time
+*/
+func StopDeliveryQueue(timeout time.Duration) bool {
+	wasStarted := true
+	globalDeliveryQueueOnce.Do(func() {
+		// Never started, and now it never will
+		wasStarted = false
+	})
+	globalDeliveryQueueStopOnce.Do(func() {
+		close(globalDeliveryQueueStop)
+	})
+	if !wasStarted {
+		return true
+	}
+	select {
+	case <-globalDeliveryQueueStopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func runDeliveryQueue() {
+	defer close(globalDeliveryQueueStopped)
+	failures := 0
+	for !isDeliveryQueueStopped() {
+		if err := deliverDueMessages(); err != nil {
+			failures++
+			backoff := getDeliveryQueueErrorBackoff(failures)
+			zap.S().Warnw("Delivery queue failed, pausing it", "failures", failures, "backoff", backoff, "error", err)
+			waitForDeliveryQueueBackoff(backoff)
+			continue
+		}
+		failures = 0
+		waitForNextDelivery()
+	}
+}
+
+func isDeliveryQueueStopped() bool {
+	select {
+	case <-globalDeliveryQueueStop:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+deliverDueMessages sends queued messages until none are due, or until the queue is stopped.
+Returns an error if the DB fails us
+*/
+func deliverDueMessages() error {
+	for !isDeliveryQueueStopped() {
+		deliveries, err := db_connectors.GetDuePendingDeliveries(time.Now().UTC(), DELIVERY_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+		for _, delivery := range deliveries {
+			if isDeliveryQueueStopped() {
+				return nil
+			}
+			if err := deliver(delivery); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// waitForNextDelivery blocks until the next queued message is due, a new one was queued, or the queue is stopped
+func waitForNextDelivery() {
+	waitTime := DELIVERY_POLL_INTERVAL
+	nextDeliveryAt, found, err := db_connectors.GetTimeOfNextPendingDelivery()
+	if err == nil && found {
+		waitTime = time.Until(nextDeliveryAt)
+		if waitTime <= 0 {
+			return
+		}
+	}
+	timer := time.NewTimer(waitTime)
+	defer timer.Stop()
+	select {
+	case <-globalDeliveryWakeup:
+	case <-globalDeliveryQueueStop:
+	case <-timer.C:
+	}
+}
+
+// waitForDeliveryQueueBackoff blocks for the given time after an error, or until the queue is stopped. New messages don't end it
+func waitForDeliveryQueueBackoff(backoff time.Duration) {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-globalDeliveryQueueStop:
+	case <-timer.C:
+	}
+}
+
+/*
+deliver sends a single queued message, and then removes it from the queue or reschedules it.
+Only returns an error if the queue couldn't be updated
+*/
+func deliver(delivery db_connectors.PendingDelivery) error {
+	if globalFinishedDeliveries[delivery.ID] {
+		return finishDelivery(delivery.ID)
+	}
+	err := SendMessage(delivery.ChatID, delivery.Message, KeyboardIdentifier(delivery.Keyboard))
+	if err == nil {
+		return finishDelivery(delivery.ID)
+	}
+
+	nowUTC := time.Now().UTC()
+	var apiError *APIError
+	if errors.As(err, &apiError) && apiError.IsTooManyRequests() {
+		// The message itself is fine, so this doesn't count as a failed attempt
+		return db_connectors.ReschedulePendingDelivery(delivery.ID, delivery.Attempts, nowUTC.Add(apiError.RetryAfter))
+	}
+	if errors.As(err, &apiError) && !apiError.IsServerError() {
+		// E.g. the user blocked us, repeating the request won't change anything
+		zap.S().Warnw("Telegram refused queued message, dropping it", "error", err)
+		return finishDelivery(delivery.ID)
+	}
+
+	attempts := delivery.Attempts + 1
+	if attempts >= MAX_DELIVERY_ATTEMPTS {
+		zap.S().Errorw("Giving up on queued message", "attempts", attempts, "error", err)
+		return finishDelivery(delivery.ID)
+	}
+	backoff := getDeliveryBackoff(attempts)
+	zap.S().Infow("Queued message failed, retrying later", "attempts", attempts, "backoff", backoff, "error", err)
+	return db_connectors.ReschedulePendingDelivery(delivery.ID, attempts, nowUTC.Add(backoff))
+}
+
+/*
+finishDelivery removes a message that needs no further attempts from the queue.
+If that fails, the message is remembered, so that it isn't sent again
+*/
+func finishDelivery(deliveryID int) error {
+	if err := db_connectors.DeletePendingDelivery(deliveryID); err != nil {
+		globalFinishedDeliveries[deliveryID] = true
+		return err
+	}
+	delete(globalFinishedDeliveries, deliveryID)
+	return nil
+}
+
+// getDeliveryBackoff returns how long to wait after the given number of failed attempts
+func getDeliveryBackoff(attempts int) time.Duration {
+	backoff := INITIAL_DELIVERY_BACKOFF
+	for i := 1; i < attempts && backoff < MAX_DELIVERY_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > MAX_DELIVERY_BACKOFF {
+		return MAX_DELIVERY_BACKOFF
+	}
+	return backoff
+}
+
+// getDeliveryQueueErrorBackoff returns how long the queue pauses after the given number of consecutive errors
+func getDeliveryQueueErrorBackoff(failures int) time.Duration {
+	backoff := DELIVERY_POLL_INTERVAL
+	for i := 1; i < failures && backoff < MAX_DELIVERY_QUEUE_ERROR_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > MAX_DELIVERY_QUEUE_ERROR_BACKOFF {
+		return MAX_DELIVERY_QUEUE_ERROR_BACKOFF
+	}
+	return backoff
+}
@@ -0,0 +1,120 @@
+package telegram_connector
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+)
+
+func TestChatBucketAllowsBurstThenLimits(t *testing.T) {
+	now := time.Date(2022, 10, 10, 10, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(GLOBAL_MESSAGES_PER_SECOND, PER_CHAT_MESSAGES_PER_SECOND, PER_CHAT_BURST, now)
+	chatID := 1
+
+	for i := 0; i < PER_CHAT_BURST; i++ {
+		if waitTime := limiter.reserve(chatID, now); waitTime != 0 {
+			t.Fatalf("Message %d of burst had to wait %s", i, waitTime)
+		}
+	}
+	if waitTime := limiter.reserve(chatID, now); waitTime != time.Second/PER_CHAT_MESSAGES_PER_SECOND {
+		t.Errorf("Message after burst should wait one refill, waits %s", waitTime)
+	}
+	if waitTime := limiter.reserve(chatID+1, now); waitTime != 0 {
+		t.Errorf("Other chat was limited by first chats burst, waits %s", waitTime)
+	}
+}
+
+func TestGlobalBucketLimitsAllChats(t *testing.T) {
+	now := time.Date(2022, 10, 10, 10, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(GLOBAL_MESSAGES_PER_SECOND, PER_CHAT_MESSAGES_PER_SECOND, PER_CHAT_BURST, now)
+
+	for chatID := 0; chatID < GLOBAL_MESSAGES_PER_SECOND; chatID++ {
+		limiter.reserve(chatID, now)
+	}
+	if waitTime := limiter.reserve(GLOBAL_MESSAGES_PER_SECOND, now); waitTime <= 0 {
+		t.Errorf("Global limit wasn't enforced")
+	}
+	if waitTime := limiter.reserve(GLOBAL_MESSAGES_PER_SECOND+1, now.Add(time.Second)); waitTime != 0 {
+		t.Errorf("Global bucket didn't refill, waits %s", waitTime)
+	}
+}
+
+func TestPauseDelaysAllChats(t *testing.T) {
+	now := time.Date(2022, 10, 10, 10, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(GLOBAL_MESSAGES_PER_SECOND, PER_CHAT_MESSAGES_PER_SECOND, PER_CHAT_BURST, now)
+	limiter.pause(5*time.Second, now)
+	// A shorter retry_after doesn't shorten an existing pause
+	limiter.pause(time.Second, now)
+
+	if waitTime := limiter.reserve(1, now.Add(time.Second)); waitTime != 4*time.Second {
+		t.Errorf("Expected to wait for rest of pause, waits %s", waitTime)
+	}
+	if waitTime := limiter.reserve(2, now.Add(5*time.Second)); waitTime != 0 {
+		t.Errorf("Pause didn't end, waits %s", waitTime)
+	}
+}
+
+func TestRateLimitedEditPausesAllChats(t *testing.T) {
+	fake := NewFakeBotAPI()
+	defer fake.Close()
+	previousClient := globalClient
+	SetClient(NewHTTPClient(fake.URL, "token"))
+	defer SetClient(previousClient)
+	defer func() {
+		globalRateLimiter.mutex.Lock()
+		globalRateLimiter.pausedUntil = time.Time{}
+		globalRateLimiter.mutex.Unlock()
+	}()
+
+	fake.FailNextRequest("editMessageText", http.StatusTooManyRequests, 3)
+	if err := EditMessageText(1, 1, "Edited", nil); err == nil {
+		t.Fatalf("Rate limited edit didn't fail")
+	}
+	if waitTime := globalRateLimiter.reserve(2, time.Now()); waitTime < 2*time.Second {
+		t.Errorf("retry_after of an edit didn't pause other chats, they wait %s", waitTime)
+	}
+}
+
+func TestDeliveryBackoffIsExponentialAndCapped(t *testing.T) {
+	if getDeliveryBackoff(1) != INITIAL_DELIVERY_BACKOFF || getDeliveryBackoff(3) != 4*INITIAL_DELIVERY_BACKOFF {
+		t.Errorf("Backoff doesn't double, got %s and %s", getDeliveryBackoff(1), getDeliveryBackoff(3))
+	}
+	if getDeliveryBackoff(100) != MAX_DELIVERY_BACKOFF {
+		t.Errorf("Backoff isn't capped, got %s", getDeliveryBackoff(100))
+	}
+}
+
+func TestDeliveryQueueErrorBackoffStartsAtPollInterval(t *testing.T) {
+	if getDeliveryQueueErrorBackoff(1) != DELIVERY_POLL_INTERVAL || getDeliveryQueueErrorBackoff(2) != 2*DELIVERY_POLL_INTERVAL {
+		t.Errorf("Backoff doesn't start at poll interval, got %s and %s", getDeliveryQueueErrorBackoff(1), getDeliveryQueueErrorBackoff(2))
+	}
+	if getDeliveryQueueErrorBackoff(100) != MAX_DELIVERY_QUEUE_ERROR_BACKOFF {
+		t.Errorf("Backoff isn't capped, got %s", getDeliveryQueueErrorBackoff(100))
+	}
+}
+
+func TestSentDeliveryIsntSentAgainIfDBFails(t *testing.T) {
+	fake := NewFakeBotAPI()
+	defer fake.Close()
+	previousClient := globalClient
+	SetClient(NewHTTPClient(fake.URL, "token"))
+	defer SetClient(previousClient)
+	// A DB that can't be opened fails every query
+	db_connectors.CloseDBHandle()
+	t.Setenv(db_connectors.KEY_DB_BASE_PATH, t.TempDir()+"/doesNotExist/")
+	defer db_connectors.CloseDBHandle()
+	defer func() { globalFinishedDeliveries = make(map[int]bool) }()
+
+	delivery := db_connectors.PendingDelivery{ID: 1, ChatID: 1, Message: "Queued"}
+	if err := deliver(delivery); err == nil {
+		t.Fatalf("Delivery didn't report failing DB")
+	}
+	if err := deliver(delivery); err == nil {
+		t.Fatalf("Retried delivery didn't report failing DB")
+	}
+	if messages := fake.MessagesTo(1); len(messages) != 1 {
+		t.Errorf("Expected message to be sent once, was sent %d times", len(messages))
+	}
+}
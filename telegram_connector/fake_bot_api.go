@@ -0,0 +1,669 @@
+package telegram_connector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+FakeBotAPI is an in-process stand-in for the telegram bot API. It records everything
+the bot sends, so that tests can drive the bot and assert on its replies.
+Point a HTTPClient at URL (with any token) to use it:
+
+	fake := telegram_connector.NewFakeBotAPI()
+	defer fake.Close()
+	telegram_connector.SetClient(telegram_connector.NewHTTPClient(fake.URL, "token"))
+*/
+type FakeBotAPI struct {
+	URL string
+
+	server          *httptest.Server
+	mutex           sync.Mutex
+	nextMessageID   int
+	messages        []RecordedMessage
+	photos          []RecordedPhoto
+	chatActions     []RecordedChatAction
+	documents       []RecordedDocument
+	callbackAnswers []RecordedCallbackAnswer
+	edits           []RecordedEdit
+
+	pendingUpdates     []WebhookRequestBody
+	webhook            RecordedWebhook
+	webhookDeleteCalls int
+	injectedFailures   map[string][]injectedFailure
+	blockedChats       map[int]bool
+}
+
+// injectedFailure is an error response the fake gives instead of handling a request, see FailNextRequest
+type injectedFailure struct {
+	statusCode        int
+	description       string
+	retryAfterSeconds int
+}
+
+// RecordedReplyMarkup contains the keyboard related parts of a reply_markup
+type RecordedReplyMarkup struct {
+	Keyboard       [][]KeyboardButton       `json:"keyboard"`
+	RemoveKeyboard bool                     `json:"remove_keyboard"`
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type RecordedMessage struct {
+	MessageID   int
+	ChatID      int                  `json:"chat_id"`
+	Text        string               `json:"text"`
+	ParseMode   string               `json:"parse_mode"`
+	ReplyMarkup *RecordedReplyMarkup `json:"reply_markup"`
+}
+
+/*
+RecordedPhoto is a photo sent via sendPhoto. For photos that were sent via URL
+or telegram file_id Photo contains that reference, for uploaded photos it contains
+the filename and UploadedBytes contains the file
+*/
+type RecordedPhoto struct {
+	MessageID     int
+	ChatID        int                  `json:"chat_id"`
+	Photo         string               `json:"photo"`
+	Caption       string               `json:"caption"`
+	ReplyMarkup   *RecordedReplyMarkup `json:"reply_markup"`
+	UploadedBytes []byte
+}
+
+type RecordedChatAction struct {
+	ChatID int    `json:"chat_id"`
+	Action string `json:"action"`
+}
+
+// RecordedDocument is a file sent via sendDocument
+type RecordedDocument struct {
+	MessageID int
+	ChatID    int
+	FileName  string
+	Caption   string
+	Content   []byte
+}
+
+/*
+RecordedEdit is a call of one of the editMessage* methods. Edits are also applied to
+the recorded message or photo, so Messages and Photos always show the current state.
+Photo is set for edits of the photo itself, like RecordedPhoto.Photo
+*/
+type RecordedEdit struct {
+	Method      string
+	ChatID      int                  `json:"chat_id"`
+	MessageID   int                  `json:"message_id"`
+	Text        string               `json:"text"`
+	Caption     string               `json:"caption"`
+	Photo       string               `json:"-"`
+	ReplyMarkup *RecordedReplyMarkup `json:"reply_markup"`
+}
+
+// RecordedWebhook is the webhook that was set via setWebhook. URL is empty if none is set
+type RecordedWebhook struct {
+	URL            string   `json:"url"`
+	SecretToken    string   `json:"secret_token"`
+	AllowedUpdates []string `json:"allowed_updates"`
+}
+
+type RecordedCallbackAnswer struct {
+	CallbackQueryID string `json:"callback_query_id"`
+	Text            string `json:"text"`
+}
+
+// NewFakeBotAPI starts a new fake API server. Close it when done
+func NewFakeBotAPI() *FakeBotAPI {
+	fake := &FakeBotAPI{nextMessageID: 1}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	fake.URL = fake.server.URL
+	return fake
+}
+
+func (fake *FakeBotAPI) Close() {
+	fake.server.Close()
+}
+
+// Reset forgets everything that has been recorded so far
+func (fake *FakeBotAPI) Reset() {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.messages = nil
+	fake.photos = nil
+	fake.chatActions = nil
+	fake.documents = nil
+	fake.callbackAnswers = nil
+	fake.edits = nil
+	fake.pendingUpdates = nil
+	fake.webhook = RecordedWebhook{}
+	fake.webhookDeleteCalls = 0
+	fake.injectedFailures = nil
+	fake.blockedChats = nil
+}
+
+func (fake *FakeBotAPI) Messages() []RecordedMessage {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]RecordedMessage{}, fake.messages...)
+}
+
+// MessagesTo returns all messages that were sent to the given chat, in order
+func (fake *FakeBotAPI) MessagesTo(chatID int) []RecordedMessage {
+	var messagesToChat []RecordedMessage
+	for _, message := range fake.Messages() {
+		if message.ChatID == chatID {
+			messagesToChat = append(messagesToChat, message)
+		}
+	}
+	return messagesToChat
+}
+
+func (fake *FakeBotAPI) Photos() []RecordedPhoto {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]RecordedPhoto{}, fake.photos...)
+}
+
+func (fake *FakeBotAPI) ChatActions() []RecordedChatAction {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]RecordedChatAction{}, fake.chatActions...)
+}
+
+func (fake *FakeBotAPI) Documents() []RecordedDocument {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]RecordedDocument{}, fake.documents...)
+}
+
+func (fake *FakeBotAPI) CallbackAnswers() []RecordedCallbackAnswer {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]RecordedCallbackAnswer{}, fake.callbackAnswers...)
+}
+
+func (fake *FakeBotAPI) Edits() []RecordedEdit {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]RecordedEdit{}, fake.edits...)
+}
+
+/*
+QueueUpdate makes the given update available via getUpdates. Updates
+stay available until a getUpdates call confirms them by requesting
+a higher offset, just like with telegram
+*/
+func (fake *FakeBotAPI) QueueUpdate(update WebhookRequestBody) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.pendingUpdates = append(fake.pendingUpdates, update)
+}
+
+// Webhook returns the webhook that is currently set
+func (fake *FakeBotAPI) Webhook() RecordedWebhook {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.webhook
+}
+
+// WebhookDeleteCalls returns how often deleteWebhook was called
+func (fake *FakeBotAPI) WebhookDeleteCalls() int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.webhookDeleteCalls
+}
+
+/*
+FailNextRequest makes the next request to the given method fail with the given status code,
+without recording anything. For 429 responses retryAfterSeconds is sent as retry_after.
+Multiple calls queue up multiple failures
+*/
+func (fake *FakeBotAPI) FailNextRequest(method string, statusCode int, retryAfterSeconds int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if fake.injectedFailures == nil {
+		fake.injectedFailures = make(map[string][]injectedFailure)
+	}
+	description := http.StatusText(statusCode)
+	if statusCode == http.StatusTooManyRequests {
+		description = fmt.Sprintf("Too Many Requests: retry after %d", retryAfterSeconds)
+	}
+	fake.injectedFailures[method] = append(fake.injectedFailures[method], injectedFailure{
+		statusCode:        statusCode,
+		description:       description,
+		retryAfterSeconds: retryAfterSeconds,
+	})
+}
+
+// PendingFailures returns how many injected failures of the given method haven't happened yet
+func (fake *FakeBotAPI) PendingFailures(method string) int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return len(fake.injectedFailures[method])
+}
+
+/*
+BlockChat makes the fake behave as if the user of the given chat blocked the bot:
+Every request concerning that chat fails with 403, until UnblockChat is called
+*/
+func (fake *FakeBotAPI) BlockChat(chatID int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if fake.blockedChats == nil {
+		fake.blockedChats = make(map[int]bool)
+	}
+	fake.blockedChats[chatID] = true
+}
+
+func (fake *FakeBotAPI) UnblockChat(chatID int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	delete(fake.blockedChats, chatID)
+}
+
+/*
+isBlockedChatRequest returns true if the request concerns a blocked chat. Reads the
+chat_id from JSON and multipart requests, and leaves the body readable for the handlers
+*/
+func (fake *FakeBotAPI) isBlockedChatRequest(r *http.Request) bool {
+	fake.mutex.Lock()
+	hasBlockedChats := len(fake.blockedChats) > 0
+	fake.mutex.Unlock()
+	if !hasBlockedChats {
+		return false
+	}
+
+	var chatID int
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return false
+		}
+		chatID, _ = strconv.Atoi(r.FormValue("chat_id"))
+	} else {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var request struct {
+			ChatID int `json:"chat_id"`
+		}
+		json.Unmarshal(body, &request)
+		chatID = request.ChatID
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.blockedChats[chatID]
+}
+
+// popInjectedFailure returns the next injected failure of the given method, if any
+func (fake *FakeBotAPI) popInjectedFailure(method string) (injectedFailure, bool) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	failures := fake.injectedFailures[method]
+	if len(failures) == 0 {
+		return injectedFailure{}, false
+	}
+	fake.injectedFailures[method] = failures[1:]
+	return failures[0], true
+}
+
+func (fake *FakeBotAPI) claimMessageID() int {
+	messageID := fake.nextMessageID
+	fake.nextMessageID++
+	return messageID
+}
+
+// handle dispatches on the method, which is the last path segment of /bot<token>/<method>
+func (fake *FakeBotAPI) handle(w http.ResponseWriter, r *http.Request) {
+	pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathSegments) != 2 || !strings.HasPrefix(pathSegments[0], "bot") {
+		writeFakeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if fake.isBlockedChatRequest(r) {
+		writeFakeError(w, http.StatusForbidden, "Forbidden: bot was blocked by the user")
+		return
+	}
+	if failure, found := fake.popInjectedFailure(pathSegments[1]); found {
+		writeFakeErrorWithRetryAfter(w, failure.statusCode, failure.description, failure.retryAfterSeconds)
+		return
+	}
+	switch pathSegments[1] {
+	case "sendMessage":
+		fake.handleSendMessage(w, r)
+	case "sendPhoto":
+		fake.handleSendPhoto(w, r)
+	case "sendChatAction":
+		fake.handleSendChatAction(w, r)
+	case "sendDocument":
+		fake.handleSendDocument(w, r)
+	case "answerCallbackQuery":
+		fake.handleAnswerCallbackQuery(w, r)
+	case "editMessageText", "editMessageReplyMarkup":
+		fake.handleEdit(w, r, pathSegments[1])
+	case "editMessageCaption", "editMessageMedia":
+		fake.handlePhotoEdit(w, r, pathSegments[1])
+	case "getUpdates":
+		fake.handleGetUpdates(w, r)
+	case "setWebhook":
+		var webhook RecordedWebhook
+		if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+			writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse JSON")
+			return
+		}
+		fake.mutex.Lock()
+		fake.webhook = webhook
+		fake.mutex.Unlock()
+		writeFakeResult(w, true)
+	case "deleteWebhook":
+		fake.mutex.Lock()
+		fake.webhook = RecordedWebhook{}
+		fake.webhookDeleteCalls++
+		fake.mutex.Unlock()
+		writeFakeResult(w, true)
+	default:
+		writeFakeError(w, http.StatusNotFound, "Not Found: method not found")
+	}
+}
+
+func (fake *FakeBotAPI) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	var message RecordedMessage
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse JSON")
+		return
+	}
+	fake.mutex.Lock()
+	message.MessageID = fake.claimMessageID()
+	fake.messages = append(fake.messages, message)
+	fake.mutex.Unlock()
+
+	writeFakeResult(w, map[string]interface{}{
+		"message_id": message.MessageID,
+		"chat":       map[string]int{"id": message.ChatID},
+		"text":       message.Text,
+	})
+}
+
+func (fake *FakeBotAPI) handleSendPhoto(w http.ResponseWriter, r *http.Request) {
+	var photo RecordedPhoto
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse multipart form")
+			return
+		}
+		photo.ChatID, _ = strconv.Atoi(r.FormValue("chat_id"))
+		photo.Caption = r.FormValue("caption")
+		if replyMarkup := r.FormValue("reply_markup"); replyMarkup != "" {
+			json.Unmarshal([]byte(replyMarkup), &photo.ReplyMarkup)
+		}
+		file, header, err := r.FormFile("photo")
+		if err != nil {
+			writeFakeError(w, http.StatusBadRequest, "Bad Request: there is no photo in the request")
+			return
+		}
+		defer file.Close()
+		photo.Photo = header.Filename
+		photo.UploadedBytes, _ = io.ReadAll(file)
+	} else if err := json.NewDecoder(r.Body).Decode(&photo); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse JSON")
+		return
+	}
+
+	fake.mutex.Lock()
+	photo.MessageID = fake.claimMessageID()
+	fake.photos = append(fake.photos, photo)
+	fake.mutex.Unlock()
+
+	fileID := photo.Photo
+	if photo.UploadedBytes != nil {
+		fileID = fmt.Sprintf("fake-file-id-%d", photo.MessageID)
+	}
+	writeFakeResult(w, map[string]interface{}{
+		"message_id": photo.MessageID,
+		"chat":       map[string]int{"id": photo.ChatID},
+		"caption":    photo.Caption,
+		"photo":      []map[string]string{{"file_id": fileID}},
+	})
+}
+
+func (fake *FakeBotAPI) handleSendChatAction(w http.ResponseWriter, r *http.Request) {
+	var chatAction RecordedChatAction
+	if err := json.NewDecoder(r.Body).Decode(&chatAction); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse JSON")
+		return
+	}
+	fake.mutex.Lock()
+	fake.chatActions = append(fake.chatActions, chatAction)
+	fake.mutex.Unlock()
+	writeFakeResult(w, true)
+}
+
+func (fake *FakeBotAPI) handleSendDocument(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse multipart form")
+		return
+	}
+	var document RecordedDocument
+	document.ChatID, _ = strconv.Atoi(r.FormValue("chat_id"))
+	document.Caption = r.FormValue("caption")
+	file, header, err := r.FormFile("document")
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "Bad Request: there is no document in the request")
+		return
+	}
+	defer file.Close()
+	document.FileName = header.Filename
+	document.Content, _ = io.ReadAll(file)
+
+	fake.mutex.Lock()
+	document.MessageID = fake.claimMessageID()
+	fake.documents = append(fake.documents, document)
+	fake.mutex.Unlock()
+	writeFakeResult(w, map[string]interface{}{
+		"message_id": document.MessageID,
+		"chat":       map[string]int{"id": document.ChatID},
+		"caption":    document.Caption,
+	})
+}
+
+func (fake *FakeBotAPI) handleAnswerCallbackQuery(w http.ResponseWriter, r *http.Request) {
+	var answer RecordedCallbackAnswer
+	if err := json.NewDecoder(r.Body).Decode(&answer); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse JSON")
+		return
+	}
+	fake.mutex.Lock()
+	fake.callbackAnswers = append(fake.callbackAnswers, answer)
+	fake.mutex.Unlock()
+	writeFakeResult(w, true)
+}
+
+/*
+handleEdit applies an edit to the recorded message. Like telegram it refuses
+edits of unknown messages, and edits that don't change anything
+*/
+func (fake *FakeBotAPI) handleEdit(w http.ResponseWriter, r *http.Request, method string) {
+	edit := RecordedEdit{Method: method}
+	if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse JSON")
+		return
+	}
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for i := range fake.messages {
+		message := &fake.messages[i]
+		if message.MessageID != edit.MessageID || message.ChatID != edit.ChatID {
+			continue
+		}
+		editedMessage := *message
+		if method == "editMessageText" {
+			editedMessage.Text = edit.Text
+		}
+		editedMessage.ReplyMarkup = edit.ReplyMarkup
+		editedAsJSON, _ := json.Marshal(editedMessage)
+		messageAsJSON, _ := json.Marshal(message)
+		if string(editedAsJSON) == string(messageAsJSON) {
+			writeFakeError(w, http.StatusBadRequest, "Bad Request: message is not modified")
+			return
+		}
+		*message = editedMessage
+		fake.edits = append(fake.edits, edit)
+		writeFakeResult(w, map[string]interface{}{
+			"message_id": message.MessageID,
+			"chat":       map[string]int{"id": message.ChatID},
+			"text":       message.Text,
+		})
+		return
+	}
+	writeFakeError(w, http.StatusBadRequest, "Bad Request: message to edit not found")
+}
+
+// handlePhotoEdit works like handleEdit, but for edits of photos
+func (fake *FakeBotAPI) handlePhotoEdit(w http.ResponseWriter, r *http.Request, method string) {
+	edit := RecordedEdit{Method: method}
+	var uploadedBytes []byte
+	var media struct {
+		Media   string `json:"media"`
+		Caption string `json:"caption"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse multipart form")
+			return
+		}
+		edit.ChatID, _ = strconv.Atoi(r.FormValue("chat_id"))
+		edit.MessageID, _ = strconv.Atoi(r.FormValue("message_id"))
+		json.Unmarshal([]byte(r.FormValue("media")), &media)
+		if replyMarkup := r.FormValue("reply_markup"); replyMarkup != "" {
+			json.Unmarshal([]byte(replyMarkup), &edit.ReplyMarkup)
+		}
+		attachedName := strings.TrimPrefix(media.Media, "attach://")
+		file, header, err := r.FormFile(attachedName)
+		if err != nil {
+			writeFakeError(w, http.StatusBadRequest, "Bad Request: can't find attached file")
+			return
+		}
+		defer file.Close()
+		media.Media = header.Filename
+		uploadedBytes, _ = io.ReadAll(file)
+	} else {
+		var body struct {
+			RecordedEdit
+			Media json.RawMessage `json:"media"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse JSON")
+			return
+		}
+		edit.ChatID = body.ChatID
+		edit.MessageID = body.MessageID
+		edit.Caption = body.Caption
+		edit.ReplyMarkup = body.ReplyMarkup
+		json.Unmarshal(body.Media, &media)
+	}
+	if method == "editMessageMedia" {
+		edit.Caption = media.Caption
+		edit.Photo = media.Media
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for i := range fake.photos {
+		photo := &fake.photos[i]
+		if photo.MessageID != edit.MessageID || photo.ChatID != edit.ChatID {
+			continue
+		}
+		editedPhoto := *photo
+		editedPhoto.Caption = edit.Caption
+		editedPhoto.ReplyMarkup = edit.ReplyMarkup
+		if edit.Photo != "" {
+			editedPhoto.Photo = edit.Photo
+			editedPhoto.UploadedBytes = uploadedBytes
+		}
+		editedMarkup, _ := json.Marshal(editedPhoto.ReplyMarkup)
+		markup, _ := json.Marshal(photo.ReplyMarkup)
+		if edit.Photo == "" && editedPhoto.Caption == photo.Caption && string(editedMarkup) == string(markup) {
+			writeFakeError(w, http.StatusBadRequest, "Bad Request: message is not modified")
+			return
+		}
+		*photo = editedPhoto
+		fake.edits = append(fake.edits, edit)
+
+		fileID := photo.Photo
+		if photo.UploadedBytes != nil {
+			fileID = fmt.Sprintf("fake-file-id-%d-%d", photo.MessageID, len(fake.edits))
+		}
+		writeFakeResult(w, map[string]interface{}{
+			"message_id": photo.MessageID,
+			"chat":       map[string]int{"id": photo.ChatID},
+			"caption":    photo.Caption,
+			"photo":      []map[string]string{{"file_id": fileID}},
+		})
+		return
+	}
+	writeFakeError(w, http.StatusBadRequest, "Bad Request: message to edit not found")
+}
+
+/*
+handleGetUpdates returns all pending updates with an update_id of at least the
+requested offset, and forgets all others. If there are none it waits for up to
+the requested timeout for new ones
+*/
+func (fake *FakeBotAPI) handleGetUpdates(w http.ResponseWriter, r *http.Request) {
+	var request getUpdatesRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "Bad Request: can't parse JSON")
+		return
+	}
+	deadline := time.Now().Add(time.Duration(request.Timeout) * time.Second)
+	for {
+		fake.mutex.Lock()
+		var remainingUpdates []WebhookRequestBody
+		for _, update := range fake.pendingUpdates {
+			if update.UpdateID >= request.Offset {
+				remainingUpdates = append(remainingUpdates, update)
+			}
+		}
+		fake.pendingUpdates = remainingUpdates
+		fake.mutex.Unlock()
+
+		if len(remainingUpdates) > 0 || time.Now().After(deadline) {
+			writeFakeResult(w, append([]WebhookRequestBody{}, remainingUpdates...))
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeFakeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":     true,
+		"result": result,
+	})
+}
+
+func writeFakeError(w http.ResponseWriter, statusCode int, description string) {
+	writeFakeErrorWithRetryAfter(w, statusCode, description, 0)
+}
+
+// writeFakeErrorWithRetryAfter works like writeFakeError, but also tells the bot to wait if retryAfterSeconds isn't 0
+func writeFakeErrorWithRetryAfter(w http.ResponseWriter, statusCode int, description string, retryAfterSeconds int) {
+	response := map[string]interface{}{
+		"ok":          false,
+		"error_code":  statusCode,
+		"description": description,
+	}
+	if retryAfterSeconds != 0 {
+		response["parameters"] = map[string]int{"retry_after": retryAfterSeconds}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
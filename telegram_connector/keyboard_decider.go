@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/mensas"
 	"go.uber.org/zap"
 )
 
@@ -37,15 +39,26 @@ const (
 	MainKeyboard     KeyboardIdentifier = 2
 	SettingsKeyboard KeyboardIdentifier = 3
 	NoKeyboard       KeyboardIdentifier = 4
+	// Used while setting up queue alerts via /alerts
+	AlertLevelKeyboard KeyboardIdentifier = 5
+	AlertTimeKeyboard  KeyboardIdentifier = 6
 )
 
 const LEGACY_KEYBOARD_FILEPATH = "./telegram_connector/keyboards/keyboard.json"
-const REPORT_KEYBOARD_FILEPATH = "./telegram_connector/keyboards/00_report_keyboard.json"
 const MAIN_KEYBOARD_FILEPATH = "./telegram_connector/keyboards/01_main_keyboard.json"
 const SETTINGS_KEYBOARD_FILEPATH = "./telegram_connector/keyboards/02_settings_keyboard.json"
 
 // Needs to be consistent with javascript logic in settings.html
-const KEYBOARD_SETTINGS_OPENER_BASE_QUERY_STRING = "?reportAtAll=%t&reportingDays=%d&fromTime=%s&toTime=%s&points=%t"
+const KEYBOARD_SETTINGS_OPENER_BASE_QUERY_STRING = "?reportAtAll=%t&reportingDays=%d&fromTime=%s&toTime=%s&points=%t&alertAtAll=%t&alertLevel=%d&alertFromTime=%s&alertToTime=%s&mensa=%s&diet=%s&noPork=%t&allergens=%s"
+
+// How many queue lengths are displayed next to each other on the report keyboard
+const REPORT_KEYBOARD_BUTTONS_PER_ROW = 3
+
+// Buttons of the keyboards used while setting up queue alerts. Alert levels must not look like reports
+const ALERT_LEVEL_BUTTON_FORMAT = "At most L%d"
+const CANCEL_BUTTON_TEXT = "Cancel"
+
+var ALERT_TIMEFRAME_BUTTONS = []string{"11:00 - 14:00", "11:30 - 13:30", "12:00 - 14:00", "13:00 - 15:00"}
 
 func GetCustomizedKeyboardFromIdentifier(chatID int, identifier KeyboardIdentifier) (*ReplyKeyboardMarkupStruct, error) {
 	baseKeyboard, err := getBaseKeyboardFromIdentifier(identifier)
@@ -84,7 +97,8 @@ func getBaseKeyboardFromIdentifier(identifier KeyboardIdentifier) (*ReplyKeyboar
 		}
 	case ReportKeyboard:
 		{
-			return getReplyKeyboard(REPORT_KEYBOARD_FILEPATH), nil
+			defaultMensa, err := mensas.GetMensa(mensas.DEFAULT_MENSA_ID)
+			return getReportKeyboard(defaultMensa), err
 		}
 	case MainKeyboard:
 		{
@@ -94,17 +108,35 @@ func getBaseKeyboardFromIdentifier(identifier KeyboardIdentifier) (*ReplyKeyboar
 		{
 			return getReplyKeyboard(SETTINGS_KEYBOARD_FILEPATH), nil
 		}
+	case AlertLevelKeyboard:
+		{
+			defaultMensa, err := mensas.GetMensa(mensas.DEFAULT_MENSA_ID)
+			return getAlertLevelKeyboard(defaultMensa), err
+		}
+	case AlertTimeKeyboard:
+		{
+			return getAlertTimeKeyboard(), nil
+		}
 	}
 	var nilKeyboard ReplyKeyboardMarkupStruct
 	return &nilKeyboard, errors.New("Caller requested unknown keyboard type")
 }
 
 /*
-"Customizes" the base keyboard for a single user. Right now this means exactly one thing:
+"Customizes" the base keyboard for a single user. Right now this means two things:
 The settings keyboard is enriched with the current user settings, so that they can be
-displayed without serving an additional request.
+displayed without serving an additional request, and the report keyboard contains
+the queue lengths of the users mensa.
 */
 func customizeKeyboardForUser(userID int, identifier KeyboardIdentifier, baseKeyboard *ReplyKeyboardMarkupStruct) (*ReplyKeyboardMarkupStruct, error) {
+	if identifier == ReportKeyboard {
+		usersMensa := mensas.GetMensaOrDefault(db_connectors.GetUserMensaID(userID))
+		return getReportKeyboard(usersMensa), nil
+	}
+	if identifier == AlertLevelKeyboard {
+		usersMensa := mensas.GetMensaOrDefault(db_connectors.GetUserMensaID(userID))
+		return getAlertLevelKeyboard(usersMensa), nil
+	}
 	if identifier == SettingsKeyboard {
 		// This is the only one that needs customization right now
 		// We need to add the users current settings to the web_app url
@@ -128,7 +160,19 @@ func getSettingsQueryStringForUser(userID int) (string, error) {
 		return "", err
 	}
 	userPointPreferences := db_connectors.UserIsCollectingPoints(userID)
-	queryString := fmt.Sprintf(KEYBOARD_SETTINGS_OPENER_BASE_QUERY_STRING, preferencesStruct.ReportAtAll, preferencesStruct.WeekdayBitmap, preferencesStruct.FromTime, preferencesStruct.ToTime, userPointPreferences)
+	alertSettings, err := db_connectors.GetQueueAlertSettings(userID)
+	if err != nil {
+		zap.S().Error("Can't get user queue alert", err)
+		return "", err
+	}
+	dietaryPreferences, err := db_connectors.GetDietaryPreferences(userID)
+	if err != nil {
+		zap.S().Error("Can't get user dietary preferences", err)
+		return "", err
+	}
+	queryString := fmt.Sprintf(KEYBOARD_SETTINGS_OPENER_BASE_QUERY_STRING, preferencesStruct.ReportAtAll, preferencesStruct.WeekdayBitmap, preferencesStruct.FromTime, preferencesStruct.ToTime, userPointPreferences,
+		alertSettings.AlertAtAll, alertSettings.MaximumLevel, alertSettings.FromTime, alertSettings.ToTime, preferencesStruct.MensaID,
+		dietaryPreferences.Diet, dietaryPreferences.NoPork, strings.Join(dietaryPreferences.ExcludedAllergens, ","))
 	return queryString, nil
 
 }
@@ -197,6 +241,67 @@ func GetIdentifierViaRequestType(requestType UserRequestType, userID int) Keyboa
 	return NilKeyboard
 }
 
+/*
+getReportKeyboard builds the keyboard with which users report queue lengths at the given mensa:
+One button per queue length, and a way out for users that can't see the queue
+*/
+func getReportKeyboard(mensa mensas.Mensa) *ReplyKeyboardMarkupStruct {
+	var keyboardArray [][]KeyboardButton
+	var currentRow []KeyboardButton
+	for _, levelLabel := range mensa.GetLevelLabels() {
+		currentRow = append(currentRow, KeyboardButton{Text: levelLabel})
+		if len(currentRow) == REPORT_KEYBOARD_BUTTONS_PER_ROW {
+			keyboardArray = append(keyboardArray, currentRow)
+			currentRow = nil
+		}
+	}
+	if len(currentRow) > 0 {
+		keyboardArray = append(keyboardArray, currentRow)
+	}
+	keyboardArray = append(keyboardArray, []KeyboardButton{{Text: "Can't tell"}})
+
+	return &ReplyKeyboardMarkupStruct{
+		Keyboard:       keyboardArray,
+		ResizeKeyboard: true,
+	}
+}
+
+// getAlertLevelKeyboard offers one button per queue length of the given mensa, and a way out
+func getAlertLevelKeyboard(mensa mensas.Mensa) *ReplyKeyboardMarkupStruct {
+	var keyboardArray [][]KeyboardButton
+	var currentRow []KeyboardButton
+	for level := range mensa.QueueLevels {
+		currentRow = append(currentRow, KeyboardButton{Text: fmt.Sprintf(ALERT_LEVEL_BUTTON_FORMAT, level)})
+		if len(currentRow) == REPORT_KEYBOARD_BUTTONS_PER_ROW {
+			keyboardArray = append(keyboardArray, currentRow)
+			currentRow = nil
+		}
+	}
+	if len(currentRow) > 0 {
+		keyboardArray = append(keyboardArray, currentRow)
+	}
+	keyboardArray = append(keyboardArray, []KeyboardButton{{Text: CANCEL_BUTTON_TEXT}})
+
+	return &ReplyKeyboardMarkupStruct{
+		Keyboard:       keyboardArray,
+		ResizeKeyboard: true,
+	}
+}
+
+// getAlertTimeKeyboard offers a couple of timeframes for queue alerts, and a way out
+func getAlertTimeKeyboard() *ReplyKeyboardMarkupStruct {
+	var keyboardArray [][]KeyboardButton
+	for _, timeframe := range ALERT_TIMEFRAME_BUTTONS {
+		keyboardArray = append(keyboardArray, []KeyboardButton{{Text: timeframe}})
+	}
+	keyboardArray = append(keyboardArray, []KeyboardButton{{Text: CANCEL_BUTTON_TEXT}})
+
+	return &ReplyKeyboardMarkupStruct{
+		Keyboard:       keyboardArray,
+		ResizeKeyboard: true,
+	}
+}
+
 // Returns the struct that represents the custom keyboard that should be shown to the user
 // Reads the json from the given file
 func getReplyKeyboard(jsonPath string) *ReplyKeyboardMarkupStruct {
@@ -229,4 +334,6 @@ func LoadAllKeyboardsForTest() {
 	getBaseKeyboardFromIdentifier(ReportKeyboard)
 	getBaseKeyboardFromIdentifier(MainKeyboard)
 	getBaseKeyboardFromIdentifier(SettingsKeyboard)
+	getBaseKeyboardFromIdentifier(AlertLevelKeyboard)
+	getBaseKeyboardFromIdentifier(AlertTimeKeyboard)
 }
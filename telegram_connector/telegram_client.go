@@ -0,0 +1,598 @@
+package telegram_connector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const KEY_TELEGRAM_API_URL string = "MENSA_QUEUE_BOT_TELEGRAM_API_URL"
+const DEFAULT_TELEGRAM_API_URL string = "https://api.telegram.org"
+
+/*
+Client is everything we can ask of the telegram bot API.
+The package level functions (SendMessage, SendDynamicPhoto, ...) delegate to
+the client returned by GetClient, which can be replaced with SetClient, e.g.
+to point the bot at a FakeBotAPI during tests.
+*/
+type Client interface {
+	SendMessage(chatID int, message string, keyboardIdentifier KeyboardIdentifier) error
+	SendStaticWebPhoto(chatID int, photoURL string, description string, keyboardIdentifier KeyboardIdentifier) error
+	SendDynamicPhoto(chatID int, photoFilePath string, description string, keyboardIdentifier KeyboardIdentifier) (string, error)
+	SendMessageWithInlineKeyboard(chatID int, message string, keyboard InlineKeyboardMarkup) (int, error)
+	AnswerCallbackQuery(callbackQueryID string, text string) error
+	SendPhotoWithInlineKeyboard(chatID int, photo InputPhoto, caption string, keyboard InlineKeyboardMarkup) (SentPhoto, error)
+	EditMessageCaption(chatID int, messageID int, caption string, keyboard *InlineKeyboardMarkup) error
+	EditMessagePhoto(chatID int, messageID int, photo InputPhoto, caption string, keyboard *InlineKeyboardMarkup) (string, error)
+	EditMessageText(chatID int, messageID int, message string, keyboard *InlineKeyboardMarkup) error
+	EditMessageReplyMarkup(chatID int, messageID int, keyboard *InlineKeyboardMarkup) error
+	SendDocument(chatID int, fileName string, content []byte, caption string) error
+	SendTypingIndicator(chatID int) error
+	GetUpdates(offset int, timeoutInSeconds int) ([]WebhookRequestBody, error)
+	SetWebhook(url string, secretToken string, allowedUpdates []string) error
+	DeleteWebhook() error
+}
+
+var globalClient Client
+var globalClientMutex sync.Mutex
+
+/*
+GetClient returns the client used by the package level functions. If none was set
+yet a HTTPClient is created, which talks to the API at MENSA_QUEUE_BOT_TELEGRAM_API_URL
+(or the official API, if that variable isn't set)
+*/
+func GetClient() Client {
+	globalClientMutex.Lock()
+	defer globalClientMutex.Unlock()
+	if globalClient == nil {
+		globalClient = NewHTTPClient(GetTelegramAPIURL(), GetTelegramToken())
+	}
+	return globalClient
+}
+
+// SetClient replaces the client used by the package level functions
+func SetClient(client Client) {
+	globalClientMutex.Lock()
+	globalClient = client
+	globalClientMutex.Unlock()
+}
+
+/*
+Reads the base URL of the telegram bot API from an environment variable.
+Defaults to the official API if the variable isn't set.
+*/
+func GetTelegramAPIURL() string {
+	apiURL, doesExist := os.LookupEnv(KEY_TELEGRAM_API_URL)
+	if !doesExist || apiURL == "" {
+		return DEFAULT_TELEGRAM_API_URL
+	}
+	return strings.TrimSuffix(apiURL, "/")
+}
+
+/*
+HTTPClient implements Client against an actual bot API server, which is
+either the official one or something that behaves like it
+*/
+type HTTPClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func NewHTTPClient(baseURL string, token string) *HTTPClient {
+	return &HTTPClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{},
+	}
+}
+
+// methodURL returns the URL under which the given bot API method is reachable
+func (client *HTTPClient) methodURL(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", client.baseURL, client.token, method)
+}
+
+/*
+postJSON sends the given body to the given bot API method, and returns the response.
+Callers need to close the response body.
+*/
+func (client *HTTPClient) postJSON(method string, requestBody interface{}) (*http.Response, error) {
+	reqBytes, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, err
+	}
+	return client.httpClient.Post(client.methodURL(method), "application/json", bytes.NewBuffer(reqBytes))
+}
+
+func (client *HTTPClient) SendStaticWebPhoto(chatID int, photoURL string, description string, keyboardIdentifier KeyboardIdentifier) error {
+	if keyboardIdentifier != NilKeyboard {
+		zap.S().Error("Tried to set a keyboard with SendDynamicPhoto. Is that even possible?")
+		// Initial scan of the documentation says it isn't, but I was really tired, and it's quite hot right now. Definitely recheck if needed.
+	}
+
+	requestBody := &sendWebPhotoRequestBody{
+		ChatID:  chatID,
+		Photo:   photoURL,
+		Caption: description,
+	}
+
+	response, err := client.postJSON("sendPhoto", requestBody)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return checkResponse("sendPhoto", response)
+}
+
+/* PrepareMultipartForUpload reads the given file, chatID and caption, and writes them
+to a buffer in a format corresponding to a multipart request.
+Addicionally, it also returns the FormDataContentType for said multipart request.
+*/
+func prepareMultipartForUpload(pathToFile string, chatID int, caption string) (*bytes.Buffer, string, error) {
+	// Read file content
+	file, err := os.Open(pathToFile)
+	if err != nil {
+		zap.S().Errorf("Can't open graph file for detailed /jetze report: %s", pathToFile)
+		return new(bytes.Buffer), "", err
+	}
+	defer file.Close()
+	return prepareMultipartForContent("photo", filepath.Base(pathToFile), file, chatID, caption)
+}
+
+/*
+prepareMultipartForContent works like prepareMultipartForUpload, except that the
+uploaded content is read from content, and sent as the given form field
+*/
+func prepareMultipartForContent(fieldName string, fileName string, content io.Reader, chatID int, caption string) (*bytes.Buffer, string, error) {
+	requestBody := new(bytes.Buffer)
+	writer := multipart.NewWriter(requestBody)
+	part, err := writer.CreateFormFile(fieldName, fileName)
+	if err != nil {
+		zap.S().Errorf("Can't CreateFormFile for upload: %s", fileName)
+		return nil, "", err
+	}
+	io.Copy(part, content)
+
+	writer.WriteField("chat_id", strconv.Itoa(chatID))
+	writer.WriteField("caption", caption)
+	// Close writes the trailing boundary, so it needs to happen before the buffer is sent
+	writer.Close()
+
+	return requestBody, writer.FormDataContentType(), nil
+}
+
+func (client *HTTPClient) SendDynamicPhoto(chatID int, photoFilePath string, description string, keyboardIdentifier KeyboardIdentifier) (string, error) {
+	requestBody, contentType, err := prepareMultipartForUpload(photoFilePath, chatID, description)
+
+	if keyboardIdentifier != NilKeyboard {
+		zap.S().Error("Tried to set a keyboard with SendDynamicPhoto. Is that even possible?")
+		// Initial scan of the documentation says it isn't, but I was really tired, and it's quite hot right now. Definitely recheck if needed.
+	}
+
+	if err != nil {
+		zap.S().Errorf("Couldn't build request to send detailed /jetze report")
+		return "", err
+	}
+	request, _ := http.NewRequest("POST", client.methodURL("sendPhoto"), requestBody)
+	request.Header.Add("Content-Type", contentType)
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		zap.S().Errorw("Dynamic photo request failed", "error", err)
+		return "", err
+	}
+	defer response.Body.Close()
+
+	telegramResponse, err := decodePhotoResponse("sendPhoto", response)
+	if err != nil {
+		return "", err
+	}
+
+	// Telegram returns a list of images, in different resolutions
+	// All of them share the same file_id
+	telegramIdentifier := telegramResponse.Result.Photo[0].FileID
+
+	return telegramIdentifier, nil
+}
+
+func (client *HTTPClient) SendMessage(chatID int, message string, keyboardIdentifier KeyboardIdentifier) error {
+	var requestBody interface{}
+	if keyboardIdentifier == NilKeyboard {
+		requestBody = &sendMessageRequestBody{
+			ChatID:    chatID,
+			Text:      message,
+			ParseMode: "HTML",
+		}
+	} else if keyboardIdentifier == NoKeyboard {
+		noKeyboard := &ReplyKeyboardRemoveStruct{RemoveKeyboard: true}
+		requestBody = &sendMessageRequestDeleteKeyboardRequestBody{
+			ChatID:              chatID,
+			Text:                message,
+			ParseMode:           "HTML",
+			ReplyKeyboardMarkup: noKeyboard,
+		}
+	} else {
+		keyboard, err := GetCustomizedKeyboardFromIdentifier(chatID, keyboardIdentifier)
+		if err != nil {
+			zap.S().Errorw("Error while sending message, can't get keyboard",
+				"keyboardIdentifier", keyboardIdentifier,
+				"error", err)
+		}
+		requestBody = &sendMessageRequestBody{
+			ChatID:              chatID,
+			Text:                message,
+			ParseMode:           "HTML",
+			ReplyKeyboardMarkup: keyboard,
+		}
+	}
+
+	response, err := client.postJSON("sendMessage", requestBody)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := checkResponse("sendMessage", response); err != nil {
+		zap.S().Errorw("Sending message failed", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (client *HTTPClient) SendMessageWithInlineKeyboard(chatID int, message string, keyboard InlineKeyboardMarkup) (int, error) {
+	requestBody := &sendMessageWithInlineKeyboardRequestBody{
+		ChatID:      chatID,
+		Text:        message,
+		ParseMode:   "HTML",
+		ReplyMarkup: keyboard,
+	}
+	response, err := client.postJSON("sendMessage", requestBody)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	telegramResponse := &telegramResponseBody{}
+	if err := json.NewDecoder(response.Body).Decode(telegramResponse); err != nil {
+		return 0, err
+	}
+	if !telegramResponse.Ok {
+		return 0, newAPIError("sendMessage", response.StatusCode, telegramResponse.telegramStatusResponseBody)
+	}
+	return telegramResponse.Result.MessageID, nil
+}
+
+func (client *HTTPClient) AnswerCallbackQuery(callbackQueryID string, text string) error {
+	requestBody := &answerCallbackQueryRequestBody{
+		CallbackQueryID: callbackQueryID,
+		Text:            text,
+	}
+	response, err := client.postJSON("answerCallbackQuery", requestBody)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return checkResponse("answerCallbackQuery", response)
+}
+
+func (client *HTTPClient) SendPhotoWithInlineKeyboard(chatID int, photo InputPhoto, caption string, keyboard InlineKeyboardMarkup) (SentPhoto, error) {
+	var response *http.Response
+	var err error
+	if photo.FilePath != "" {
+		keyboardAsJSON, _ := json.Marshal(keyboard)
+		response, err = client.postMultipartFile("sendPhoto", "photo", photo.FilePath, map[string]string{
+			"chat_id":      strconv.Itoa(chatID),
+			"caption":      caption,
+			"reply_markup": string(keyboardAsJSON),
+		})
+	} else {
+		response, err = client.postJSON("sendPhoto", &sendPhotoWithInlineKeyboardRequestBody{
+			ChatID:      chatID,
+			Photo:       photo.FileID,
+			Caption:     caption,
+			ReplyMarkup: keyboard,
+		})
+	}
+	if err != nil {
+		return SentPhoto{}, err
+	}
+	defer response.Body.Close()
+
+	telegramResponse, err := decodePhotoResponse("sendPhoto", response)
+	if err != nil {
+		return SentPhoto{}, err
+	}
+	return SentPhoto{MessageID: telegramResponse.Result.MessageID, FileID: telegramResponse.Result.Photo[0].FileID}, nil
+}
+
+func (client *HTTPClient) EditMessageCaption(chatID int, messageID int, caption string, keyboard *InlineKeyboardMarkup) error {
+	requestBody := &editMessageCaptionRequestBody{
+		ChatID:      chatID,
+		MessageID:   messageID,
+		Caption:     caption,
+		ReplyMarkup: keyboard,
+	}
+	return client.postEdit("editMessageCaption", requestBody)
+}
+
+func (client *HTTPClient) EditMessagePhoto(chatID int, messageID int, photo InputPhoto, caption string, keyboard *InlineKeyboardMarkup) (string, error) {
+	var response *http.Response
+	var err error
+	if photo.FilePath != "" {
+		// Uploaded files are referenced from the media via attach://<name of the form field>
+		mediaAsJSON, _ := json.Marshal(inputMediaPhoto{Type: "photo", Media: "attach://photo", Caption: caption})
+		fields := map[string]string{
+			"chat_id":    strconv.Itoa(chatID),
+			"message_id": strconv.Itoa(messageID),
+			"media":      string(mediaAsJSON),
+		}
+		if keyboard != nil {
+			keyboardAsJSON, _ := json.Marshal(keyboard)
+			fields["reply_markup"] = string(keyboardAsJSON)
+		}
+		response, err = client.postMultipartFile("editMessageMedia", "photo", photo.FilePath, fields)
+	} else {
+		response, err = client.postJSON("editMessageMedia", &editMessageMediaRequestBody{
+			ChatID:      chatID,
+			MessageID:   messageID,
+			Media:       inputMediaPhoto{Type: "photo", Media: photo.FileID, Caption: caption},
+			ReplyMarkup: keyboard,
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	telegramResponse, err := decodePhotoResponse("editMessageMedia", response)
+	if err != nil {
+		var apiError *APIError
+		if photo.FileID != "" && errors.As(err, &apiError) && apiError.IsMessageNotModified() {
+			// Nothing changed, see postEdit
+			return photo.FileID, nil
+		}
+		return "", err
+	}
+	return telegramResponse.Result.Photo[0].FileID, nil
+}
+
+/*
+postMultipartFile uploads the file at filePath as the form field fileFieldName to the given
+bot API method, together with the given fields. Callers need to close the response body
+*/
+func (client *HTTPClient) postMultipartFile(method string, fileFieldName string, filePath string, fields map[string]string) (*http.Response, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		zap.S().Errorf("Can't open file for upload: %s", filePath)
+		return nil, err
+	}
+	defer file.Close()
+
+	requestBody := new(bytes.Buffer)
+	writer := multipart.NewWriter(requestBody)
+	part, err := writer.CreateFormFile(fileFieldName, filepath.Base(filePath))
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(part, file)
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	writer.Close()
+
+	request, _ := http.NewRequest("POST", client.methodURL(method), requestBody)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	return client.httpClient.Do(request)
+}
+
+// decodePhotoResponse returns the response to a request that results in a photo message, or an error if there is none
+func decodePhotoResponse(method string, response *http.Response) (*telegramResponseBody, error) {
+	telegramResponse := &telegramResponseBody{}
+	if err := json.NewDecoder(response.Body).Decode(telegramResponse); err != nil {
+		return nil, err
+	}
+	if !telegramResponse.Ok {
+		return nil, newAPIError(method, response.StatusCode, telegramResponse.telegramStatusResponseBody)
+	}
+	if len(telegramResponse.Result.Photo) == 0 {
+		return nil, fmt.Errorf("Telegram response to %s contains no photo", method)
+	}
+	return telegramResponse, nil
+}
+
+func (client *HTTPClient) EditMessageText(chatID int, messageID int, message string, keyboard *InlineKeyboardMarkup) error {
+	requestBody := &editMessageTextRequestBody{
+		ChatID:      chatID,
+		MessageID:   messageID,
+		Text:        message,
+		ParseMode:   "HTML",
+		ReplyMarkup: keyboard,
+	}
+	return client.postEdit("editMessageText", requestBody)
+}
+
+func (client *HTTPClient) EditMessageReplyMarkup(chatID int, messageID int, keyboard *InlineKeyboardMarkup) error {
+	requestBody := &editMessageReplyMarkupRequestBody{
+		ChatID:      chatID,
+		MessageID:   messageID,
+		ReplyMarkup: keyboard,
+	}
+	return client.postEdit("editMessageReplyMarkup", requestBody)
+}
+
+/*
+APIError is returned if telegram refused a request. RetryAfter is only set if
+we sent too many requests, and is how long telegram wants us to wait, see
+https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+*/
+type APIError struct {
+	Method      string
+	StatusCode  int
+	Description string
+	RetryAfter  time.Duration
+}
+
+func (err *APIError) Error() string {
+	return fmt.Sprintf("Telegram refused %s (%d): %s", err.Method, err.StatusCode, err.Description)
+}
+
+// IsTooManyRequests returns true if telegram refused the request because of its rate limits
+func (err *APIError) IsTooManyRequests() bool {
+	return err.StatusCode == http.StatusTooManyRequests
+}
+
+// IsServerError returns true if the request failed on telegrams side, and may succeed if repeated
+func (err *APIError) IsServerError() bool {
+	return err.StatusCode >= 500
+}
+
+/*
+IsChatUnreachable returns true if we can't send anything to the chat anymore,
+because the user blocked us, deleted their account, or the chat doesn't exist
+*/
+func (err *APIError) IsChatUnreachable() bool {
+	return err.StatusCode == http.StatusForbidden ||
+		(err.StatusCode == http.StatusBadRequest && strings.Contains(err.Description, "chat not found"))
+}
+
+// IsMessageNotModified returns true if telegram refused an edit because it wouldn't change anything
+func (err *APIError) IsMessageNotModified() bool {
+	return err.StatusCode == http.StatusBadRequest && strings.Contains(err.Description, "message is not modified")
+}
+
+// newAPIError returns the error described by the given response body. statusCode is the HTTP status of the response
+func newAPIError(method string, statusCode int, status telegramStatusResponseBody) *APIError {
+	if status.ErrorCode != 0 {
+		statusCode = status.ErrorCode
+	}
+	return &APIError{
+		Method:      method,
+		StatusCode:  statusCode,
+		Description: status.Description,
+		RetryAfter:  time.Duration(status.Parameters.RetryAfter) * time.Second,
+	}
+}
+
+// checkResponse returns an *APIError if the given response says that telegram refused the request
+func checkResponse(method string, response *http.Response) error {
+	body, _ := ioutil.ReadAll(response.Body)
+	telegramResponse := &telegramStatusResponseBody{}
+	if err := json.Unmarshal(body, telegramResponse); err != nil {
+		if response.StatusCode == http.StatusOK {
+			return err
+		}
+		// E.g. a proxy in between that answers with HTML
+		return &APIError{Method: method, StatusCode: response.StatusCode, Description: string(body)}
+	}
+	if telegramResponse.Ok {
+		return nil
+	}
+	return newAPIError(method, response.StatusCode, *telegramResponse)
+}
+
+/*
+postEdit sends an edit of an existing message to the given bot API method. Telegram
+refuses edits that don't change anything, which happens e.g. if a button is
+pressed twice. We treat those as successful, since the message is how we want it
+*/
+func (client *HTTPClient) postEdit(method string, requestBody interface{}) error {
+	response, err := client.postJSON(method, requestBody)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	err = checkResponse(method, response)
+	var apiError *APIError
+	if errors.As(err, &apiError) && apiError.IsMessageNotModified() {
+		return nil
+	}
+	return err
+}
+
+func (client *HTTPClient) SendDocument(chatID int, fileName string, content []byte, caption string) error {
+	requestBody, contentType, err := prepareMultipartForContent("document", fileName, bytes.NewReader(content), chatID, caption)
+	if err != nil {
+		zap.S().Errorw("Couldn't build request to send document", "error", err)
+		return err
+	}
+	request, _ := http.NewRequest("POST", client.methodURL("sendDocument"), requestBody)
+	request.Header.Add("Content-Type", contentType)
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return checkResponse("sendDocument", response)
+}
+
+func (client *HTTPClient) SendTypingIndicator(chatID int) error {
+	indicatorString := "upload_photo"
+	requestBody := &sendChatActionRequestBody{
+		ChatID: chatID,
+		Action: indicatorString,
+	}
+	response, err := client.postJSON("sendChatAction", requestBody)
+	if err != nil {
+		zap.S().Error("Failure while sending typing indicator", err)
+		return err
+	}
+	defer response.Body.Close()
+	return checkResponse("sendChatAction", response)
+}
+
+func (client *HTTPClient) GetUpdates(offset int, timeoutInSeconds int) ([]WebhookRequestBody, error) {
+	requestBody := &getUpdatesRequestBody{
+		Offset:         offset,
+		Timeout:        timeoutInSeconds,
+		AllowedUpdates: ALLOWED_UPDATES,
+	}
+	response, err := client.postJSON("getUpdates", requestBody)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	updatesResponse := &getUpdatesResponseBody{}
+	if err := json.NewDecoder(response.Body).Decode(updatesResponse); err != nil {
+		return nil, err
+	}
+	if !updatesResponse.Ok {
+		return nil, newAPIError("getUpdates", response.StatusCode, updatesResponse.telegramStatusResponseBody)
+	}
+	return updatesResponse.Result, nil
+}
+
+func (client *HTTPClient) SetWebhook(url string, secretToken string, allowedUpdates []string) error {
+	requestBody := &setWebhookRequestBody{
+		URL:            url,
+		SecretToken:    secretToken,
+		AllowedUpdates: allowedUpdates,
+	}
+	response, err := client.postJSON("setWebhook", requestBody)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return checkResponse("setWebhook", response)
+}
+
+func (client *HTTPClient) DeleteWebhook() error {
+	response, err := client.postJSON("deleteWebhook", struct{}{})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return checkResponse("deleteWebhook", response)
+}
@@ -0,0 +1,51 @@
+package telegram_connector
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// errorResponse returns the response telegram would give with the given error
+func errorResponse(statusCode int, description string, retryAfterSeconds int) *http.Response {
+	recorder := httptest.NewRecorder()
+	writeFakeErrorWithRetryAfter(recorder, statusCode, description, retryAfterSeconds)
+	return recorder.Result()
+}
+
+func TestErrorResponsesAreParsedIntoAPIErrors(t *testing.T) {
+	var apiError *APIError
+
+	err := checkResponse("sendMessage", errorResponse(http.StatusTooManyRequests, "Too Many Requests: retry after 7", 7))
+	if !errors.As(err, &apiError) || !apiError.IsTooManyRequests() || apiError.RetryAfter != 7*time.Second {
+		t.Errorf("429 wasn't parsed with its retry_after: %v", err)
+	}
+
+	err = checkResponse("sendMessage", errorResponse(http.StatusForbidden, "Forbidden: bot was blocked by the user", 0))
+	if !errors.As(err, &apiError) || !apiError.IsChatUnreachable() {
+		t.Errorf("Blocked chat isn't recognized as unreachable: %v", err)
+	}
+
+	err = checkResponse("sendMessage", errorResponse(http.StatusBadRequest, "Bad Request: chat not found", 0))
+	if !errors.As(err, &apiError) || !apiError.IsChatUnreachable() {
+		t.Errorf("Missing chat isn't recognized as unreachable: %v", err)
+	}
+
+	err = checkResponse("editMessageText", errorResponse(http.StatusBadRequest, "Bad Request: message is not modified", 0))
+	if !errors.As(err, &apiError) || apiError.IsChatUnreachable() || !apiError.IsMessageNotModified() {
+		t.Errorf("Unmodified edit was misclassified: %v", err)
+	}
+
+	err = checkResponse("sendMessage", errorResponse(http.StatusBadGateway, "Bad Gateway", 0))
+	if !errors.As(err, &apiError) || !apiError.IsServerError() || apiError.IsChatUnreachable() {
+		t.Errorf("Server error was misclassified: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	writeFakeResult(recorder, true)
+	if err := checkResponse("sendChatAction", recorder.Result()); err != nil {
+		t.Errorf("Successful response was treated as error: %s", err)
+	}
+}
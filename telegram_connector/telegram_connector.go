@@ -1,30 +1,31 @@
 package telegram_connector
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"mime/multipart"
-	"net/http"
+	"errors"
 	"os"
-	"path/filepath"
-	"strconv"
 
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
 	"go.uber.org/zap"
 )
 
 const KEY_TELEGRAM_TOKEN string = "MENSA_QUEUE_BOT_TELEGRAM_TOKEN"
 
+// Update types we handle, telegram doesn't send us any others. Applies to getUpdates and the webhook
+var ALLOWED_UPDATES = []string{"message", "callback_query"}
+
+// Telegram sends the secret_token given in setWebhook with every webhook request in this header
+const WEBHOOK_SECRET_HEADER = "X-Telegram-Bot-Api-Secret-Token"
+
 type WebhookRequestBodyWebAppData struct {
 	ButtonText string `json:"button_text"`
 	Data       string `json:"data"`
 }
 
 // Struct definitions taken from https://www.sohamkamani.com/golang/telegram-bot/
+// The same struct is used for updates received via webhook and via getUpdates
 type WebhookRequestBody struct {
-	Message struct {
+	UpdateID int `json:"update_id"`
+	Message  struct {
 		Text string `json:"text"`
 		Chat struct {
 			ID int `json:"id"`
@@ -32,6 +33,20 @@ type WebhookRequestBody struct {
 		Date       int                          `json:"date"`
 		WebAppData WebhookRequestBodyWebAppData `json:"web_app_data"`
 	} `json:"message"`
+	CallbackQuery WebhookRequestBodyCallbackQuery `json:"callback_query"`
+}
+
+// Sent when a user presses a button of an inline keyboard, https://core.telegram.org/bots/api#callbackquery
+type WebhookRequestBodyCallbackQuery struct {
+	ID      string `json:"id"`
+	Data    string `json:"data"`
+	Message struct {
+		MessageID int `json:"message_id"`
+		Date      int `json:"date"`
+		Chat      struct {
+			ID int `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
 }
 
 // Also see sendMessageRequestDeleteKeyboardRequestBody
@@ -74,6 +89,118 @@ type ReplyKeyboardMarkupStruct struct { // https://core.telegram.org/bots/api/#r
 	ResizeKeyboard bool               `json:"resize_keyboard,omitempty"`
 }
 
+// https://core.telegram.org/bots/api#inlinekeyboardbutton
+type InlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+// Buttons that are attached to a single message, https://core.telegram.org/bots/api#inlinekeyboardmarkup
+type InlineKeyboardMarkup struct {
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+// Separates the action of callback data from its arguments, as in "forgetme:confirm"
+const CALLBACK_DATA_SEPARATOR = ":"
+
+// Telegram refuses callback data that is longer than this, in bytes
+const MAX_CALLBACK_DATA_LENGTH = 64
+
+/*
+NewCallbackButton returns a button that, when pressed, sends the given action and
+argument as callback data. Routers match on the action, see command_router.HandleCallback
+*/
+func NewCallbackButton(text string, action string, argument string) InlineKeyboardButton {
+	callbackData := action
+	if argument != "" {
+		callbackData = action + CALLBACK_DATA_SEPARATOR + argument
+	}
+	if len(callbackData) > MAX_CALLBACK_DATA_LENGTH {
+		zap.S().Errorw("Callback data is too long, telegram will refuse the keyboard", "callbackData", callbackData)
+	}
+	return InlineKeyboardButton{Text: text, CallbackData: callbackData}
+}
+
+// NewInlineKeyboard returns an inline keyboard with the given rows of buttons
+func NewInlineKeyboard(rows ...[]InlineKeyboardButton) InlineKeyboardMarkup {
+	return InlineKeyboardMarkup{InlineKeyboard: rows}
+}
+
+type sendMessageWithInlineKeyboardRequestBody struct {
+	ChatID      int                  `json:"chat_id"`
+	Text        string               `json:"text"`
+	ParseMode   string               `json:"parse_mode"`
+	ReplyMarkup InlineKeyboardMarkup `json:"reply_markup"`
+}
+
+/*
+InputPhoto is a photo we want to send. Either FileID is set, to send a photo
+telegram already knows (or a URL), or FilePath is set, to upload a local file
+*/
+type InputPhoto struct {
+	FileID   string
+	FilePath string
+}
+
+// SentPhoto identifies a photo message we sent
+type SentPhoto struct {
+	MessageID int
+	// Can be used to send the same photo again, without uploading it
+	FileID string
+}
+
+type sendPhotoWithInlineKeyboardRequestBody struct {
+	ChatID      int                  `json:"chat_id"`
+	Photo       string               `json:"photo"`
+	Caption     string               `json:"caption"`
+	ReplyMarkup InlineKeyboardMarkup `json:"reply_markup"`
+}
+
+// https://core.telegram.org/bots/api#editmessagecaption. Leaving out ReplyMarkup removes the inline keyboard
+type editMessageCaptionRequestBody struct {
+	ChatID      int                   `json:"chat_id"`
+	MessageID   int                   `json:"message_id"`
+	Caption     string                `json:"caption"`
+	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// https://core.telegram.org/bots/api#inputmediaphoto
+type inputMediaPhoto struct {
+	Type    string `json:"type"`
+	Media   string `json:"media"`
+	Caption string `json:"caption"`
+}
+
+// https://core.telegram.org/bots/api#editmessagemedia. Leaving out ReplyMarkup removes the inline keyboard
+type editMessageMediaRequestBody struct {
+	ChatID      int                   `json:"chat_id"`
+	MessageID   int                   `json:"message_id"`
+	Media       inputMediaPhoto       `json:"media"`
+	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// https://core.telegram.org/bots/api#editmessagetext. Leaving out ReplyMarkup removes the inline keyboard
+type editMessageTextRequestBody struct {
+	ChatID      int                   `json:"chat_id"`
+	MessageID   int                   `json:"message_id"`
+	Text        string                `json:"text"`
+	ParseMode   string                `json:"parse_mode"`
+	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// https://core.telegram.org/bots/api#editmessagereplymarkup. Leaving out ReplyMarkup removes the inline keyboard
+type editMessageReplyMarkupRequestBody struct {
+	ChatID      int                   `json:"chat_id"`
+	MessageID   int                   `json:"message_id"`
+	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// https://core.telegram.org/bots/api#answercallbackquery
+type answerCallbackQueryRequestBody struct {
+	CallbackQueryID string `json:"callback_query_id"`
+	Text            string `json:"text,omitempty"`
+}
+
 type ReplyKeyboardRemoveStruct struct { // from https://core.telegram.org/bots/api#replykeyboardremove
 	RemoveKeyboard bool `json:"remove_keyboard"`
 }
@@ -92,9 +219,44 @@ type telegramResponseBodyPhoto struct {
 	FileID string `json:"file_id"` // This is the ID we want to use to re-send this image
 }
 
+// https://core.telegram.org/bots/api#getupdates
+type getUpdatesRequestBody struct {
+	Offset         int      `json:"offset"`
+	Timeout        int      `json:"timeout"`
+	AllowedUpdates []string `json:"allowed_updates"`
+}
+
+// https://core.telegram.org/bots/api#setwebhook
+type setWebhookRequestBody struct {
+	URL            string   `json:"url"`
+	SecretToken    string   `json:"secret_token,omitempty"`
+	AllowedUpdates []string `json:"allowed_updates"`
+}
+
+type getUpdatesResponseBody struct {
+	telegramStatusResponseBody
+	Result []WebhookRequestBody `json:"result"`
+}
+
+/*
+The part of a response that is the same for all methods. Also used on its own for
+methods whose result we don't care about, which may be true instead of a message
+*/
+type telegramStatusResponseBody struct {
+	Ok          bool   `json:"ok"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+	// https://core.telegram.org/bots/api#responseparameters
+	Parameters struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
 type telegramResponseBody struct {
+	telegramStatusResponseBody
 	Result struct {
-		Photo []telegramResponseBodyPhoto `json:"photo"`
+		MessageID int                         `json:"message_id"`
+		Photo     []telegramResponseBodyPhoto `json:"photo"`
 	} `json:"result"`
 }
 
@@ -111,61 +273,13 @@ func GetTelegramToken() string {
 }
 
 /*
-   Sends a POST request to the telegram API that contains the link to a photo. This photo is sent to the identified user. Description is set as the text of the message
+   Sends a message to the telegram API that contains the link to a photo. This photo is sent to the identified user. Description is set as the text of the message
    https://core.telegram.org/bots/api#sendphoto
 */
 func SendStaticWebPhoto(chatID int, photoURL string, description string, keyboardIdentifier KeyboardIdentifier) error {
-	telegramUrl := fmt.Sprintf("https://api.telegram.org/bot%s/sendPhoto", GetTelegramToken())
-
-	if keyboardIdentifier != NilKeyboard {
-		zap.S().Error("Tried to set a keyboard with SendDynamicPhoto. Is that even possible?")
-		// Initial scan of the documentation says it isn't, but I was really tired, and it's quite hot right now. Definitely recheck if needed.
-	}
-
-	requestBody := &sendWebPhotoRequestBody{
-		ChatID:  chatID,
-		Photo:   photoURL,
-		Caption: description,
-	}
-
-	reqBytes, err := json.Marshal(requestBody)
-	if err != nil {
-		return err
-	}
-
-	_, err = http.Post(telegramUrl, "application/json", bytes.NewBuffer(reqBytes))
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-/* PrepareMultipartForUpload reads the given file, chatID and caption, and writes them
-to a buffer in a format corresponding to a multipart request.
-Addicionally, it also returns the FormDataContentType for said multipart request.
-*/
-func prepareMultipartForUpload(pathToFile string, chatID int, caption string) (*bytes.Buffer, string, error) {
-	// Read file content
-	file, err := os.Open(pathToFile)
-	defer file.Close()
-	requestBody := new(bytes.Buffer)
-	if err != nil {
-		zap.S().Errorf("Can't open graph file for detailed /jetze report: %s", pathToFile)
-		return requestBody, "", err
-	}
-	writer := multipart.NewWriter(requestBody)
-	defer writer.Close()
-	part, err := writer.CreateFormFile("photo", filepath.Base(pathToFile))
-	if err != nil {
-		zap.S().Errorf("Can't CreateFormFile for /jetze report: %s", pathToFile)
-		return nil, "", err
-	}
-	io.Copy(part, file)
-
-	writer.WriteField("chat_id", strconv.Itoa(chatID))
-	writer.WriteField("caption", caption)
-
-	return requestBody, writer.FormDataContentType(), nil
+	return callRateLimited(chatID, func() error {
+		return GetClient().SendStaticWebPhoto(chatID, photoURL, description, keyboardIdentifier)
+	})
 }
 
 /* SendDynamicPhoto sends an image that is stored locally on this machine
@@ -174,121 +288,175 @@ to the user with the given chatID. A description/caption can also be added.
 Returns telegram assigned identifier and error, if the request should fail
 */
 func SendDynamicPhoto(chatID int, photoFilePath string, description string, keyboardIdentifier KeyboardIdentifier) (string, error) {
-	telegramUrl := fmt.Sprintf("https://api.telegram.org/bot%s/sendPhoto", GetTelegramToken())
+	var telegramIdentifier string
+	err := callRateLimited(chatID, func() (err error) {
+		telegramIdentifier, err = GetClient().SendDynamicPhoto(chatID, photoFilePath, description, keyboardIdentifier)
+		return err
+	})
+	return telegramIdentifier, err
+}
 
-	requestBody, contentType, err := prepareMultipartForUpload(photoFilePath, chatID, description)
+/*
+   Sends the indicated string to the indicated user, with the keyboard identified by keyboardIdentifier.
+   https://core.telegram.org/bots/api#sendmessage
+*/
+func SendMessage(chatID int, message string, keyboardIdentifier KeyboardIdentifier) error {
+	return callRateLimited(chatID, func() error {
+		return GetClient().SendMessage(chatID, message, keyboardIdentifier)
+	})
+}
 
-	if keyboardIdentifier != NilKeyboard {
-		zap.S().Error("Tried to set a keyboard with SendDynamicPhoto. Is that even possible?")
-		// Initial scan of the documentation says it isn't, but I was really tired, and it's quite hot right now. Definitely recheck if needed.
-	}
+/*
+SendMessageWithInlineKeyboard sends the given message with buttons attached to it. Presses
+of these buttons arrive as callback queries. Returns the ID of the sent message
+*/
+func SendMessageWithInlineKeyboard(chatID int, message string, keyboard InlineKeyboardMarkup) (int, error) {
+	var messageID int
+	err := callRateLimited(chatID, func() (err error) {
+		messageID, err = GetClient().SendMessageWithInlineKeyboard(chatID, message, keyboard)
+		return err
+	})
+	return messageID, err
+}
 
-	if err != nil {
-		zap.S().Errorf("Couldn't build request to send detailed /jetze report")
-		return "", err
-	}
-	request, _ := http.NewRequest("POST", telegramUrl, requestBody)
-	request.Header.Add("Content-Type", contentType)
-	client := &http.Client{}
-	response, err := client.Do(request)
-	defer response.Body.Close()
-
-	if err != nil {
-		zap.S().Errorw("Dynamic photo request failed", "error", err)
-		return "", err
-	}
-	telegramResponse := &telegramResponseBody{}
-	responseDecoder := json.NewDecoder(response.Body)
-	err = responseDecoder.Decode(telegramResponse)
+/*
+AnswerCallbackQuery tells telegram that we handled a button press. Until then the
+button shows a loading indicator. text is shown to the user as a notification, if it isn't empty
+https://core.telegram.org/bots/api#answercallbackquery
+*/
+func AnswerCallbackQuery(callbackQueryID string, text string) error {
+	// Answers don't send anything to a chat, so they don't count against our limits. They can still hit them
+	err := GetClient().AnswerCallbackQuery(callbackQueryID, text)
+	pauseIfRateLimited(err)
+	return err
+}
 
-	if err != nil {
-		return "", err
-	}
+/*
+SendPhotoWithInlineKeyboard sends the given photo with buttons attached to it
+https://core.telegram.org/bots/api#sendphoto
+*/
+func SendPhotoWithInlineKeyboard(chatID int, photo InputPhoto, caption string, keyboard InlineKeyboardMarkup) (SentPhoto, error) {
+	var sentPhoto SentPhoto
+	err := callRateLimited(chatID, func() (err error) {
+		sentPhoto, err = GetClient().SendPhotoWithInlineKeyboard(chatID, photo, caption, keyboard)
+		return err
+	})
+	return sentPhoto, err
+}
 
-	// Telegram returns a list of images, in different resolutions
-	// All of them share the same file_id
-	telegramIdentifier := telegramResponse.Result.Photo[0].FileID
+/*
+EditMessageCaption replaces the caption of a photo we sent earlier. If keyboard is nil
+the inline keyboard of the message is removed
+https://core.telegram.org/bots/api#editmessagecaption
+*/
+func EditMessageCaption(chatID int, messageID int, caption string, keyboard *InlineKeyboardMarkup) error {
+	return callRateLimited(chatID, func() error {
+		return GetClient().EditMessageCaption(chatID, messageID, caption, keyboard)
+	})
+}
 
-	return telegramIdentifier, nil
+/*
+EditMessagePhoto replaces the photo and caption of a photo we sent earlier. If keyboard is nil
+the inline keyboard of the message is removed. Returns the file ID of the new photo
+https://core.telegram.org/bots/api#editmessagemedia
+*/
+func EditMessagePhoto(chatID int, messageID int, photo InputPhoto, caption string, keyboard *InlineKeyboardMarkup) (string, error) {
+	var fileID string
+	err := callRateLimited(chatID, func() (err error) {
+		fileID, err = GetClient().EditMessagePhoto(chatID, messageID, photo, caption, keyboard)
+		return err
+	})
+	return fileID, err
 }
 
 /*
-   Sends a POST request to the telegram API that sends the indicated string to the indicated user.
-   https://core.telegram.org/bots/api#sendmessage
+EditMessageText replaces the text of a message we sent earlier, e.g. after one of its buttons was pressed.
+If keyboard is nil the inline keyboard of the message is removed
+https://core.telegram.org/bots/api#editmessagetext
 */
-func SendMessage(chatID int, message string, keyboardIdentifier KeyboardIdentifier) error {
-	telegramUrl := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", GetTelegramToken())
-	var reqBytes []byte
-	var err error
-	if keyboardIdentifier == NilKeyboard {
-		requestBody := &sendMessageRequestBody{
-			ChatID:    chatID,
-			Text:      message,
-			ParseMode: "HTML",
-		}
-		reqBytes, err = json.Marshal(requestBody)
-	} else if keyboardIdentifier == NoKeyboard {
-		noKeyboard := &ReplyKeyboardRemoveStruct{RemoveKeyboard: true}
-		requestBodyWithKeyboardRemoval := &sendMessageRequestDeleteKeyboardRequestBody{
-			ChatID:              chatID,
-			Text:                message,
-			ParseMode:           "HTML",
-			ReplyKeyboardMarkup: noKeyboard,
-		}
-		reqBytes, err = json.Marshal(requestBodyWithKeyboardRemoval)
-
-	} else {
-		keyboard, err := GetCustomizedKeyboardFromIdentifier(chatID, keyboardIdentifier)
-		if err != nil {
-			zap.S().Errorw("Error while sending message, can't get keyboard",
-				"keyboardIdentifier", keyboardIdentifier,
-				"error", err)
-		}
-		requestBody := &sendMessageRequestBody{
-			ChatID:              chatID,
-			Text:                message,
-			ParseMode:           "HTML",
-			ReplyKeyboardMarkup: keyboard,
-		}
-		reqBytes, err = json.Marshal(requestBody)
-	}
+func EditMessageText(chatID int, messageID int, message string, keyboard *InlineKeyboardMarkup) error {
+	return callRateLimited(chatID, func() error {
+		return GetClient().EditMessageText(chatID, messageID, message, keyboard)
+	})
+}
 
-	if err != nil {
-		// err from reqBytes
-		return err
-	}
+/*
+EditMessageReplyMarkup replaces the inline keyboard of a message we sent earlier, or
+removes it if keyboard is nil
+https://core.telegram.org/bots/api#editmessagereplymarkup
+*/
+func EditMessageReplyMarkup(chatID int, messageID int, keyboard *InlineKeyboardMarkup) error {
+	return callRateLimited(chatID, func() error {
+		return GetClient().EditMessageReplyMarkup(chatID, messageID, keyboard)
+	})
+}
 
-	response, err := http.Post(telegramUrl, "application/json", bytes.NewBuffer(reqBytes))
-	defer response.Body.Close()
-	if err != nil {
-		return err
-	}
-	if response.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(response.Body)
+/*
+SendDocument sends the given content to the user as a file with the given name
+https://core.telegram.org/bots/api#senddocument
+*/
+func SendDocument(chatID int, fileName string, content []byte, caption string) error {
+	return callRateLimited(chatID, func() error {
+		return GetClient().SendDocument(chatID, fileName, content, caption)
+	})
+}
 
-		zap.S().Errorw("Sending message failed:", "Response", body)
+/*
+callRateLimited makes a call that sends something to the given chat, or edits something in it.
+All of those go through here: The call waits for globalRateLimiter, pauses all calls
+if telegram says that we're sending too much, and marks chats we can't reach anymore
+*/
+func callRateLimited(chatID int, call func() error) error {
+	globalRateLimiter.wait(chatID)
+	err := call()
+	pauseIfRateLimited(err)
+	markChatIfUnreachable(chatID, err)
+	return err
+}
 
+/*
+markChatIfUnreachable marks the chat inactive if err says that we can't reach it anymore,
+so that it's left out of pushes. See db_connectors.SetChatInactive
+*/
+func markChatIfUnreachable(chatID int, err error) {
+	var apiError *APIError
+	if errors.As(err, &apiError) && apiError.IsChatUnreachable() {
+		zap.S().Infow("Chat is unreachable, marking it inactive", "error", err)
+		db_connectors.SetChatInactive(chatID)
 	}
-	return nil
 }
 
 /* SendTypingIndicator sets the bots status to "sending image"
 for this specific user*/
 func SendTypingIndicator(chatID int) error {
-	telegramUrl := fmt.Sprintf("https://api.telegram.org/bot%s/sendChatAction", GetTelegramToken())
-	indicatorString := "upload_photo"
-	requestBody := &sendChatActionRequestBody{
-		ChatID: chatID,
-		Action: indicatorString,
-	}
-	reqBytes, err := json.Marshal(requestBody)
-	if err != nil {
-		return err
-	}
-	_, err = http.Post(telegramUrl, "application/json", bytes.NewBuffer(reqBytes))
-	if err != nil {
-		zap.S().Error("Failure while sending typing indicator", err)
-		return err
-	}
-	return nil
+	// Chat actions aren't messages, so they don't count against our limits. They can still hit them
+	err := GetClient().SendTypingIndicator(chatID)
+	pauseIfRateLimited(err)
+	return err
+}
+
+/*
+GetUpdates long polls telegram for updates with an update_id of at least offset.
+Blocks for up to timeoutInSeconds if no such update exists yet.
+https://core.telegram.org/bots/api#getupdates
+*/
+func GetUpdates(offset int, timeoutInSeconds int) ([]WebhookRequestBody, error) {
+	return GetClient().GetUpdates(offset, timeoutInSeconds)
+}
+
+/*
+SetWebhook tells telegram to send all updates to the given URL. Telegram sends secretToken
+with every request in WEBHOOK_SECRET_HEADER, which lets us tell its requests apart from others.
+https://core.telegram.org/bots/api#setwebhook
+*/
+func SetWebhook(url string, secretToken string) error {
+	return GetClient().SetWebhook(url, secretToken, ALLOWED_UPDATES)
+}
+
+/*
+DeleteWebhook removes any webhook that is set for our bot. Telegram refuses
+getUpdates requests while a webhook is set
+*/
+func DeleteWebhook() error {
+	return GetClient().DeleteWebhook()
 }
@@ -0,0 +1,103 @@
+package main
+
+/*
+Allows users to take back their last report, e.g. after tapping the wrong length.
+
+Reports are stored under a daily pseudonym, so once a report is written we can't
+find out which one belongs to a user. Instead we remember the ID of each new report
+in memory, for UNDO_WINDOW. These handles are never persisted, and are gone after
+a restart.
+*/
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"go.uber.org/zap"
+)
+
+// How long after a report it can still be undone
+const UNDO_WINDOW = 5 * time.Minute
+
+var globalUndoableReports = make(map[int]undoableReport)
+var globalUndoableReportsMutex sync.Mutex
+
+type undoableReport struct {
+	ReportID     int64
+	MensaID      string
+	QueueLength  string
+	ReportedAt   time.Time
+	AwardedPoint bool
+}
+
+func (report undoableReport) isExpired(now time.Time) bool {
+	return now.Sub(report.ReportedAt) > UNDO_WINDOW
+}
+
+/*
+rememberUndoableReport replaces the undoable report of the given user. Also forgets
+about all expired reports, so that handles don't stay around longer than needed
+*/
+func rememberUndoableReport(chatID int, report undoableReport) {
+	globalUndoableReportsMutex.Lock()
+	defer globalUndoableReportsMutex.Unlock()
+	for otherChatID, otherReport := range globalUndoableReports {
+		if otherReport.isExpired(report.ReportedAt) {
+			delete(globalUndoableReports, otherChatID)
+		}
+	}
+	globalUndoableReports[chatID] = report
+}
+
+// takeUndoableReport returns and forgets the last report of the given user, if it can still be undone
+func takeUndoableReport(chatID int, now time.Time) (undoableReport, bool) {
+	globalUndoableReportsMutex.Lock()
+	defer globalUndoableReportsMutex.Unlock()
+	report, found := globalUndoableReports[chatID]
+	delete(globalUndoableReports, chatID)
+	if !found || report.isExpired(now) {
+		return undoableReport{}, false
+	}
+	return report, true
+}
+
+// forgetUndoableReport drops the handle of the given user, e.g. because they deleted their account
+func forgetUndoableReport(chatID int) {
+	globalUndoableReportsMutex.Lock()
+	defer globalUndoableReportsMutex.Unlock()
+	delete(globalUndoableReports, chatID)
+}
+
+/*
+HandleUndoRequest removes the last report of the user and the point they got for it,
+and offers the report keyboard so that they can report the length they meant
+*/
+func HandleUndoRequest(chatID int) {
+	report, found := takeUndoableReport(chatID, time.Now())
+	if !found {
+		message := "There's no report of yours I can undo. Reports can only be undone within a few minutes"
+		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.LENGTH_REPORT, chatID)
+		if err := sendMessage(chatID, message, keyboardIdentifier); err != nil {
+			zap.S().Error("Error while sending undo message", err)
+		}
+		return
+	}
+
+	if err := db_connectors.DeleteQueueLengthReport(report.ReportID, chatID, report.AwardedPoint); err != nil {
+		zap.S().Errorw("Can't undo report", "error", err)
+		message := "I'm so sorry, something went wrong while undoing your report 🤕"
+		keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.LENGTH_REPORT, chatID)
+		sendMessage(chatID, message, keyboardIdentifier)
+		return
+	}
+	invalidateGraphOfMensa(report.MensaID)
+	refreshLiveMessagesOfMensa(report.MensaID, time.Now())
+
+	message := "I removed your report of " + report.QueueLength + ". If you meant a different length, report it now"
+	keyboardIdentifier := telegram_connector.GetIdentifierViaRequestType(telegram_connector.PREPARE_REPORT, chatID)
+	if err := sendMessage(chatID, message, keyboardIdentifier); err != nil {
+		zap.S().Error("Error while sending undo message", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+/*
+Handles updates from the webhook outside of the webhook request. Telegram repeats
+updates that aren't acknowledged quickly, and some of our requests take a while
+(e.g. rendering a graph), so the webhook only hands updates to the dispatcher.
+
+The dispatcher runs a fixed number of workers, each with a bounded queue. All
+updates of a chat go to the same worker, so they are handled in the order they
+arrived. If the queue of a worker is full the update is refused, and the webhook
+asks telegram to send it again later.
+*/
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"go.uber.org/zap"
+)
+
+const UPDATE_WORKERS = 8
+const UPDATE_QUEUE_LENGTH_PER_WORKER = 100
+
+// Queues that are longer than this are logged, as a warning before we start refusing updates
+const UPDATE_QUEUE_WARNING_LENGTH = UPDATE_QUEUE_LENGTH_PER_WORKER / 2
+
+// How often the dispatcher logs its statistics, if it handled any updates in between
+const UPDATE_STATS_INTERVAL = 10 * time.Minute
+
+var globalUpdateDispatcher *updateDispatcher
+
+// DispatcherStats describe how busy the dispatcher is
+type DispatcherStats struct {
+	Accepted int
+	// Refused because the queue of the chats worker was full, or the dispatcher was stopped
+	Refused int
+	Handled int
+	// Updates that were accepted, but not handled yet
+	Pending int
+	// Longest queue of a single worker since the stats were last logged
+	LongestQueue int
+}
+
+type updateDispatcher struct {
+	mutex     sync.Mutex
+	queues    []chan *telegram_connector.WebhookRequestBody
+	handle    func(*telegram_connector.WebhookRequestBody)
+	isStopped bool
+	stats     DispatcherStats
+	// Counts updates that were accepted but not handled yet
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+	stop    chan struct{}
+}
+
+// startUpdateDispatcher starts globalUpdateDispatcher, which hands updates to handleUpdate
+func startUpdateDispatcher() {
+	globalUpdateDispatcher = newUpdateDispatcher(UPDATE_WORKERS, UPDATE_QUEUE_LENGTH_PER_WORKER, handleUpdate)
+}
+
+func newUpdateDispatcher(numberOfWorkers int, queueLength int, handle func(*telegram_connector.WebhookRequestBody)) *updateDispatcher {
+	dispatcher := &updateDispatcher{
+		handle: handle,
+		stop:   make(chan struct{}),
+	}
+	for i := 0; i < numberOfWorkers; i++ {
+		queue := make(chan *telegram_connector.WebhookRequestBody, queueLength)
+		dispatcher.queues = append(dispatcher.queues, queue)
+		dispatcher.workers.Add(1)
+		go dispatcher.work(queue)
+	}
+	go dispatcher.logStatsRegularly()
+	return dispatcher
+}
+
+// getChatOfUpdate returns the chat an update belongs to, regardless of its type
+func getChatOfUpdate(update *telegram_connector.WebhookRequestBody) int {
+	if update.CallbackQuery.ID != "" {
+		return update.CallbackQuery.Message.Chat.ID
+	}
+	return update.Message.Chat.ID
+}
+
+/*
+dispatch queues the update for the worker of its chat. Returns false if the update
+was refused, because that worker has too much to do or the dispatcher was stopped
+*/
+func (dispatcher *updateDispatcher) dispatch(update *telegram_connector.WebhookRequestBody) bool {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	if dispatcher.isStopped {
+		dispatcher.stats.Refused++
+		return false
+	}
+	// Negative chat IDs (groups) need to end up at a worker too
+	workerIndex := uint(getChatOfUpdate(update)) % uint(len(dispatcher.queues))
+	queue := dispatcher.queues[workerIndex]
+
+	dispatcher.pending.Add(1)
+	select {
+	case queue <- update:
+	default:
+		dispatcher.pending.Done()
+		dispatcher.stats.Refused++
+		zap.S().Warnw("Refusing update, queue of worker is full", "worker", workerIndex)
+		return false
+	}
+	dispatcher.stats.Accepted++
+	queueLength := len(queue)
+	if queueLength > dispatcher.stats.LongestQueue {
+		dispatcher.stats.LongestQueue = queueLength
+	}
+	if queueLength == UPDATE_QUEUE_WARNING_LENGTH {
+		zap.S().Warnw("Queue of update worker is filling up", "worker", workerIndex, "queueLength", queueLength)
+	}
+	return true
+}
+
+func (dispatcher *updateDispatcher) work(queue chan *telegram_connector.WebhookRequestBody) {
+	defer dispatcher.workers.Done()
+	for update := range queue {
+		dispatcher.handle(update)
+		dispatcher.mutex.Lock()
+		dispatcher.stats.Handled++
+		dispatcher.mutex.Unlock()
+		dispatcher.pending.Done()
+	}
+}
+
+// getStats returns the current statistics of the dispatcher
+func (dispatcher *updateDispatcher) getStats() DispatcherStats {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	stats := dispatcher.stats
+	stats.Pending = stats.Accepted - stats.Handled
+	return stats
+}
+
+func (dispatcher *updateDispatcher) logStatsRegularly() {
+	ticker := time.NewTicker(UPDATE_STATS_INTERVAL)
+	defer ticker.Stop()
+	lastLoggedAccepted := 0
+	for {
+		select {
+		case <-dispatcher.stop:
+			return
+		case <-ticker.C:
+		}
+		stats := dispatcher.getStats()
+		if stats.Accepted == lastLoggedAccepted && stats.Refused == 0 {
+			continue
+		}
+		zap.S().Infow("Update dispatcher stats", "accepted", stats.Accepted, "refused", stats.Refused,
+			"handled", stats.Handled, "pending", stats.Pending, "longestQueue", stats.LongestQueue)
+		lastLoggedAccepted = stats.Accepted
+		dispatcher.mutex.Lock()
+		dispatcher.stats.LongestQueue = 0
+		dispatcher.mutex.Unlock()
+	}
+}
+
+// waitUntilIdle blocks until all accepted updates have been handled
+func (dispatcher *updateDispatcher) waitUntilIdle() {
+	dispatcher.pending.Wait()
+}
+
+/*
+drain stops accepting updates, and waits for up to timeout for the workers to
+handle all updates they accepted. Returns false if they didn't finish in time
+*/
+func (dispatcher *updateDispatcher) drain(timeout time.Duration) bool {
+	dispatcher.mutex.Lock()
+	if !dispatcher.isStopped {
+		dispatcher.isStopped = true
+		close(dispatcher.stop)
+		for _, queue := range dispatcher.queues {
+			close(queue)
+		}
+	}
+	dispatcher.mutex.Unlock()
+
+	workersDone := make(chan struct{})
+	go func() {
+		dispatcher.workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+		zap.S().Infow("Handled all pending updates", "handled", dispatcher.getStats().Handled)
+		return true
+	case <-time.After(timeout):
+		zap.S().Errorw("Gave up waiting for pending updates", "pending", dispatcher.getStats().Pending)
+		return false
+	}
+}
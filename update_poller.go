@@ -0,0 +1,112 @@
+package main
+
+/*
+Receives updates by long polling telegrams getUpdates method, as an alternative
+to the webhook. Which of the two is used is decided by utils.GetUpdateMode
+*/
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ADimeo/MensaQueueBot/db_connectors"
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"go.uber.org/zap"
+)
+
+const POLLING_TIMEOUT_IN_SECONDS = 50
+
+// How long we wait before polling again after telegram couldn't be reached
+const POLLING_ERROR_BACKOFF = 5 * time.Second
+
+// Held while a polled update is handled, so that stopLongPolling can wait for it
+var globalPolledUpdateMutex sync.Mutex
+
+/*
+runLongPolling polls for updates until stop is closed. Any webhook that is
+still set is removed first, since telegram refuses getUpdates otherwise.
+*/
+func runLongPolling(stop <-chan struct{}) {
+	if err := telegram_connector.DeleteWebhook(); err != nil {
+		zap.S().Error("Couldn't remove webhook, polling will likely fail", err)
+	}
+
+	offset := db_connectors.GetPollingOffset()
+	zap.S().Infof("Starting to poll for updates at offset %d", offset)
+	for {
+		select {
+		case <-stop:
+			zap.S().Info("Stopped polling for updates")
+			return
+		default:
+		}
+
+		newOffset, err := pollUpdatesOnce(offset, POLLING_TIMEOUT_IN_SECONDS, stop)
+		if err != nil {
+			zap.S().Error("Polling for updates failed, retrying soon", err)
+			select {
+			case <-stop:
+			case <-time.After(POLLING_ERROR_BACKOFF):
+			}
+			continue
+		}
+		offset = newOffset
+	}
+}
+
+/*
+pollUpdatesOnce requests all updates starting at offset, handles them,
+and returns the offset for the next request.
+
+The offset is persisted before an update is handled. If we crash while handling
+an update that update is lost, but we never handle an update twice
+(which would e.g. count a report twice). Once stop is closed no further updates are
+handled, and telegram sends them again after the next start
+*/
+func pollUpdatesOnce(offset int, timeoutInSeconds int, stop <-chan struct{}) (int, error) {
+	updates, err := telegram_connector.GetUpdates(offset, timeoutInSeconds)
+	if err != nil {
+		return offset, err
+	}
+	for i := range updates {
+		update := updates[i]
+		if update.UpdateID < offset {
+			// Telegram shouldn't send these, but let's not handle them twice
+			continue
+		}
+		globalPolledUpdateMutex.Lock()
+		select {
+		case <-stop:
+			globalPolledUpdateMutex.Unlock()
+			return offset, nil
+		default:
+		}
+		offset = update.UpdateID + 1
+		db_connectors.SavePollingOffset(offset)
+		handleUpdate(&update)
+		globalPolledUpdateMutex.Unlock()
+	}
+	return offset, nil
+}
+
+/*
+stopLongPolling stops runLongPolling, and waits for up to timeout for the update it is
+handling. Requests to telegram that are still waiting for updates aren't waited for,
+since updates they receive won't be handled anymore. Returns false if the update in
+progress wasn't handled in time
+*/
+func stopLongPolling(stop chan struct{}, timeout time.Duration) bool {
+	close(stop)
+	updateHandled := make(chan struct{})
+	go func() {
+		globalPolledUpdateMutex.Lock()
+		globalPolledUpdateMutex.Unlock()
+		close(updateHandled)
+	}()
+	select {
+	case <-updateHandled:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"os"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -9,6 +10,12 @@ import (
 
 const KEY_PERSONAL_TOKEN string = "MENSA_QUEUE_BOT_PERSONAL_TOKEN"
 const KEY_DEBUG_MODE string = "MENSA_QUEUE_BOT_DEBUG_MODE"
+const KEY_UPDATE_MODE string = "MENSA_QUEUE_BOT_UPDATE_MODE"
+const KEY_WEBHOOK_URL string = "MENSA_QUEUE_BOT_WEBHOOK_URL"
+const KEY_WEBHOOK_SECRET string = "MENSA_QUEUE_BOT_WEBHOOK_SECRET"
+
+const UPDATE_MODE_WEBHOOK string = "webhook"
+const UPDATE_MODE_POLLING string = "polling"
 
 func GetLocalLocation() *time.Location {
 	potsdamLocation, err := time.LoadLocation("Europe/Berlin")
@@ -32,20 +39,6 @@ func GetPersonalToken() string {
 	return personalKey
 }
 
-func GetMensaOpeningTime() time.Time {
-	var today = time.Now()
-	// Mensa opens at 08:00
-	var openingTime = time.Date(today.Year(), today.Month(), today.Day(), 8, 0, 0, 0, GetLocalLocation())
-	return openingTime
-}
-
-func GetMensaClosingTime() time.Time {
-	var today = time.Now()
-	// Mensa closes at 18:00
-	var closingTime = time.Date(today.Year(), today.Month(), today.Day(), 18, 0, 0, 0, GetLocalLocation())
-	return closingTime
-}
-
 /*IsInDebugMode can be used to change behaviour
 for testing. Currently mostly used to allow
 reports at weird times
@@ -57,3 +50,35 @@ func IsInDebugMode() bool {
 	}
 	return true
 }
+
+/*GetUpdateMode returns how we receive updates from telegram: Either
+via webhook (the default), or by long polling getUpdates. Polling doesn't
+need a public HTTPS endpoint, which makes it useful for development
+*/
+func GetUpdateMode() string {
+	updateMode, doesExist := os.LookupEnv(KEY_UPDATE_MODE)
+	if !doesExist || updateMode == "" {
+		return UPDATE_MODE_WEBHOOK
+	}
+	if updateMode != UPDATE_MODE_WEBHOOK && updateMode != UPDATE_MODE_POLLING {
+		zap.S().Panicf("Fatal Error: %s needs to be either %s or %s, is %s", KEY_UPDATE_MODE, UPDATE_MODE_WEBHOOK, UPDATE_MODE_POLLING, updateMode)
+	}
+	return updateMode
+}
+
+/*GetWebhookURL returns the public URL under which this server is reachable for telegram,
+e.g. https://mensa.example.com. If it is set we register our webhook ourselves on startup.
+Returns an empty string if it isn't set
+*/
+func GetWebhookURL() string {
+	webhookURL, _ := os.LookupEnv(KEY_WEBHOOK_URL)
+	return strings.TrimSuffix(webhookURL, "/")
+}
+
+/*GetWebhookSecret returns the secret telegram needs to send with each webhook request.
+Returns an empty string if it isn't set
+*/
+func GetWebhookSecret() string {
+	webhookSecret, _ := os.LookupEnv(KEY_WEBHOOK_SECRET)
+	return webhookSecret
+}
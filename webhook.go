@@ -0,0 +1,163 @@
+package main
+
+/*
+Receives updates via webhook, which is the default way of receiving them, see
+utils.GetUpdateMode.
+
+Only telegram knows the path of the webhook (utils.GetPersonalToken) and its secret,
+which it sends with each request. Requests without the secret are refused.
+Telegram repeats updates if we take too long to answer, so we remember the IDs
+of recent updates and handle each only once.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"os"
+	"sync"
+
+	"github.com/ADimeo/MensaQueueBot/telegram_connector"
+	"github.com/ADimeo/MensaQueueBot/utils"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// How many update IDs we remember. Repeated updates arrive within minutes, so this is plenty
+const PROCESSED_UPDATES_TO_REMEMBER = 1000
+
+var globalProcessedUpdates = newUpdateDeduplicator(PROCESSED_UPDATES_TO_REMEMBER)
+
+/*
+updateDeduplicator remembers the IDs of the last capacity updates. Kept in memory only,
+since repetitions of an update are sent while the first attempt is still being handled
+*/
+type updateDeduplicator struct {
+	mutex     sync.Mutex
+	seen      map[int]bool
+	order     []int
+	nextIndex int
+}
+
+func newUpdateDeduplicator(capacity int) *updateDeduplicator {
+	return &updateDeduplicator{
+		seen:  make(map[int]bool, capacity),
+		order: make([]int, 0, capacity),
+	}
+}
+
+// isNew remembers the given update ID, and returns false if it was remembered already
+func (deduplicator *updateDeduplicator) isNew(updateID int) bool {
+	deduplicator.mutex.Lock()
+	defer deduplicator.mutex.Unlock()
+	if deduplicator.seen[updateID] {
+		return false
+	}
+	if len(deduplicator.order) < cap(deduplicator.order) {
+		deduplicator.order = append(deduplicator.order, updateID)
+	} else {
+		// Full, replace the oldest ID
+		delete(deduplicator.seen, deduplicator.order[deduplicator.nextIndex])
+		deduplicator.order[deduplicator.nextIndex] = updateID
+		deduplicator.nextIndex = (deduplicator.nextIndex + 1) % len(deduplicator.order)
+	}
+	deduplicator.seen[updateID] = true
+	return true
+}
+
+/*
+forget makes the given update ID count as new again, e.g. because handling the update
+failed before it started. The remaining IDs keep their order, so that remembering the
+update again doesn't push out an ID that is still in use
+*/
+func (deduplicator *updateDeduplicator) forget(updateID int) {
+	deduplicator.mutex.Lock()
+	defer deduplicator.mutex.Unlock()
+	if !deduplicator.seen[updateID] {
+		return
+	}
+	delete(deduplicator.seen, updateID)
+	// Oldest ID first, so that appending continues where the ring left off
+	remainingIDs := make([]int, 0, cap(deduplicator.order))
+	for i := range deduplicator.order {
+		rememberedID := deduplicator.order[(deduplicator.nextIndex+i)%len(deduplicator.order)]
+		if rememberedID != updateID {
+			remainingIDs = append(remainingIDs, rememberedID)
+		}
+	}
+	deduplicator.order = remainingIDs
+	deduplicator.nextIndex = 0
+}
+
+/*
+requireWebhookSecret refuses all requests that don't contain the given secret in
+telegram_connector.WEBHOOK_SECRET_HEADER. With an empty secret all requests are refused
+*/
+func requireWebhookSecret(webhookSecret string) gin.HandlerFunc {
+	return func(ginContext *gin.Context) {
+		receivedSecret := ginContext.GetHeader(telegram_connector.WEBHOOK_SECRET_HEADER)
+		if webhookSecret == "" || subtle.ConstantTimeCompare([]byte(receivedSecret), []byte(webhookSecret)) != 1 {
+			zap.S().Warn("Refused webhook request without valid secret")
+			ginContext.AbortWithStatus(401)
+		}
+	}
+}
+
+/*
+setUpWebhook registers our webhook with telegram if we know our public URL, and returns
+the secret telegram will send with each request. If no secret is configured a random one
+is generated, which works because we register the webhook anew on each start.
+Without public URL the webhook needs to be registered manually, see README. In that case
+we can't tell telegram about a generated secret, so we refuse to start without one
+*/
+func setUpWebhook(personalURLPath string) string {
+	webhookSecret := utils.GetWebhookSecret()
+	webhookURL := utils.GetWebhookURL()
+	if webhookURL == "" {
+		if webhookSecret == "" {
+			zap.S().Panicf("Neither %s nor %s are set, refusing to accept webhook requests without secret", utils.KEY_WEBHOOK_URL, utils.KEY_WEBHOOK_SECRET)
+		}
+		return webhookSecret
+	}
+
+	if webhookSecret == "" {
+		webhookSecret = generateWebhookSecret()
+	}
+	if err := telegram_connector.SetWebhook(webhookURL+personalURLPath, webhookSecret); err != nil {
+		zap.S().Panic("Can't register webhook: ", err)
+	}
+	zap.S().Info("Registered webhook with telegram")
+	return webhookSecret
+}
+
+// generateWebhookSecret returns a random secret that only contains characters telegram allows
+func generateWebhookSecret() string {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		zap.S().Panic("Can't generate webhook secret: ", err)
+	}
+	return hex.EncodeToString(randomBytes)
+}
+
+// getListenAddress returns the address the webhook server listens on. Like gin we use $PORT if it is set, and 8080 otherwise
+func getListenAddress() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+// newWebhookServer returns a server that handles updates sent to personalURLPath
+func newWebhookServer(personalURLPath string, webhookSecret string) *gin.Engine {
+	r := gin.Default()
+	// r.SetTrustedProxies([]string{"172.21.0.2"})
+	// We trust all proxies, [as is insecure default in gin](https://pkg.go.dev/github.com/gin-gonic/gin#readme-don-t-trust-all-proxies)
+	// That shouldn't be a problem since we have
+	// a reverse proxy in front of this server, and it "shouldn't" be
+	// directly reachable from anywhere else.
+	// We don't want to trust that reverse proxy explicitly because
+	// it's wihtin our docker network, and assigning static IP addresses
+	// to containers [may not be recommended](https://stackoverflow.com/questions/39493490/provide-static-ip-to-docker-containers-via-docker-compose)
+	r.POST(personalURLPath, requireWebhookSecret(webhookSecret), reactToRequest)
+	return r
+}